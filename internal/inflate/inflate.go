@@ -0,0 +1,462 @@
+// Package inflate decompresses zlib streams (RFC 1950 and RFC 1951) that
+// arrive in pieces, such as the payloads of compressed SSH packets.
+//
+// Unlike compress/flate, which only returns data at the end of a block
+// or at a sync flush, an Inflater returns all the data it can decode from
+// the input it has. This is needed for streams flushed with
+// Z_PARTIAL_FLUSH, as OpenSSH does after each packet.
+package inflate
+
+import (
+	"errors"
+	"hash"
+	"hash/adler32"
+)
+
+const (
+	windowSize = 1 << 15
+	maxBits    = 15
+)
+
+var (
+	errCorrupt = errors.New("inflate: corrupt stream")
+	errTooLong = errors.New("inflate: output exceeds limit")
+)
+
+// errNeedInput is returned by the steps of the decoder when they run
+// out of input, which is undone until more arrives.
+var errNeedInput = errors.New("inflate: need input")
+
+type state int
+
+const (
+	stateHeader state = iota
+	stateBlock
+	stateStored
+	stateHuffman
+	stateTrailer
+	stateDone
+)
+
+// An Inflater decompresses a zlib stream. The zero value is ready to
+// use.
+type Inflater struct {
+	state state
+	final bool
+
+	// in holds the input not consumed yet, from pos on. bits holds
+	// nbits bits read from it ahead of time.
+	in    []byte
+	pos   int
+	bits  uint32
+	nbits uint
+
+	// stored is the number of bytes left in a stored block.
+	stored int
+
+	// lit and dist decode the lengths and literals, and the
+	// distances of the current block.
+	lit, dist *huffman
+
+	window [windowSize]byte
+	wpos   int
+	wfull  bool
+
+	checksum hash.Hash32
+}
+
+// Inflate appends to dst the data decompressed from in, with any input
+// left over from previous calls. It fails if this appends more than
+// limit bytes.
+func (z *Inflater) Inflate(dst, in []byte, limit int) ([]byte, error) {
+	if z.checksum == nil {
+		z.checksum = adler32.New()
+	}
+	z.in = append(z.in[z.pos:], in...)
+	z.pos = 0
+
+	start, summed := len(dst), len(dst)
+	var err error
+	for err == nil {
+		if z.state == stateTrailer {
+			z.checksum.Write(dst[summed:])
+			summed = len(dst)
+		}
+		// Each step either completes, or leaves the state as
+		// it found it.
+		pos, bits, nbits := z.pos, z.bits, z.nbits
+		before := len(dst)
+		dst, err = z.step(dst, start+limit)
+		if err == errNeedInput {
+			z.pos, z.bits, z.nbits = pos, bits, nbits
+			dst = dst[:before]
+		}
+	}
+	z.checksum.Write(dst[summed:])
+	if err == errNeedInput {
+		err = nil
+	}
+	return dst, err
+}
+
+func (z *Inflater) step(dst []byte, max int) ([]byte, error) {
+	switch z.state {
+	case stateHeader:
+		cmf, err := z.readBits(8)
+		if err != nil {
+			return dst, err
+		}
+		flg, err := z.readBits(8)
+		if err != nil {
+			return dst, err
+		}
+		// Deflate with a window of at most 32 KB, and no preset
+		// dictionary.
+		if cmf&0x0f != 8 || cmf>>4 > 7 || (cmf<<8|flg)%31 != 0 || flg&0x20 != 0 {
+			return dst, errCorrupt
+		}
+		z.state = stateBlock
+
+	case stateBlock:
+		if z.final {
+			z.state = stateTrailer
+			return dst, nil
+		}
+		header, err := z.readBits(3)
+		if err != nil {
+			return dst, err
+		}
+		z.final = header&1 != 0
+		switch header >> 1 {
+		case 0:
+			return dst, z.storedHeader()
+		case 1:
+			z.lit, z.dist = fixedLit, fixedDist
+		case 2:
+			if err := z.dynamicHeader(); err != nil {
+				return dst, err
+			}
+		default:
+			return dst, errCorrupt
+		}
+		z.state = stateHuffman
+
+	case stateStored:
+		if z.stored == 0 {
+			z.state = stateBlock
+			return dst, nil
+		}
+		if z.pos == len(z.in) {
+			return dst, errNeedInput
+		}
+		n := len(z.in) - z.pos
+		if n > z.stored {
+			n = z.stored
+		}
+		if len(dst)+n > max {
+			return dst, errTooLong
+		}
+		for _, c := range z.in[z.pos : z.pos+n] {
+			dst = z.put(dst, c)
+		}
+		z.pos += n
+		z.stored -= n
+
+	case stateHuffman:
+		return z.symbol(dst, max)
+
+	case stateTrailer:
+		z.bits >>= z.nbits % 8
+		z.nbits -= z.nbits % 8
+		var sum uint32
+		for i := 0; i < 4; i++ {
+			b, err := z.readBits(8)
+			if err != nil {
+				return dst, err
+			}
+			sum = sum<<8 | b
+		}
+		if sum != z.checksum.Sum32() {
+			return dst, errCorrupt
+		}
+		z.state = stateDone
+
+	case stateDone:
+		if z.pos != len(z.in) || z.nbits != 0 {
+			return dst, errors.New("inflate: data after the end of the stream")
+		}
+		return dst, errNeedInput
+	}
+	return dst, nil
+}
+
+// storedHeader reads the length of a stored block, which starts at the
+// next byte.
+func (z *Inflater) storedHeader() error {
+	z.bits >>= z.nbits % 8
+	z.nbits -= z.nbits % 8
+	n, err := z.readBits(16)
+	if err != nil {
+		return err
+	}
+	nn, err := z.readBits(16)
+	if err != nil {
+		return err
+	}
+	if n != ^nn&0xffff {
+		return errCorrupt
+	}
+	// Byte alignment left no bits behind, so the block continues at
+	// z.pos.
+	z.stored = int(n)
+	z.state = stateStored
+	return nil
+}
+
+var codeLengthOrder = [19]int{16, 17, 18, 0, 8, 7, 9, 6, 10, 5, 11, 4, 12, 3, 13, 2, 14, 1, 15}
+
+// dynamicHeader reads the code lengths of a block with dynamic Huffman
+// codes.
+func (z *Inflater) dynamicHeader() error {
+	nlit, err := z.readBits(5)
+	if err != nil {
+		return err
+	}
+	ndist, err := z.readBits(5)
+	if err != nil {
+		return err
+	}
+	nlen, err := z.readBits(4)
+	if err != nil {
+		return err
+	}
+	nlit += 257
+	ndist++
+	nlen += 4
+	if nlit > 286 || ndist > 30 {
+		return errCorrupt
+	}
+
+	var lengths [286 + 30]uint8
+	for i := 0; i < int(nlen); i++ {
+		l, err := z.readBits(3)
+		if err != nil {
+			return err
+		}
+		lengths[codeLengthOrder[i]] = uint8(l)
+	}
+	lencode, err := newHuffman(lengths[:19])
+	if err != nil {
+		return err
+	}
+
+	lengths = [286 + 30]uint8{}
+	for i := 0; i < int(nlit+ndist); {
+		sym, err := z.decode(lencode)
+		if err != nil {
+			return err
+		}
+		if sym < 16 {
+			lengths[i] = uint8(sym)
+			i++
+			continue
+		}
+		var l uint8
+		var n uint32
+		switch sym {
+		case 16:
+			if i == 0 {
+				return errCorrupt
+			}
+			l = lengths[i-1]
+			n, err = z.readBits(2)
+			n += 3
+		case 17:
+			n, err = z.readBits(3)
+			n += 3
+		default:
+			n, err = z.readBits(7)
+			n += 11
+		}
+		if err != nil {
+			return err
+		}
+		if i+int(n) > int(nlit+ndist) {
+			return errCorrupt
+		}
+		for ; n > 0; n-- {
+			lengths[i] = l
+			i++
+		}
+	}
+	if lengths[256] == 0 {
+		return errCorrupt
+	}
+
+	if z.lit, err = newHuffman(lengths[:nlit]); err != nil {
+		return err
+	}
+	z.dist, err = newHuffman(lengths[nlit : nlit+ndist])
+	return err
+}
+
+var (
+	lengthBase  = [29]uint16{3, 4, 5, 6, 7, 8, 9, 10, 11, 13, 15, 17, 19, 23, 27, 31, 35, 43, 51, 59, 67, 83, 99, 115, 131, 163, 195, 227, 258}
+	lengthExtra = [29]uint8{0, 0, 0, 0, 0, 0, 0, 0, 1, 1, 1, 1, 2, 2, 2, 2, 3, 3, 3, 3, 4, 4, 4, 4, 5, 5, 5, 5, 0}
+	distBase    = [30]uint16{1, 2, 3, 4, 5, 7, 9, 13, 17, 25, 33, 49, 65, 97, 129, 193, 257, 385, 513, 769, 1025, 1537, 2049, 3073, 4097, 6145, 8193, 12289, 16385, 24577}
+	distExtra   = [30]uint8{0, 0, 0, 0, 1, 1, 2, 2, 3, 3, 4, 4, 5, 5, 6, 6, 7, 7, 8, 8, 9, 9, 10, 10, 11, 11, 12, 12, 13, 13}
+)
+
+// symbol decodes a literal, a back reference or the end of the block.
+func (z *Inflater) symbol(dst []byte, max int) ([]byte, error) {
+	sym, err := z.decode(z.lit)
+	if err != nil {
+		return dst, err
+	}
+	switch {
+	case sym < 256:
+		if len(dst) >= max {
+			return dst, errTooLong
+		}
+		return z.put(dst, byte(sym)), nil
+	case sym == 256:
+		z.state = stateBlock
+		return dst, nil
+	}
+
+	sym -= 257
+	if sym >= 29 {
+		return dst, errCorrupt
+	}
+	extra, err := z.readBits(uint(lengthExtra[sym]))
+	if err != nil {
+		return dst, err
+	}
+	length := int(lengthBase[sym]) + int(extra)
+
+	sym, err = z.decode(z.dist)
+	if err != nil {
+		return dst, err
+	}
+	if sym >= 30 {
+		return dst, errCorrupt
+	}
+	extra, err = z.readBits(uint(distExtra[sym]))
+	if err != nil {
+		return dst, err
+	}
+	dist := int(distBase[sym]) + int(extra)
+	if !z.wfull && dist > z.wpos {
+		return dst, errCorrupt
+	}
+	if len(dst)+length > max {
+		return dst, errTooLong
+	}
+	for ; length > 0; length-- {
+		dst = z.put(dst, z.window[(z.wpos-dist)&(windowSize-1)])
+	}
+	return dst, nil
+}
+
+// put appends c to dst and to the window.
+func (z *Inflater) put(dst []byte, c byte) []byte {
+	z.window[z.wpos] = c
+	z.wpos++
+	if z.wpos == windowSize {
+		z.wpos = 0
+		z.wfull = true
+	}
+	return append(dst, c)
+}
+
+// readBits returns the next n bits of input, or errNeedInput.
+func (z *Inflater) readBits(n uint) (uint32, error) {
+	for z.nbits < n {
+		if z.pos == len(z.in) {
+			return 0, errNeedInput
+		}
+		z.bits |= uint32(z.in[z.pos]) << z.nbits
+		z.pos++
+		z.nbits += 8
+	}
+	v := z.bits & (1<<n - 1)
+	z.bits >>= n
+	z.nbits -= n
+	return v, nil
+}
+
+// huffman is a canonical Huffman code, which decodes to symbol the
+// codes of each length in order.
+type huffman struct {
+	count  [maxBits + 1]uint16
+	symbol []uint16
+}
+
+// newHuffman builds the code in which symbol i has a code of lengths[i]
+// bits, or none if it is zero. Incomplete codes are allowed.
+func newHuffman(lengths []uint8) (*huffman, error) {
+	h := &huffman{symbol: make([]uint16, 0, len(lengths))}
+	for _, l := range lengths {
+		h.count[l]++
+	}
+	left := 1
+	for l := 1; l <= maxBits; l++ {
+		left = left<<1 - int(h.count[l])
+		if left < 0 {
+			return nil, errCorrupt
+		}
+	}
+	for l := 1; l <= maxBits; l++ {
+		for sym, sl := range lengths {
+			if int(sl) == l {
+				h.symbol = append(h.symbol, uint16(sym))
+			}
+		}
+	}
+	return h, nil
+}
+
+// decode reads a code from the input and returns its symbol.
+func (z *Inflater) decode(h *huffman) (int, error) {
+	code, first, index := 0, 0, 0
+	for l := 1; l <= maxBits; l++ {
+		bit, err := z.readBits(1)
+		if err != nil {
+			return 0, err
+		}
+		code |= int(bit)
+		count := int(h.count[l])
+		if code-first < count {
+			return int(h.symbol[index+code-first]), nil
+		}
+		index += count
+		first += count
+		first <<= 1
+		code <<= 1
+	}
+	return 0, errCorrupt
+}
+
+var fixedLit, fixedDist = fixedCodes()
+
+func fixedCodes() (lit, dist *huffman) {
+	var lengths [288]uint8
+	for i := range lengths {
+		switch {
+		case i < 144:
+			lengths[i] = 8
+		case i < 256:
+			lengths[i] = 9
+		case i < 280:
+			lengths[i] = 7
+		default:
+			lengths[i] = 8
+		}
+	}
+	lit, _ = newHuffman(lengths[:])
+	for i := 0; i < 30; i++ {
+		lengths[i] = 5
+	}
+	dist, _ = newHuffman(lengths[:30])
+	return lit, dist
+}
@@ -0,0 +1,141 @@
+package inflate
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/hex"
+	"math/rand"
+	"testing"
+)
+
+func testData() []byte {
+	r := rand.New(rand.NewSource(1))
+	var b bytes.Buffer
+	words := []string{"ssh ", "zlib ", "packet ", "window ", "channel ", "\x00\x01", "\n"}
+	for b.Len() < 300000 {
+		if r.Intn(50) == 0 {
+			// Some incompressible data.
+			junk := make([]byte, r.Intn(2000))
+			r.Read(junk)
+			b.Write(junk)
+			continue
+		}
+		b.WriteString(words[r.Intn(len(words))])
+	}
+	return b.Bytes()
+}
+
+func TestInflate(t *testing.T) {
+	data := testData()
+	for _, level := range []int{zlib.NoCompression, zlib.BestSpeed, zlib.DefaultCompression, zlib.HuffmanOnly} {
+		var c bytes.Buffer
+		w, _ := zlib.NewWriterLevel(&c, level)
+		w.Write(data)
+		w.Close()
+
+		// Feed the stream in pieces of increasing size.
+		var z Inflater
+		var got []byte
+		in := c.Bytes()
+		for n := 1; len(in) > 0; n = n*2 + 1 {
+			if n > len(in) {
+				n = len(in)
+			}
+			var err error
+			if got, err = z.Inflate(got, in[:n], len(data)); err != nil {
+				t.Fatalf("level %d: Inflate: %v", level, err)
+			}
+			in = in[n:]
+		}
+		if !bytes.Equal(got, data) {
+			t.Errorf("level %d: got %d bytes, want %d", level, len(got), len(data))
+		}
+		if z.state != stateDone {
+			t.Errorf("level %d: stream not complete", level)
+		}
+	}
+}
+
+func TestInflateFlushes(t *testing.T) {
+	data := testData()
+	var c bytes.Buffer
+	w := zlib.NewWriter(&c)
+	var z Inflater
+	for len(data) > 0 {
+		n := 1000
+		if n > len(data) {
+			n = len(data)
+		}
+		c.Reset()
+		w.Write(data[:n])
+		w.Flush()
+		got, err := z.Inflate(nil, c.Bytes(), n)
+		if err != nil {
+			t.Fatalf("Inflate: %v", err)
+		}
+		if !bytes.Equal(got, data[:n]) {
+			t.Fatalf("got %q, want %q", got, data[:n])
+		}
+		data = data[n:]
+	}
+}
+
+// TestPartialFlush decodes packets compressed by OpenSSH, which flushes
+// them with Z_PARTIAL_FLUSH. The empty block that ends each one is
+// completed by the next.
+func TestPartialFlush(t *testing.T) {
+	var z Inflater
+	in, _ := hex.DecodeString("789c8a626060602f4e2d2ececccf6300010510d1c00010")
+	want := "Z\x00\x00\x00\asession\x00\x00\x00\x00\x00 \x00\x00\x00\x00\x80\x00"
+	got, err := z.Inflate(nil, in, 1000)
+	if err != nil {
+		t.Fatalf("Inflate: %v", err)
+	}
+	if string(got) != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestInflateLimit(t *testing.T) {
+	var c bytes.Buffer
+	w := zlib.NewWriter(&c)
+	w.Write(make([]byte, 100000))
+	w.Flush()
+
+	var z Inflater
+	if _, err := z.Inflate(nil, c.Bytes(), 99999); err != errTooLong {
+		t.Errorf("got %v, want %v", err, errTooLong)
+	}
+	z = Inflater{}
+	if _, err := z.Inflate(nil, c.Bytes(), 100000); err != nil {
+		t.Errorf("Inflate: %v", err)
+	}
+}
+
+func TestInflateCorrupt(t *testing.T) {
+	var c bytes.Buffer
+	w := zlib.NewWriter(&c)
+	w.Write(testData()[:10000])
+	w.Close()
+	stream := c.Bytes()
+
+	for _, test := range []struct {
+		name string
+		mod  func([]byte)
+	}{
+		{"header", func(b []byte) { b[0] = 0x79 }},
+		{"checksum", func(b []byte) { b[len(b)-1]++ }},
+	} {
+		b := append([]byte(nil), stream...)
+		test.mod(b)
+		var z Inflater
+		if _, err := z.Inflate(nil, b, 1<<20); err == nil {
+			t.Errorf("%s: Inflate succeeded on a corrupt stream", test.name)
+		}
+	}
+
+	var z Inflater
+	if _, err := z.Inflate(nil, append(stream, 0), 1<<20); err == nil {
+		t.Error("Inflate accepted data after the end of the stream")
+	}
+}
@@ -0,0 +1,470 @@
+// Package mlkem768 implements the quantum-resistant key encapsulation
+// method ML-KEM-768, as specified in FIPS 203,
+// https://doi.org/10.6028/NIST.FIPS.203.
+//
+// Decapsulation keys are stored as the 64-byte seed they are derived
+// from, the format used by the SSH hybrid key exchanges.
+package mlkem768
+
+import (
+	"crypto/subtle"
+	"errors"
+	"io"
+
+	"golang.org/x/crypto/sha3"
+)
+
+const (
+	// SeedSize is the size of the seed decapsulation keys are
+	// derived from.
+	SeedSize = 64
+
+	// EncapsulationKeySize is the size of an encoded encapsulation
+	// key, CiphertextSize that of a ciphertext, and SharedKeySize
+	// that of the shared key.
+	EncapsulationKeySize = k*encodingSize12 + 32
+	CiphertextSize       = k*encodingSize10 + encodingSize4
+	SharedKeySize        = 32
+)
+
+// ML-KEM-768 parameters.
+const (
+	n = 256
+	q = 3329
+	k = 3
+
+	encodingSize12 = n * 12 / 8
+	encodingSize10 = n * 10 / 8
+	encodingSize4  = n * 4 / 8
+	encodingSize1  = n * 1 / 8
+
+	// invN is 128⁻¹ mod q, the scale of the inverse NTT.
+	invN = 3303
+)
+
+// A fieldElement is an integer modulo q, in [0, q).
+type fieldElement uint16
+
+// fieldReduceOnce reduces a value in [0, 2q) to [0, q) in constant time.
+func fieldReduceOnce(a uint16) fieldElement {
+	x := a - q
+	// If x underflowed, its top bit is set and q is added back.
+	x += (x >> 15) * q
+	return fieldElement(x)
+}
+
+func fieldAdd(a, b fieldElement) fieldElement {
+	return fieldReduceOnce(uint16(a + b))
+}
+
+func fieldSub(a, b fieldElement) fieldElement {
+	return fieldReduceOnce(uint16(a - b + q))
+}
+
+func fieldMul(a, b fieldElement) fieldElement {
+	return fieldElement(uint32(a) * uint32(b) % q)
+}
+
+// compress maps x to round(2ᵈ·x/q) mod 2ᵈ. As q is odd, the quotient
+// is never exactly halfway between two integers.
+func compress(x fieldElement, d uint) uint16 {
+	return uint16((uint32(x)<<d + q/2) / q & (1<<d - 1))
+}
+
+// decompress maps y to round(q·y/2ᵈ), rounding halves up.
+func decompress(y uint16, d uint) fieldElement {
+	return fieldElement((uint32(y)*q + 1<<(d-1)) >> d)
+}
+
+// A ringElement is a polynomial of Z_q[X]/(X²⁵⁶+1) given by its
+// coefficients, and an nttElement one in the NTT domain.
+type (
+	ringElement [n]fieldElement
+	nttElement  [n]fieldElement
+)
+
+func polyAdd(a, b ringElement) ringElement {
+	var s ringElement
+	for i := range s {
+		s[i] = fieldAdd(a[i], b[i])
+	}
+	return s
+}
+
+func polySub(a, b ringElement) ringElement {
+	var s ringElement
+	for i := range s {
+		s[i] = fieldSub(a[i], b[i])
+	}
+	return s
+}
+
+// zetas[i] is 17^BitRev₇(i) mod q, and gammas[i] is
+// 17^(2·BitRev₇(i)+1) mod q.
+var zetas, gammas = func() (z, g [128]fieldElement) {
+	var pow [256]fieldElement
+	pow[0] = 1
+	for i := 1; i < len(pow); i++ {
+		pow[i] = fieldMul(pow[i-1], 17)
+	}
+	for i := range z {
+		r := 0
+		for b := 0; b < 7; b++ {
+			r |= (i >> uint(b) & 1) << uint(6-b)
+		}
+		z[i] = pow[r]
+		g[i] = pow[2*r+1]
+	}
+	return z, g
+}()
+
+// ntt implements Algorithm 9 of FIPS 203.
+func ntt(f ringElement) nttElement {
+	i := 1
+	for length := n / 2; length >= 2; length /= 2 {
+		for start := 0; start < n; start += 2 * length {
+			zeta := zetas[i]
+			i++
+			for j := start; j < start+length; j++ {
+				t := fieldMul(zeta, f[j+length])
+				f[j+length] = fieldSub(f[j], t)
+				f[j] = fieldAdd(f[j], t)
+			}
+		}
+	}
+	return nttElement(f)
+}
+
+// inverseNTT implements Algorithm 10 of FIPS 203.
+func inverseNTT(f nttElement) ringElement {
+	i := 127
+	for length := 2; length <= n/2; length *= 2 {
+		for start := 0; start < n; start += 2 * length {
+			zeta := zetas[i]
+			i--
+			for j := start; j < start+length; j++ {
+				t := f[j]
+				f[j] = fieldAdd(t, f[j+length])
+				f[j+length] = fieldMul(zeta, fieldSub(f[j+length], t))
+			}
+		}
+	}
+	for i := range f {
+		f[i] = fieldMul(f[i], invN)
+	}
+	return ringElement(f)
+}
+
+// nttMulAdd adds the product of a and b to acc, following Algorithms 11
+// and 12 of FIPS 203.
+func nttMulAdd(acc *nttElement, a, b *nttElement) {
+	for i := 0; i < n; i += 2 {
+		a0, a1, b0, b1 := a[i], a[i+1], b[i], b[i+1]
+		c0 := fieldAdd(fieldMul(a0, b0), fieldMul(fieldMul(a1, b1), gammas[i/2]))
+		c1 := fieldAdd(fieldMul(a0, b1), fieldMul(a1, b0))
+		acc[i] = fieldAdd(acc[i], c0)
+		acc[i+1] = fieldAdd(acc[i+1], c1)
+	}
+}
+
+// sampleNTT implements Algorithm 7 of FIPS 203, deriving the element of
+// the matrix Â from the seed rho and the indexes j and i.
+func sampleNTT(rho []byte, j, i byte) nttElement {
+	xof := sha3.NewShake128()
+	xof.Write(rho)
+	xof.Write([]byte{j, i})
+
+	var a nttElement
+	var buf [168]byte // the SHAKE128 rate, a multiple of 3
+	off := len(buf)
+	for c := 0; c < n; {
+		if off == len(buf) {
+			xof.Read(buf[:])
+			off = 0
+		}
+		d1 := uint16(buf[off]) | uint16(buf[off+1]&0x0f)<<8
+		d2 := uint16(buf[off+1]>>4) | uint16(buf[off+2])<<4
+		off += 3
+		if d1 < q {
+			a[c] = fieldElement(d1)
+			c++
+		}
+		if d2 < q && c < n {
+			a[c] = fieldElement(d2)
+			c++
+		}
+	}
+	return a
+}
+
+// samplePolyCBD implements Algorithm 8 of FIPS 203 with η = 2, using
+// PRF(s, b) as the source of randomness.
+func samplePolyCBD(s []byte, b byte) ringElement {
+	prf := sha3.NewShake256()
+	prf.Write(s)
+	prf.Write([]byte{b})
+	var buf [64 * 2]byte
+	prf.Read(buf[:])
+
+	var f ringElement
+	for i := 0; i < n; i += 2 {
+		b := buf[i/2]
+		f[i] = fieldSub(fieldElement(b&1+b>>1&1), fieldElement(b>>2&1+b>>3&1))
+		f[i+1] = fieldSub(fieldElement(b>>4&1+b>>5&1), fieldElement(b>>6&1+b>>7&1))
+	}
+	return f
+}
+
+// matrix derives Â from rho. The element in row i and column j is
+// a[i*k+j].
+func matrix(rho []byte) (a [k * k]nttElement) {
+	for i := byte(0); i < k; i++ {
+		for j := byte(0); j < k; j++ {
+			a[i*k+j] = sampleNTT(rho, j, i)
+		}
+	}
+	return a
+}
+
+// polyByteEncode appends the 12-bit encoding of f to b.
+func polyByteEncode(b []byte, f nttElement) []byte {
+	for i := 0; i < n; i += 2 {
+		x := uint32(f[i]) | uint32(f[i+1])<<12
+		b = append(b, byte(x), byte(x>>8), byte(x>>16))
+	}
+	return b
+}
+
+// polyByteDecode decodes the 12-bit encoding b, which must only hold
+// coefficients below q.
+func polyByteDecode(b []byte) (nttElement, error) {
+	var f nttElement
+	for i := 0; i < n; i += 2 {
+		x := uint32(b[0]) | uint32(b[1])<<8 | uint32(b[2])<<16
+		f[i], f[i+1] = fieldElement(x&0xfff), fieldElement(x>>12)
+		if f[i] >= q || f[i+1] >= q {
+			return nttElement{}, errors.New("mlkem768: invalid polynomial encoding")
+		}
+		b = b[3:]
+	}
+	return f, nil
+}
+
+// ringCompressAndEncode appends the d-bit encoding of the compressed
+// coefficients of f to b.
+func ringCompressAndEncode(b []byte, f ringElement, d uint) []byte {
+	var acc uint32
+	var bits uint
+	for i := range f {
+		acc |= uint32(compress(f[i], d)) << bits
+		bits += d
+		for bits >= 8 {
+			b = append(b, byte(acc))
+			acc >>= 8
+			bits -= 8
+		}
+	}
+	return b
+}
+
+// ringDecodeAndDecompress decodes the d-bit encoding b, and
+// decompresses its coefficients.
+func ringDecodeAndDecompress(b []byte, d uint) ringElement {
+	var f ringElement
+	var acc uint32
+	var bits uint
+	for i := range f {
+		for bits < d {
+			acc |= uint32(b[0]) << bits
+			b = b[1:]
+			bits += 8
+		}
+		f[i] = decompress(uint16(acc&(1<<d-1)), d)
+		acc >>= d
+		bits -= d
+	}
+	return f
+}
+
+// encryptionKey is a parsed K-PKE encryption key.
+type encryptionKey struct {
+	t [k]nttElement
+	a [k * k]nttElement
+}
+
+// parseEncryptionKey parses an encapsulation key, checking that it is
+// correctly encoded as required by section 7.2 of FIPS 203.
+func parseEncryptionKey(ek []byte) (*encryptionKey, error) {
+	if len(ek) != EncapsulationKeySize {
+		return nil, errors.New("mlkem768: invalid encapsulation key length")
+	}
+	key := &encryptionKey{}
+	for i := range key.t {
+		var err error
+		key.t[i], err = polyByteDecode(ek[i*encodingSize12 : (i+1)*encodingSize12])
+		if err != nil {
+			return nil, err
+		}
+	}
+	key.a = matrix(ek[k*encodingSize12:])
+	return key, nil
+}
+
+// encrypt implements Algorithm 14 of FIPS 203, K-PKE.Encrypt, appending
+// the ciphertext to c.
+func (key *encryptionKey) encrypt(c []byte, m, r []byte) []byte {
+	var rHat [k]nttElement
+	var e1 [k]ringElement
+	var nonce byte
+	for i := range rHat {
+		rHat[i] = ntt(samplePolyCBD(r, nonce))
+		nonce++
+	}
+	for i := range e1 {
+		e1[i] = samplePolyCBD(r, nonce)
+		nonce++
+	}
+	e2 := samplePolyCBD(r, nonce)
+
+	for i := 0; i < k; i++ {
+		var acc nttElement
+		for j := 0; j < k; j++ {
+			// The transpose of Â.
+			nttMulAdd(&acc, &key.a[j*k+i], &rHat[j])
+		}
+		u := polyAdd(inverseNTT(acc), e1[i])
+		c = ringCompressAndEncode(c, u, 10)
+	}
+
+	var acc nttElement
+	for i := range key.t {
+		nttMulAdd(&acc, &key.t[i], &rHat[i])
+	}
+	mu := ringDecodeAndDecompress(m, 1)
+	v := polyAdd(polyAdd(inverseNTT(acc), e2), mu)
+	return ringCompressAndEncode(c, v, 4)
+}
+
+// A DecapsulationKey is an ML-KEM-768 decapsulation key.
+type DecapsulationKey struct {
+	seed [SeedSize]byte
+	ek   [EncapsulationKeySize]byte
+	h    [32]byte // H(ek)
+	s    [k]nttElement
+	encryptionKey
+}
+
+// GenerateKey generates a decapsulation key, reading its seed from rand.
+func GenerateKey(rand io.Reader) (*DecapsulationKey, error) {
+	var seed [SeedSize]byte
+	if _, err := io.ReadFull(rand, seed[:]); err != nil {
+		return nil, err
+	}
+	return NewKeyFromSeed(seed[:])
+}
+
+// NewKeyFromSeed derives a decapsulation key from the 64-byte seed d‖z,
+// following Algorithms 16 and 13 of FIPS 203.
+func NewKeyFromSeed(seed []byte) (*DecapsulationKey, error) {
+	if len(seed) != SeedSize {
+		return nil, errors.New("mlkem768: invalid seed length")
+	}
+	dk := &DecapsulationKey{}
+	copy(dk.seed[:], seed)
+
+	g := sha3.New512()
+	g.Write(seed[:32])
+	g.Write([]byte{k})
+	G := g.Sum(nil)
+	rho, sigma := G[:32], G[32:]
+	dk.a = matrix(rho)
+
+	var nonce byte
+	for i := range dk.s {
+		dk.s[i] = ntt(samplePolyCBD(sigma, nonce))
+		nonce++
+	}
+	for i := range dk.t {
+		e := ntt(samplePolyCBD(sigma, nonce))
+		nonce++
+		for j := range dk.s {
+			nttMulAdd(&e, &dk.a[i*k+j], &dk.s[j])
+		}
+		dk.t[i] = e
+	}
+
+	ek := dk.ek[:0]
+	for i := range dk.t {
+		ek = polyByteEncode(ek, dk.t[i])
+	}
+	copy(dk.ek[k*encodingSize12:], rho)
+	dk.h = sha3.Sum256(dk.ek[:])
+	return dk, nil
+}
+
+// Bytes returns the seed of the decapsulation key.
+func (dk *DecapsulationKey) Bytes() []byte {
+	return append([]byte(nil), dk.seed[:]...)
+}
+
+// EncapsulationKey returns the encoded encapsulation key matching dk.
+func (dk *DecapsulationKey) EncapsulationKey() []byte {
+	return append([]byte(nil), dk.ek[:]...)
+}
+
+// Encapsulate generates a shared key and its encapsulation to the
+// encoded encapsulation key ek, reading the message from rand.
+func Encapsulate(rand io.Reader, ek []byte) (ciphertext, sharedKey []byte, err error) {
+	key, err := parseEncryptionKey(ek)
+	if err != nil {
+		return nil, nil, err
+	}
+	m := make([]byte, 32)
+	if _, err := io.ReadFull(rand, m); err != nil {
+		return nil, nil, err
+	}
+	h := sha3.Sum256(ek)
+	ciphertext, sharedKey = key.encapsulate(m, h[:])
+	return ciphertext, sharedKey, nil
+}
+
+// encapsulate implements Algorithm 17 of FIPS 203, where h is H(ek).
+func (key *encryptionKey) encapsulate(m, h []byte) (ciphertext, sharedKey []byte) {
+	g := sha3.New512()
+	g.Write(m)
+	g.Write(h)
+	G := g.Sum(nil)
+	sharedKey, r := G[:SharedKeySize], G[SharedKeySize:]
+	return key.encrypt(make([]byte, 0, CiphertextSize), m, r), sharedKey
+}
+
+// Decapsulate returns the shared key encapsulated in ciphertext,
+// following Algorithms 18 and 15 of FIPS 203. An invalid ciphertext
+// yields a pseudorandom key, which fails to match the peer's.
+func Decapsulate(dk *DecapsulationKey, ciphertext []byte) (sharedKey []byte, err error) {
+	if len(ciphertext) != CiphertextSize {
+		return nil, errors.New("mlkem768: invalid ciphertext length")
+	}
+
+	var acc nttElement
+	for i := range dk.s {
+		u := ringDecodeAndDecompress(ciphertext[i*encodingSize10:(i+1)*encodingSize10], 10)
+		uHat := ntt(u)
+		nttMulAdd(&acc, &dk.s[i], &uHat)
+	}
+	v := ringDecodeAndDecompress(ciphertext[k*encodingSize10:], 4)
+	w := polySub(v, inverseNTT(acc))
+	m := ringCompressAndEncode(make([]byte, 0, encodingSize1), w, 1)
+
+	c, sharedKey := dk.encapsulate(m, dk.h[:])
+
+	rejection := make([]byte, SharedKeySize)
+	j := sha3.NewShake256()
+	j.Write(dk.seed[32:])
+	j.Write(ciphertext)
+	j.Read(rejection)
+
+	equal := subtle.ConstantTimeCompare(c, ciphertext)
+	subtle.ConstantTimeCopy(1-equal, sharedKey, rejection)
+	return sharedKey, nil
+}
@@ -0,0 +1,139 @@
+package mlkem768
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"testing"
+
+	"golang.org/x/crypto/sha3"
+)
+
+func TestRoundTrip(t *testing.T) {
+	dk, err := GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, Ke, err := Encapsulate(rand.Reader, dk.EncapsulationKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	Kd, err := Decapsulate(dk, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(Ke, Kd) {
+		t.Fatal("shared keys do not match")
+	}
+
+	dk1, err := NewKeyFromSeed(dk.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(dk1.EncapsulationKey(), dk.EncapsulationKey()) {
+		t.Error("key derived from the seed differs")
+	}
+
+	c[0] ^= 1
+	Kd, err = Decapsulate(dk, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(Ke, Kd) {
+		t.Error("modified ciphertext yielded the same key")
+	}
+}
+
+func TestBadLengths(t *testing.T) {
+	dk, err := GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ek := dk.EncapsulationKey()
+	if _, _, err := Encapsulate(rand.Reader, ek[:len(ek)-1]); err == nil {
+		t.Error("short encapsulation key accepted")
+	}
+	if _, _, err := Encapsulate(rand.Reader, append(ek, 0)); err == nil {
+		t.Error("long encapsulation key accepted")
+	}
+	c, _, err := Encapsulate(rand.Reader, ek)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Decapsulate(dk, c[:len(c)-1]); err == nil {
+		t.Error("short ciphertext accepted")
+	}
+	if _, err := NewKeyFromSeed(dk.Bytes()[1:]); err == nil {
+		t.Error("short seed accepted")
+	}
+}
+
+func TestUnreducedKey(t *testing.T) {
+	dk, err := GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ek := dk.EncapsulationKey()
+	// Set the first coefficient to q, which is not reduced.
+	ek[0] = byte(q & 0xff)
+	ek[1] = ek[1]&0xf0 | byte(q>>8)
+	if _, _, err := Encapsulate(rand.Reader, ek); err == nil {
+		t.Error("unreduced encapsulation key accepted")
+	}
+}
+
+// TestAccumulated runs the accumulated vector test of the C2SP CCTV
+// project, https://c2sp.org/CCTV/ML-KEM: keys, ciphertexts and shared
+// keys derived from a SHAKE-128 stream are hashed into a single value.
+// Random ciphertexts exercise the implicit rejection.
+func TestAccumulated(t *testing.T) {
+	iterations, expected := 10000, "8a518cc63da366322a8e7a818c7a0d63483cb3528d34a4cf42f35d5ad73f22fc"
+	if testing.Short() {
+		iterations, expected = 100, "1114b1b6699ed191734fa339376afa7e285c9e6acf6ff0177d346696ce564415"
+	}
+
+	s := sha3.NewShake128()
+	o := sha3.NewShake128()
+	seed := make([]byte, SeedSize)
+	msg := make([]byte, 32)
+	ct1 := make([]byte, CiphertextSize)
+
+	for i := 0; i < iterations; i++ {
+		s.Read(seed)
+		dk, err := NewKeyFromSeed(seed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ek := dk.EncapsulationKey()
+		o.Write(ek)
+
+		s.Read(msg)
+		ct, k, err := Encapsulate(bytes.NewReader(msg), ek)
+		if err != nil {
+			t.Fatal(err)
+		}
+		o.Write(ct)
+		o.Write(k)
+
+		kk, err := Decapsulate(dk, ct)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(kk, k) {
+			t.Fatalf("iteration %d: shared keys do not match", i)
+		}
+
+		s.Read(ct1)
+		k1, err := Decapsulate(dk, ct1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		o.Write(k1)
+	}
+
+	got := make([]byte, 32)
+	o.Read(got)
+	if hex.EncodeToString(got) != expected {
+		t.Errorf("got %x, want %s", got, expected)
+	}
+}
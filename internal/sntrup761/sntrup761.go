@@ -0,0 +1,544 @@
+// Package sntrup761 implements the Streamlined NTRU Prime 761 key
+// encapsulation method, as submitted to the third round of the NIST
+// post-quantum competition, https://ntruprime.cr.yp.to/. It follows the
+// reference implementation, which OpenSSH also uses, so that both derive
+// the same keys from the same randomness.
+package sntrup761
+
+import (
+	"crypto/sha512"
+	"crypto/subtle"
+	"errors"
+	"io"
+)
+
+const (
+	// EncapsulationKeySize is the size of an encoded encapsulation
+	// key, CiphertextSize that of a ciphertext, and SharedKeySize
+	// that of the shared key.
+	EncapsulationKeySize = 1158
+	CiphertextSize       = roundedBytes + hashBytes
+	SharedKeySize        = hashBytes
+)
+
+// sntrup761 parameters. Polynomials live in Z[x]/(x^p - x - 1), and
+// short polynomials have w nonzero coefficients, all in {-1, 0, 1}.
+const (
+	p   = 761
+	q   = 4591
+	w   = 286
+	q12 = (q - 1) / 2
+
+	smallBytes   = (p + 3) / 4
+	roundedBytes = 1007
+	hashBytes    = 32
+)
+
+// A small is an element of F_3, represented as -1, 0 or 1.
+type small int8
+
+// An fq is an element of F_q, represented in [-q12, q12].
+type fq int16
+
+// modUint14 returns x mod m, in [0, m), for a positive m below 2^14.
+func modUint14(x, m int32) int32 {
+	r := x % m
+	return r + m&(r>>31)
+}
+
+func f3Freeze(x int32) small {
+	return small(modUint14(x+1, 3) - 1)
+}
+
+func fqFreeze(x int32) fq {
+	return fq(modUint14(x+q12, q) - q12)
+}
+
+// fqRecip returns a^(q-2), the inverse of a nonzero a.
+func fqRecip(a fq) fq {
+	ai := a
+	for i := 1; i < q-2; i++ {
+		ai = fqFreeze(int32(a) * int32(ai))
+	}
+	return ai
+}
+
+// nonzeroMask returns -1 if x, which fits in 16 bits, is nonzero, and 0
+// otherwise.
+func nonzeroMask(x int32) int32 {
+	return -int32((uint32(x) | uint32(-x)) >> 31)
+}
+
+// negativeMask returns -1 if x is negative, and 0 otherwise.
+func negativeMask(x int32) int32 {
+	return x >> 31
+}
+
+// weightMask returns 0 if r has weight w, and -1 otherwise.
+func weightMask(r *[p]small) int32 {
+	var weight int32
+	for i := range r {
+		weight += int32(r[i] & 1)
+	}
+	return nonzeroMask(weight - w)
+}
+
+// r3Mult returns f*g in R/3.
+func r3Mult(f, g *[p]small) (h [p]small) {
+	var fg [p + p - 1]small
+	for i := 0; i < p; i++ {
+		var r small
+		for j := 0; j <= i; j++ {
+			r = f3Freeze(int32(r) + int32(f[j])*int32(g[i-j]))
+		}
+		fg[i] = r
+	}
+	for i := p; i < p+p-1; i++ {
+		var r small
+		for j := i - p + 1; j < p; j++ {
+			r = f3Freeze(int32(r) + int32(f[j])*int32(g[i-j]))
+		}
+		fg[i] = r
+	}
+	// Reduce by x^p = x + 1.
+	for i := p + p - 2; i >= p; i-- {
+		fg[i-p] = f3Freeze(int32(fg[i-p]) + int32(fg[i]))
+		fg[i-p+1] = f3Freeze(int32(fg[i-p+1]) + int32(fg[i]))
+	}
+	copy(h[:], fg[:p])
+	return h
+}
+
+// r3Recip returns the inverse of in in R/3, with a mask of 0 if it
+// exists, and -1 otherwise. It runs in constant time.
+func r3Recip(in *[p]small) (out [p]small, mask int32) {
+	var f, g, v, r [p + 1]small
+	r[0] = 1
+	f[0] = 1
+	f[p-1], f[p] = -1, -1
+	for i := 0; i < p; i++ {
+		g[p-1-i] = in[i]
+	}
+	delta := int32(1)
+
+	for loop := 0; loop < 2*p-1; loop++ {
+		copy(v[1:], v[:p])
+		v[0] = 0
+
+		sign := -int32(g[0]) * int32(f[0])
+		swap := negativeMask(-delta) & nonzeroMask(int32(g[0]))
+		delta ^= swap & (delta ^ -delta)
+		delta++
+
+		for i := range f {
+			t := small(swap) & (f[i] ^ g[i])
+			f[i] ^= t
+			g[i] ^= t
+			t = small(swap) & (v[i] ^ r[i])
+			v[i] ^= t
+			r[i] ^= t
+		}
+		for i := range g {
+			g[i] = f3Freeze(int32(g[i]) + sign*int32(f[i]))
+		}
+		for i := range r {
+			r[i] = f3Freeze(int32(r[i]) + sign*int32(v[i]))
+		}
+		copy(g[:p], g[1:])
+		g[p] = 0
+	}
+
+	sign := f[0]
+	for i := 0; i < p; i++ {
+		out[i] = sign * v[p-1-i]
+	}
+	return out, nonzeroMask(delta)
+}
+
+// rqMultSmall returns f*g in R/q.
+func rqMultSmall(f *[p]fq, g *[p]small) (h [p]fq) {
+	var fg [p + p - 1]fq
+	for i := 0; i < p; i++ {
+		var r fq
+		for j := 0; j <= i; j++ {
+			r = fqFreeze(int32(r) + int32(f[j])*int32(g[i-j]))
+		}
+		fg[i] = r
+	}
+	for i := p; i < p+p-1; i++ {
+		var r fq
+		for j := i - p + 1; j < p; j++ {
+			r = fqFreeze(int32(r) + int32(f[j])*int32(g[i-j]))
+		}
+		fg[i] = r
+	}
+	for i := p + p - 2; i >= p; i-- {
+		fg[i-p] = fqFreeze(int32(fg[i-p]) + int32(fg[i]))
+		fg[i-p+1] = fqFreeze(int32(fg[i-p+1]) + int32(fg[i]))
+	}
+	copy(h[:], fg[:p])
+	return h
+}
+
+// rqRecip3 returns the inverse of 3*in in R/q, with a mask of 0 if it
+// exists, and -1 otherwise. It runs in constant time.
+func rqRecip3(in *[p]small) (out [p]fq, mask int32) {
+	var f, g, v, r [p + 1]fq
+	r[0] = fqRecip(3)
+	f[0] = 1
+	f[p-1], f[p] = -1, -1
+	for i := 0; i < p; i++ {
+		g[p-1-i] = fq(in[i])
+	}
+	delta := int32(1)
+
+	for loop := 0; loop < 2*p-1; loop++ {
+		copy(v[1:], v[:p])
+		v[0] = 0
+
+		swap := negativeMask(-delta) & nonzeroMask(int32(g[0]))
+		delta ^= swap & (delta ^ -delta)
+		delta++
+
+		for i := range f {
+			t := fq(swap) & (f[i] ^ g[i])
+			f[i] ^= t
+			g[i] ^= t
+			t = fq(swap) & (v[i] ^ r[i])
+			v[i] ^= t
+			r[i] ^= t
+		}
+		f0, g0 := int32(f[0]), int32(g[0])
+		for i := range g {
+			g[i] = fqFreeze(f0*int32(g[i]) - g0*int32(f[i]))
+		}
+		for i := range r {
+			r[i] = fqFreeze(f0*int32(r[i]) - g0*int32(v[i]))
+		}
+		copy(g[:p], g[1:])
+		g[p] = 0
+	}
+
+	scale := int32(fqRecip(f[0]))
+	for i := 0; i < p; i++ {
+		out[i] = fqFreeze(scale * int32(v[p-1-i]))
+	}
+	return out, nonzeroMask(delta)
+}
+
+// round rounds each coefficient of a to the nearest multiple of 3.
+func round(a *[p]fq) (out [p]fq) {
+	for i := range a {
+		out[i] = a[i] - fq(f3Freeze(int32(a[i])))
+	}
+	return out
+}
+
+// shortFromList derives a short polynomial from p random words, by
+// sorting w of them tagged as nonzero with the others tagged as zero.
+func shortFromList(in *[p]uint32) (out [p]small) {
+	var l [p]uint32
+	for i := 0; i < w; i++ {
+		l[i] = in[i] &^ 1
+	}
+	for i := w; i < p; i++ {
+		l[i] = in[i]&^2 | 1
+	}
+	sortUint32(l[:])
+	for i := range l {
+		out[i] = small(l[i]&3) - 1
+	}
+	return out
+}
+
+func randomWords(rand io.Reader) (*[p]uint32, error) {
+	var buf [4 * p]byte
+	if _, err := io.ReadFull(rand, buf[:]); err != nil {
+		return nil, err
+	}
+	var l [p]uint32
+	for i := range l {
+		b := buf[4*i:]
+		l[i] = uint32(b[0]) | uint32(b[1])<<8 | uint32(b[2])<<16 | uint32(b[3])<<24
+	}
+	return &l, nil
+}
+
+func shortRandom(rand io.Reader) ([p]small, error) {
+	l, err := randomWords(rand)
+	if err != nil {
+		return [p]small{}, err
+	}
+	return shortFromList(l), nil
+}
+
+func smallRandom(rand io.Reader) ([p]small, error) {
+	l, err := randomWords(rand)
+	if err != nil {
+		return [p]small{}, err
+	}
+	var out [p]small
+	for i := range l {
+		out[i] = small(((l[i]&0x3fffffff)*3)>>30) - 1
+	}
+	return out, nil
+}
+
+func smallEncode(s []byte, f *[p]small) []byte {
+	for i := 0; i < p/4; i++ {
+		x := byte(f[4*i]+1) | byte(f[4*i+1]+1)<<2 | byte(f[4*i+2]+1)<<4 | byte(f[4*i+3]+1)<<6
+		s = append(s, x)
+	}
+	return append(s, byte(f[p-1]+1))
+}
+
+func smallDecode(s []byte) (f [p]small) {
+	for i := 0; i < p/4; i++ {
+		x := s[i]
+		f[4*i] = small(x&3) - 1
+		f[4*i+1] = small(x>>2&3) - 1
+		f[4*i+2] = small(x>>4&3) - 1
+		f[4*i+3] = small(x>>6&3) - 1
+	}
+	f[p-1] = small(s[p/4]&3) - 1
+	return f
+}
+
+func rqEncode(s []byte, r *[p]fq) []byte {
+	var values, moduli [p]uint16
+	for i := range r {
+		values[i] = uint16(r[i] + q12)
+		moduli[i] = q
+	}
+	return encode(s, values[:], moduli[:])
+}
+
+func rqDecode(s []byte) (r [p]fq) {
+	var moduli [p]uint16
+	for i := range moduli {
+		moduli[i] = q
+	}
+	values := decode(s, moduli[:])
+	for i := range r {
+		r[i] = fq(values[i]) - q12
+	}
+	return r
+}
+
+func roundedEncode(s []byte, r *[p]fq) []byte {
+	var values, moduli [p]uint16
+	for i := range r {
+		values[i] = uint16((int32(r[i]+q12) * 10923) >> 15)
+		moduli[i] = (q + 2) / 3
+	}
+	return encode(s, values[:], moduli[:])
+}
+
+func roundedDecode(s []byte) (r [p]fq) {
+	var moduli [p]uint16
+	for i := range moduli {
+		moduli[i] = (q + 2) / 3
+	}
+	values := decode(s, moduli[:])
+	for i := range r {
+		r[i] = fq(values[i])*3 - q12
+	}
+	return r
+}
+
+// encode appends the encoding of the values r, where r[i] < m[i] < 2^14,
+// to s, merging pairs of values until their product no longer fits in
+// 14 bits.
+func encode(s []byte, r, m []uint16) []byte {
+	if len(r) == 1 {
+		v, mod := r[0], m[0]
+		for mod > 1 {
+			s = append(s, byte(v))
+			v >>= 8
+			mod = (mod + 255) >> 8
+		}
+		return s
+	}
+	r2 := make([]uint16, (len(r)+1)/2)
+	m2 := make([]uint16, (len(r)+1)/2)
+	i := 0
+	for ; i < len(r)-1; i += 2 {
+		m0 := uint32(m[i])
+		v := uint32(r[i]) + uint32(r[i+1])*m0
+		mod := uint32(m[i+1]) * m0
+		for mod >= 16384 {
+			s = append(s, byte(v))
+			v >>= 8
+			mod = (mod + 255) >> 8
+		}
+		r2[i/2] = uint16(v)
+		m2[i/2] = uint16(mod)
+	}
+	if i < len(r) {
+		r2[i/2] = r[i]
+		m2[i/2] = m[i]
+	}
+	return encode(s, r2, m2)
+}
+
+// decode reverses encode for the moduli m. Values out of range are
+// reduced, so that any input decodes.
+func decode(s []byte, m []uint16) []uint16 {
+	out := make([]uint16, len(m))
+	if len(m) == 1 {
+		switch {
+		case m[0] == 1:
+			out[0] = 0
+		case m[0] <= 256:
+			out[0] = uint16(uint32(s[0]) % uint32(m[0]))
+		default:
+			out[0] = uint16((uint32(s[0]) | uint32(s[1])<<8) % uint32(m[0]))
+		}
+		return out
+	}
+	m2 := make([]uint16, (len(m)+1)/2)
+	bottomR := make([]uint32, len(m)/2)
+	bottomT := make([]uint32, len(m)/2)
+	i := 0
+	for ; i < len(m)-1; i += 2 {
+		mod := uint32(m[i]) * uint32(m[i+1])
+		switch {
+		case mod > 256*16383:
+			bottomT[i/2] = 256 * 256
+			bottomR[i/2] = uint32(s[0]) | uint32(s[1])<<8
+			s = s[2:]
+			m2[i/2] = uint16((((mod + 255) >> 8) + 255) >> 8)
+		case mod >= 16384:
+			bottomT[i/2] = 256
+			bottomR[i/2] = uint32(s[0])
+			s = s[1:]
+			m2[i/2] = uint16((mod + 255) >> 8)
+		default:
+			bottomT[i/2] = 1
+			m2[i/2] = uint16(mod)
+		}
+	}
+	if i < len(m) {
+		m2[i/2] = m[i]
+	}
+	r2 := decode(s, m2)
+	for i = 0; i < len(m)-1; i += 2 {
+		v := bottomR[i/2] + bottomT[i/2]*uint32(r2[i/2])
+		out[i] = uint16(v % uint32(m[i]))
+		out[i+1] = uint16(v / uint32(m[i]) % uint32(m[i+1]))
+	}
+	if i < len(m) {
+		out[i] = r2[i/2]
+	}
+	return out
+}
+
+// hashPrefix returns the first 32 bytes of SHA-512(b || in).
+func hashPrefix(b byte, in ...[]byte) []byte {
+	h := sha512.New()
+	h.Write([]byte{b})
+	for _, x := range in {
+		h.Write(x)
+	}
+	return h.Sum(nil)[:hashBytes]
+}
+
+// A DecapsulationKey is an sntrup761 decapsulation key.
+type DecapsulationKey struct {
+	f, ginv [p]small
+	ek      [EncapsulationKeySize]byte
+	rho     [smallBytes]byte // implicit rejection input
+	cache   []byte           // hashPrefix(4, ek)
+}
+
+// GenerateKey generates a decapsulation key, reading its randomness
+// from rand.
+func GenerateKey(rand io.Reader) (*DecapsulationKey, error) {
+	dk := &DecapsulationKey{}
+	var g [p]small
+	for {
+		var err error
+		if g, err = smallRandom(rand); err != nil {
+			return nil, err
+		}
+		var mask int32
+		if dk.ginv, mask = r3Recip(&g); mask == 0 {
+			break
+		}
+	}
+	var err error
+	if dk.f, err = shortRandom(rand); err != nil {
+		return nil, err
+	}
+	// f is short, so 3f is always invertible.
+	finv, _ := rqRecip3(&dk.f)
+	h := rqMultSmall(&finv, &g)
+	rqEncode(dk.ek[:0], &h)
+
+	if _, err := io.ReadFull(rand, dk.rho[:]); err != nil {
+		return nil, err
+	}
+	dk.cache = hashPrefix(4, dk.ek[:])
+	return dk, nil
+}
+
+// EncapsulationKey returns the encoded encapsulation key matching dk.
+func (dk *DecapsulationKey) EncapsulationKey() []byte {
+	return append([]byte(nil), dk.ek[:]...)
+}
+
+// hide encrypts the short polynomial r to the public key h, returning
+// the encoding of r and the ciphertext, with its confirmation hash.
+func hide(r *[p]small, h *[p]fq, cache []byte) (rEnc, ciphertext []byte) {
+	rEnc = smallEncode(make([]byte, 0, smallBytes), r)
+	hr := rqMultSmall(h, r)
+	c := round(&hr)
+	ciphertext = roundedEncode(make([]byte, 0, CiphertextSize), &c)
+	confirm := hashPrefix(2, hashPrefix(3, rEnc), cache)
+	return rEnc, append(ciphertext, confirm...)
+}
+
+// Encapsulate generates a shared key and its encapsulation to the
+// encoded encapsulation key ek, reading the randomness from rand.
+func Encapsulate(rand io.Reader, ek []byte) (ciphertext, sharedKey []byte, err error) {
+	if len(ek) != EncapsulationKeySize {
+		return nil, nil, errors.New("sntrup761: invalid encapsulation key length")
+	}
+	r, err := shortRandom(rand)
+	if err != nil {
+		return nil, nil, err
+	}
+	h := rqDecode(ek)
+	rEnc, ciphertext := hide(&r, &h, hashPrefix(4, ek))
+	return ciphertext, hashPrefix(1, hashPrefix(3, rEnc), ciphertext), nil
+}
+
+// Decapsulate returns the shared key encapsulated in ciphertext. An
+// invalid ciphertext yields a pseudorandom key, which fails to match
+// the peer's.
+func Decapsulate(dk *DecapsulationKey, ciphertext []byte) (sharedKey []byte, err error) {
+	if len(ciphertext) != CiphertextSize {
+		return nil, errors.New("sntrup761: invalid ciphertext length")
+	}
+	c := roundedDecode(ciphertext[:roundedBytes])
+	cf := rqMultSmall(&c, &dk.f)
+	var e [p]small
+	for i := range cf {
+		e[i] = f3Freeze(int32(fqFreeze(3 * int32(cf[i]))))
+	}
+	ev := r3Mult(&e, &dk.ginv)
+	mask := small(weightMask(&ev))
+	var r [p]small
+	for i := 0; i < w; i++ {
+		r[i] = ((ev[i] ^ 1) &^ mask) ^ 1
+	}
+	for i := w; i < p; i++ {
+		r[i] = ev[i] &^ mask
+	}
+
+	h := rqDecode(dk.ek[:])
+	rEnc, cNew := hide(&r, &h, dk.cache)
+	equal := subtle.ConstantTimeCompare(cNew, ciphertext)
+	subtle.ConstantTimeCopy(1-equal, rEnc, dk.rho[:])
+	return hashPrefix(byte(equal), hashPrefix(3, rEnc), ciphertext), nil
+}
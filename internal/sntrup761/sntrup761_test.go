@@ -0,0 +1,191 @@
+package sntrup761
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	mathrand "math/rand"
+	"sort"
+	"testing"
+)
+
+func TestRoundTrip(t *testing.T) {
+	for i := 0; i < 5; i++ {
+		dk, err := GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ek := dk.EncapsulationKey()
+		if len(ek) != EncapsulationKeySize {
+			t.Fatalf("got a %d-byte encapsulation key, want %d", len(ek), EncapsulationKeySize)
+		}
+		c, Ke, err := Encapsulate(rand.Reader, ek)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(c) != CiphertextSize {
+			t.Fatalf("got a %d-byte ciphertext, want %d", len(c), CiphertextSize)
+		}
+		Kd, err := Decapsulate(dk, c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(Ke, Kd) {
+			t.Fatal("shared keys do not match")
+		}
+
+		// Both the rounded polynomial and the confirmation hash are
+		// checked.
+		for _, pos := range []int{0, CiphertextSize - 1} {
+			c[pos] ^= 1
+			Kd, err = Decapsulate(dk, c)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if bytes.Equal(Ke, Kd) {
+				t.Errorf("ciphertext modified at %d yielded the same key", pos)
+			}
+			c[pos] ^= 1
+		}
+	}
+}
+
+// openSSHEncapsulationKey was generated by OpenSSH 9.2p1, whose
+// sntrup761 is the reference implementation from SUPERCOP, for a
+// sntrup761x25519-sha512 key exchange.
+const openSSHEncapsulationKey = "bf64e914e3ee76c4ba9501aad8979113c28cd00cfe779771357b5a5e36d21e7bfaa1ad666988997ecc400ef8bdccacb13f72273ee3def1bdcceeb26dd23889676bb81abd1dc0609e1af2706ec07cb11ecec94ce284b24933fc8c206496ea5beb3860556d4a313e79f583b682d278559ca71d8cb2050d8d5f33626bcd1ed6d16d688773b8e63f6cc61e3b7b35c9406230d80ffbfaf92b23f0977fa7e30222a1ab822a2e88a00cf586c2502aa3e40c3137d3ada937445344674059e13c527617d0f5cf5101b893f6d175dd0b7fe4f6bd3dda512408edd673ebf2012c550c9d65777ce0cbcc1c473d81837e8e9941ecc0ad7d6bf2e64173d41e8bca0a886f8ac7bf3755eaba19d294fd8a2fd60c9bcc2702f872e345fdc8627674e23ce7b828c1f0acdd845891b25a8950b50a7ae96870c339d5ddc8a37ae1f9ba991b9e7631daf93539fb0f18326305c28c2eb881af3b42777a67ee1c54891cbb9c6b77f895f03f7a7985727805555d05f856307df803dc643f6d7280865f307da43817d726a46e32c2af1ff2f92a24536f5e25374456159711be732dfb1694a31a24bf8afc9ad389b50dead7721fb7f101247de77cb655aef29441e558f591d184d945fe55135c3ec8d18fa8177c107de1be67bc336f8b8918818a0257a2aa1662689bdc8ee60b604c01caf272a0b5dde0149fe38a2e35f5ed0a129738012f3f8c50c8b25e46a90bb88351cd16e13d9717c3ab8bf1752a0a01aa112a2c64b5d5179c41bc159cf72c2a4a0557ea528338917f881793345a46634f410ee21f95a6b83ad3059ebd8a2aeabf1ded8794f8636f1509d475d6bbb4116034ff8b22887de925da6654e36fe57caa0f14774b0c14c377480bc1a509e1c809e882b9e2d3c591cb91e5d8cab48a10574334ac2fccd95b4453a37b8db8894a85b3f9094fa40a5708f5f6f9d1ae2459d6b341c619fd5fbd768bb1ff9568f72b3a023fa82132ab985dd9f63ea16a928aeb8e0ee1c35cbfc610f6c56c6399b4d9a77d94011fcabdf860238205951726f2265b286197993f762d7c6cf6d5c04f19db703f43a15af76bb89084b9baa286aee7b99533a68486dd31d6e2ef0df5a08349ce4792fd1851d3282fa198e185cb96439ad87d3215c4690ea9ec6fa2bc63c2dae12504b217f4110eb69f38d7f6dea965c45aea20eec07d79ff15fc0f28ae1c225d687a0a17eb68739feb38ed5a9f1305e4d034279fdf9e0f0360c4b3f339acf3f35d9b1d5fa9f4942e014108e7c333187f7eda5106e12ee06ebcaef99b9f8898479faca0c57d1d22855e1a5a0eb743dd0f88ad9cdb437f60f152bac604bca7afdf6363ba3f3d3099c67f5b22f666beef83a8a93c458a495823684b0dbbb8563486c83615cfd07e4c46bfdae562f2254bbfbc64b4585685bdbe0000b94aad118772f2c05607f22ecd326175f668842cddfc02c17cf3707f8cfdc75ca8a384c9c483ee94b30fd00ac425699eb1998cb28ccfecccb9524a1f2ddab083b96d899039bcea0043eb4f58bd20753044ed9a34b44ef5ad3d0da51532cf12723e971f5638fe2fdbba37b2001c3bfb098d1d051c0d3c589c873c5436b90129f46c95ec3cd95ec6f737d2b413a9d920faea1fb0b915097105"
+
+// TestKnownAnswer checks Encapsulate against the reference
+// implementation. The ciphertext and key were sent to OpenSSH in the
+// exchange that openSSHEncapsulationKey started, and the connection
+// they keyed completed, so OpenSSH decapsulated the same key.
+func TestKnownAnswer(t *testing.T) {
+	const (
+		wantCiphertext = "93d4fef62b86acdac8cadb6c37c634430f25d52db5dd98bd6fe3ea7a2da8238a" // SHA-256
+		wantKey        = "2b3325a7496efbc8679014197d36c70e8a42d85ec67e57c7f6af423250b0785a"
+	)
+	ek, err := hex.DecodeString(openSSHEncapsulationKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	random := make([]byte, 4*p)
+	for i := range random {
+		random[i] = byte(160 + i)
+	}
+	c, K, err := Encapsulate(bytes.NewReader(random), ek)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := sha256.Sum256(c); hex.EncodeToString(got[:]) != wantCiphertext {
+		t.Errorf("got ciphertext with SHA-256 %x, want %s", got, wantCiphertext)
+	}
+	if got := hex.EncodeToString(K); got != wantKey {
+		t.Errorf("got key %s, want %s", got, wantKey)
+	}
+}
+
+func TestBadLengths(t *testing.T) {
+	dk, err := GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ek := dk.EncapsulationKey()
+	if _, _, err := Encapsulate(rand.Reader, ek[1:]); err == nil {
+		t.Error("short encapsulation key accepted")
+	}
+	c, _, err := Encapsulate(rand.Reader, ek)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Decapsulate(dk, append(c, 0)); err == nil {
+		t.Error("long ciphertext accepted")
+	}
+}
+
+func TestReciprocals(t *testing.T) {
+	var one [p]small
+	one[0] = 1
+	for i := 0; i < 3; i++ {
+		g, err := smallRandom(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ginv, mask := r3Recip(&g)
+		if mask != 0 {
+			continue
+		}
+		if r3Mult(&g, &ginv) != one {
+			t.Error("g * 1/g != 1 in R/3")
+		}
+	}
+
+	f, err := shortRandom(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	weight := 0
+	for _, c := range f {
+		if c != 0 {
+			weight++
+		}
+	}
+	if weight != w {
+		t.Errorf("short polynomial has weight %d, want %d", weight, w)
+	}
+	finv, mask := rqRecip3(&f)
+	if mask != 0 {
+		t.Fatal("3f is not invertible")
+	}
+	prod := rqMultSmall(&finv, &f)
+	for i := range prod {
+		want := fq(0)
+		if i == 0 {
+			want = fqRecip(3)
+		}
+		if prod[i] != want {
+			t.Fatalf("coefficient %d of f * 1/3f is %d, want %d", i, prod[i], want)
+		}
+	}
+}
+
+func TestEncoding(t *testing.T) {
+	var r [p]fq
+	for i := range r {
+		r[i] = fq(mathrand.Intn(q) - q12)
+	}
+	enc := rqEncode(nil, &r)
+	if len(enc) != EncapsulationKeySize {
+		t.Fatalf("got %d bytes, want %d", len(enc), EncapsulationKeySize)
+	}
+	if rqDecode(enc) != r {
+		t.Error("R/q encoding does not round trip")
+	}
+
+	r = round(&r)
+	enc = roundedEncode(nil, &r)
+	if len(enc) != roundedBytes {
+		t.Fatalf("got %d bytes, want %d", len(enc), roundedBytes)
+	}
+	if roundedDecode(enc) != r {
+		t.Error("rounded encoding does not round trip")
+	}
+}
+
+func TestSort(t *testing.T) {
+	for _, n := range []int{0, 1, 2, 3, 7, 64, 100, p} {
+		x := make([]uint32, n)
+		for i := range x {
+			x[i] = mathrand.Uint32()
+		}
+		want := append([]uint32(nil), x...)
+		sort.Slice(want, func(i, j int) bool { return want[i] < want[j] })
+		sortUint32(x)
+		for i := range x {
+			if x[i] != want[i] {
+				t.Errorf("n=%d: element %d is %d, want %d", n, i, x[i], want[i])
+				break
+			}
+		}
+	}
+}
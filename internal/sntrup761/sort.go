@@ -0,0 +1,92 @@
+package sntrup761
+
+// int32MinMax sets a and b to their minimum and maximum, in constant
+// time.
+func int32MinMax(a, b *int32) {
+	ab := *b ^ *a
+	c := *b - *a
+	c ^= ab & (c ^ *b)
+	c >>= 31
+	c &= ab
+	*a ^= c
+	*b ^= c
+}
+
+// sortInt32 sorts x with a sorting network, so that its running time
+// does not depend on the values sorted. It follows djbsort,
+// https://sorting.cr.yp.to/.
+func sortInt32(x []int32) {
+	n := len(x)
+	if n < 2 {
+		return
+	}
+	top := 1
+	for top < n-top {
+		top += top
+	}
+	for p := top; p >= 1; p >>= 1 {
+		i := 0
+		for i+2*p <= n {
+			for j := i; j < i+p; j++ {
+				int32MinMax(&x[j], &x[j+p])
+			}
+			i += 2 * p
+		}
+		for j := i; j < n-p; j++ {
+			int32MinMax(&x[j], &x[j+p])
+		}
+
+		i = 0
+		j := 0
+	merge:
+		for q := top; q > p; q >>= 1 {
+			if j != i {
+				for {
+					if j == n-q {
+						continue merge
+					}
+					a := x[j+p]
+					for r := q; r > p; r >>= 1 {
+						int32MinMax(&a, &x[j+r])
+					}
+					x[j+p] = a
+					j++
+					if j == i+p {
+						i += 2 * p
+						break
+					}
+				}
+			}
+			for i+p <= n-q {
+				for j = i; j < i+p; j++ {
+					a := x[j+p]
+					for r := q; r > p; r >>= 1 {
+						int32MinMax(&a, &x[j+r])
+					}
+					x[j+p] = a
+				}
+				i += 2 * p
+			}
+			// Now i+p > n-q.
+			for j = i; j < n-q; j++ {
+				a := x[j+p]
+				for r := q; r > p; r >>= 1 {
+					int32MinMax(&a, &x[j+r])
+				}
+				x[j+p] = a
+			}
+		}
+	}
+}
+
+// sortUint32 sorts x in constant time.
+func sortUint32(x []uint32) {
+	y := make([]int32, len(x))
+	for i := range x {
+		y[i] = int32(x[i] ^ 0x80000000)
+	}
+	sortInt32(y)
+	for i := range x {
+		x[i] = uint32(y[i]) ^ 0x80000000
+	}
+}
@@ -0,0 +1,250 @@
+// Package umac implements the UMAC message authentication code with
+// AES-128, as specified in RFC 4418. UMAC-64 and UMAC-128 back the
+// umac-64-etm@openssh.com and umac-128-etm@openssh.com SSH MACs.
+//
+// Like the reference implementation, which OpenSSH uses and which
+// computed the test vectors of the RFC, L2-HASH hashes messages of any
+// length with POLY over 64-bit words. The RFC switches to 128-bit words
+// past 2 MB, far beyond the size of an SSH packet.
+package umac
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"math/bits"
+)
+
+// KeySize is the size of a UMAC key.
+const KeySize = 16
+
+const (
+	// chunkSize is the size of the chunks of the message that
+	// L1-HASH compresses into 8 bytes each.
+	chunkSize = 1024
+
+	p36 = 1<<36 - 5
+	p64 = 1<<64 - 59
+
+	mask64 = 0x01ffffff01ffffff
+)
+
+// MAC computes UMAC tags. It accumulates the message with Write, and
+// computes the tag of the data written since the last Reset with Sum.
+type MAC struct {
+	size  int
+	iters int
+	pdf   cipher.Block
+
+	// The keys of each iteration of UHASH, one per 4 bytes of tag.
+	// That of L1-HASH for iteration i starts at l1Key[4*i].
+	l1Key  []uint32
+	l2Key  []uint64
+	l3Key1 [][8]uint64
+	l3Key2 []uint32
+
+	// buf holds the chunk of the message not hashed yet, which is
+	// the last one as long as no more data is written.
+	buf    [chunkSize]byte
+	n      int
+	chunks int
+
+	// l2 holds the POLY state of L2-HASH in each iteration.
+	l2 []uint64
+}
+
+// New returns a MAC computing tags of size bytes, which must be 4, 8,
+// 12 or 16, with key.
+func New(key []byte, size int) (*MAC, error) {
+	if len(key) != KeySize {
+		return nil, errors.New("umac: invalid key size")
+	}
+	if size != 4 && size != 8 && size != 12 && size != 16 {
+		return nil, errors.New("umac: invalid tag size")
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	iters := size / 4
+	m := &MAC{
+		size:   size,
+		iters:  iters,
+		l2Key:  make([]uint64, iters),
+		l3Key1: make([][8]uint64, iters),
+		l3Key2: make([]uint32, iters),
+		l2:     make([]uint64, iters),
+	}
+
+	m.pdf, err = aes.NewCipher(kdf(block, 0, 16))
+	if err != nil {
+		return nil, err
+	}
+
+	l1Key := kdf(block, 1, chunkSize+(iters-1)*16)
+	m.l1Key = make([]uint32, len(l1Key)/4)
+	for i := range m.l1Key {
+		m.l1Key[i] = binary.BigEndian.Uint32(l1Key[4*i:])
+	}
+	l2Key := kdf(block, 2, iters*24)
+	l3Key1 := kdf(block, 3, iters*64)
+	l3Key2 := kdf(block, 4, iters*4)
+	for i := 0; i < iters; i++ {
+		// The last 16 bytes are the key of the 128-bit POLY.
+		m.l2Key[i] = binary.BigEndian.Uint64(l2Key[24*i:]) & mask64
+		for j := range m.l3Key1[i] {
+			m.l3Key1[i][j] = binary.BigEndian.Uint64(l3Key1[64*i+8*j:]) % p36
+		}
+		m.l3Key2[i] = binary.BigEndian.Uint32(l3Key2[4*i:])
+	}
+	m.Reset()
+	return m, nil
+}
+
+// kdf derives n bytes of key material for the given index, as
+// specified in section 3.2 of RFC 4418.
+func kdf(block cipher.Block, index uint64, n int) []byte {
+	out := make([]byte, (n+15)/16*16)
+	var in [16]byte
+	binary.BigEndian.PutUint64(in[:], index)
+	for i := 0; i < len(out)/16; i++ {
+		binary.BigEndian.PutUint64(in[8:], uint64(i+1))
+		block.Encrypt(out[16*i:], in[:])
+	}
+	return out[:n]
+}
+
+// Size returns the size of the tags.
+func (m *MAC) Size() int { return m.size }
+
+// Reset discards the data written so far.
+func (m *MAC) Reset() {
+	m.n = 0
+	m.chunks = 0
+	for i := range m.l2 {
+		m.l2[i] = 1
+	}
+}
+
+// Write adds p to the message.
+func (m *MAC) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		if m.n == chunkSize {
+			m.hashChunk()
+		}
+		c := copy(m.buf[m.n:], p)
+		m.n += c
+		p = p[c:]
+	}
+	return n, nil
+}
+
+// hashChunk feeds the full chunk in buf through L1-HASH and L2-HASH.
+func (m *MAC) hashChunk() {
+	for i := 0; i < m.iters; i++ {
+		a := nh(m.l1Key[4*i:], m.buf[:]) + 8*chunkSize
+		m.l2[i] = poly64(m.l2Key[i], m.l2[i], a)
+	}
+	m.n = 0
+	m.chunks++
+}
+
+// Sum appends to b the tag of the data written so far, with nonce,
+// which must be between 1 and 16 bytes long. It does not change the
+// underlying state.
+func (m *MAC) Sum(b, nonce []byte) []byte {
+	if len(nonce) < 1 || len(nonce) > 16 {
+		panic("umac: invalid nonce size")
+	}
+
+	// The last chunk is padded with zeros to a multiple of 32
+	// bytes, of at least 32 bytes.
+	padded := (m.n + 31) / 32 * 32
+	if padded == 0 {
+		padded = 32
+	}
+	for i := m.n; i < padded; i++ {
+		m.buf[i] = 0
+	}
+
+	var tag [16]byte
+	for i := 0; i < m.iters; i++ {
+		a := nh(m.l1Key[4*i:], m.buf[:padded]) + 8*uint64(m.n)
+		// L2-HASH is skipped for messages of a single chunk.
+		h := a
+		if m.chunks > 0 {
+			h = poly64(m.l2Key[i], m.l2[i], a)
+		}
+		binary.BigEndian.PutUint32(tag[4*i:], l3Hash(&m.l3Key1[i], m.l3Key2[i], h))
+	}
+
+	// Generate the pad. With 4 and 8-byte tags, the low bits of
+	// the nonce select a part of the block.
+	var in, pad [16]byte
+	copy(in[:], nonce)
+	index := 0
+	if m.size <= 8 {
+		last := len(nonce) - 1
+		index = int(in[last]) % (16 / m.size)
+		in[last] ^= byte(index)
+	}
+	m.pdf.Encrypt(pad[:], in[:])
+	for i := 0; i < m.size; i++ {
+		tag[i] ^= pad[index*m.size+i]
+	}
+	return append(b, tag[:m.size]...)
+}
+
+// nh computes the NH hash of msg, whose length is a multiple of 32
+// bytes, with the first len(msg)/4 words of key.
+func nh(key []uint32, msg []byte) uint64 {
+	var y uint64
+	for ; len(msg) >= 32; msg, key = msg[32:], key[8:] {
+		m0 := binary.LittleEndian.Uint32(msg[0:]) + key[0]
+		m1 := binary.LittleEndian.Uint32(msg[4:]) + key[1]
+		m2 := binary.LittleEndian.Uint32(msg[8:]) + key[2]
+		m3 := binary.LittleEndian.Uint32(msg[12:]) + key[3]
+		m4 := binary.LittleEndian.Uint32(msg[16:]) + key[4]
+		m5 := binary.LittleEndian.Uint32(msg[20:]) + key[5]
+		m6 := binary.LittleEndian.Uint32(msg[24:]) + key[6]
+		m7 := binary.LittleEndian.Uint32(msg[28:]) + key[7]
+		y += uint64(m0)*uint64(m4) + uint64(m1)*uint64(m5) +
+			uint64(m2)*uint64(m6) + uint64(m3)*uint64(m7)
+	}
+	return y
+}
+
+// poly64 adds the word m to the POLY hash y with key k, modulo 2^64 -
+// 59. Words too large to be reduced are encoded as two.
+func poly64(k, y, m uint64) uint64 {
+	if m >= 1<<64-1<<32 {
+		y = mulAdd64(k, y, p64-1)
+		m -= 1<<64 - p64
+	}
+	return mulAdd64(k, y, m)
+}
+
+// mulAdd64 returns k*y + m modulo 2^64 - 59, for k < 2^57.
+func mulAdd64(k, y, m uint64) uint64 {
+	hi, lo := bits.Mul64(k, y)
+	// 2^64 is 59 modulo p64, and hi*59 < 2^63.
+	lo, c := bits.Add64(lo, hi*59, 0)
+	lo += c * 59
+	lo, c = bits.Add64(lo, m, 0)
+	lo += c * 59
+	t, b := bits.Sub64(lo, p64, 0)
+	mask := b - 1
+	return t&mask | lo&^mask
+}
+
+// l3Hash computes L3-HASH of the L2-HASH output h, whose upper 64
+// bits are zero and do not contribute.
+func l3Hash(k1 *[8]uint64, k2 uint32, h uint64) uint32 {
+	var y uint64
+	for j := 0; j < 4; j++ {
+		y += (h >> (48 - 16*uint(j)) & 0xffff) * k1[4+j]
+	}
+	return uint32(y%p36) ^ k2
+}
@@ -0,0 +1,96 @@
+package umac
+
+import (
+	"bytes"
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+// The UMAC-32, UMAC-64 and UMAC-96 tags are the test vectors of
+// appendix A of RFC 4418, with key "abcdefghijklmnop" and nonce
+// "bcdefghi". The UMAC-128 tags were computed with this package and
+// match OpenSSH's in umac-128-etm@openssh.com connections; their first
+// 12 bytes are the UMAC-96 tags.
+var testVectors = []struct {
+	msg    string
+	n      int
+	tag32  string
+	tag64  string
+	tag96  string
+	tag128 string
+}{
+	{"", 0, "113145FB", "6E155FAD26900BE1", "32FEDB100C79AD58F07FF764", "32FEDB100C79AD58F07FF7643CC60465"},
+	{"a", 3, "3B91D102", "44B5CB542F220104", "185E4FE905CBA7BD85E4C2DC", "185E4FE905CBA7BD85E4C2DC3D117D8D"},
+	{"a", 1 << 10, "599B350B", "26BF2F5D60118BD9", "7A54ABE04AF82D60FB298C3C", "7A54ABE04AF82D60FB298C3CBD195BCB"},
+	{"a", 1 << 15, "58DCF532", "27F8EF643B0D118D", "7B136BD911E4B734286EF2BE", "7B136BD911E4B734286EF2BE501F2C3C"},
+	{"a", 1 << 20, "DB6364D1", "A4477E87E9F55853", "F8ACFA3AC31CFEEA047F7B11", "F8ACFA3AC31CFEEA047F7B115B03BEF5"},
+	{"a", 1 << 25, "5109A660", "2E2DBC36860A0A5F", "72C6388BACE3ACE6FBF062D9", "72C6388BACE3ACE6FBF062D919F5D8DD"},
+	{"abc", 1, "ABF3A3A0", "D4D7B9F6BD4FBFCF", "883C3D4B97A61976FFCF2323", "883C3D4B97A61976FFCF232308CBA5A5"},
+	{"abc", 500, "ABEB3C8B", "D4CF26DDEFD5C01A", "8824A260C53C66A36C9260A6", "8824A260C53C66A36C9260A62CB83AA1"},
+}
+
+func TestVectors(t *testing.T) {
+	key := []byte("abcdefghijklmnop")
+	nonce := []byte("bcdefghi")
+	for _, tv := range testVectors {
+		if tv.n == 1<<25 && testing.Short() {
+			continue
+		}
+		msg := []byte(strings.Repeat(tv.msg, tv.n))
+		for i, want := range []string{tv.tag32, tv.tag64, tv.tag96, tv.tag128} {
+			m, err := New(key, 4*(i+1))
+			if err != nil {
+				t.Fatal(err)
+			}
+			m.Write(msg)
+			if got := hex.EncodeToString(m.Sum(nil, nonce)); !strings.EqualFold(got, want) {
+				t.Errorf("UMAC-%d(%q * %d) = %s, want %s", 32*(i+1), tv.msg, tv.n, got, want)
+			}
+		}
+	}
+}
+
+func TestWrites(t *testing.T) {
+	key := []byte("abcdefghijklmnop")
+	msg := make([]byte, 5000)
+	for i := range msg {
+		msg[i] = byte(i * 7)
+	}
+	for _, size := range []int{8, 16} {
+		m, err := New(key, size)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m.Write(msg)
+		want := m.Sum(nil, []byte{1})
+
+		// Sum does not change the state, and the tag does not
+		// depend on how the message is split.
+		m.Reset()
+		m.Write(msg[:1])
+		m.Sum(nil, []byte{1})
+		for i, n := 1, 1; i < len(msg); i, n = i+n, n*3 {
+			if i+n > len(msg) {
+				n = len(msg) - i
+			}
+			m.Write(msg[i : i+n])
+			m.Sum(nil, []byte{1})
+		}
+		if got := m.Sum(nil, []byte{1}); !bytes.Equal(got, want) {
+			t.Errorf("UMAC-%d: got %x after split writes, want %x", 8*size, got, want)
+		}
+		if got := m.Sum(nil, []byte{2}); bytes.Equal(got, want) {
+			t.Errorf("UMAC-%d: tag does not depend on the nonce", 8*size)
+		}
+	}
+}
+
+func TestBadSizes(t *testing.T) {
+	if _, err := New(make([]byte, KeySize-1), 8); err == nil {
+		t.Error("New succeeded with a short key")
+	}
+	if _, err := New(make([]byte, KeySize), 10); err == nil {
+		t.Error("New succeeded with a tag size of 10")
+	}
+}
@@ -57,6 +57,54 @@ type Agent interface {
 	Signers() ([]ssh.Signer, error)
 }
 
+// SignatureFlags represent additional flags that can be passed to the signature
+// requests as defined in [PROTOCOL.agent] section 4.5.1.
+type SignatureFlags uint32
+
+// SignatureFlag values as defined in [PROTOCOL.agent] section 5.3.
+const (
+	SignatureFlagReserved SignatureFlags = 1 << iota
+	SignatureFlagRsaSha256
+	SignatureFlagRsaSha512
+)
+
+// ExtendedAgent is an Agent that can also choose the signature
+// algorithm of RSA keys, as defined in RFC 8332.
+type ExtendedAgent interface {
+	Agent
+
+	// SignWithFlags signs like Sign, with flags selecting the
+	// signature algorithm of RSA keys.
+	SignWithFlags(key ssh.PublicKey, data []byte, flags SignatureFlags) (*ssh.Signature, error)
+}
+
+// flagsForAlgorithm returns the flags that request a signature with
+// the signature algorithm algo, as passed to
+// ssh.AlgorithmSigner.SignWithAlgorithm.
+func flagsForAlgorithm(algo string) (SignatureFlags, error) {
+	switch algo {
+	case "", ssh.KeyAlgoRSA, ssh.KeyAlgoDSA, ssh.KeyAlgoECDSA256, ssh.KeyAlgoECDSA384, ssh.KeyAlgoECDSA521, ssh.KeyAlgoED25519:
+		return 0, nil
+	case ssh.KeyAlgoRSASHA256:
+		return SignatureFlagRsaSha256, nil
+	case ssh.KeyAlgoRSASHA512:
+		return SignatureFlagRsaSha512, nil
+	}
+	return 0, fmt.Errorf("agent: unsupported signature algorithm %s", algo)
+}
+
+// algorithmForFlags returns the signature algorithm that flags request,
+// or the empty string for the default of the key.
+func algorithmForFlags(flags SignatureFlags) string {
+	switch {
+	case flags&SignatureFlagRsaSha512 != 0:
+		return ssh.KeyAlgoRSASHA512
+	case flags&SignatureFlagRsaSha256 != 0:
+		return ssh.KeyAlgoRSASHA256
+	}
+	return ""
+}
+
 // ConstraintExtension describes an optional constraint defined by users.
 type ConstraintExtension struct {
 	// ExtensionName consist of a UTF-8 string suffixed by the
@@ -369,9 +417,14 @@ func (c *client) List() ([]*Key, error) {
 // Sign has the agent sign the data using a protocol 2 key as defined
 // in [PROTOCOL.agent] section 2.6.2.
 func (c *client) Sign(key ssh.PublicKey, data []byte) (*ssh.Signature, error) {
+	return c.SignWithFlags(key, data, 0)
+}
+
+func (c *client) SignWithFlags(key ssh.PublicKey, data []byte, flags SignatureFlags) (*ssh.Signature, error) {
 	req := ssh.Marshal(signRequestAgentMsg{
 		KeyBlob: key.Marshal(),
 		Data:    data,
+		Flags:   uint32(flags),
 	})
 
 	msg, err := c.call(req)
@@ -681,3 +734,18 @@ func (s *agentKeyringSigner) Sign(rand io.Reader, data []byte) (*ssh.Signature,
 	// The agent has its own entropy source, so the rand argument is ignored.
 	return s.agent.Sign(s.pub, data)
 }
+
+func (s *agentKeyringSigner) SignWithAlgorithm(rand io.Reader, data []byte, algorithm string) (*ssh.Signature, error) {
+	flags, err := flagsForAlgorithm(algorithm)
+	if err != nil {
+		return nil, err
+	}
+	keyType := s.pub.Type()
+	if cert, ok := s.pub.(*ssh.Certificate); ok {
+		keyType = cert.Key.Type()
+	}
+	if flags != 0 && keyType != ssh.KeyAlgoRSA || flags == 0 && algorithm != "" && algorithm != keyType {
+		return nil, fmt.Errorf("agent: cannot sign with %s using a %s key", algorithm, keyType)
+	}
+	return s.agent.SignWithFlags(s.pub, data, flags)
+}
@@ -263,6 +263,43 @@ func TestAuth(t *testing.T) {
 	conn.Close()
 }
 
+func TestSignWithAlgorithm(t *testing.T) {
+	agent, cleanup := startKeyringAgent(t)
+	defer cleanup()
+	if err := agent.Add(AddedKey{PrivateKey: testPrivateKeys["rsa"]}); err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+	signers, err := agent.Signers()
+	if err != nil {
+		t.Fatalf("Signers: %v", err)
+	}
+	signer, ok := signers[0].(ssh.AlgorithmSigner)
+	if !ok {
+		t.Fatalf("agent signer %T is not an AlgorithmSigner", signers[0])
+	}
+
+	data := []byte("sign me")
+	for _, algo := range []string{"", ssh.KeyAlgoRSA, ssh.KeyAlgoRSASHA256, ssh.KeyAlgoRSASHA512} {
+		sig, err := signer.SignWithAlgorithm(rand.Reader, data, algo)
+		if err != nil {
+			t.Fatalf("SignWithAlgorithm(%q): %v", algo, err)
+		}
+		want := algo
+		if want == "" {
+			want = ssh.KeyAlgoRSA
+		}
+		if sig.Format != want {
+			t.Errorf("got signature format %s, want %s", sig.Format, want)
+		}
+		if err := testPublicKeys["rsa"].Verify(data, sig); err != nil {
+			t.Errorf("Verify(%s): %v", want, err)
+		}
+	}
+	if _, err := signer.SignWithAlgorithm(rand.Reader, data, ssh.KeyAlgoED25519); err == nil {
+		t.Errorf("RSA key signed with %s", ssh.KeyAlgoED25519)
+	}
+}
+
 func TestLockOpenSSHAgent(t *testing.T) {
 	agent, _, cleanup := startOpenSSHAgent(t)
 	defer cleanup()
@@ -0,0 +1,222 @@
+package agent
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// See [PROTOCOL.agent], section 4.7.
+const agentExtension = 27
+
+type extensionAgentMsg struct {
+	ExtensionType string `sshtype:"27"`
+	Contents      []byte `ssh:"rest"`
+}
+
+// signRequestExtension is the extension a Delegate uses to ask for
+// a signature along with its context. The agent answers it like a
+// sign request.
+const signRequestExtension = "sign-request@cs.stanford.edu"
+
+type signRequestExtensionMsg struct {
+	KeyBlob       []byte
+	Data          []byte
+	Flags         uint32
+	SessionID     []byte
+	ServerAddress string
+	User          string
+	Command       string
+}
+
+// A ContextSigner is an Agent that can sign a proxy's authentication
+// knowing what the signature is for.
+type ContextSigner interface {
+	SignWithContext(req *ssh.SignRequest) (*ssh.Signature, error)
+}
+
+// NewDelegate returns an ssh.Delegate that has the agent at the other
+// end of rw, typically a channel forwarded from the delegating user,
+// sign with its keys. The agent must implement ContextSigner, as the
+// agents returned by NewApprovingAgent do.
+func NewDelegate(rw io.ReadWriter) ssh.Delegate {
+	return &delegate{NewClient(rw).(*client)}
+}
+
+type delegate struct {
+	c *client
+}
+
+func (d *delegate) PublicKeys() ([]ssh.PublicKey, error) {
+	keys, err := d.c.List()
+	if err != nil {
+		return nil, err
+	}
+	pubKeys := make([]ssh.PublicKey, len(keys))
+	for i, k := range keys {
+		pubKeys[i] = k
+	}
+	return pubKeys, nil
+}
+
+func (d *delegate) Sign(req *ssh.SignRequest) (*ssh.Signature, error) {
+	flags, err := flagsForAlgorithm(req.Algorithm)
+	if err != nil {
+		return nil, err
+	}
+	msg, err := d.c.call(ssh.Marshal(extensionAgentMsg{
+		ExtensionType: signRequestExtension,
+		Contents: ssh.Marshal(signRequestExtensionMsg{
+			KeyBlob:       req.Key.Marshal(),
+			Data:          req.Data,
+			Flags:         uint32(flags),
+			SessionID:     req.SessionID,
+			ServerAddress: req.ServerAddress,
+			User:          req.User,
+			Command:       req.Command,
+		}),
+	}))
+	if err != nil {
+		return nil, err
+	}
+
+	switch msg := msg.(type) {
+	case *signResponseAgentMsg:
+		var sig ssh.Signature
+		if err := ssh.Unmarshal(msg.SigBlob, &sig); err != nil {
+			return nil, err
+		}
+		return &sig, nil
+	case *failureAgentMsg:
+		return nil, errors.New("agent: delegated signature refused")
+	}
+	return nil, fmt.Errorf("agent: unexpected reply %T to delegated sign request", msg)
+}
+
+// processExtension handles an extension request for s.
+func (s *server) processExtension(data []byte) (interface{}, error) {
+	var msg extensionAgentMsg
+	if err := ssh.Unmarshal(data, &msg); err != nil {
+		return nil, err
+	}
+	signer, ok := s.agent.(ContextSigner)
+	if msg.ExtensionType != signRequestExtension || !ok {
+		return nil, fmt.Errorf("unsupported extension %q", msg.ExtensionType)
+	}
+
+	var req signRequestExtensionMsg
+	if err := ssh.Unmarshal(msg.Contents, &req); err != nil {
+		return nil, err
+	}
+	var wk wireKey
+	if err := ssh.Unmarshal(req.KeyBlob, &wk); err != nil {
+		return nil, err
+	}
+	sig, err := signer.SignWithContext(&ssh.SignRequest{
+		Key:           &Key{Format: wk.Format, Blob: req.KeyBlob},
+		Data:          req.Data,
+		Algorithm:     algorithmForFlags(SignatureFlags(req.Flags)),
+		SessionID:     req.SessionID,
+		ServerAddress: req.ServerAddress,
+		User:          req.User,
+		Command:       req.Command,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &signResponseAgentMsg{SigBlob: ssh.Marshal(sig)}, nil
+}
+
+// msgUserAuthRequest is the SSH message number of an authentication
+// request, as in RFC 4252, section 5.
+const msgUserAuthRequest = 50
+
+// publickeyAuthData is the data signed for public key authentication,
+// as in RFC 4252, section 7.
+type publickeyAuthData struct {
+	SessionID []byte
+	Type      byte
+	User      string
+	Service   string
+	Method    string
+	HasSig    bool
+	Algorithm string
+	PubKey    []byte
+}
+
+// checkSignedData returns an error unless req.Data is the public key
+// authentication request that the rest of req describes.
+func checkSignedData(req *ssh.SignRequest) error {
+	var data publickeyAuthData
+	if err := ssh.Unmarshal(req.Data, &data); err != nil || data.Type != msgUserAuthRequest ||
+		data.Service != "ssh-connection" || data.Method != "publickey" || !data.HasSig {
+		return errors.New("agent: signed data is not a public key authentication request")
+	}
+	algo := req.Algorithm
+	if algo == "" {
+		algo = req.Key.Type()
+	}
+	switch {
+	case !bytes.Equal(data.SessionID, req.SessionID):
+		return errors.New("agent: signed data is for another session")
+	case data.User != req.User:
+		return fmt.Errorf("agent: signed data authenticates as %q, not %q", data.User, req.User)
+	case !bytes.Equal(data.PubKey, req.Key.Marshal()):
+		return errors.New("agent: signed data names another key")
+	case data.Algorithm != algo:
+		return fmt.Errorf("agent: signed data uses algorithm %s, not %s", data.Algorithm, algo)
+	}
+	return nil
+}
+
+// errNoContext is returned by approving agents for signatures
+// requested without their context.
+var errNoContext = errors.New("agent: signature requested without context")
+
+// NewApprovingAgent returns an Agent to serve to a proxy that
+// authenticates on the user's behalf. It signs with the keys of a, but
+// only requests made through a Delegate, and only if approve returns
+// nil for them. Plain sign requests, which do not say what the
+// signature is for, are refused, as are requests whose data is not the
+// public key authentication their session ID, user, key and algorithm
+// describe.
+func NewApprovingAgent(a Agent, approve func(req *ssh.SignRequest) error) Agent {
+	return &approvingAgent{Agent: a, approve: approve}
+}
+
+type approvingAgent struct {
+	Agent
+	approve func(req *ssh.SignRequest) error
+}
+
+func (a *approvingAgent) Sign(key ssh.PublicKey, data []byte) (*ssh.Signature, error) {
+	return nil, errNoContext
+}
+
+func (a *approvingAgent) Signers() ([]ssh.Signer, error) {
+	return nil, errNoContext
+}
+
+func (a *approvingAgent) SignWithContext(req *ssh.SignRequest) (*ssh.Signature, error) {
+	if err := checkSignedData(req); err != nil {
+		return nil, err
+	}
+	if err := a.approve(req); err != nil {
+		return nil, err
+	}
+	if req.Algorithm == "" {
+		return a.Agent.Sign(req.Key, req.Data)
+	}
+	extended, ok := a.Agent.(ExtendedAgent)
+	if !ok {
+		return nil, fmt.Errorf("agent: signature algorithm %s not supported", req.Algorithm)
+	}
+	flags, err := flagsForAlgorithm(req.Algorithm)
+	if err != nil {
+		return nil, err
+	}
+	return extended.SignWithFlags(req.Key, req.Data, flags)
+}
@@ -0,0 +1,260 @@
+package agent
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// authData returns the data signed for public key authentication as
+// user in sessionID.
+func authData(sessionID []byte, user, algo string, key ssh.PublicKey) []byte {
+	return ssh.Marshal(publickeyAuthData{
+		SessionID: sessionID,
+		Type:      msgUserAuthRequest,
+		User:      user,
+		Service:   "ssh-connection",
+		Method:    "publickey",
+		HasSig:    true,
+		Algorithm: algo,
+		PubKey:    key.Marshal(),
+	})
+}
+
+func TestDelegate(t *testing.T) {
+	c1, c2, err := netPipe()
+	if err != nil {
+		t.Fatalf("netPipe: %v", err)
+	}
+	defer c1.Close()
+	defer c2.Close()
+
+	keyring := NewKeyring()
+	if err := keyring.Add(AddedKey{PrivateKey: testPrivateKeys["ecdsa"]}); err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+	requests := make(chan *ssh.SignRequest, 2)
+	go ServeAgent(NewApprovingAgent(keyring, func(req *ssh.SignRequest) error {
+		requests <- req
+		if len(requests) > 1 {
+			return errors.New("denied")
+		}
+		return nil
+	}), c2)
+
+	delegate := NewDelegate(c1)
+	keys, err := delegate.PublicKeys()
+	if err != nil {
+		t.Fatalf("PublicKeys: %v", err)
+	}
+	if len(keys) != 1 || !bytes.Equal(keys[0].Marshal(), testPublicKeys["ecdsa"].Marshal()) {
+		t.Fatalf("got keys %v, want the ecdsa key", keys)
+	}
+
+	req := &ssh.SignRequest{
+		Key:           keys[0],
+		Data:          authData([]byte("session id"), "alice", keys[0].Type(), keys[0]),
+		SessionID:     []byte("session id"),
+		ServerAddress: "example.com:22",
+		User:          "alice",
+		Command:       "make deploy",
+	}
+	sig, err := delegate.Sign(req)
+	if err != nil {
+		t.Fatalf("Sign: %v", err)
+	}
+	if err := testPublicKeys["ecdsa"].Verify(req.Data, sig); err != nil {
+		t.Errorf("Verify: %v", err)
+	}
+	got := <-requests
+	if got.ServerAddress != req.ServerAddress || got.User != req.User || got.Command != req.Command || !bytes.Equal(got.SessionID, req.SessionID) {
+		t.Errorf("approver got %+v, want %+v", got, req)
+	}
+
+	// The approver denies the second request.
+	requests <- nil
+	if _, err := delegate.Sign(req); err == nil {
+		t.Errorf("Sign succeeded without approval")
+	}
+
+	// Signatures without context are refused.
+	if _, err := NewClient(c1).Sign(keys[0], req.Data); err == nil {
+		t.Errorf("plain sign request succeeded")
+	}
+}
+
+func TestDelegateAlgorithm(t *testing.T) {
+	c1, c2, err := netPipe()
+	if err != nil {
+		t.Fatalf("netPipe: %v", err)
+	}
+	defer c1.Close()
+	defer c2.Close()
+
+	keyring := NewKeyring()
+	if err := keyring.Add(AddedKey{PrivateKey: testPrivateKeys["rsa"]}); err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+	algos := make(chan string, 1)
+	go ServeAgent(NewApprovingAgent(keyring, func(req *ssh.SignRequest) error {
+		algos <- req.Algorithm
+		return nil
+	}), c2)
+
+	req := &ssh.SignRequest{
+		Key:       testPublicKeys["rsa"],
+		Data:      authData([]byte("session id"), "alice", ssh.KeyAlgoRSASHA512, testPublicKeys["rsa"]),
+		Algorithm: ssh.KeyAlgoRSASHA512,
+		SessionID: []byte("session id"),
+		User:      "alice",
+	}
+	sig, err := NewDelegate(c1).Sign(req)
+	if err != nil {
+		t.Fatalf("Sign: %v", err)
+	}
+	if sig.Format != ssh.KeyAlgoRSASHA512 {
+		t.Errorf("got signature format %s, want %s", sig.Format, ssh.KeyAlgoRSASHA512)
+	}
+	if err := testPublicKeys["rsa"].Verify(req.Data, sig); err != nil {
+		t.Errorf("Verify: %v", err)
+	}
+	if got := <-algos; got != ssh.KeyAlgoRSASHA512 {
+		t.Errorf("approver got algorithm %q, want %s", got, ssh.KeyAlgoRSASHA512)
+	}
+}
+
+func TestDelegateRefusesMismatchedData(t *testing.T) {
+	c1, c2, err := netPipe()
+	if err != nil {
+		t.Fatalf("netPipe: %v", err)
+	}
+	defer c1.Close()
+	defer c2.Close()
+
+	keyring := NewKeyring()
+	if err := keyring.Add(AddedKey{PrivateKey: testPrivateKeys["ecdsa"]}); err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+	approved := make(chan *ssh.SignRequest, 10)
+	go ServeAgent(NewApprovingAgent(keyring, func(req *ssh.SignRequest) error {
+		approved <- req
+		return nil
+	}), c2)
+	delegate := NewDelegate(c1)
+
+	key := testPublicKeys["ecdsa"]
+	sessionID := []byte("session id")
+	for name, data := range map[string][]byte{
+		"user":       authData(sessionID, "root", key.Type(), key),
+		"session ID": authData([]byte("other session"), "alice", key.Type(), key),
+		"key":        authData(sessionID, "alice", key.Type(), testPublicKeys["rsa"]),
+		"algorithm":  authData(sessionID, "alice", ssh.KeyAlgoED25519, key),
+		"not auth":   []byte("session id and request"),
+	} {
+		// The proxy shows the user one thing and asks to sign another.
+		_, err := delegate.Sign(&ssh.SignRequest{
+			Key:           key,
+			Data:          data,
+			SessionID:     sessionID,
+			ServerAddress: "example.com:22",
+			User:          "alice",
+			Command:       "ls",
+		})
+		if err == nil {
+			t.Errorf("%s: signed data that does not match the request", name)
+		}
+	}
+	if len(approved) != 0 {
+		t.Errorf("approver asked about %d mismatched requests", len(approved))
+	}
+}
+
+func TestDelegatedProxyAuth(t *testing.T) {
+	toServer, serverSide, err := netPipe()
+	if err != nil {
+		t.Fatalf("netPipe: %v", err)
+	}
+	clientSide, toClient, err := netPipe()
+	if err != nil {
+		t.Fatalf("netPipe: %v", err)
+	}
+	agentConn, agentSide, err := netPipe()
+	if err != nil {
+		t.Fatalf("netPipe: %v", err)
+	}
+	defer agentConn.Close()
+	defer agentSide.Close()
+
+	serverConf := &ssh.ServerConfig{
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if !bytes.Equal(key.Marshal(), testPublicKeys["ecdsa"].Marshal()) {
+				return nil, errors.New("unknown key")
+			}
+			return nil, nil
+		},
+	}
+	serverConf.AddHostKey(testSigners["rsa"])
+	go func() {
+		conn, chans, reqs, err := ssh.NewServerConn(serverSide, serverConf)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		go ssh.DiscardRequests(reqs)
+		for newCh := range chans {
+			newCh.Reject(ssh.Prohibited, "")
+		}
+	}()
+
+	keyring := NewKeyring()
+	if err := keyring.Add(AddedKey{PrivateKey: testPrivateKeys["ecdsa"]}); err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+	requests := make(chan *ssh.SignRequest, 1)
+	go ServeAgent(NewApprovingAgent(keyring, func(req *ssh.SignRequest) error {
+		requests <- req
+		return nil
+	}), agentSide)
+
+	type result struct {
+		pc  ssh.ProxyConn
+		err error
+	}
+	proxyResult := make(chan result, 1)
+	go func() {
+		pc, err := ssh.NewProxyConnWithConfig("server", toClient, toServer, &ssh.ProxyConfig{
+			ClientConfig: &ssh.ClientConfig{
+				User:            "alice",
+				HostKeyCallback: ssh.FixedHostKey(testPublicKeys["rsa"]),
+			},
+			Filter:   ssh.NewFilter("uptime", nil),
+			Delegate: NewDelegate(agentConn),
+		})
+		proxyResult <- result{pc, err}
+	}()
+
+	conn, _, _, err := ssh.NewClientConn(clientSide, "server", &ssh.ClientConfig{
+		User:                     "alice",
+		HostKeyCallback:          ssh.FixedHostKey(testPublicKeys["rsa"]),
+		DeferHostKeyVerification: true,
+	})
+	if err != nil {
+		t.Fatalf("NewClientConn: %v", err)
+	}
+	defer conn.Close()
+	res := <-proxyResult
+	if res.err != nil {
+		t.Fatalf("NewProxyConnWithConfig: %v", res.err)
+	}
+	defer res.pc.Close()
+
+	req := <-requests
+	if req.ServerAddress != "server" || req.User != "alice" || req.Command != "uptime" {
+		t.Errorf("got sign request %+v", req)
+	}
+	if !bytes.HasPrefix(req.Data[4:], req.SessionID) {
+		t.Errorf("signed data does not start with the session ID")
+	}
+}
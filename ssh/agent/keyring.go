@@ -182,6 +182,12 @@ func (r *keyring) Add(key AddedKey) error {
 
 // Sign returns a signature for the data.
 func (r *keyring) Sign(key ssh.PublicKey, data []byte) (*ssh.Signature, error) {
+	return r.SignWithFlags(key, data, 0)
+}
+
+// SignWithFlags returns a signature for the data, with the algorithm
+// that flags select for RSA keys.
+func (r *keyring) SignWithFlags(key ssh.PublicKey, data []byte, flags SignatureFlags) (*ssh.Signature, error) {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 	if r.locked {
@@ -191,9 +197,18 @@ func (r *keyring) Sign(key ssh.PublicKey, data []byte) (*ssh.Signature, error) {
 	r.expireKeysLocked()
 	wanted := key.Marshal()
 	for _, k := range r.keys {
-		if bytes.Equal(k.signer.PublicKey().Marshal(), wanted) {
+		if !bytes.Equal(k.signer.PublicKey().Marshal(), wanted) {
+			continue
+		}
+		algorithm := algorithmForFlags(flags)
+		if algorithm == "" {
 			return k.signer.Sign(rand.Reader, data)
 		}
+		algorithmSigner, ok := k.signer.(ssh.AlgorithmSigner)
+		if !ok {
+			return nil, fmt.Errorf("agent: signer %T does not support signature algorithms", k.signer)
+		}
+		return algorithmSigner.SignWithAlgorithm(rand.Reader, data, algorithm)
 	}
 	return nil, errors.New("not found")
 }
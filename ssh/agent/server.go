@@ -128,7 +128,15 @@ func (s *server) processRequest(data []byte) (interface{}, error) {
 			Blob:   req.KeyBlob,
 		}
 
-		sig, err := s.agent.Sign(k, req.Data) //  TODO(hanwen): flags.
+		var sig *ssh.Signature
+		var err error
+		if flags := SignatureFlags(req.Flags); flags == 0 {
+			sig, err = s.agent.Sign(k, req.Data)
+		} else if extended, ok := s.agent.(ExtendedAgent); ok {
+			sig, err = extended.SignWithFlags(k, req.Data, flags)
+		} else {
+			err = fmt.Errorf("agent: signature flags %d not supported", flags)
+		}
 		if err != nil {
 			return nil, err
 		}
@@ -150,6 +158,9 @@ func (s *server) processRequest(data []byte) (interface{}, error) {
 
 	case agentAddIdConstrained, agentAddIdentity:
 		return nil, s.insertIdentity(data)
+
+	case agentExtension:
+		return s.processExtension(data)
 	}
 
 	return nil, fmt.Errorf("unknown opcode %d", data[0])
@@ -0,0 +1,101 @@
+package ssh
+
+import (
+	"errors"
+	"time"
+)
+
+// ApprovalRequest describes a client request that a Filter cannot
+// decide on its own, either because its Policy escalates the request
+// or because the client attempts a handoff without the server having
+// acknowledged no-more-sessions.
+type ApprovalRequest struct {
+	// ServerAddress is the address the proxy dialed, as passed to
+	// NewProxyConn.
+	ServerAddress string
+
+	// User is the user the proxy authenticated as on the server.
+	User string
+
+	// Request describes what is to be approved, such as
+	// "exec ls -l", "channel direct-tcpip" or "handoff".
+	Request string
+
+	// Command is the command of an "exec" request. For a handoff,
+	// it is the last command the client was allowed to run.
+	Command string
+
+	// ChannelTypes lists the types of all channels the client
+	// asked to open so far, in order.
+	ChannelTypes []string
+
+	// NoMoreSessions reports whether the server acknowledged the
+	// client's no-more-sessions@openssh.com request.
+	NoMoreSessions bool
+
+	// HostKeyFingerprint is the SHA256 fingerprint of the server's
+	// host key, in the format of FingerprintSHA256.
+	HostKeyFingerprint string
+}
+
+// Approval is an Approver's answer to an ApprovalRequest.
+type Approval struct {
+	// Allowed reports whether the request may proceed.
+	Allowed bool
+
+	// Duration, if positive, extends an allowing decision to
+	// identical requests made on the same connection within that
+	// time, without asking the Approver again.
+	Duration time.Duration
+
+	// Reason explains a denial. It is sent to the client in place
+	// of the policy's message.
+	Reason string
+}
+
+// AllowOnce returns an Approval that allows only the request at hand.
+func AllowOnce() Approval {
+	return Approval{Allowed: true}
+}
+
+// AllowFor returns an Approval that also allows identical requests
+// for the duration d.
+func AllowFor(d time.Duration) Approval {
+	return Approval{Allowed: true, Duration: d}
+}
+
+// DenyWithReason returns an Approval that denies the request,
+// explaining why to the client.
+func DenyWithReason(reason string) Approval {
+	return Approval{Reason: reason}
+}
+
+// An Approver decides on requests that a Filter escalates. Approve is
+// called synchronously while forwarding is paused, so it may take as
+// long as a human needs to answer. An error is treated as a denial.
+type Approver interface {
+	Approve(req *ApprovalRequest) (Approval, error)
+}
+
+// EscalateFunc is the simplest Approver: it allows a request, once,
+// if the function returns nil.
+type EscalateFunc func() error
+
+// Approve calls f and allows the request once if f returns nil.
+func (f EscalateFunc) Approve(req *ApprovalRequest) (Approval, error) {
+	if err := f(); err != nil {
+		return Approval{}, err
+	}
+	return AllowOnce(), nil
+}
+
+// errApprovalDenied is returned for denials that carry no reason.
+var errApprovalDenied = errors.New("ssh: request denied by approver")
+
+// deniedError is returned for denials that carry a reason meant for
+// the client.
+type deniedError string
+
+func (e deniedError) Error() string {
+	return string(e)
+}
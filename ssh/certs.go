@@ -23,6 +23,13 @@ const (
 	CertAlgoECDSA384v01 = "ecdsa-sha2-nistp384-cert-v01@openssh.com"
 	CertAlgoECDSA521v01 = "ecdsa-sha2-nistp521-cert-v01@openssh.com"
 	CertAlgoED25519v01  = "ssh-ed25519-cert-v01@openssh.com"
+
+	// CertAlgoRSASHA256v01 and CertAlgoRSASHA512v01 can't appear as a
+	// Certificate.Type (or PublicKey.Type), but only in
+	// ClientConfig.HostKeyAlgorithms and in the algorithm name of
+	// public key authentication, per RFC 8332.
+	CertAlgoRSASHA256v01 = "rsa-sha2-256-cert-v01@openssh.com"
+	CertAlgoRSASHA512v01 = "rsa-sha2-512-cert-v01@openssh.com"
 )
 
 // Certificate types distinguish between host and user
@@ -220,14 +227,24 @@ type openSSHCertSigner struct {
 	signer Signer
 }
 
+type algorithmOpenSSHCertSigner struct {
+	*openSSHCertSigner
+	algorithmSigner AlgorithmSigner
+}
+
 // NewCertSigner returns a Signer that signs with the given Certificate, whose
 // private key is held by signer. It returns an error if the public key in cert
-// doesn't match the key used by signer.
+// doesn't match the key used by signer. The Signer is an AlgorithmSigner if
+// signer is one.
 func NewCertSigner(cert *Certificate, signer Signer) (Signer, error) {
 	if bytes.Compare(cert.Key.Marshal(), signer.PublicKey().Marshal()) != 0 {
 		return nil, errors.New("ssh: signer and cert have different public key")
 	}
 
+	if algorithmSigner, ok := signer.(AlgorithmSigner); ok {
+		return &algorithmOpenSSHCertSigner{
+			&openSSHCertSigner{cert, signer}, algorithmSigner}, nil
+	}
 	return &openSSHCertSigner{cert, signer}, nil
 }
 
@@ -235,6 +252,13 @@ func (s *openSSHCertSigner) Sign(rand io.Reader, data []byte) (*Signature, error
 	return s.signer.Sign(rand, data)
 }
 
+// SignWithAlgorithm signs with the certificate's key. algorithm is a
+// signature algorithm of the key, such as KeyAlgoRSASHA256, rather than
+// a certificate algorithm.
+func (s *algorithmOpenSSHCertSigner) SignWithAlgorithm(rand io.Reader, data []byte, algorithm string) (*Signature, error) {
+	return s.algorithmSigner.SignWithAlgorithm(rand, data, algorithm)
+}
+
 func (s *openSSHCertSigner) PublicKey() PublicKey {
 	return s.pub
 }
@@ -404,7 +428,15 @@ func (c *Certificate) SignCert(rand io.Reader, authority Signer) error {
 	}
 	c.SignatureKey = authority.PublicKey()
 
-	sig, err := authority.Sign(rand, c.bytesForSigning())
+	// OpenSSH signs certificates with rsa-sha2-512 by default, and
+	// no longer accepts ssh-rsa signatures on them.
+	var sig *Signature
+	var err error
+	if v, ok := authority.(AlgorithmSigner); ok && c.SignatureKey.Type() == KeyAlgoRSA {
+		sig, err = v.SignWithAlgorithm(rand, c.bytesForSigning(), KeyAlgoRSASHA512)
+	} else {
+		sig, err = authority.Sign(rand, c.bytesForSigning())
+	}
 	if err != nil {
 		return err
 	}
@@ -432,6 +464,29 @@ func certToPrivAlgo(algo string) string {
 	panic("unknown cert algorithm")
 }
 
+// certKeyAlgoNames maps certificate algorithms, including those that
+// are not certificate types, to the signature algorithms of their keys.
+var certKeyAlgoNames = map[string]string{
+	CertAlgoRSAv01:       KeyAlgoRSA,
+	CertAlgoRSASHA256v01: KeyAlgoRSASHA256,
+	CertAlgoRSASHA512v01: KeyAlgoRSASHA512,
+	CertAlgoDSAv01:       KeyAlgoDSA,
+	CertAlgoECDSA256v01:  KeyAlgoECDSA256,
+	CertAlgoECDSA384v01:  KeyAlgoECDSA384,
+	CertAlgoECDSA521v01:  KeyAlgoECDSA521,
+	CertAlgoED25519v01:   KeyAlgoED25519,
+}
+
+// underlyingAlgo returns the signature algorithm of the public key or
+// host key algorithm algo. They are the same, except for certificate
+// algorithms, whose signatures are made by the certified key.
+func underlyingAlgo(algo string) string {
+	if a, ok := certKeyAlgoNames[algo]; ok {
+		return a
+	}
+	return algo
+}
+
 func (cert *Certificate) bytesForSigning() []byte {
 	c2 := *cert
 	c2.Signature = nil
@@ -158,6 +158,32 @@ func TestValidateCertTime(t *testing.T) {
 // host keys:
 // * fallbacks
 
+func TestSignCertRSASHA2(t *testing.T) {
+	cert := &Certificate{
+		Key:         testPublicKeys["ecdsa"],
+		ValidBefore: CertTimeInfinity,
+		CertType:    UserCert,
+	}
+	if err := cert.SignCert(rand.Reader, testSigners["rsa"]); err != nil {
+		t.Fatalf("SignCert: %v", err)
+	}
+	if cert.Signature.Format != KeyAlgoRSASHA512 {
+		t.Errorf("got signature format %s, want %s", cert.Signature.Format, KeyAlgoRSASHA512)
+	}
+	checker := &CertChecker{SupportedCriticalOptions: []string{}}
+	if err := checker.CheckCert("", cert); err != nil {
+		t.Errorf("CheckCert: %v", err)
+	}
+
+	certSigner, err := NewCertSigner(cert, testSigners["ecdsa"])
+	if err != nil {
+		t.Fatalf("NewCertSigner: %v", err)
+	}
+	if _, ok := certSigner.(AlgorithmSigner); !ok {
+		t.Errorf("NewCertSigner of an AlgorithmSigner returned %T, not an AlgorithmSigner", certSigner)
+	}
+}
+
 func TestHostKeyCert(t *testing.T) {
 	cert := &Certificate{
 		ValidPrincipals: []string{"hostname", "hostname.domain", "otherhost"},
@@ -16,6 +16,9 @@ import (
 	"hash"
 	"io"
 	"io/ioutil"
+
+	"golang.org/x/crypto/internal/chacha20"
+	"golang.org/x/crypto/poly1305"
 )
 
 const (
@@ -53,78 +56,104 @@ func newRC4(key, iv []byte) (cipher.Stream, error) {
 	return rc4.NewCipher(key)
 }
 
-type streamCipherMode struct {
-	keySize    int
-	ivSize     int
-	skip       int
-	createFunc func(key, iv []byte) (cipher.Stream, error)
+// cipherMode describes a cipher: the sizes of the key and IV derived
+// for it, and how to make a packetCipher from them.
+type cipherMode struct {
+	keySize int
+	ivSize  int
+
+	// tagSize is the size of the tag that an AEAD cipher appends to
+	// each packet, or zero for ciphers that rely on a MAC. AEAD
+	// ciphers authenticate packets themselves, so no MAC is
+	// negotiated or keyed for them.
+	tagSize int
+
+	// create makes a packetCipher from the derived key material.
+	// macKey and algs.MAC are unset for AEAD ciphers.
+	create func(iv, key, macKey []byte, algs directionAlgorithms) (packetCipher, error)
 }
 
-func (c *streamCipherMode) createStream(key, iv []byte) (cipher.Stream, error) {
-	if len(key) < c.keySize {
-		panic("ssh: key length too small for cipher")
-	}
-	if len(iv) < c.ivSize {
-		panic("ssh: iv too small for cipher")
-	}
+// aead reports whether the cipher is an AEAD.
+func (c *cipherMode) aead() bool {
+	return c.tagSize > 0
+}
 
-	stream, err := c.createFunc(key[:c.keySize], iv[:c.ivSize])
-	if err != nil {
-		return nil, err
-	}
+// streamCipherMode returns the constructor of a streamPacketCipher,
+// which combines the stream cipher made by createFunc with the
+// negotiated MAC, after discarding the first skip bytes of its key
+// stream.
+func streamCipherMode(skip int, createFunc func(key, iv []byte) (cipher.Stream, error)) func(iv, key, macKey []byte, algs directionAlgorithms) (packetCipher, error) {
+	return func(iv, key, macKey []byte, algs directionAlgorithms) (packetCipher, error) {
+		stream, err := createFunc(key, iv)
+		if err != nil {
+			return nil, err
+		}
 
-	var streamDump []byte
-	if c.skip > 0 {
-		streamDump = make([]byte, 512)
-	}
+		var streamDump []byte
+		if skip > 0 {
+			streamDump = make([]byte, 512)
+		}
 
-	for remainingToDump := c.skip; remainingToDump > 0; {
-		dumpThisTime := remainingToDump
-		if dumpThisTime > len(streamDump) {
-			dumpThisTime = len(streamDump)
+		for remainingToDump := skip; remainingToDump > 0; {
+			dumpThisTime := remainingToDump
+			if dumpThisTime > len(streamDump) {
+				dumpThisTime = len(streamDump)
+			}
+			stream.XORKeyStream(streamDump[:dumpThisTime], streamDump[:dumpThisTime])
+			remainingToDump -= dumpThisTime
 		}
-		stream.XORKeyStream(streamDump[:dumpThisTime], streamDump[:dumpThisTime])
-		remainingToDump -= dumpThisTime
-	}
 
-	return stream, nil
+		mac := macModes[algs.MAC]
+		c := &streamPacketCipher{
+			mac:    mac.new(macKey),
+			etm:    mac.etm,
+			cipher: stream,
+		}
+		c.macResult = make([]byte, c.mac.Size())
+		return c, nil
+	}
 }
 
 // cipherModes documents properties of supported ciphers. Ciphers not included
 // are not supported and will not be negotiated, even if explicitly requested in
 // ClientConfig.Crypto.Ciphers.
-var cipherModes = map[string]*streamCipherMode{
+var cipherModes = map[string]*cipherMode{
 	// Ciphers from RFC4344, which introduced many CTR-based ciphers. Algorithms
 	// are defined in the order specified in the RFC.
-	"aes128-ctr": {16, aes.BlockSize, 0, newAESCTR},
-	"aes192-ctr": {24, aes.BlockSize, 0, newAESCTR},
-	"aes256-ctr": {32, aes.BlockSize, 0, newAESCTR},
+	"aes128-ctr": {16, aes.BlockSize, 0, streamCipherMode(0, newAESCTR)},
+	"aes192-ctr": {24, aes.BlockSize, 0, streamCipherMode(0, newAESCTR)},
+	"aes256-ctr": {32, aes.BlockSize, 0, streamCipherMode(0, newAESCTR)},
 
 	// Ciphers from RFC4345, which introduces security-improved arcfour ciphers.
 	// They are defined in the order specified in the RFC.
-	"arcfour128": {16, 0, 1536, newRC4},
-	"arcfour256": {32, 0, 1536, newRC4},
+	"arcfour128": {16, 0, 0, streamCipherMode(1536, newRC4)},
+	"arcfour256": {32, 0, 0, streamCipherMode(1536, newRC4)},
 
 	// Cipher defined in RFC 4253, which describes SSH Transport Layer Protocol.
 	// Note that this cipher is not safe, as stated in RFC 4253: "Arcfour (and
 	// RC4) has problems with weak keys, and should be used with caution."
 	// RFC4345 introduces improved versions of Arcfour.
-	"arcfour": {16, 0, 0, newRC4},
+	"arcfour": {16, 0, 0, streamCipherMode(0, newRC4)},
 
-	// AES-GCM is not a stream cipher, so it is constructed with a
-	// special case. If we add any more non-stream ciphers, we
-	// should invest a cleaner way to do this.
-	gcmCipherID: {16, 12, 0, nil},
+	// AEAD ciphers from OpenSSH's PROTOCOL. AES-GCM takes a 12-byte
+	// IV, whose last 8 bytes count packets.
+	gcmCipherID:    {16, 12, gcmTagSize, newGCMCipher},
+	gcm256CipherID: {32, 12, gcmTagSize, newGCMCipher},
+
+	// chacha20-poly1305@openssh.com derives two ChaCha20 keys, one for
+	// the packet length and one for the contents, and takes its nonce
+	// from the sequence number, so it needs no IV.
+	chacha20Poly1305ID: {64, 0, poly1305.TagSize, newChaCha20Cipher},
 
 	// CBC mode is insecure and so is not included in the default config.
 	// (See http://www.isg.rhul.ac.uk/~kp/SandPfinal.pdf). If absolutely
 	// needed, it's possible to specify a custom Config to enable it.
 	// You should expect that an active attacker can recover plaintext if
 	// you do.
-	aes128cbcID: {16, aes.BlockSize, 0, nil},
+	aes128cbcID: {16, aes.BlockSize, 0, newAESCBCCipher},
 
 	// 3des-cbc is insecure and is disabled by default.
-	tripledescbcID: {24, des.BlockSize, 0, nil},
+	tripledescbcID: {24, des.BlockSize, 0, newTripleDESCBCCipher},
 }
 
 // prefixLen is the length of the packet prefix that contains the packet length
@@ -304,7 +333,7 @@ type gcmCipher struct {
 	buf    []byte
 }
 
-func newGCMCipher(iv, key, macKey []byte) (packetCipher, error) {
+func newGCMCipher(iv, key, unusedMACKey []byte, unusedAlgs directionAlgorithms) (packetCipher, error) {
 	c, err := aes.NewCipher(key)
 	if err != nil {
 		return nil, err
@@ -405,6 +434,137 @@ func (c *gcmCipher) readPacket(seqNum uint32, r io.Reader) ([]byte, error) {
 	return plain, nil
 }
 
+// chacha20Poly1305Cipher implements chacha20-poly1305@openssh.com, as
+// described in OpenSSH's PROTOCOL.chacha20poly1305. The packet length
+// is encrypted with its own key, so that it can be decrypted before the
+// rest of the packet arrives, and the poly1305 tag covers the encrypted
+// length and contents.
+type chacha20Poly1305Cipher struct {
+	lengthKey  [32]byte
+	contentKey [32]byte
+	buf        []byte
+}
+
+func newChaCha20Cipher(unusedIV, key, unusedMACKey []byte, unusedAlgs directionAlgorithms) (packetCipher, error) {
+	if len(key) != 64 {
+		return nil, fmt.Errorf("ssh: got %d bytes of key for %s, want 64", len(key), chacha20Poly1305ID)
+	}
+	c := &chacha20Poly1305Cipher{
+		buf: make([]byte, 256),
+	}
+	copy(c.contentKey[:], key[:32])
+	copy(c.lengthKey[:], key[32:])
+	return c, nil
+}
+
+// chacha20Counter returns the ChaCha20 input block for the given block
+// counter and sequence number. The sequence number is the 64-bit
+// big-endian nonce of the original ChaCha20, whose counter is 64-bit
+// too, so the upper half of the counter stays zero.
+func chacha20Counter(block byte, seqNum uint32) *[16]byte {
+	var counter [16]byte
+	counter[0] = block
+	binary.BigEndian.PutUint64(counter[8:], uint64(seqNum))
+	return &counter
+}
+
+// polyKey returns the poly1305 key for the packet seqNum, which is the
+// first 32 bytes of the content key stream.
+func (c *chacha20Poly1305Cipher) polyKey(seqNum uint32) *[32]byte {
+	var polyKey [32]byte
+	chacha20.XORKeyStream(polyKey[:], polyKey[:], chacha20Counter(0, seqNum), &c.contentKey)
+	return &polyKey
+}
+
+func (c *chacha20Poly1305Cipher) readPacket(seqNum uint32, r io.Reader) ([]byte, error) {
+	encryptedLength := c.buf[:4]
+	if _, err := io.ReadFull(r, encryptedLength); err != nil {
+		return nil, err
+	}
+
+	var lenBytes [4]byte
+	chacha20.XORKeyStream(lenBytes[:], encryptedLength, chacha20Counter(0, seqNum), &c.lengthKey)
+	length := binary.BigEndian.Uint32(lenBytes[:])
+	if length > maxPacket {
+		return nil, errors.New("ssh: invalid packet length, packet too large")
+	}
+
+	contentEnd := 4 + length
+	packetEnd := contentEnd + poly1305.TagSize
+	if uint32(cap(c.buf)) < packetEnd {
+		c.buf = make([]byte, packetEnd)
+		copy(c.buf, encryptedLength)
+	} else {
+		c.buf = c.buf[:packetEnd]
+	}
+	if _, err := io.ReadFull(r, c.buf[4:packetEnd]); err != nil {
+		return nil, err
+	}
+
+	var mac [poly1305.TagSize]byte
+	copy(mac[:], c.buf[contentEnd:packetEnd])
+	if !poly1305.Verify(&mac, c.buf[:contentEnd], c.polyKey(seqNum)) {
+		return nil, fmt.Errorf("ssh: MAC failure, expected seq num: %d", seqNum)
+	}
+
+	plain := c.buf[4:contentEnd]
+	chacha20.XORKeyStream(plain, plain, chacha20Counter(1, seqNum), &c.contentKey)
+
+	if len(plain) == 0 {
+		return nil, errors.New("ssh: invalid packet length, packet too small")
+	}
+	padding := plain[0]
+	if padding < 4 {
+		// padding is a byte, so it automatically satisfies
+		// the maximum size, which is 255.
+		return nil, fmt.Errorf("ssh: illegal padding %d", padding)
+	}
+	if int(padding)+1 >= len(plain) {
+		return nil, fmt.Errorf("ssh: padding %d too large", padding)
+	}
+	return plain[1 : len(plain)-int(padding)], nil
+}
+
+func (c *chacha20Poly1305Cipher) writePacket(seqNum uint32, w io.Writer, rand io.Reader, payload []byte) error {
+	if len(payload) > maxPacket {
+		return errors.New("ssh: packet too large")
+	}
+
+	// There is no block size, so pad to a multiple of 8 bytes as
+	// RFC 4253 section 6 requires. As with AES-GCM, the length is
+	// not counted.
+	const packetSizeMultiple = 8
+	padding := packetSizeMultiple - (1+len(payload))%packetSizeMultiple
+	if padding < 4 {
+		padding += packetSizeMultiple
+	}
+
+	// length (4 bytes), padding length (1), payload, padding, tag.
+	packetEnd := 4 + 1 + len(payload) + padding
+	totalLength := packetEnd + poly1305.TagSize
+	if cap(c.buf) < totalLength {
+		c.buf = make([]byte, totalLength)
+	} else {
+		c.buf = c.buf[:totalLength]
+	}
+
+	binary.BigEndian.PutUint32(c.buf, uint32(1+len(payload)+padding))
+	chacha20.XORKeyStream(c.buf[:4], c.buf[:4], chacha20Counter(0, seqNum), &c.lengthKey)
+	c.buf[4] = byte(padding)
+	copy(c.buf[5:], payload)
+	if _, err := io.ReadFull(rand, c.buf[5+len(payload):packetEnd]); err != nil {
+		return err
+	}
+	chacha20.XORKeyStream(c.buf[4:packetEnd], c.buf[4:packetEnd], chacha20Counter(1, seqNum), &c.contentKey)
+
+	var mac [poly1305.TagSize]byte
+	poly1305.Sum(&mac, c.buf[:packetEnd], c.polyKey(seqNum))
+	copy(c.buf[packetEnd:], mac[:])
+
+	_, err := w.Write(c.buf)
+	return err
+}
+
 // cbcCipher implements aes128-cbc cipher defined in RFC 4253 section 6.1
 type cbcCipher struct {
 	mac       hash.Hash
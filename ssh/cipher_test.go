@@ -9,6 +9,7 @@ import (
 	"crypto"
 	"crypto/aes"
 	"crypto/rand"
+	"encoding/hex"
 	"testing"
 )
 
@@ -22,7 +23,7 @@ func TestDefaultCiphersExist(t *testing.T) {
 
 func TestPacketCiphers(t *testing.T) {
 	// Still test aes128cbc cipher although it's commented out.
-	cipherModes[aes128cbcID] = &streamCipherMode{16, aes.BlockSize, 0, nil}
+	cipherModes[aes128cbcID] = &cipherMode{16, aes.BlockSize, 0, newAESCBCCipher}
 	defer delete(cipherModes, aes128cbcID)
 
 	for cipher := range cipherModes {
@@ -65,8 +66,116 @@ func TestPacketCiphers(t *testing.T) {
 	}
 }
 
+func TestPacketMACSequenceNumber(t *testing.T) {
+	for mac := range macModes {
+		kr := &kexResult{Hash: crypto.SHA256}
+		algs := directionAlgorithms{Cipher: "aes128-ctr", MAC: mac, Compression: "none"}
+		client, err := newPacketCipher(clientKeys, algs, kr)
+		if err != nil {
+			t.Fatalf("newPacketCipher(%q): %v", mac, err)
+		}
+		server, err := newPacketCipher(clientKeys, algs, kr)
+		if err != nil {
+			t.Fatalf("newPacketCipher(%q): %v", mac, err)
+		}
+
+		buf := &bytes.Buffer{}
+		if err := client.writePacket(7, buf, rand.Reader, []byte("bla bla")); err != nil {
+			t.Fatalf("writePacket(%q): %v", mac, err)
+		}
+		if _, err := server.readPacket(8, buf); err == nil {
+			t.Errorf("%s: readPacket succeeded with the wrong sequence number", mac)
+		}
+	}
+}
+
+func TestChaCha20Poly1305Packet(t *testing.T) {
+	// The packet was computed following OpenSSH's
+	// PROTOCOL.chacha20poly1305, with zero padding.
+	const want = "a39afcb22e4315434e8f592d0440ce83b2fdb25940da30367ee33d836a3430ef1d734e90b2e3b0e4717ba829"
+	key := make([]byte, 64)
+	for i := range key {
+		key[i] = byte(i)
+	}
+	payload := Marshal(serviceRequestMsg{serviceUserAuth})
+
+	c, err := newChaCha20Cipher(nil, key, nil, directionAlgorithms{})
+	if err != nil {
+		t.Fatalf("newChaCha20Cipher: %v", err)
+	}
+	buf := &bytes.Buffer{}
+	if err := c.writePacket(7, buf, bytes.NewReader(make([]byte, 16)), payload); err != nil {
+		t.Fatalf("writePacket: %v", err)
+	}
+	if got := hex.EncodeToString(buf.Bytes()); got != want {
+		t.Errorf("got packet %s, want %s", got, want)
+	}
+
+	packet := buf.Bytes()
+	got, err := c.readPacket(7, bytes.NewReader(packet))
+	if err != nil {
+		t.Fatalf("readPacket: %v", err)
+	}
+	if !bytes.Equal(got, payload) {
+		t.Errorf("got payload %q, want %q", got, payload)
+	}
+
+	if _, err := c.readPacket(8, bytes.NewReader(packet)); err == nil {
+		t.Errorf("readPacket succeeded with the wrong sequence number")
+	}
+	packet[len(packet)-1] ^= 1
+	if _, err := c.readPacket(7, bytes.NewReader(packet)); err == nil {
+		t.Errorf("readPacket succeeded with a corrupted tag")
+	}
+}
+
+func TestCipherPreferences(t *testing.T) {
+	if got := cipherPreferences(false)[0]; got != chacha20Poly1305ID {
+		t.Errorf("got %q preferred without hardware AES, want %q", got, chacha20Poly1305ID)
+	}
+	if got := cipherPreferences(true)[0]; got != "aes128-ctr" {
+		t.Errorf("got %q preferred with hardware AES, want aes128-ctr", got)
+	}
+}
+
+func TestAEADIgnoresMACs(t *testing.T) {
+	for cipher, mode := range cipherModes {
+		client := &kexInitMsg{
+			KexAlgos:                []string{kexAlgoCurve25519SHA256},
+			ServerHostKeyAlgos:      []string{KeyAlgoED25519},
+			CiphersClientServer:     []string{cipher},
+			CiphersServerClient:     []string{cipher},
+			MACsClientServer:        []string{"hmac-sha1"},
+			MACsServerClient:        []string{"hmac-sha1"},
+			CompressionClientServer: []string{compressionNone},
+			CompressionServerClient: []string{compressionNone},
+		}
+		server := *client
+		server.MACsClientServer = []string{"hmac-sha2-256"}
+		server.MACsServerClient = nil
+
+		algs, err := findAgreedAlgorithms(client, &server)
+		if !mode.aead() {
+			if err == nil {
+				t.Errorf("%s: negotiated without a common MAC", cipher)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", cipher, err)
+			continue
+		}
+		if algs.r.MAC != "" || algs.w.MAC != "" {
+			t.Errorf("%s: negotiated MACs %q and %q", cipher, algs.r.MAC, algs.w.MAC)
+		}
+		if _, err := newPacketCipher(clientKeys, algs.w, &kexResult{Hash: crypto.SHA256}); err != nil {
+			t.Errorf("%s: newPacketCipher: %v", cipher, err)
+		}
+	}
+}
+
 func TestCBCOracleCounterMeasure(t *testing.T) {
-	cipherModes[aes128cbcID] = &streamCipherMode{16, aes.BlockSize, 0, nil}
+	cipherModes[aes128cbcID] = &cipherMode{16, aes.BlockSize, 0, newAESCBCCipher}
 	defer delete(cipherModes, aes128cbcID)
 
 	kr := &kexResult{Hash: crypto.SHA1}
@@ -12,6 +12,7 @@ import (
 	"log"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -75,6 +76,9 @@ func NewClient(c Conn, chans <-chan NewChannel, reqs <-chan *Request) *Client {
 func NewClientConn(c net.Conn, addr string, config *ClientConfig) (Conn, <-chan NewChannel, <-chan *Request, error) {
 	fullConf := *config
 	fullConf.SetDefaults()
+	if fullConf.ServerAliveCountMax == 0 {
+		fullConf.ServerAliveCountMax = defaultKeepaliveCountMax
+	}
 	if fullConf.HostKeyCallback == nil {
 		c.Close()
 		return nil, nil, nil, errors.New("ssh: must specify HostKeyCallback")
@@ -89,6 +93,9 @@ func NewClientConn(c net.Conn, addr string, config *ClientConfig) (Conn, <-chan
 		return nil, nil, nil, fmt.Errorf("ssh: handshake failed: %v", err)
 	}
 	conn.mux = newMux(conn.transport)
+	if fullConf.ServerAliveInterval > 0 {
+		go conn.mux.keepalive(fullConf.ServerAliveInterval, fullConf.ServerAliveCountMax)
+	}
 	return conn, conn.mux.incomingChannels, conn.mux.incomingRequests, nil
 }
 
@@ -114,20 +121,48 @@ func (c *connection) clientHandshake(dialAddress string, config *ClientConfig) e
 	}
 
 	c.sessionID = c.transport.getSessionID()
-	return c.clientAuthenticate(config)
+	if err := c.clientAuthenticate(config); err != nil {
+		return err
+	}
+	if config.DeferHostKeyVerification && c.transport.provenHostKey == nil {
+		return errors.New("ssh: proxy did not prove the server's host key")
+	}
+	return nil
 }
 
 // verifyHostKeySignature verifies the host key obtained in the key
-// exchange.
-func verifyHostKeySignature(hostKey PublicKey, result *kexResult) error {
+// exchange, whose negotiated algorithm is algo.
+func verifyHostKeySignature(hostKey PublicKey, algo string, result *kexResult) error {
 	sig, rest, ok := parseSignatureBody(result.Signature)
 	if len(rest) > 0 || !ok {
 		return errors.New("ssh: signature parse error")
 	}
+	if !contains(algorithmsForKeyFormat(hostKey.Type()), algo) {
+		return fmt.Errorf("ssh: host key of type %s for algorithm %s", hostKey.Type(), algo)
+	}
+	if a := underlyingAlgo(algo); sig.Format != a {
+		return fmt.Errorf("ssh: invalid signature algorithm %q, expected %q", sig.Format, a)
+	}
 
 	return hostKey.Verify(result.H, sig)
 }
 
+// ServerExtensions returns the extensions the server announced with
+// SSH_MSG_EXT_INFO after the first key exchange, by name, as described
+// in RFC 8308. It returns nil if the server announced none, or if c was
+// not created from a connection returned by NewClientConn.
+func (c *Client) ServerExtensions() map[string][]byte {
+	conn, ok := c.Conn.(*connection)
+	if !ok || conn.serverExtensions == nil {
+		return nil
+	}
+	extensions := make(map[string][]byte, len(conn.serverExtensions))
+	for name, value := range conn.serverExtensions {
+		extensions[name] = dup(value)
+	}
+	return extensions
+}
+
 // NewSession opens a new Session for this client. (A session is a remote
 // execution of a program.)
 func (c *Client) NewSession() (*Session, error) {
@@ -169,7 +204,7 @@ func (c *Client) handleChannelOpens(in <-chan NewChannel) {
 }
 
 func (c *connection) RequestKeyChange() {
-	c.transport.deferHostKeyVerification = false
+	atomic.StoreInt32(&c.transport.deferHostKeyVerification, 0)
 	c.transport.requestKeyExchange()
 }
 
@@ -219,6 +254,13 @@ type ClientConfig struct {
 	// FixedHostKey can be used for simplistic host key checks.
 	HostKeyCallback HostKeyCallback
 
+	// DeferHostKeyVerification connects through a proxy that later
+	// hands the connection off to the server. The proxy presents no
+	// host key of its own. Instead, it relays the server's host key
+	// with the server's signature over the session ID, and
+	// HostKeyCallback is called with that key during the handshake.
+	// The connection fails if the proxy does not prove a host key,
+	// or if the server presents a different key at handoff.
 	DeferHostKeyVerification bool
 
 	// ClientVersion contains the version identification string that will
@@ -236,6 +278,17 @@ type ClientConfig struct {
 	//
 	// A Timeout of zero means no timeout.
 	Timeout time.Duration
+
+	// ServerAliveInterval, if positive, makes the client send a
+	// keepalive@openssh.com request whenever it received nothing
+	// from the server for that long.
+	ServerAliveInterval time.Duration
+
+	// ServerAliveCountMax is the number of keepalive requests that
+	// may go unanswered. Once exceeded, the client closes the
+	// connection, and Wait returns ErrKeepaliveTimeout. If zero, 3
+	// is used.
+	ServerAliveCountMax int
 }
 
 // InsecureIgnoreHostKey returns a function that can be used for
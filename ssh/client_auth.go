@@ -9,6 +9,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"strings"
 )
 
 // clientAuthenticate authenticates with the remote server. See RFC 4252.
@@ -21,6 +22,17 @@ func (c *connection) clientAuthenticate(config *ClientConfig) error {
 	if err != nil {
 		return err
 	}
+	// The server may announce extensions before accepting the
+	// service, since we advertised ext-info-c. See RFC 8308,
+	// section 2.4.
+	if packet[0] == msgExtInfo {
+		if c.serverExtensions, err = parseExtInfo(packet); err != nil {
+			return err
+		}
+		if packet, err = c.transport.readPacket(); err != nil {
+			return err
+		}
+	}
 	var serviceAccept serviceAcceptMsg
 	if err := Unmarshal(packet, &serviceAccept); err != nil {
 		return err
@@ -34,7 +46,7 @@ func (c *connection) clientAuthenticate(config *ClientConfig) error {
 	sessionID := c.transport.getSessionID()
 
 	for auth := AuthMethod(new(noneAuth)); auth != nil; {
-		ok, methods, err := auth.auth(sessionID, config.User, c.transport, config.Rand)
+		ok, methods, err := auth.auth(sessionID, config.User, c.transport, config.Rand, c.serverExtensions)
 		if err != nil {
 			return err
 		}
@@ -78,12 +90,13 @@ func keys(m map[string]bool) []string {
 
 // An AuthMethod represents an instance of an RFC 4252 authentication method.
 type AuthMethod interface {
-	// auth authenticates user over transport t.
+	// auth authenticates user over transport t, given the
+	// extensions the server announced.
 	// Returns true if authentication is successful.
 	// If authentication is not successful, a []string of alternative
 	// method names is returned. If the slice is nil, it will be ignored
 	// and the previous set of possible methods will be reused.
-	auth(session []byte, user string, p packetConn, rand io.Reader) (bool, []string, error)
+	auth(session []byte, user string, p packetConn, rand io.Reader, extensions map[string][]byte) (bool, []string, error)
 
 	// method returns the RFC 4252 method name.
 	method() string
@@ -92,7 +105,7 @@ type AuthMethod interface {
 // "none" authentication, RFC 4252 section 5.2.
 type noneAuth int
 
-func (n *noneAuth) auth(session []byte, user string, c packetConn, rand io.Reader) (bool, []string, error) {
+func (n *noneAuth) auth(session []byte, user string, c packetConn, rand io.Reader, extensions map[string][]byte) (bool, []string, error) {
 	if err := c.writePacket(Marshal(&userAuthRequestMsg{
 		User:    user,
 		Service: serviceSSH,
@@ -112,7 +125,7 @@ func (n *noneAuth) method() string {
 // a function call, e.g. by prompting the user.
 type passwordCallback func() (password string, err error)
 
-func (cb passwordCallback) auth(session []byte, user string, c packetConn, rand io.Reader) (bool, []string, error) {
+func (cb passwordCallback) auth(session []byte, user string, c packetConn, rand io.Reader, extensions map[string][]byte) (bool, []string, error) {
 	type passwordAuthMsg struct {
 		User     string `sshtype:"50"`
 		Service  string
@@ -179,7 +192,7 @@ func (cb publicKeyCallback) method() string {
 	return "publickey"
 }
 
-func (cb publicKeyCallback) auth(session []byte, user string, c packetConn, rand io.Reader) (bool, []string, error) {
+func (cb publicKeyCallback) auth(session []byte, user string, c packetConn, rand io.Reader, extensions map[string][]byte) (bool, []string, error) {
 	// Authentication is performed by sending an enquiry to test if a key is
 	// acceptable to the remote. If the key is acceptable, the client will
 	// attempt to authenticate with the valid key.  If not the client will repeat
@@ -191,7 +204,9 @@ func (cb publicKeyCallback) auth(session []byte, user string, c packetConn, rand
 	}
 	var methods []string
 	for _, signer := range signers {
-		ok, err := validateKey(signer.PublicKey(), user, c)
+		pub := signer.PublicKey()
+		algo := pickSignatureAlgorithm(signer, extensions)
+		ok, err := validateKey(pub, algo, user, c)
 		if err != nil {
 			return false, nil, err
 		}
@@ -199,13 +214,12 @@ func (cb publicKeyCallback) auth(session []byte, user string, c packetConn, rand
 			continue
 		}
 
-		pub := signer.PublicKey()
 		pubKey := pub.Marshal()
-		sign, err := signer.Sign(rand, buildDataSignedForAuth(session, userAuthRequestMsg{
+		sign, err := signWithAlgorithm(signer, rand, buildDataSignedForAuth(session, userAuthRequestMsg{
 			User:    user,
 			Service: serviceSSH,
 			Method:  cb.method(),
-		}, []byte(pub.Type()), pubKey))
+		}, []byte(algo), pubKey), underlyingAlgo(algo))
 		if err != nil {
 			return false, nil, err
 		}
@@ -219,7 +233,7 @@ func (cb publicKeyCallback) auth(session []byte, user string, c packetConn, rand
 			Service:  serviceSSH,
 			Method:   cb.method(),
 			HasSig:   true,
-			Algoname: pub.Type(),
+			Algoname: algo,
 			PubKey:   pubKey,
 			Sig:      sig,
 		}
@@ -255,27 +269,58 @@ func containsMethod(methods []string, method string) bool {
 	return false
 }
 
-// validateKey validates the key provided is acceptable to the server.
-func validateKey(key PublicKey, user string, c packetConn) (bool, error) {
+// pickSignatureAlgorithm returns the public key algorithm to
+// authenticate with signer: the one it prefers among those the server
+// lists in server-sig-algs. If the server lists none of them, or does
+// not announce the extension, this is the default of the key's type,
+// which all servers supporting the type accept. Trying others would
+// count as failed attempts against servers that refuse them.
+func pickSignatureAlgorithm(signer Signer, extensions map[string][]byte) string {
+	keyFormat := signer.PublicKey().Type()
+	list, ok := extensions[extServerSigAlgs]
+	if !ok {
+		return keyFormat
+	}
+	serverAlgos := strings.Split(string(list), ",")
+	for _, algo := range signerAlgorithms(signer) {
+		if contains(serverAlgos, underlyingAlgo(algo)) {
+			return algo
+		}
+	}
+	return keyFormat
+}
+
+// signWithAlgorithm signs data with the signature algorithm algo, which
+// must be the default of the signer's key unless it is an
+// AlgorithmSigner.
+func signWithAlgorithm(signer Signer, rand io.Reader, data []byte, algo string) (*Signature, error) {
+	if as, ok := signer.(AlgorithmSigner); ok {
+		return as.SignWithAlgorithm(rand, data, algo)
+	}
+	return signer.Sign(rand, data)
+}
+
+// validateKey validates the key provided is acceptable to the server
+// with the public key algorithm algo.
+func validateKey(key PublicKey, algo string, user string, c packetConn) (bool, error) {
 	pubKey := key.Marshal()
 	msg := publickeyAuthMsg{
 		User:     user,
 		Service:  serviceSSH,
 		Method:   "publickey",
 		HasSig:   false,
-		Algoname: key.Type(),
+		Algoname: algo,
 		PubKey:   pubKey,
 	}
 	if err := c.writePacket(Marshal(&msg)); err != nil {
 		return false, err
 	}
 
-	return confirmKeyAck(key, c)
+	return confirmKeyAck(key, algo, c)
 }
 
-func confirmKeyAck(key PublicKey, c packetConn) (bool, error) {
+func confirmKeyAck(key PublicKey, algo string, c packetConn) (bool, error) {
 	pubKey := key.Marshal()
-	algoname := key.Type()
 
 	for {
 		packet, err := c.readPacket()
@@ -290,7 +335,7 @@ func confirmKeyAck(key PublicKey, c packetConn) (bool, error) {
 			if err := Unmarshal(packet, &msg); err != nil {
 				return false, err
 			}
-			if msg.Algo != algoname || !bytes.Equal(msg.PubKey, pubKey) {
+			if msg.Algo != algo || !bytes.Equal(msg.PubKey, pubKey) {
 				return false, nil
 			}
 			return true, nil
@@ -360,7 +405,7 @@ func (cb KeyboardInteractiveChallenge) method() string {
 	return "keyboard-interactive"
 }
 
-func (cb KeyboardInteractiveChallenge) auth(session []byte, user string, c packetConn, rand io.Reader) (bool, []string, error) {
+func (cb KeyboardInteractiveChallenge) auth(session []byte, user string, c packetConn, rand io.Reader, extensions map[string][]byte) (bool, []string, error) {
 	type initiateMsg struct {
 		User       string `sshtype:"50"`
 		Service    string
@@ -457,9 +502,9 @@ type retryableAuthMethod struct {
 	maxTries   int
 }
 
-func (r *retryableAuthMethod) auth(session []byte, user string, c packetConn, rand io.Reader) (ok bool, methods []string, err error) {
+func (r *retryableAuthMethod) auth(session []byte, user string, c packetConn, rand io.Reader, extensions map[string][]byte) (ok bool, methods []string, err error) {
 	for i := 0; r.maxTries <= 0 || i < r.maxTries; i++ {
-		ok, methods, err = r.authMethod.auth(session, user, c, rand)
+		ok, methods, err = r.authMethod.auth(session, user, c, rand, extensions)
 		if ok || err != nil { // either success or error terminate
 			return ok, methods, err
 		}
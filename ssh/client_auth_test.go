@@ -9,6 +9,7 @@ import (
 	"crypto/rand"
 	"errors"
 	"fmt"
+	"io"
 	"os"
 	"strings"
 	"testing"
@@ -213,6 +214,175 @@ func TestAuthMethodRSAandDSA(t *testing.T) {
 	}
 }
 
+// algorithmPublicKey authenticates with signer using the public key
+// algorithm algo, signing with the signature algorithm sigAlgo.
+type algorithmPublicKey struct {
+	signer  AlgorithmSigner
+	algo    string
+	sigAlgo string
+}
+
+func (a algorithmPublicKey) method() string {
+	return "publickey"
+}
+
+func (a algorithmPublicKey) auth(session []byte, user string, c packetConn, rand io.Reader, extensions map[string][]byte) (bool, []string, error) {
+	pubKey := a.signer.PublicKey().Marshal()
+	sign, err := a.signer.SignWithAlgorithm(rand, buildDataSignedForAuth(session, userAuthRequestMsg{
+		User:    user,
+		Service: serviceSSH,
+		Method:  a.method(),
+	}, []byte(a.algo), pubKey), a.sigAlgo)
+	if err != nil {
+		return false, nil, err
+	}
+	s := Marshal(sign)
+	sig := make([]byte, stringLength(len(s)))
+	marshalString(sig, s)
+	msg := publickeyAuthMsg{
+		User:     user,
+		Service:  serviceSSH,
+		Method:   a.method(),
+		HasSig:   true,
+		Algoname: a.algo,
+		PubKey:   pubKey,
+		Sig:      sig,
+	}
+	if err := c.writePacket(Marshal(&msg)); err != nil {
+		return false, nil, err
+	}
+	return handleAuthResponse(c)
+}
+
+func TestAuthMethodRSASHA2(t *testing.T) {
+	cert := &Certificate{
+		Key:             testPublicKeys["rsa"],
+		ValidPrincipals: []string{"testuser"},
+		ValidBefore:     CertTimeInfinity,
+		CertType:        UserCert,
+	}
+	cert.SignCert(rand.Reader, testSigners["ecdsa"])
+	certSigner, err := NewCertSigner(cert, testSigners["rsa"])
+	if err != nil {
+		t.Fatalf("NewCertSigner: %v", err)
+	}
+
+	rsaSigner := testSigners["rsa"].(AlgorithmSigner)
+	ecdsaSigner := testSigners["ecdsa"].(AlgorithmSigner)
+	for _, test := range []struct {
+		signer  Signer
+		algo    string
+		sigAlgo string
+		ok      bool
+	}{
+		{rsaSigner, KeyAlgoRSASHA256, KeyAlgoRSASHA256, true},
+		{rsaSigner, KeyAlgoRSASHA512, KeyAlgoRSASHA512, true},
+		{rsaSigner, KeyAlgoRSA, KeyAlgoRSA, true},
+		{certSigner, CertAlgoRSASHA256v01, KeyAlgoRSASHA256, true},
+		{certSigner, CertAlgoRSASHA512v01, KeyAlgoRSASHA512, true},
+
+		// The signature must match the algorithm.
+		{rsaSigner, KeyAlgoRSASHA256, KeyAlgoRSA, false},
+		{certSigner, CertAlgoRSASHA512v01, KeyAlgoRSASHA256, false},
+
+		// The algorithm must match the key.
+		{ecdsaSigner, KeyAlgoRSASHA256, KeyAlgoECDSA256, false},
+		{certSigner, KeyAlgoRSASHA256, KeyAlgoRSASHA256, false},
+	} {
+		config := &ClientConfig{
+			User:            "testuser",
+			Auth:            []AuthMethod{algorithmPublicKey{test.signer.(AlgorithmSigner), test.algo, test.sigAlgo}},
+			HostKeyCallback: InsecureIgnoreHostKey(),
+		}
+		if err := tryAuth(t, config); (err == nil) != test.ok {
+			t.Errorf("%s key with algorithm %s and signature %s: got %v, want success %v", test.signer.PublicKey().Type(), test.algo, test.sigAlgo, err, test.ok)
+		}
+	}
+}
+
+// recordingSigner records the algorithms it is asked to sign with.
+type recordingSigner struct {
+	AlgorithmSigner
+	algos []string
+}
+
+func (s *recordingSigner) SignWithAlgorithm(rand io.Reader, data []byte, algorithm string) (*Signature, error) {
+	s.algos = append(s.algos, algorithm)
+	return s.AlgorithmSigner.SignWithAlgorithm(rand, data, algorithm)
+}
+
+func TestServerSigAlgs(t *testing.T) {
+	c1, c2, err := netPipe()
+	if err != nil {
+		t.Fatalf("netPipe: %v", err)
+	}
+	defer c1.Close()
+	defer c2.Close()
+
+	serverConfig := &ServerConfig{
+		PublicKeyCallback: func(conn ConnMetadata, key PublicKey) (*Permissions, error) {
+			return nil, nil
+		},
+	}
+	serverConfig.AddHostKey(testSigners["ecdsa"])
+	go newServer(c1, serverConfig)
+
+	signer := &recordingSigner{AlgorithmSigner: testSigners["rsa"].(AlgorithmSigner)}
+	conn, chans, reqs, err := NewClientConn(c2, "", &ClientConfig{
+		User:            "testuser",
+		Auth:            []AuthMethod{PublicKeys(signer)},
+		HostKeyCallback: InsecureIgnoreHostKey(),
+	})
+	if err != nil {
+		t.Fatalf("NewClientConn: %v", err)
+	}
+	client := NewClient(conn, chans, reqs)
+	defer client.Close()
+
+	got := string(client.ServerExtensions()[extServerSigAlgs])
+	if want := strings.Join(serverSigAlgs, ","); got != want {
+		t.Errorf("got server-sig-algs %q, want %q", got, want)
+	}
+	if len(signer.algos) != 1 || signer.algos[0] != KeyAlgoRSASHA512 {
+		t.Errorf("signed with %v, want %s", signer.algos, KeyAlgoRSASHA512)
+	}
+}
+
+func TestPickSignatureAlgorithm(t *testing.T) {
+	cert := &Certificate{
+		Key:         testPublicKeys["rsa"],
+		ValidBefore: CertTimeInfinity,
+		CertType:    UserCert,
+	}
+	cert.SignCert(rand.Reader, testSigners["ecdsa"])
+	certSigner, err := NewCertSigner(cert, testSigners["rsa"])
+	if err != nil {
+		t.Fatalf("NewCertSigner: %v", err)
+	}
+
+	for _, test := range []struct {
+		signer     Signer
+		serverAlgs string // if empty, server-sig-algs is not announced
+		want       string
+	}{
+		{testSigners["rsa"], "", KeyAlgoRSA},
+		{testSigners["rsa"], "ssh-ed25519,rsa-sha2-256,ssh-rsa", KeyAlgoRSASHA256},
+		{testSigners["rsa"], "rsa-sha2-256,rsa-sha2-512", KeyAlgoRSASHA512},
+		{testSigners["rsa"], "ssh-ed25519", KeyAlgoRSA},
+		{certSigner, "rsa-sha2-512,ssh-rsa", CertAlgoRSASHA512v01},
+		{certSigner, "", CertAlgoRSAv01},
+		{testSigners["ecdsa"], "rsa-sha2-512", KeyAlgoECDSA256},
+	} {
+		var extensions map[string][]byte
+		if test.serverAlgs != "" {
+			extensions = map[string][]byte{extServerSigAlgs: []byte(test.serverAlgs)}
+		}
+		if got := pickSignatureAlgorithm(test.signer, extensions); got != test.want {
+			t.Errorf("%s key with server-sig-algs %q: got %s, want %s", test.signer.PublicKey().Type(), test.serverAlgs, got, test.want)
+		}
+	}
+}
+
 func TestClientHMAC(t *testing.T) {
 	for _, mac := range supportedMACs {
 		config := &ClientConfig{
@@ -257,7 +427,7 @@ func TestClientUnsupportedKex(t *testing.T) {
 			PublicKeys(),
 		},
 		Config: Config{
-			KeyExchanges: []string{"diffie-hellman-group-exchange-sha256"}, // not currently supported
+			KeyExchanges: []string{"diffie-hellman-group-exchange-sha1"}, // not offered by default
 		},
 		HostKeyCallback: InsecureIgnoreHostKey(),
 	}
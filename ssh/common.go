@@ -13,6 +13,8 @@ import (
 	"math"
 	"sync"
 
+	"golang.org/x/sys/cpu"
+
 	_ "crypto/sha1"
 	_ "crypto/sha256"
 	_ "crypto/sha512"
@@ -25,30 +27,85 @@ const (
 	serviceSSH      = "ssh-connection"
 )
 
+// These are the extension negotiation names of RFC 8308. A client
+// advertises extInfoClient as a key exchange pseudo-algorithm in its
+// first kexinit to receive the server's extensions.
+const (
+	extInfoClient    = "ext-info-c"
+	extServerSigAlgs = "server-sig-algs"
+)
+
+// These pseudo-algorithms advertise strict key exchange, OpenSSH's
+// mitigation of the Terrapin prefix truncation attack, in the first
+// kexinit of the client and of the server. See section 1.10 of
+// OpenSSH's PROTOCOL.
+const (
+	kexStrictClient = "kex-strict-c-v00@openssh.com"
+	kexStrictServer = "kex-strict-s-v00@openssh.com"
+)
+
+// serverSigAlgs lists the signature algorithms that servers accept for
+// public key authentication, announced in server-sig-algs.
+var serverSigAlgs = []string{
+	KeyAlgoED25519,
+	KeyAlgoECDSA256, KeyAlgoECDSA384, KeyAlgoECDSA521,
+	KeyAlgoRSASHA512, KeyAlgoRSASHA256,
+	KeyAlgoRSA, KeyAlgoDSA,
+}
+
 // supportedCiphers specifies the supported ciphers in preference order.
-var supportedCiphers = []string{
-	"aes128-ctr", "aes192-ctr", "aes256-ctr",
-	"aes128-gcm@openssh.com",
-	"arcfour256", "arcfour128",
+var supportedCiphers = cipherPreferences(hasAESHardwareSupport)
+
+// hasAESHardwareSupport reports whether AES and GHASH are implemented
+// in hardware, as crypto/tls checks before preferring AES-GCM.
+var hasAESHardwareSupport = cpu.X86.HasAES && cpu.X86.HasPCLMULQDQ ||
+	cpu.ARM64.HasAES && cpu.ARM64.HasPMULL ||
+	cpu.S390X.HasAES && cpu.S390X.HasAESCTR && cpu.S390X.HasGHASH
+
+// cipherPreferences returns the supported ciphers in preference order.
+// Without hardware AES, chacha20-poly1305@openssh.com is preferred, as
+// it is faster than software AES and, unlike it, constant-time.
+func cipherPreferences(aesHardware bool) []string {
+	aesCiphers := []string{
+		"aes128-ctr", "aes192-ctr", "aes256-ctr",
+		gcmCipherID, gcm256CipherID,
+	}
+	var ciphers []string
+	if aesHardware {
+		ciphers = append(aesCiphers, chacha20Poly1305ID)
+	} else {
+		ciphers = append([]string{chacha20Poly1305ID}, aesCiphers...)
+	}
+	return append(ciphers, "arcfour256", "arcfour128")
 }
 
 // supportedKexAlgos specifies the supported key-exchange algorithms in
 // preference order.
 var supportedKexAlgos = []string{
+	// The hybrid key exchanges resist quantum computers as long as
+	// either of their halves does.
+	kexAlgoMLKEM768X25519SHA256,
+	kexAlgoSNTRUP761X25519SHA512, kexAlgoSNTRUP761X25519SHA512OpenSSH,
 	kexAlgoCurve25519SHA256,
 	// P384 and P521 are not constant-time yet, but since we don't
 	// reuse ephemeral keys, using them for ECDH should be OK.
 	kexAlgoECDH256, kexAlgoECDH384, kexAlgoECDH521,
-	kexAlgoDH14SHA1, kexAlgoDH1SHA1,
+	kexAlgoDHGEXSHA256,
+	kexAlgoDH16SHA512, kexAlgoDH18SHA512, kexAlgoDH14SHA256,
+
+	// The key exchanges hashing with SHA-1 are only used if listed
+	// in Config.KeyExchanges.
 }
 
 // supportedHostKeyAlgos specifies the supported host-key algorithms (i.e. methods
 // of authenticating servers) in preference order.
 var supportedHostKeyAlgos = []string{
+	CertAlgoRSASHA512v01, CertAlgoRSASHA256v01,
 	CertAlgoRSAv01, CertAlgoDSAv01, CertAlgoECDSA256v01,
 	CertAlgoECDSA384v01, CertAlgoECDSA521v01, CertAlgoED25519v01,
 
 	KeyAlgoECDSA256, KeyAlgoECDSA384, KeyAlgoECDSA521,
+	KeyAlgoRSASHA512, KeyAlgoRSASHA256,
 	KeyAlgoRSA, KeyAlgoDSA,
 
 	KeyAlgoED25519,
@@ -56,26 +113,42 @@ var supportedHostKeyAlgos = []string{
 
 // supportedMACs specifies a default set of MAC algorithms in preference order.
 // This is based on RFC 4253, section 6.4, but with hmac-md5 variants removed
-// because they have reached the end of their useful life.
+// because they have reached the end of their useful life. The
+// encrypt-then-MAC variants come first.
 var supportedMACs = []string{
-	"hmac-sha2-256-etm@openssh.com", "hmac-sha2-256", "hmac-sha1", "hmac-sha1-96",
+	"hmac-sha2-256-etm@openssh.com", "hmac-sha2-512-etm@openssh.com", "umac-128-etm@openssh.com",
+	"hmac-sha2-256", "hmac-sha2-512", "hmac-sha1", "hmac-sha1-96",
 }
 
-var supportedCompressions = []string{compressionNone}
+// supportedCompressions specifies the default compression algorithms in
+// preference order. zlib@openssh.com is offered, as OpenSSH servers do,
+// but only used if the peer prefers it.
+var supportedCompressions = []string{compressionNone, compressionZlibOpenSSH}
+
+// compressions lists the compression algorithms we implement.
+var compressions = map[string]bool{
+	compressionNone:        true,
+	compressionZlib:        true,
+	compressionZlibOpenSSH: true,
+}
 
 // hashFuncs keeps the mapping of supported algorithms to their respective
 // hashes needed for signature verification.
 var hashFuncs = map[string]crypto.Hash{
-	KeyAlgoRSA:          crypto.SHA1,
-	KeyAlgoDSA:          crypto.SHA1,
-	KeyAlgoECDSA256:     crypto.SHA256,
-	KeyAlgoECDSA384:     crypto.SHA384,
-	KeyAlgoECDSA521:     crypto.SHA512,
-	CertAlgoRSAv01:      crypto.SHA1,
-	CertAlgoDSAv01:      crypto.SHA1,
-	CertAlgoECDSA256v01: crypto.SHA256,
-	CertAlgoECDSA384v01: crypto.SHA384,
-	CertAlgoECDSA521v01: crypto.SHA512,
+	KeyAlgoRSA:           crypto.SHA1,
+	KeyAlgoRSASHA256:     crypto.SHA256,
+	KeyAlgoRSASHA512:     crypto.SHA512,
+	KeyAlgoDSA:           crypto.SHA1,
+	KeyAlgoECDSA256:      crypto.SHA256,
+	KeyAlgoECDSA384:      crypto.SHA384,
+	KeyAlgoECDSA521:      crypto.SHA512,
+	CertAlgoRSAv01:       crypto.SHA1,
+	CertAlgoRSASHA256v01: crypto.SHA256,
+	CertAlgoRSASHA512v01: crypto.SHA512,
+	CertAlgoDSAv01:       crypto.SHA1,
+	CertAlgoECDSA256v01:  crypto.SHA256,
+	CertAlgoECDSA384v01:  crypto.SHA384,
+	CertAlgoECDSA521v01:  crypto.SHA512,
 }
 
 // unexpectedMessageError results when the SSH message that we received didn't
@@ -89,6 +162,16 @@ func parseError(tag uint8) error {
 	return fmt.Errorf("ssh: parse error in message type %d", tag)
 }
 
+// contains reports whether list contains e.
+func contains(list []string, e string) bool {
+	for _, s := range list {
+		if s == e {
+			return true
+		}
+	}
+	return false
+}
+
 func findCommon(what string, client []string, server []string) (common string, err error) {
 	for _, c := range client {
 		for _, s := range server {
@@ -112,7 +195,7 @@ func (a *directionAlgorithms) rekeyBytes() int64 {
 	// 2^(BLOCKSIZE/4) blocks. For all AES flavors BLOCKSIZE is
 	// 128.
 	switch a.Cipher {
-	case "aes128-ctr", "aes192-ctr", "aes256-ctr", gcmCipherID, aes128cbcID:
+	case "aes128-ctr", "aes192-ctr", "aes256-ctr", gcmCipherID, gcm256CipherID, aes128cbcID:
 		return 16 * (1 << 32)
 
 	}
@@ -128,6 +211,12 @@ type algorithms struct {
 	r       directionAlgorithms
 }
 
+// isAEADCipher reports whether the cipher name is a supported AEAD.
+func isAEADCipher(name string) bool {
+	mode := cipherModes[name]
+	return mode != nil && mode.aead()
+}
+
 func findAgreedAlgorithms(clientKexInit, serverKexInit *kexInitMsg) (algs *algorithms, err error) {
 	result := &algorithms{}
 
@@ -136,7 +225,9 @@ func findAgreedAlgorithms(clientKexInit, serverKexInit *kexInitMsg) (algs *algor
 		return
 	}
 
-	log.Printf("host key algorithms: server: %v, client: %v", serverKexInit.ServerHostKeyAlgos, clientKexInit.ServerHostKeyAlgos)
+	if debugHandshake {
+		log.Printf("host key algorithms: server: %v, client: %v", serverKexInit.ServerHostKeyAlgos, clientKexInit.ServerHostKeyAlgos)
+	}
 	result.hostKey, err = findCommon("host key", clientKexInit.ServerHostKeyAlgos, serverKexInit.ServerHostKeyAlgos)
 	if err != nil {
 		return
@@ -152,14 +243,20 @@ func findAgreedAlgorithms(clientKexInit, serverKexInit *kexInitMsg) (algs *algor
 		return
 	}
 
-	result.w.MAC, err = findCommon("client to server MAC", clientKexInit.MACsClientServer, serverKexInit.MACsClientServer)
-	if err != nil {
-		return
+	// AEAD ciphers authenticate packets themselves, so the MAC
+	// lists are ignored for them, as OpenSSH does.
+	if !isAEADCipher(result.w.Cipher) {
+		result.w.MAC, err = findCommon("client to server MAC", clientKexInit.MACsClientServer, serverKexInit.MACsClientServer)
+		if err != nil {
+			return
+		}
 	}
 
-	result.r.MAC, err = findCommon("server to client MAC", clientKexInit.MACsServerClient, serverKexInit.MACsServerClient)
-	if err != nil {
-		return
+	if !isAEADCipher(result.r.Cipher) {
+		result.r.MAC, err = findCommon("server to client MAC", clientKexInit.MACsServerClient, serverKexInit.MACsServerClient)
+		if err != nil {
+			return
+		}
 	}
 
 	result.w.Compression, err = findCommon("client to server compression", clientKexInit.CompressionClientServer, serverKexInit.CompressionClientServer)
@@ -208,8 +305,26 @@ type Config struct {
 	// is used.
 	MACs []string
 
+	// The allowed compression algorithms. If unspecified then a
+	// sensible default is used, which compresses only if the peer
+	// asks for it.
+	Compressions []string
+
 	// KexCallback is called after each Key Exchange
 	KexCallback KexCallback
+
+	// KeyLogWriter, if not nil, receives the keys derived in each key
+	// exchange, so that captured connections can be decrypted with
+	// DecryptStream. Each direction of each exchange is a line
+	//
+	//	SSH_KEYS <session ID> <exchange hash> <direction> <cipher> <MAC> <compression> <strict> <IV> <key> <MAC key>
+	//
+	// where direction is client-to-server or server-to-client, strict
+	// is 1 if sequence numbers reset when the keys take effect and 0
+	// otherwise, and byte strings are hexadecimal. Fields that do not
+	// apply, such as the MAC of AEAD ciphers, are "-". Logging keys
+	// compromises security, and should only be used for debugging.
+	KeyLogWriter io.Writer
 }
 
 // SetDefaults sets sensible values for unset fields in config. This is
@@ -239,6 +354,17 @@ func (c *Config) SetDefaults() {
 		c.MACs = supportedMACs
 	}
 
+	if c.Compressions == nil {
+		c.Compressions = supportedCompressions
+	}
+	var comps []string
+	for _, name := range c.Compressions {
+		if compressions[name] {
+			comps = append(comps, name)
+		}
+	}
+	c.Compressions = comps
+
 	if c.RekeyThreshold == 0 {
 		// cipher specific default
 	} else if c.RekeyThreshold < minRekeyThreshold {
@@ -0,0 +1,109 @@
+package ssh
+
+import (
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"sync/atomic"
+
+	"golang.org/x/crypto/internal/inflate"
+)
+
+// zlib compresses packets from the first msgNewKeys on, as described in
+// RFC 4253, section 6.2. zlib@openssh.com waits until authentication
+// succeeds, so that unauthenticated peers cannot reach the
+// decompressor. Both restart their streams at every msgNewKeys, as
+// OpenSSH does.
+const (
+	compressionZlib        = "zlib"
+	compressionZlibOpenSSH = "zlib@openssh.com"
+)
+
+// compressionLevel is the level OpenSSH compresses at.
+const compressionLevel = 6
+
+// compressionCipher compresses the payload of packets before passing
+// them on to its packetCipher, or decompresses the payload it returns.
+// Like packet ciphers, it is used for one direction only.
+type compressionCipher struct {
+	packetCipher
+
+	// delayed is set for zlib@openssh.com, which compresses once
+	// *afterAuth is nonzero. afterAuth is accessed atomically.
+	delayed   bool
+	afterAuth *int32
+
+	deflater *deflater
+	inflater *inflate.Inflater
+}
+
+// newCompressionCipher returns c, compressing with the given algorithm.
+func newCompressionCipher(c packetCipher, compression string, afterAuth *int32) packetCipher {
+	switch compression {
+	case compressionZlib:
+		return &compressionCipher{packetCipher: c}
+	case compressionZlibOpenSSH:
+		return &compressionCipher{packetCipher: c, delayed: true, afterAuth: afterAuth}
+	}
+	return c
+}
+
+func (c *compressionCipher) active() bool {
+	return !c.delayed || atomic.LoadInt32(c.afterAuth) != 0
+}
+
+func (c *compressionCipher) writePacket(seqNum uint32, w io.Writer, rand io.Reader, packet []byte) error {
+	if c.active() {
+		if c.deflater == nil {
+			c.deflater = newDeflater()
+		}
+		var err error
+		if packet, err = c.deflater.deflate(packet); err != nil {
+			return err
+		}
+	}
+	return c.packetCipher.writePacket(seqNum, w, rand, packet)
+}
+
+func (c *compressionCipher) readPacket(seqNum uint32, r io.Reader) ([]byte, error) {
+	packet, err := c.packetCipher.readPacket(seqNum, r)
+	if err != nil || !c.active() {
+		return packet, err
+	}
+	if c.inflater == nil {
+		c.inflater = &inflate.Inflater{}
+	}
+	// To protect against decompression bombs, the payload may not
+	// inflate beyond maxPacket.
+	if packet, err = c.inflater.Inflate(nil, packet, maxPacket); err != nil {
+		return nil, fmt.Errorf("ssh: decompression failed: %v", err)
+	}
+	return packet, nil
+}
+
+// deflater compresses the payloads of packets into a zlib stream,
+// flushing it after each packet.
+type deflater struct {
+	buf bytes.Buffer
+	w   *zlib.Writer
+}
+
+func newDeflater() *deflater {
+	d := &deflater{}
+	d.w, _ = zlib.NewWriterLevel(&d.buf, compressionLevel)
+	return d
+}
+
+// deflate returns the compressed packet, which is valid until the next
+// call.
+func (d *deflater) deflate(packet []byte) ([]byte, error) {
+	d.buf.Reset()
+	if _, err := d.w.Write(packet); err != nil {
+		return nil, err
+	}
+	if err := d.w.Flush(); err != nil {
+		return nil, err
+	}
+	return d.buf.Bytes(), nil
+}
@@ -0,0 +1,124 @@
+package ssh
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestCompressionCipher(t *testing.T) {
+	for _, comp := range []string{compressionZlib, compressionZlibOpenSSH} {
+		var afterAuth int32
+		w := newCompressionCipher(&streamPacketCipher{cipher: noneCipher{}}, comp, &afterAuth)
+		r := newCompressionCipher(&streamPacketCipher{cipher: noneCipher{}}, comp, &afterAuth)
+
+		for i := 0; i < 4; i++ {
+			if i == 2 {
+				afterAuth = 1
+			}
+			want := []byte(strings.Repeat("compressible ", 1000))
+			want[0] = byte(i)
+
+			buf := &bytes.Buffer{}
+			if err := w.writePacket(uint32(i), buf, rand.Reader, want); err != nil {
+				t.Fatalf("%s: writePacket: %v", comp, err)
+			}
+			compressed := buf.Len() < len(want)/2
+			if wantCompressed := comp == compressionZlib || i >= 2; compressed != wantCompressed {
+				t.Errorf("%s: packet %d: got %d bytes on the wire for %d, compressed = %v, want %v", comp, i, buf.Len(), len(want), compressed, wantCompressed)
+			}
+
+			got, err := r.readPacket(uint32(i), buf)
+			if err != nil {
+				t.Fatalf("%s: readPacket: %v", comp, err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Fatalf("%s: packet %d changed in the round trip", comp, i)
+			}
+		}
+	}
+}
+
+func TestCompressionBomb(t *testing.T) {
+	w := newCompressionCipher(&streamPacketCipher{cipher: noneCipher{}}, compressionZlib, nil)
+	r := newCompressionCipher(&streamPacketCipher{cipher: noneCipher{}}, compressionZlib, nil)
+
+	buf := &bytes.Buffer{}
+	if err := w.writePacket(0, buf, rand.Reader, make([]byte, maxPacket+1)); err != nil {
+		t.Fatalf("writePacket: %v", err)
+	}
+	if _, err := r.readPacket(0, buf); err == nil {
+		t.Error("readPacket accepted a packet inflating beyond maxPacket")
+	}
+}
+
+func TestCompressionSession(t *testing.T) {
+	data := make([]byte, 1<<20)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+	for _, comp := range []string{compressionZlib, compressionZlibOpenSSH} {
+		c1, c2, err := netPipe()
+		if err != nil {
+			t.Fatalf("netPipe: %v", err)
+		}
+
+		serverConf := &ServerConfig{
+			NoClientAuth: true,
+			Config:       Config{Compressions: []string{comp}},
+		}
+		serverConf.AddHostKey(testSigners["ecdsa"])
+		go func() {
+			defer c1.Close()
+			_, chans, reqs, err := NewServerConn(c1, serverConf)
+			if err != nil {
+				t.Errorf("%s: NewServerConn: %v", comp, err)
+				return
+			}
+			go DiscardRequests(reqs)
+			for newCh := range chans {
+				ch, inReqs, err := newCh.Accept()
+				if err != nil {
+					t.Errorf("%s: Accept: %v", comp, err)
+					continue
+				}
+				go DiscardRequests(inReqs)
+				go func() {
+					defer ch.Close()
+					io.Copy(ch, ch)
+				}()
+			}
+		}()
+
+		clientConf := &ClientConfig{
+			User:            "testuser",
+			HostKeyCallback: InsecureIgnoreHostKey(),
+			Config:          Config{Compressions: []string{comp}},
+		}
+		conn, chans, reqs, err := NewClientConn(c2, "", clientConf)
+		if err != nil {
+			t.Fatalf("%s: NewClientConn: %v", comp, err)
+		}
+		client := NewClient(conn, chans, reqs)
+
+		ch, _, err := client.OpenChannel("session", nil)
+		if err != nil {
+			t.Fatalf("%s: OpenChannel: %v", comp, err)
+		}
+		go func() {
+			ch.Write(data)
+			ch.CloseWrite()
+		}()
+		got, err := ioutil.ReadAll(ch)
+		if err != nil {
+			t.Fatalf("%s: ReadAll: %v", comp, err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Errorf("%s: echoed data differs", comp)
+		}
+		client.Close()
+	}
+}
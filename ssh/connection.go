@@ -108,6 +108,9 @@ type sshConn struct {
 	sessionID     []byte
 	clientVersion []byte
 	serverVersion []byte
+
+	// serverExtensions is set by clientAuthenticate.
+	serverExtensions map[string][]byte
 }
 
 func dup(src []byte) []byte {
@@ -0,0 +1,94 @@
+package ssh
+
+import (
+	"io"
+)
+
+// A SignRequest asks a delegating user to sign a proxy's public key
+// authentication to a server. Besides the data to sign, it describes
+// what the signature grants, so that the user can approve it knowing
+// exactly what the proxy will do with the connection.
+//
+// Key, Algorithm, SessionID and User can be checked against Data, as
+// agent.NewApprovingAgent does. ServerAddress and Command are only what
+// the proxy claims: they cannot be verified, and are informational only.
+type SignRequest struct {
+	// Key is the key to sign with, and Data the authentication
+	// request to sign, as in RFC 4252, section 7.
+	Key  PublicKey
+	Data []byte
+
+	// Algorithm is the signature algorithm to use, such as
+	// KeyAlgoRSASHA256. If empty, the default of Key's type is used.
+	Algorithm string
+
+	// SessionID is the session ID of the proxy's connection to the
+	// server. Data starts with it, as a string.
+	SessionID []byte
+
+	// ServerAddress is the address the proxy dialed, and User the
+	// user it authenticates as. User is also in Data.
+	ServerAddress string
+	User          string
+
+	// Command is the only command the proxy's filter allows, as
+	// given to NewFilter. It is empty if the filter's policy allows
+	// only a shell, or more than one command.
+	Command string
+}
+
+// A Delegate signs a proxy's authentication to a server on behalf of
+// a user, so that the proxy holds no credentials of its own. It is
+// typically the user's agent, reached over a forwarded channel; see
+// agent.NewDelegate.
+type Delegate interface {
+	// PublicKeys returns the keys the proxy may authenticate with.
+	PublicKeys() ([]PublicKey, error)
+
+	// Sign signs req.Data with req.Key, or returns an error if the
+	// user does not approve req.
+	Sign(req *SignRequest) (*Signature, error)
+}
+
+// delegatedSigner is a Signer whose signatures are made by a Delegate.
+type delegatedSigner struct {
+	key      PublicKey
+	delegate Delegate
+
+	// template holds the context of every request.
+	template SignRequest
+}
+
+func (s *delegatedSigner) PublicKey() PublicKey {
+	return s.key
+}
+
+func (s *delegatedSigner) Sign(rand io.Reader, data []byte) (*Signature, error) {
+	return s.SignWithAlgorithm(rand, data, "")
+}
+
+func (s *delegatedSigner) SignWithAlgorithm(rand io.Reader, data []byte, algorithm string) (*Signature, error) {
+	req := s.template
+	req.Key = s.key
+	req.Data = data
+	req.Algorithm = algorithm
+	return s.delegate.Sign(&req)
+}
+
+// delegatedConfig returns a copy of config that authenticates with the
+// keys of delegate, describing each signature with template.
+func delegatedConfig(config *ClientConfig, delegate Delegate, template SignRequest) *ClientConfig {
+	delegated := *config
+	delegated.Auth = []AuthMethod{PublicKeysCallback(func() ([]Signer, error) {
+		keys, err := delegate.PublicKeys()
+		if err != nil {
+			return nil, err
+		}
+		signers := make([]Signer, len(keys))
+		for i, key := range keys {
+			signers[i] = &delegatedSigner{key: key, delegate: delegate, template: template}
+		}
+		return signers, nil
+	})}
+	return &delegated
+}
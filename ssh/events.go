@@ -0,0 +1,187 @@
+package ssh
+
+import (
+	"fmt"
+	"time"
+)
+
+// Direction identifies which way a packet travels through a proxy.
+type Direction int
+
+const (
+	ClientToServer Direction = iota
+	ServerToClient
+)
+
+func (d Direction) String() string {
+	if d == ClientToServer {
+		return "client->server"
+	}
+	return "server->client"
+}
+
+// Event is implemented by the event types that ProxyConn and Filter
+// emit: *VersionEvent, *AuthEvent, *PacketEvent,
+// *NoMoreSessionsEvent, *EscalationEvent, *HandoffStartEvent,
+// *HandoffCompleteEvent and *SeqNumRemapEvent.
+type Event interface {
+	event()
+}
+
+// EventSink receives the events of a proxied connection. Events are
+// delivered synchronously from the goroutine that produced them, in
+// the order they occur in each direction, so Event should return
+// quickly.
+type EventSink interface {
+	Event(e Event)
+}
+
+// EventSinkFunc adapts an ordinary function to the EventSink
+// interface.
+type EventSinkFunc func(e Event)
+
+// Event calls f(e).
+func (f EventSinkFunc) Event(e Event) {
+	f(e)
+}
+
+// VersionEvent records the version exchange. The proxy announces each
+// side's version string to the other unchanged.
+type VersionEvent struct {
+	Time          time.Time
+	ClientVersion string
+	ServerVersion string
+}
+
+// AuthEvent records the result of authenticating to the server. Err
+// is nil on success.
+type AuthEvent struct {
+	Time time.Time
+	User string
+	Err  error
+}
+
+// PacketEvent records a packet read from one side of the proxy.
+type PacketEvent struct {
+	Time      time.Time
+	Direction Direction
+
+	// Type is the message number, and Name its symbolic name from
+	// the RFCs, such as "SSH_MSG_CHANNEL_OPEN".
+	Type uint8
+	Name string
+
+	// Allowed reports whether the packet was forwarded. Blocked
+	// packets are replaced by SSH_MSG_IGNORE on the other side.
+	Allowed bool
+
+	// InSeqNum is the sequence number of the packet on the side it
+	// was read from. OutSeqNum is the sequence number it was
+	// forwarded with, if Allowed.
+	InSeqNum  uint32
+	OutSeqNum uint32
+}
+
+// NoMoreSessionsEvent records a change in the status of the client's
+// no-more-sessions@openssh.com request. Status is one of
+// AwaitingReply, Success or Failure.
+type NoMoreSessionsEvent struct {
+	Time   time.Time
+	Status int
+}
+
+// EscalationEvent records the outcome of asking for approval of a
+// request the filter could not decide on its own. Request describes
+// what was asked for. Err is nil if the request was approved.
+type EscalationEvent struct {
+	Time    time.Time
+	Request string
+	Err     error
+}
+
+// HandoffStartEvent records that the client initiated a handoff by
+// sending its key exchange init message.
+type HandoffStartEvent struct {
+	Time time.Time
+}
+
+// HandoffCompleteEvent records the end of a handoff. Err is nil if
+// both directions stopped forwarding cleanly.
+type HandoffCompleteEvent struct {
+	Time time.Time
+	Err  error
+}
+
+// SeqNumRemapEvent records the client's sequence numbers being
+// rewritten to continue those of the server connection at handoff.
+// Outgoing and incoming are from the proxy's point of view.
+type SeqNumRemapEvent struct {
+	Time        time.Time
+	OldOutgoing uint32
+	OldIncoming uint32
+	NewOutgoing uint32
+	NewIncoming uint32
+}
+
+func (*VersionEvent) event()         {}
+func (*AuthEvent) event()            {}
+func (*PacketEvent) event()          {}
+func (*NoMoreSessionsEvent) event()  {}
+func (*EscalationEvent) event()      {}
+func (*HandoffStartEvent) event()    {}
+func (*HandoffCompleteEvent) event() {}
+func (*SeqNumRemapEvent) event()     {}
+
+// emitEvent delivers e to sink, if there is one.
+func emitEvent(sink EventSink, e Event) {
+	if sink != nil {
+		sink.Event(e)
+	}
+}
+
+var msgNames = map[uint8]string{
+	msgDisconnect:           "SSH_MSG_DISCONNECT",
+	msgIgnore:               "SSH_MSG_IGNORE",
+	msgUnimplemented:        "SSH_MSG_UNIMPLEMENTED",
+	msgDebug:                "SSH_MSG_DEBUG",
+	msgServiceRequest:       "SSH_MSG_SERVICE_REQUEST",
+	msgServiceAccept:        "SSH_MSG_SERVICE_ACCEPT",
+	msgExtInfo:              "SSH_MSG_EXT_INFO",
+	msgKexInit:              "SSH_MSG_KEXINIT",
+	msgNewKeys:              "SSH_MSG_NEWKEYS",
+	msgKexDHInit:            "SSH_MSG_KEXDH_INIT",
+	msgKexDHReply:           "SSH_MSG_KEXDH_REPLY",
+	msgKexDHGexInit:         "SSH_MSG_KEX_DH_GEX_INIT",
+	msgKexDHGexReply:        "SSH_MSG_KEX_DH_GEX_REPLY",
+	msgKexDHGexRequest:      "SSH_MSG_KEX_DH_GEX_REQUEST",
+	msgUserAuthRequest:      "SSH_MSG_USERAUTH_REQUEST",
+	msgUserAuthFailure:      "SSH_MSG_USERAUTH_FAILURE",
+	msgUserAuthSuccess:      "SSH_MSG_USERAUTH_SUCCESS",
+	msgUserAuthBanner:       "SSH_MSG_USERAUTH_BANNER",
+	msgUserAuthPubKeyOk:     "SSH_MSG_USERAUTH_PK_OK",
+	msgUserAuthInfoResponse: "SSH_MSG_USERAUTH_INFO_RESPONSE",
+	msgGlobalRequest:        "SSH_MSG_GLOBAL_REQUEST",
+	msgRequestSuccess:       "SSH_MSG_REQUEST_SUCCESS",
+	msgRequestFailure:       "SSH_MSG_REQUEST_FAILURE",
+	msgChannelOpen:          "SSH_MSG_CHANNEL_OPEN",
+	msgChannelOpenConfirm:   "SSH_MSG_CHANNEL_OPEN_CONFIRMATION",
+	msgChannelOpenFailure:   "SSH_MSG_CHANNEL_OPEN_FAILURE",
+	msgChannelWindowAdjust:  "SSH_MSG_CHANNEL_WINDOW_ADJUST",
+	msgChannelData:          "SSH_MSG_CHANNEL_DATA",
+	msgChannelExtendedData:  "SSH_MSG_CHANNEL_EXTENDED_DATA",
+	msgChannelEOF:           "SSH_MSG_CHANNEL_EOF",
+	msgChannelClose:         "SSH_MSG_CHANNEL_CLOSE",
+	msgChannelRequest:       "SSH_MSG_CHANNEL_REQUEST",
+	msgChannelSuccess:       "SSH_MSG_CHANNEL_SUCCESS",
+	msgChannelFailure:       "SSH_MSG_CHANNEL_FAILURE",
+}
+
+// msgName returns the symbolic name of message number t. Numbers
+// whose meaning depends on the negotiated key exchange or
+// authentication method are named after the most common one.
+func msgName(t uint8) string {
+	if name, ok := msgNames[t]; ok {
+		return name
+	}
+	return fmt.Sprintf("SSH_MSG_%d", t)
+}
@@ -1,7 +1,12 @@
 package ssh
 
 import (
+	"encoding/binary"
+	"errors"
+	"fmt"
 	"log"
+	"sync"
+	"time"
 )
 
 const (
@@ -11,24 +16,161 @@ const (
 	Failure
 )
 
-type EscalateFunc func() error
+// disconnectByApplication is SSH_DISCONNECT_BY_APPLICATION from RFC 4253,
+// section 11.1.
+const disconnectByApplication = 11
+
+// filterChannel is a channel the client asked to open.
+type filterChannel struct {
+	chanType string
+
+	// clientID is the client's identifier for the channel, needed
+	// to address replies to requests that are blocked.
+	clientID uint32
+}
 
 type Filter struct {
-	// kept to validate that promised command is made command (may be unecessary since we don't check thereafter if all approved)
-	command       string
-	sessionOpened bool
-	nmsStatus     int
-	escalate      EscalateFunc
+	// mu protects the state of the filter, which packets in both
+	// directions update. It is released while the approver runs.
+	mu sync.Mutex
+
+	policy    *Policy
+	sessions  int
+	nmsStatus int
+	approver  Approver
+	events    EventSink
+
+	// Connection details passed on to the approver.
+	serverAddress string
+	user          string
+	hostKey       PublicKey
+	channelTypes  []string
+	lastCommand   string
+
+	// approvals maps requests approved for a limited time to the
+	// expiry of the approval.
+	approvals map[string]time.Time
+
+	// pending holds channels whose opening has not been confirmed
+	// by the server yet, keyed by the client's channel identifier.
+	pending map[uint32]*filterChannel
+
+	// channels holds open channels, keyed by the server's channel
+	// identifier.
+	channels map[uint32]*filterChannel
+
+	// serverOpened holds the types of channels the server asked to
+	// open, keyed by the server's channel identifier, until the
+	// client answers.
+	serverOpened map[uint32]string
 }
 
+// NewFilter returns a Filter that allows only a single session, in
+// which the client may request a pty and run givenCommand. If
+// givenCommand is empty, a shell is allowed instead. A handoff without
+// no-more-sessions is allowed if escalate returns nil.
 func NewFilter(givenCommand string, escalate EscalateFunc) *Filter {
+	var approver Approver
+	if escalate != nil {
+		approver = escalate
+	}
+	fil, _ := NewPolicyFilter(&Policy{
+		Commands:    []CommandRule{{Rule: Rule{Decision: Allow}, Match: MatchExact, Pattern: givenCommand}},
+		Channels:    []ChannelRule{{Rule: Rule{Decision: Allow}, Type: "session"}},
+		Requests:    []RequestRule{{Rule: Rule{Decision: Allow}, Type: "pty-req"}},
+		MaxSessions: 1,
+	}, approver)
+	return fil
+}
+
+// NewPolicyFilter returns a Filter that decides client requests
+// according to policy. Requests the policy escalates, and handoffs
+// without no-more-sessions, are referred to approver; if approver is
+// nil, they are denied. The policy must not be modified afterwards.
+func NewPolicyFilter(policy *Policy, approver Approver) (*Filter, error) {
+	if err := policy.compile(); err != nil {
+		return nil, err
+	}
 	return &Filter{
-		command:  givenCommand,
-		escalate: escalate,
+		policy:       policy,
+		approver:     approver,
+		approvals:    make(map[string]time.Time),
+		pending:      make(map[uint32]*filterChannel),
+		channels:     make(map[uint32]*filterChannel),
+		serverOpened: make(map[uint32]string),
+	}, nil
+}
+
+// setConnection records the details of the server connection that
+// approvers are shown.
+func (fil *Filter) setConnection(serverAddress, user string, hostKey PublicKey) {
+	fil.mu.Lock()
+	defer fil.mu.Unlock()
+	fil.serverAddress = serverAddress
+	fil.user = user
+	fil.hostKey = hostKey
+}
+
+// promisedCommand returns the only command the filter's policy allows,
+// or "" if it allows only a shell or more than one command.
+func (fil *Filter) promisedCommand() string {
+	if fil.policy.Default.Decision == Allow {
+		return ""
+	}
+	var command string
+	allowed := 0
+	for _, r := range fil.policy.Commands {
+		if r.Decision != Allow {
+			continue
+		}
+		if r.Match != MatchExact {
+			return ""
+		}
+		command = r.Pattern
+		allowed++
+	}
+	if allowed != 1 {
+		return ""
 	}
+	return command
 }
 
 func (fil *Filter) FilterServerPacket(packet []byte) (validState bool, response []byte, err error) {
+	fil.mu.Lock()
+	defer fil.mu.Unlock()
+
+	switch packet[0] {
+	case msgChannelOpen:
+		var msg channelOpenMsg
+		if err := Unmarshal(packet, &msg); err != nil {
+			return false, nil, err
+		}
+		fil.serverOpened[msg.PeersId] = msg.ChanType
+		return true, nil, nil
+	case msgChannelOpenConfirm:
+		var msg channelOpenConfirmMsg
+		if err := Unmarshal(packet, &msg); err != nil {
+			return false, nil, err
+		}
+		if ch, ok := fil.pending[msg.PeersId]; ok {
+			delete(fil.pending, msg.PeersId)
+			fil.channels[msg.MyId] = ch
+		}
+		return true, nil, nil
+	case msgChannelOpenFailure:
+		var msg channelOpenFailureMsg
+		if err := Unmarshal(packet, &msg); err != nil {
+			return false, nil, err
+		}
+		if ch, ok := fil.pending[msg.PeersId]; ok {
+			delete(fil.pending, msg.PeersId)
+			if ch.chanType == "session" {
+				fil.sessions--
+			}
+		}
+		return true, nil, nil
+	}
+
 	if fil.nmsStatus != AwaitingReply {
 		return true, nil, nil
 	}
@@ -38,19 +180,132 @@ func (fil *Filter) FilterServerPacket(packet []byte) (validState bool, response
 		if debugProxy {
 			log.Printf("Server approved no-more-sessions.")
 		}
-		fil.nmsStatus = Success
+		fil.setNoMoreSessionsStatus(Success)
 	case msgUnimplemented:
 		fallthrough
 	case msgRequestFailure:
 		if debugProxy {
 			log.Printf("Server sent no-more-sessions failure.")
 		}
-		fil.nmsStatus = Failure
+		fil.setNoMoreSessionsStatus(Failure)
+	}
+	return true, nil, nil
+}
+
+func (fil *Filter) setNoMoreSessionsStatus(status int) {
+	fil.nmsStatus = status
+	emitEvent(fil.events, &NoMoreSessionsEvent{Time: time.Now(), Status: status})
+}
+
+// runEscalation asks the approver about the request described by
+// what. command is the command of an exec request, if any. A nil error
+// means the request was approved; otherwise the error explains the
+// denial.
+func (fil *Filter) runEscalation(what, command string) error {
+	err := fil.approve(what, command)
+	emitEvent(fil.events, &EscalationEvent{Time: time.Now(), Request: what, Err: err})
+	return err
+}
+
+func (fil *Filter) approve(what, command string) error {
+	if expiry, ok := fil.approvals[what]; ok {
+		if time.Now().Before(expiry) {
+			return nil
+		}
+		delete(fil.approvals, what)
+	}
+	if fil.approver == nil {
+		return errors.New("ssh: no approver configured")
+	}
+
+	req := &ApprovalRequest{
+		ServerAddress:  fil.serverAddress,
+		User:           fil.user,
+		Request:        what,
+		Command:        command,
+		ChannelTypes:   append([]string(nil), fil.channelTypes...),
+		NoMoreSessions: fil.nmsStatus == Success,
+	}
+	if fil.hostKey != nil {
+		req.HostKeyFingerprint = FingerprintSHA256(fil.hostKey)
+	}
+	// Approvers may wait for the user, during which the server's
+	// packets must keep flowing.
+	fil.mu.Unlock()
+	approval, err := fil.approver.Approve(req)
+	fil.mu.Lock()
+	if err != nil {
+		return err
+	}
+	if !approval.Allowed {
+		if approval.Reason != "" {
+			return deniedError(approval.Reason)
+		}
+		return errApprovalDenied
+	}
+	if approval.Duration > 0 {
+		fil.approvals[what] = time.Now().Add(approval.Duration)
+	}
+	return nil
+}
+
+// decide resolves an Escalate decision by asking for approval of the
+// request described by what, and reports whether the request may
+// proceed. If not, it returns the message to send to the client.
+func (fil *Filter) decide(rule Rule, what, command string) (ok bool, message string) {
+	switch rule.Decision {
+	case Allow:
+		return true, ""
+	case Escalate:
+		err := fil.runEscalation(what, command)
+		if err == nil {
+			return true, ""
+		}
+		if reason, ok := err.(deniedError); ok {
+			return false, string(reason)
+		}
+	}
+	return false, rule.Message
+}
+
+// deny builds the response for a request denied by rule. reply is the
+// failure message appropriate for the request, or nil if the client
+// does not expect one.
+func (fil *Filter) deny(rule Rule, message string, reply []byte) (allowed bool, response []byte, err error) {
+	if rule.Disconnect {
+		if message == "" {
+			message = "request denied by policy"
+		}
+		return false, Marshal(disconnectMsg{Reason: disconnectByApplication, Message: message}), errors.New("ssh: " + message)
+	}
+	return false, reply, nil
+}
+
+// filterChannelMessage blocks messages about channels that are not
+// open, which the client could otherwise use to reach channels the
+// filter never saw being opened.
+func (fil *Filter) filterChannelMessage(packet []byte) (allowed bool, response []byte, err error) {
+	if len(packet) < 5 {
+		return false, nil, parseError(packet[0])
+	}
+	if _, ok := fil.channels[binary.BigEndian.Uint32(packet[1:])]; !ok {
+		if debugProxy {
+			log.Printf("Message %d for unknown channel blocked", packet[0])
+		}
+		return false, nil, nil
 	}
 	return true, nil, nil
 }
 
 func (fil *Filter) FilterClientPacket(packet []byte) (allowed bool, response []byte, err error) {
+	fil.mu.Lock()
+	defer fil.mu.Unlock()
+
+	switch packet[0] {
+	case msgChannelData, msgChannelExtendedData, msgChannelWindowAdjust, msgChannelEOF, msgChannelSuccess, msgChannelFailure:
+		return fil.filterChannelMessage(packet)
+	}
+
 	decoded, err := decode(packet)
 	if err != nil {
 		return false, nil, err
@@ -58,53 +313,158 @@ func (fil *Filter) FilterClientPacket(packet []byte) (allowed bool, response []b
 
 	switch msg := decoded.(type) {
 	case *channelOpenMsg:
-		if msg.ChanType != "session" || fil.sessionOpened {
-			return false, Marshal(channelOpenFailureMsg{}), nil
+		rule := fil.policy.channel(msg.ChanType)
+		if msg.ChanType == "direct-tcpip" {
+			var dest struct {
+				Host     string
+				Port     uint32
+				OrigHost string
+				OrigPort uint32
+			}
+			if err := Unmarshal(msg.TypeSpecificData, &dest); err != nil {
+				return false, nil, err
+			}
+			rule = stricter(rule, fil.policy.forward(dest.Host, dest.Port))
 		}
-		fil.sessionOpened = true
+		if rule.Decision != Deny && msg.ChanType == "session" && fil.policy.MaxSessions > 0 && fil.sessions >= fil.policy.MaxSessions {
+			rule = Rule{Decision: Deny, Message: "too many sessions"}
+		}
+		fil.channelTypes = append(fil.channelTypes, msg.ChanType)
+		if ok, message := fil.decide(rule, "channel "+msg.ChanType, ""); !ok {
+			if debugProxy {
+				log.Printf("Channel open %s blocked by policy", msg.ChanType)
+			}
+			return fil.deny(rule, message, Marshal(channelOpenFailureMsg{
+				PeersId: msg.PeersId,
+				Reason:  Prohibited,
+				Message: message,
+			}))
+		}
+		if msg.ChanType == "session" {
+			fil.sessions++
+		}
+		fil.pending[msg.PeersId] = &filterChannel{chanType: msg.ChanType, clientID: msg.PeersId}
 		return true, nil, nil
 	case *globalRequestMsg:
-		if msg.Type != NoMoreSessionRequestName {
-			return false, Marshal(globalRequestFailureMsg{}), nil
+		var reply []byte
+		if msg.WantReply {
+			reply = Marshal(globalRequestFailureMsg{})
 		}
-		if debugProxy {
-			log.Printf("Client sent no-more-sessions")
+		switch msg.Type {
+		case NoMoreSessionRequestName:
+			if debugProxy {
+				log.Printf("Client sent no-more-sessions")
+			}
+			fil.setNoMoreSessionsStatus(AwaitingReply)
+			return true, nil, nil
+		case "tcpip-forward", "cancel-tcpip-forward":
+			var bind struct {
+				Host string
+				Port uint32
+			}
+			if err := Unmarshal(msg.Data, &bind); err != nil {
+				return false, nil, err
+			}
+			what := fmt.Sprintf("%s %s:%d", msg.Type, bind.Host, bind.Port)
+			rule := fil.policy.forward(bind.Host, bind.Port)
+			if ok, message := fil.decide(rule, what, ""); !ok {
+				if debugProxy {
+					log.Printf("Remote forwarding of %s:%d blocked by policy", bind.Host, bind.Port)
+				}
+				return fil.deny(rule, message, reply)
+			}
+			return true, nil, nil
+		}
+		rule := fil.policy.Default
+		if ok, message := fil.decide(rule, "global request "+msg.Type, ""); !ok {
+			if debugProxy {
+				log.Printf("Global request %s blocked by policy", msg.Type)
+			}
+			return fil.deny(rule, message, reply)
 		}
-		fil.nmsStatus = AwaitingReply
 		return true, nil, nil
 	case *channelRequestMsg:
-		reqCmd := ""
-		if msg.Request == "pty-req" {
-			return true, nil, nil
+		ch, ok := fil.channels[msg.PeersId]
+		if !ok {
+			if debugProxy {
+				log.Printf("Channel request %s for unknown channel blocked", msg.Request)
+			}
+			return false, nil, nil
 		}
-		if msg.Request == "exec" {
+		var reply []byte
+		if msg.WantReply {
+			reply = Marshal(channelRequestFailureMsg{PeersId: ch.clientID})
+		}
+		var rule Rule
+		var command string
+		what := msg.Request
+		switch msg.Request {
+		case "exec":
 			var execReq execMsg
 			if err := Unmarshal(msg.RequestSpecificData, &execReq); err != nil {
 				return false, nil, err
 			}
-			reqCmd = execReq.Command
-		} else if msg.Request != "shell" {
-			log.Printf("Channel request %s blocked (only 'exec'/'shell' is allowed)", msg.Request)
-			return false, Marshal(channelRequestFailureMsg{}), nil
+			command = execReq.Command
+			rule = fil.policy.command(command)
+			what += " " + command
+		case "shell":
+			rule = fil.policy.command("")
+		case "env":
+			var env setenvRequest
+			if err := Unmarshal(msg.RequestSpecificData, &env); err != nil {
+				return false, nil, err
+			}
+			rule = fil.policy.request(msg.Request, env.Name)
+			what += " " + env.Name
+		case "subsystem":
+			var sub subsystemRequestMsg
+			if err := Unmarshal(msg.RequestSpecificData, &sub); err != nil {
+				return false, nil, err
+			}
+			rule = fil.policy.request(msg.Request, sub.Subsystem)
+			what += " " + sub.Subsystem
+		default:
+			rule = fil.policy.request(msg.Request, "")
+		}
+		if ok, message := fil.decide(rule, what, command); !ok {
+			if debugProxy {
+				log.Printf("Channel request %s blocked by policy", msg.Request)
+			}
+			return fil.deny(rule, message, reply)
 		}
-		if reqCmd != fil.command {
-			log.Printf("Unexpected command: %s, (expecting: %s)", reqCmd, fil.command)
-			return false, Marshal(channelRequestFailureMsg{}), nil
+		if msg.Request == "exec" {
+			fil.lastCommand = command
+		}
+		return true, nil, nil
+	case *channelOpenConfirmMsg:
+		if chanType, ok := fil.serverOpened[msg.PeersId]; ok {
+			delete(fil.serverOpened, msg.PeersId)
+			fil.channels[msg.PeersId] = &filterChannel{chanType: chanType, clientID: msg.MyId}
 		}
 		return true, nil, nil
+	case *channelOpenFailureMsg:
+		delete(fil.serverOpened, msg.PeersId)
+		return true, nil, nil
+	case *channelCloseMsg:
+		delete(fil.channels, msg.PeersId)
+		return true, nil, nil
 	case *kexInitMsg:
 		if fil.nmsStatus == Success {
 			return true, nil, nil
 		}
-		log.Printf("Attempting handoff without successful no-more-sessions.")
-		err = fil.escalate()
-		if err == nil {
+		if debugProxy {
+			log.Printf("Attempting handoff without successful no-more-sessions.")
+		}
+		if err = fil.runEscalation("handoff", fil.lastCommand); err == nil {
 			return true, nil, nil
 		}
 		reason := "Must issue no-more-sessions before handoff"
 		if fil.nmsStatus == Failure {
 			reason = "Server does not support fine-grained permissions, and user denied full access"
 		}
+		if denied, ok := err.(deniedError); ok {
+			reason = string(denied)
+		}
 		return false, Marshal(disconnectMsg{Reason: 2, Message: reason}), err
 	default:
 		return true, nil, nil
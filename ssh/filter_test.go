@@ -0,0 +1,303 @@
+package ssh
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func openSession(t *testing.T, fil *Filter, clientID, serverID uint32) {
+	allowed, _, err := fil.FilterClientPacket(Marshal(&channelOpenMsg{ChanType: "session", PeersId: clientID}))
+	if err != nil || !allowed {
+		t.Fatalf("session open: allowed %v, err %v", allowed, err)
+	}
+	if _, _, err := fil.FilterServerPacket(Marshal(&channelOpenConfirmMsg{PeersId: clientID, MyId: serverID})); err != nil {
+		t.Fatalf("session confirm: %v", err)
+	}
+}
+
+func execPacket(serverID uint32, cmd string) []byte {
+	return Marshal(&channelRequestMsg{
+		PeersId:             serverID,
+		Request:             "exec",
+		WantReply:           true,
+		RequestSpecificData: Marshal(&execMsg{cmd}),
+	})
+}
+
+func TestNewFilterSingleCommand(t *testing.T) {
+	fil := NewFilter("ls", nil)
+	openSession(t, fil, 3, 7)
+
+	if allowed, _, err := fil.FilterClientPacket(execPacket(7, "ls")); err != nil || !allowed {
+		t.Errorf("exec ls: allowed %v, err %v", allowed, err)
+	}
+
+	allowed, response, err := fil.FilterClientPacket(execPacket(7, "rm -rf /"))
+	if err != nil || allowed {
+		t.Fatalf("exec rm: allowed %v, err %v", allowed, err)
+	}
+	var failure channelRequestFailureMsg
+	if err := Unmarshal(response, &failure); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	if failure.PeersId != 3 {
+		t.Errorf("failure sent to channel %d, want client channel 3", failure.PeersId)
+	}
+
+	allowed, response, _ = fil.FilterClientPacket(Marshal(&channelOpenMsg{ChanType: "session", PeersId: 4}))
+	if allowed {
+		t.Errorf("second session allowed")
+	}
+	var openFailure channelOpenFailureMsg
+	if err := Unmarshal(response, &openFailure); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	if openFailure.PeersId != 4 || openFailure.Reason != Prohibited {
+		t.Errorf("got %+v, want prohibited failure for channel 4", openFailure)
+	}
+}
+
+func TestFilterChannelRequestWithoutReply(t *testing.T) {
+	fil := NewFilter("ls", nil)
+	openSession(t, fil, 0, 0)
+
+	allowed, response, err := fil.FilterClientPacket(Marshal(&channelRequestMsg{
+		Request:             "env",
+		RequestSpecificData: Marshal(&setenvRequest{"LANG", "C"}),
+	}))
+	if err != nil || allowed {
+		t.Fatalf("env: allowed %v, err %v", allowed, err)
+	}
+	if response != nil {
+		t.Errorf("got response %v to a request without want-reply", response)
+	}
+}
+
+func TestFilterEscalation(t *testing.T) {
+	calls := 0
+	approve := true
+	fil, err := NewPolicyFilter(&Policy{
+		Commands: []CommandRule{{Rule: Rule{Decision: Escalate}, Match: MatchGlob, Pattern: "sudo *"}},
+		Channels: []ChannelRule{{Rule: Rule{Decision: Allow}, Type: "session"}},
+	}, EscalateFunc(func() error {
+		calls++
+		if approve {
+			return nil
+		}
+		return errors.New("denied")
+	}))
+	if err != nil {
+		t.Fatalf("NewPolicyFilter: %v", err)
+	}
+	openSession(t, fil, 0, 0)
+
+	if allowed, _, _ := fil.FilterClientPacket(execPacket(0, "sudo reboot")); !allowed {
+		t.Errorf("approved escalation was blocked")
+	}
+	approve = false
+	if allowed, _, _ := fil.FilterClientPacket(execPacket(0, "sudo reboot")); allowed {
+		t.Errorf("rejected escalation was allowed")
+	}
+	if calls != 2 {
+		t.Errorf("escalate called %d times, want 2", calls)
+	}
+}
+
+func TestFilterForwards(t *testing.T) {
+	fil, err := NewPolicyFilter(&Policy{
+		Channels: []ChannelRule{{Rule: Rule{Decision: Allow}, Type: "direct-tcpip"}},
+		Forwards: []ForwardRule{{Rule: Rule{Decision: Allow}, Host: "db.internal", Port: 5432}},
+		Default:  Rule{Decision: Deny, Message: "nope"},
+	}, nil)
+	if err != nil {
+		t.Fatalf("NewPolicyFilter: %v", err)
+	}
+
+	open := func(host string, port uint32) (bool, []byte) {
+		allowed, response, err := fil.FilterClientPacket(Marshal(&channelOpenMsg{
+			ChanType:         "direct-tcpip",
+			TypeSpecificData: Marshal(&channelOpenDirectMsg{host, port, "127.0.0.1", 1234}),
+		}))
+		if err != nil {
+			t.Fatalf("FilterClientPacket: %v", err)
+		}
+		return allowed, response
+	}
+
+	if allowed, _ := open("db.internal", 5432); !allowed {
+		t.Errorf("allowed destination was blocked")
+	}
+	allowed, response := open("db.internal", 22)
+	if allowed {
+		t.Fatalf("other port was allowed")
+	}
+	var failure channelOpenFailureMsg
+	if err := Unmarshal(response, &failure); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	if failure.Message != "nope" {
+		t.Errorf("got message %q, want the policy's deny message", failure.Message)
+	}
+}
+
+func TestFilterDisconnectRule(t *testing.T) {
+	fil, err := NewPolicyFilter(&Policy{
+		Channels: []ChannelRule{{Rule: Rule{Decision: Allow}, Type: "session"}},
+		Requests: []RequestRule{{Rule: Rule{Decision: Deny, Message: "no sftp", Disconnect: true}, Type: "subsystem", Name: "sftp"}},
+	}, nil)
+	if err != nil {
+		t.Fatalf("NewPolicyFilter: %v", err)
+	}
+	openSession(t, fil, 0, 0)
+
+	allowed, response, err := fil.FilterClientPacket(Marshal(&channelRequestMsg{
+		Request:             "subsystem",
+		WantReply:           true,
+		RequestSpecificData: Marshal(&subsystemRequestMsg{"sftp"}),
+	}))
+	if allowed || err == nil {
+		t.Fatalf("subsystem: allowed %v, err %v; want disconnect", allowed, err)
+	}
+	var msg disconnectMsg
+	if err := Unmarshal(response, &msg); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	if msg.Message != "no sftp" {
+		t.Errorf("got disconnect message %q, want %q", msg.Message, "no sftp")
+	}
+}
+
+type recordingApprover struct {
+	requests []*ApprovalRequest
+	approval Approval
+}
+
+func (a *recordingApprover) Approve(req *ApprovalRequest) (Approval, error) {
+	a.requests = append(a.requests, req)
+	return a.approval, nil
+}
+
+func TestFilterApprover(t *testing.T) {
+	approver := &recordingApprover{approval: AllowFor(time.Hour)}
+	fil, err := NewPolicyFilter(&Policy{
+		Commands: []CommandRule{{Rule: Rule{Decision: Escalate}, Match: MatchGlob, Pattern: "*"}},
+		Channels: []ChannelRule{{Rule: Rule{Decision: Allow}, Type: "session"}},
+	}, approver)
+	if err != nil {
+		t.Fatalf("NewPolicyFilter: %v", err)
+	}
+	fil.setConnection("example.com:22", "alice", testPublicKeys["ecdsa"])
+	openSession(t, fil, 0, 0)
+
+	for i := 0; i < 2; i++ {
+		if allowed, _, _ := fil.FilterClientPacket(execPacket(0, "make deploy")); !allowed {
+			t.Fatalf("exec %d was blocked", i)
+		}
+	}
+	if len(approver.requests) != 1 {
+		t.Fatalf("approver called %d times, want once for a scoped approval", len(approver.requests))
+	}
+	want := &ApprovalRequest{
+		ServerAddress:      "example.com:22",
+		User:               "alice",
+		Request:            "exec make deploy",
+		Command:            "make deploy",
+		ChannelTypes:       []string{"session"},
+		HostKeyFingerprint: FingerprintSHA256(testPublicKeys["ecdsa"]),
+	}
+	if got := approver.requests[0]; !reflect.DeepEqual(got, want) {
+		t.Errorf("got request %+v, want %+v", got, want)
+	}
+
+	// The handoff is escalated since no-more-sessions was not
+	// acknowledged, and denied with the approver's reason.
+	approver.approval = DenyWithReason("not during business hours")
+	allowed, response, err := fil.FilterClientPacket(Marshal(&kexInitMsg{}))
+	if allowed || err == nil {
+		t.Fatalf("handoff: allowed %v, err %v; want denial", allowed, err)
+	}
+	if got := approver.requests[1]; got.Request != "handoff" || got.Command != "make deploy" {
+		t.Errorf("got handoff request %+v", got)
+	}
+	var msg disconnectMsg
+	if err := Unmarshal(response, &msg); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	if msg.Message != "not during business hours" {
+		t.Errorf("got disconnect message %q, want the approver's reason", msg.Message)
+	}
+}
+
+func TestFilterUnknownChannel(t *testing.T) {
+	fil := NewFilter("ls", nil)
+	openSession(t, fil, 0, 5)
+
+	if allowed, _, err := fil.FilterClientPacket(Marshal(&channelDataMsg{PeersId: 5, Length: 1, Rest: []byte("x")})); err != nil || !allowed {
+		t.Errorf("data on open channel: allowed %v, err %v", allowed, err)
+	}
+	if allowed, _, err := fil.FilterClientPacket(Marshal(&channelDataMsg{PeersId: 6, Length: 1, Rest: []byte("x")})); err != nil || allowed {
+		t.Errorf("data on unknown channel: allowed %v, err %v", allowed, err)
+	}
+	if allowed, response, err := fil.FilterClientPacket(execPacket(6, "ls")); err != nil || allowed || response != nil {
+		t.Errorf("exec on unknown channel: allowed %v, response %v, err %v", allowed, response, err)
+	}
+
+	// Channels opened by the server become usable once the client
+	// confirms them.
+	if _, _, err := fil.FilterServerPacket(Marshal(&channelOpenMsg{ChanType: "forwarded-tcpip", PeersId: 9})); err != nil {
+		t.Fatalf("server channel open: %v", err)
+	}
+	if allowed, _, err := fil.FilterClientPacket(Marshal(&channelOpenConfirmMsg{PeersId: 9, MyId: 1})); err != nil || !allowed {
+		t.Fatalf("confirm: allowed %v, err %v", allowed, err)
+	}
+	if allowed, _, err := fil.FilterClientPacket(Marshal(&windowAdjustMsg{PeersId: 9, AdditionalBytes: 10})); err != nil || !allowed {
+		t.Errorf("window adjust on confirmed channel: allowed %v, err %v", allowed, err)
+	}
+}
+
+func TestFilterConcurrentDirections(t *testing.T) {
+	fil, err := NewPolicyFilter(&Policy{
+		Channels: []ChannelRule{{Rule: Rule{Decision: Allow}, Type: "session"}},
+	}, nil)
+	if err != nil {
+		t.Fatalf("NewPolicyFilter: %v", err)
+	}
+	openSession(t, fil, 0, 0)
+
+	// The proxy filters each direction in its own goroutine, while
+	// channels are opened and closed from both sides.
+	const n = 1000
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := uint32(1); i <= n; i++ {
+			fil.FilterServerPacket(Marshal(&channelOpenMsg{ChanType: "forwarded-tcpip", PeersId: n + i}))
+			fil.FilterServerPacket(Marshal(&channelOpenConfirmMsg{PeersId: i, MyId: i}))
+			fil.FilterServerPacket(Marshal(&channelDataMsg{PeersId: 0, Length: 1, Rest: []byte("x")}))
+		}
+	}()
+	for i := uint32(1); i <= n; i++ {
+		fil.FilterClientPacket(Marshal(&channelOpenMsg{ChanType: "session", PeersId: i}))
+		fil.FilterClientPacket(Marshal(&channelOpenConfirmMsg{PeersId: n + i, MyId: n + i}))
+		fil.FilterClientPacket(Marshal(&channelDataMsg{PeersId: 0, Length: 1, Rest: []byte("x")}))
+		fil.FilterClientPacket(Marshal(&channelCloseMsg{PeersId: i}))
+	}
+	<-done
+}
+
+func TestFilterPromisedCommand(t *testing.T) {
+	if got := NewFilter("uptime", nil).promisedCommand(); got != "uptime" {
+		t.Errorf("got %q, want the filter's only command", got)
+	}
+	fil, err := NewPolicyFilter(&Policy{
+		Commands: []CommandRule{{Rule: Rule{Decision: Allow}, Match: MatchGlob, Pattern: "git *"}},
+	}, nil)
+	if err != nil {
+		t.Fatalf("NewPolicyFilter: %v", err)
+	}
+	if got := fil.promisedCommand(); got != "" {
+		t.Errorf("got %q for a glob rule, want none", got)
+	}
+}
@@ -5,13 +5,16 @@
 package ssh
 
 import (
+	"bytes"
 	"crypto/rand"
 	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net"
+	"strings"
 	"sync"
+	"sync/atomic"
 )
 
 // debugHandshake, if set, prints messages sent and received.  Key
@@ -36,8 +39,18 @@ type keyingTransport interface {
 	prepareKeyChange(*algorithms, *kexResult) error
 
 	getSequenceNumbers() (outgoing uint32, incoming uint32)
+	getLastSequenceNumbers() (outgoing uint32, incoming uint32)
 	setOutgoingSequenceNumber(uint32)
+
+	// getIncomingSequenceNumbers returns the sequence numbers of the
+	// packet last read and of the next one. Unlike the methods above,
+	// it may be called while packets are written.
+	getIncomingSequenceNumbers() (last uint32, next uint32)
 	setIncomingSequenceNumber(uint32)
+
+	// setStrictKex sets whether msgNewKeys resets the sequence
+	// numbers.
+	setStrictKex(bool)
 }
 
 // handshakeTransport implements rekeying on top of a keyingTransport
@@ -54,14 +67,24 @@ type handshakeTransport struct {
 	// connection.
 	hostKeys []Signer
 
+	// moduli supplies the groups for group exchange, if we are the
+	// server.
+	moduli ModuliSource
+
 	// hostKeyAlgorithms is non-empty if we are the client. In that case,
 	// we accept these key types from the server as host key.
 	hostKeyAlgorithms []string
 
 	// On read error, incoming is closed, and readError is set.
-	incoming           chan []byte
-	lastIncomingSeqNum uint32
-	readError          error
+	incoming  chan incomingPacket
+	readError error
+
+	// readSeqNum is the sequence number of the packet last returned
+	// by readPacket, and nextReadSeqNum that of the packet following
+	// it. They are accessed atomically, since proxy stats read them
+	// from any goroutine.
+	readSeqNum     uint32
+	nextReadSeqNum uint32
 
 	mu             sync.Mutex
 	writeError     error
@@ -81,18 +104,28 @@ type handshakeTransport struct {
 	stopOutKex chan chan<- struct{}
 	stopInKex  chan struct{}
 
+	// responsibleForKex is cleared by the read loop when key exchanges
+	// stop being handled. Other goroutines read it under mu.
 	responsibleForKex bool
 	kexCallback       KexCallback
 
 	// data for host key checking
-	hostKeyCallback          HostKeyCallback
-	dialAddress              string
-	remoteAddr               net.Addr
-	deferHostKeyVerification bool
+	hostKeyCallback HostKeyCallback
+	dialAddress     string
+	remoteAddr      net.Addr
+
+	// deferHostKeyVerification is non-zero while the client waits for
+	// a proxy to prove the server's host key. It is accessed
+	// atomically, since RequestKeyChange clears it.
+	deferHostKeyVerification int32
 
 	// Algorithms agreed in the last key exchange.
 	algorithms *algorithms
 
+	// negotiated holds the algorithms of the last completed key
+	// exchange, protected by mu.
+	negotiated *algorithms
+
 	readPacketsLeft uint32
 	readBytesLeft   int64
 
@@ -102,7 +135,40 @@ type handshakeTransport struct {
 	// The session ID or nil if first kex did not complete yet.
 	sessionID []byte
 
+	// hostKey is the server's host key as verified in the last key
+	// exchange, if we are the client.
+	hostKey PublicKey
+
+	// firstKex holds the result of the first key exchange, if we
+	// are the client. A proxy proves the server's host key to its
+	// client with the signature it contains.
+	firstKex *kexResult
+
+	// provenHostKey and provenSessionID are the server's host key
+	// and session ID proven by a proxy, if we deferred host key
+	// verification.
+	provenHostKey   PublicKey
+	provenSessionID []byte
+
 	pendingSeqNumDelta uint32
+
+	// sessionParamsVersion is the version of the session parameters
+	// extension negotiated with the client in the first key
+	// exchange, if we are the server, or 0 if the client does not
+	// support it.
+	sessionParamsVersion uint32
+
+	// strictKex is set if strict key exchange was negotiated in the
+	// first key exchange, or, after a handoff, by the server.
+	strictKex bool
+}
+
+// incomingPacket is a packet read by readLoop, with the sequence number
+// it was received with and that of the following packet.
+type incomingPacket struct {
+	packet     []byte
+	seqNum     uint32
+	nextSeqNum uint32
 }
 
 type pendingKex struct {
@@ -112,18 +178,17 @@ type pendingKex struct {
 
 func newHandshakeTransport(conn keyingTransport, config *Config, clientVersion, serverVersion []byte) *handshakeTransport {
 	t := &handshakeTransport{
-		conn:               conn,
-		serverVersion:      serverVersion,
-		clientVersion:      clientVersion,
-		incoming:           make(chan []byte, chanSize),
-		requestKex:         make(chan struct{}, 1),
-		startKex:           make(chan *pendingKex, 1),
-		stopOutKex:         make(chan chan<- struct{}, 1),
-		stopInKex:          make(chan struct{}, 1),
-		config:             config,
-		lastIncomingSeqNum: 0,
-		responsibleForKex:  true,
-		kexCallback:        config.KexCallback,
+		conn:              conn,
+		serverVersion:     serverVersion,
+		clientVersion:     clientVersion,
+		incoming:          make(chan incomingPacket, chanSize),
+		requestKex:        make(chan struct{}, 1),
+		startKex:          make(chan *pendingKex, 1),
+		stopOutKex:        make(chan chan<- struct{}, 1),
+		stopInKex:         make(chan struct{}, 1),
+		config:            config,
+		responsibleForKex: true,
+		kexCallback:       config.KexCallback,
 	}
 	t.resetReadThresholds()
 	t.resetWriteThresholds()
@@ -138,7 +203,9 @@ func newClientTransport(conn keyingTransport, clientVersion, serverVersion []byt
 	t.dialAddress = dialAddr
 	t.remoteAddr = addr
 	t.hostKeyCallback = config.HostKeyCallback
-	t.deferHostKeyVerification = config.DeferHostKeyVerification
+	if config.DeferHostKeyVerification {
+		t.deferHostKeyVerification = 1
+	}
 	if config.HostKeyAlgorithms != nil {
 		t.hostKeyAlgorithms = config.HostKeyAlgorithms
 	} else {
@@ -152,6 +219,7 @@ func newClientTransport(conn keyingTransport, clientVersion, serverVersion []byt
 func newServerTransport(conn keyingTransport, clientVersion, serverVersion []byte, config *ServerConfig) *handshakeTransport {
 	t := newHandshakeTransport(conn, &config.Config, clientVersion, serverVersion)
 	t.hostKeys = config.hostKeys
+	t.moduli = config.Moduli
 	go t.readLoop()
 	go t.kexLoop()
 	return t
@@ -163,28 +231,141 @@ func (t *handshakeTransport) getSessionID() []byte {
 
 const updateSessionParamsReqId = "updateSessionParams@cs.stanford.edu"
 const confirmSessionParamsReqId = "confirmSessionParams@cs.stanford.edu"
+const hostKeyProofReqId = "hostKeyProof@cs.stanford.edu"
+
+// sessionParamsVersion is the version of the session parameters
+// extension implemented here. A client that can be handed off
+// advertises the versions it supports as key exchange pseudo-algorithms
+// named by sessionParamsAlgo, and the proxy uses the highest version
+// both support. Version 2 tells the client whether the server
+// negotiated strict key exchange.
+const sessionParamsVersion = 2
+
+// sessionParamsAlgo returns the key exchange pseudo-algorithm that
+// advertises version v of the session parameters extension.
+func sessionParamsAlgo(v uint32) string {
+	return fmt.Sprintf("session-params-v%d@cs.stanford.edu", v)
+}
+
+// negotiateSessionParams returns the highest version of the session
+// parameters extension advertised in kexAlgos that is supported here,
+// or 0 if there is none.
+func negotiateSessionParams(kexAlgos []string) uint32 {
+	for v := uint32(sessionParamsVersion); v > 0; v-- {
+		for _, algo := range kexAlgos {
+			if algo == sessionParamsAlgo(v) {
+				return v
+			}
+		}
+	}
+	return 0
+}
+
+// hostKeyProof relays the server's host key and its signature over
+// the session ID of the proxy's connection to the server. Since the
+// session ID enters the keys derived at handoff, the client verifies
+// the key of the server it will end up talking to.
+type hostKeyProof struct {
+	HostKey   []byte
+	Signature []byte
+	SessionID []byte
+}
+
+// sendHostKeyProof sends a client deferring host key verification the
+// proof of the host key from result, the first key exchange with the
+// server.
+func (t *handshakeTransport) sendHostKeyProof(result *kexResult) error {
+	return t.writePacket(Marshal(globalRequestMsg{
+		Type: hostKeyProofReqId,
+		Data: Marshal(hostKeyProof{
+			HostKey:   result.HostKey,
+			Signature: result.Signature,
+			SessionID: result.H,
+		}),
+	}))
+}
+
+// verifyHostKeyProof checks the signature in a proof sent by a proxy,
+// and the host key against the host key callback.
+func (t *handshakeTransport) verifyHostKeyProof(data []byte) error {
+	if !t.deferringHostKeyVerification() || t.provenHostKey != nil {
+		return errors.New("ssh: unexpected host key proof")
+	}
+	var proof hostKeyProof
+	if err := Unmarshal(data, &proof); err != nil {
+		return err
+	}
+	hostKey, err := ParsePublicKey(proof.HostKey)
+	if err != nil {
+		return err
+	}
+	// The proof does not name the host key algorithm the proxy
+	// negotiated, so accept any this client would have.
+	result := &kexResult{H: proof.SessionID, Signature: proof.Signature}
+	err = errors.New("ssh: host key proof uses no acceptable algorithm")
+	for _, algo := range t.hostKeyAlgorithms {
+		if contains(algorithmsForKeyFormat(hostKey.Type()), algo) {
+			if err = verifyHostKeySignature(hostKey, algo, result); err == nil {
+				break
+			}
+		}
+	}
+	if err != nil {
+		return err
+	}
+	if err := t.hostKeyCallback(t.dialAddress, t.remoteAddr, hostKey); err != nil {
+		return err
+	}
+	t.provenHostKey = hostKey
+	t.provenSessionID = proof.SessionID
+	return nil
+}
 
 type updateSessionParams struct {
+	Version   uint32
 	DeltaC2S  uint32
 	DeltaS2C  uint32
 	SessionID []byte
+
+	// Rest holds the fields of later versions, sessionParamsV2 from
+	// version 2 on.
+	Rest []byte `ssh:"rest"`
+}
+
+type sessionParamsV2 struct {
+	// StrictKex is set if the server negotiated strict key exchange
+	// with the proxy. The client follows it from the key exchange
+	// that completes the handoff.
+	StrictKex bool
 }
 
-func (t *handshakeTransport) updateSessionParams(sessionID []byte, outSeqNum uint32, inSeqNum uint32) error {
+// updateSessionParams tells the client to continue with sessionID and
+// the sequence numbers of the server connection, and from version 2
+// on with its strict key exchange mode. The next packet written carries
+// sequence number outSeqNum, and deltaIn is added to incoming sequence
+// numbers once the client confirms.
+func (t *handshakeTransport) updateSessionParams(sessionID []byte, outSeqNum uint32, deltaIn uint32, strictKex bool) error {
+	var rest []byte
+	if t.sessionParamsVersion >= 2 {
+		rest = Marshal(sessionParamsV2{StrictKex: strictKex})
+	}
+
 	t.sessionID = sessionID
 
-	oldOut, oldIn := t.getSequenceNumbers()
+	_, oldOut := t.getOutgoingSequenceNumbers()
 
-	t.pendingSeqNumDelta = inSeqNum - oldIn
+	t.pendingSeqNumDelta = deltaIn
 
 	err := t.pushPacket(
 		Marshal(globalRequestMsg{
 			Type:      updateSessionParamsReqId,
 			WantReply: false, // Don't use the standard request confirmation mechanism
 			Data: Marshal(updateSessionParams{
+				Version:   t.sessionParamsVersion,
 				DeltaC2S:  t.pendingSeqNumDelta,
 				DeltaS2C:  outSeqNum - oldOut - 1, // Off by one because of the update packet itself
 				SessionID: sessionID,
+				Rest:      rest,
 			}),
 		}))
 
@@ -196,12 +377,17 @@ func (t *handshakeTransport) updateSessionParams(sessionID []byte, outSeqNum uin
 	return nil
 }
 
-func (t *handshakeTransport) handleSessionParamsUpdates(sessionID []byte, deltaOut uint32, deltaIn uint32) error {
+func (t *handshakeTransport) handleSessionParamsUpdates(sessionID []byte, deltaOut uint32, deltaIn uint32, strictKex bool) error {
 	t.sessionID = sessionID
 
 	t.mu.Lock()
 	defer t.mu.Unlock()
 
+	// The next msgNewKeys in either direction belongs to the key
+	// exchange with the server.
+	t.strictKex = strictKex
+	t.conn.setStrictKex(strictKex)
+
 	err := t.pushPacket(
 		Marshal(globalRequestMsg{
 			Type:      confirmSessionParamsReqId,
@@ -219,9 +405,28 @@ func (t *handshakeTransport) handleSessionParamsUpdates(sessionID []byte, deltaO
 	return nil
 }
 
+// getSequenceNumbers returns the sequence number of the next packet
+// written, and of the packet following the one last returned by
+// readPacket.
 func (t *handshakeTransport) getSequenceNumbers() (out uint32, in uint32) {
 	out, _ = t.conn.getSequenceNumbers()
-	return out, t.lastIncomingSeqNum - uint32(len(t.incoming))
+	return out, atomic.LoadUint32(&t.nextReadSeqNum)
+}
+
+// getOutgoingSequenceNumbers returns the sequence numbers of the packet
+// last written and of the next one. Unlike the other getters, it may be
+// called while another goroutine reads packets.
+func (t *handshakeTransport) getOutgoingSequenceNumbers() (last uint32, next uint32) {
+	last, _ = t.conn.getLastSequenceNumbers()
+	next, _ = t.conn.getSequenceNumbers()
+	return last, next
+}
+
+// getLastSequenceNumbers returns the sequence number of the packet last
+// written, and of the packet last returned by readPacket.
+func (t *handshakeTransport) getLastSequenceNumbers() (out uint32, in uint32) {
+	out, _ = t.conn.getLastSequenceNumbers()
+	return out, atomic.LoadUint32(&t.readSeqNum)
 }
 
 // waitSession waits for the session to be established. This should be
@@ -264,7 +469,9 @@ func (t *handshakeTransport) readPacket() ([]byte, error) {
 	if !ok {
 		return nil, t.readError
 	}
-	return p, nil
+	atomic.StoreUint32(&t.readSeqNum, p.seqNum)
+	atomic.StoreUint32(&t.nextReadSeqNum, p.nextSeqNum)
+	return p.packet, nil
 }
 
 func (t *handshakeTransport) readLoop() {
@@ -280,12 +487,14 @@ func (t *handshakeTransport) readLoop() {
 		if t.responsibleForKex && len(p) >= 0 && (p[0] == msgDebug || p[0] == msgIgnore) {
 			continue
 		}
-		t.incoming <- p
-		_, in := t.conn.getSequenceNumbers()
-		t.lastIncomingSeqNum = in
+		// The reader of t.incoming may reuse the packet, so look at
+		// it before sending it.
+		newKeys := p[0] == msgNewKeys
+		last, next := t.conn.getIncomingSequenceNumbers()
+		t.incoming <- incomingPacket{p, last, next}
 		// If not responsible for KEX, then new keys terminates this connection
 		// (since the new keys will no longer be recognized).
-		if p[0] == msgNewKeys && !t.responsibleForKex {
+		if newKeys && !t.responsibleForKex {
 			break
 		}
 	}
@@ -322,9 +531,17 @@ func (t *handshakeTransport) recordWriteError(err error) {
 	}
 }
 
+// deferringHostKeyVerification reports whether the client waits for a
+// proxy to prove the server's host key.
+func (t *handshakeTransport) deferringHostKeyVerification() bool {
+	return atomic.LoadInt32(&t.deferHostKeyVerification) != 0
+}
+
 func (t *handshakeTransport) requestKeyExchange() {
-	log.Printf("requestKeyExchange, t.deferHostKeyVerification: %b", t.deferHostKeyVerification)
-	if t.deferHostKeyVerification {
+	if debugHandshake {
+		log.Printf("requestKeyExchange, t.deferHostKeyVerification: %v", t.deferringHostKeyVerification())
+	}
+	if t.deferringHostKeyVerification() {
 		// Don't initiate kex when in deferred mode
 		return
 	}
@@ -352,25 +569,37 @@ func (t *handshakeTransport) kexLoop() {
 
 write:
 	for t.getWriteError() == nil {
-		log.Printf("kex loop")
+		if debugHandshake {
+			log.Printf("kex loop")
+		}
 		var request *pendingKex
 		var sent bool
 
 		for request == nil || !sent {
-			log.Printf("kex inner loop")
+			if debugHandshake {
+				log.Printf("kex inner loop")
+			}
 			var ok bool
 			select {
 			case request, ok = <-t.startKex:
 				if !ok {
-					log.Printf("select exit: <-t.startKex NOT OK")
+					if debugHandshake {
+						log.Printf("select exit: <-t.startKex NOT OK")
+					}
 					break write
 				}
-				log.Printf("select exit: <-t.startKex")
+				if debugHandshake {
+					log.Printf("select exit: <-t.startKex")
+				}
 			case <-requestKex:
-				log.Printf("select exit: <-requestKex")
+				if debugHandshake {
+					log.Printf("select exit: <-requestKex")
+				}
 				break
 			case onStop = <-t.stopOutKex:
-				log.Printf("select exit: <-t.stopOutKex")
+				if debugHandshake {
+					log.Printf("select exit: <-t.stopOutKex")
+				}
 				// Don't listen on new requests for outgoing kex,
 				// so no new outoing kex will be initiated
 				requestKex = nil
@@ -378,7 +607,7 @@ write:
 				if !sent {
 					// If not awaiting a reply to an outgoing kex,
 					// stop incoming kex messages as well.
-					t.stopInKex <- struct{}{}
+					t.stopIncomingKex()
 				}
 				// Continue in case there are existing messages in startKex
 				continue
@@ -386,11 +615,13 @@ write:
 			// If kex is being cancelled, then stop incoming messages after
 			// this one.
 			if requestKex == nil {
-				t.stopInKex <- struct{}{}
+				t.stopIncomingKex()
 			}
 
 			if !sent {
-				log.Printf("!sent: sending kexInit")
+				if debugHandshake {
+					log.Printf("!sent: sending kexInit")
+				}
 				if err := t.sendKexInit(); err != nil {
 					t.recordWriteError(err)
 					break
@@ -413,12 +644,17 @@ write:
 		// has just sent us a kexInitMsg, so it can't send
 		// another key change request, until we close the done
 		// channel on the pendingKex request.
-		log.Printf("entering keyexchange")
+		if debugHandshake {
+			log.Printf("entering keyexchange")
+		}
 
 		err := t.enterKeyExchange(request.otherInit)
 
 		t.mu.Lock()
 		t.writeError = err
+		if err == nil {
+			t.negotiated = t.algorithms
+		}
 		t.sentInitPacket = nil
 		t.sentInitMsg = nil
 
@@ -512,7 +748,9 @@ func (t *handshakeTransport) readOnePacket(first bool) ([]byte, error) {
 		select {
 		case <-t.stopInKex:
 			close(t.startKex)
+			t.mu.Lock()
 			t.responsibleForKex = false
+			t.mu.Unlock()
 		case err := <-errCh:
 			return nil, err
 		case p = <-packetCh:
@@ -536,6 +774,10 @@ func (t *handshakeTransport) readOnePacket(first bool) ([]byte, error) {
 		t.printPacket(p, false)
 	}
 
+	if first && p[0] != msgKexInit {
+		return nil, fmt.Errorf("ssh: first packet should be msgKexInit")
+	}
+
 	if p[0] == msgGlobalRequest {
 		var msg globalRequestMsg
 		if err := Unmarshal(p, &msg); err != nil {
@@ -550,19 +792,37 @@ func (t *handshakeTransport) readOnePacket(first bool) ([]byte, error) {
 		case updateSessionParamsReqId:
 			reqData := new(updateSessionParams)
 			if err := Unmarshal(msg.Data, reqData); err != nil {
-				log.Printf("Failed to unmarshal updateSessionParams %s", err)
+				if debugHandshake {
+					log.Printf("Failed to unmarshal updateSessionParams %s", err)
+				}
+				return nil, err
+			}
+			if reqData.Version == 0 || reqData.Version > sessionParamsVersion {
+				return nil, fmt.Errorf("ssh: unsupported session parameters version %d", reqData.Version)
+			}
+			if t.provenSessionID == nil || !bytes.Equal(reqData.SessionID, t.provenSessionID) {
+				return nil, errors.New("ssh: session parameters update for a session with an unverified host key")
+			}
+			// With version 1, the proxy only hands off if the
+			// server's mode matches ours.
+			v2 := sessionParamsV2{StrictKex: t.strictKex}
+			if reqData.Version >= 2 {
+				if err := Unmarshal(reqData.Rest, &v2); err != nil {
+					return nil, err
+				}
+			}
+			t.handleSessionParamsUpdates(reqData.SessionID, reqData.DeltaC2S, reqData.DeltaS2C, v2.StrictKex)
+			successPacket := []byte{msgIgnore}
+			return successPacket, nil
+		case hostKeyProofReqId:
+			if err := t.verifyHostKeyProof(msg.Data); err != nil {
 				return nil, err
 			}
-			t.handleSessionParamsUpdates(reqData.SessionID, reqData.DeltaC2S, reqData.DeltaS2C)
 			successPacket := []byte{msgIgnore}
 			return successPacket, nil
 		}
 	}
 
-	if first && p[0] != msgKexInit {
-		return nil, fmt.Errorf("ssh: first packet should be msgKexInit")
-	}
-
 	if p[0] != msgKexInit || !t.responsibleForKex {
 		return p, nil
 	}
@@ -617,17 +877,44 @@ func (t *handshakeTransport) sendKexInit() error {
 		CiphersServerClient:     t.config.Ciphers,
 		MACsClientServer:        t.config.MACs,
 		MACsServerClient:        t.config.MACs,
-		CompressionClientServer: supportedCompressions,
-		CompressionServerClient: supportedCompressions,
+		CompressionClientServer: t.config.Compressions,
+		CompressionServerClient: t.config.Compressions,
 	}
 	io.ReadFull(rand.Reader, msg.Cookie[:])
 
-	if t.deferHostKeyVerification {
+	if t.sessionID == nil {
+		// Offer strict key exchange and, as a client, ask for the
+		// server's extensions. The pseudo-algorithms are only
+		// meaningful in the first key exchange.
+		msg.KexAlgos = make([]string, 0, len(t.config.KeyExchanges)+2+sessionParamsVersion)
+		msg.KexAlgos = append(msg.KexAlgos, t.config.KeyExchanges...)
+		if len(t.hostKeys) == 0 {
+			msg.KexAlgos = append(msg.KexAlgos, extInfoClient, kexStrictClient)
+		} else {
+			msg.KexAlgos = append(msg.KexAlgos, kexStrictServer)
+		}
+	}
+
+	if t.deferringHostKeyVerification() {
 		msg.ServerHostKeyAlgos = []string{KeyAlgoNone}
+
+		// Deferring verification means waiting for a handoff, so
+		// advertise the extension that makes it possible.
+		for v := uint32(sessionParamsVersion); v > 0; v-- {
+			msg.KexAlgos = append(msg.KexAlgos, sessionParamsAlgo(v))
+		}
+	} else if t.provenHostKey != nil {
+		// Only the host key proven by the proxy is acceptable at
+		// handoff.
+		for _, algo := range algorithmsForKeyFormat(t.provenHostKey.Type()) {
+			if contains(t.hostKeyAlgorithms, algo) {
+				msg.ServerHostKeyAlgos = append(msg.ServerHostKeyAlgos, algo)
+			}
+		}
 	} else if len(t.hostKeys) > 0 {
 		for _, k := range t.hostKeys {
 			msg.ServerHostKeyAlgos = append(
-				msg.ServerHostKeyAlgos, k.PublicKey().Type())
+				msg.ServerHostKeyAlgos, signerAlgorithms(k)...)
 		}
 	} else {
 		msg.ServerHostKeyAlgos = t.hostKeyAlgorithms
@@ -649,6 +936,8 @@ func (t *handshakeTransport) sendKexInit() error {
 }
 
 func (t *handshakeTransport) writePacket(p []byte) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
 	if t.responsibleForKex {
 		switch p[0] {
 		case msgKexInit:
@@ -658,8 +947,6 @@ func (t *handshakeTransport) writePacket(p []byte) error {
 		}
 	}
 
-	t.mu.Lock()
-	defer t.mu.Unlock()
 	if t.writeError != nil {
 		return t.writeError
 	}
@@ -695,6 +982,31 @@ func (t *handshakeTransport) Close() error {
 	return t.conn.Close()
 }
 
+// kexPacketConn skips SSH_MSG_IGNORE and SSH_MSG_DEBUG, which RFC 4253
+// allows at any time, including during a key exchange. A proxy sends
+// msgIgnore in place of packets it does not forward, so these do occur
+// in a handed-off key exchange.
+type kexPacketConn struct {
+	keyingTransport
+
+	// strict rejects the skipped messages instead. Strict key
+	// exchange forbids them in the first key exchange, where they
+	// could shift the sequence numbers, as in the Terrapin attack.
+	strict bool
+}
+
+func (c kexPacketConn) readPacket() ([]byte, error) {
+	for {
+		p, err := c.keyingTransport.readPacket()
+		if err != nil || (p[0] != msgIgnore && p[0] != msgDebug) {
+			return p, err
+		}
+		if c.strict {
+			return nil, fmt.Errorf("ssh: unexpected message type %d during strict key exchange", p[0])
+		}
+	}
+}
+
 func (t *handshakeTransport) enterKeyExchange(otherInitPacket []byte) error {
 	if debugHandshake {
 		log.Printf("%s entered key exchange", t.id())
@@ -726,6 +1038,15 @@ func (t *handshakeTransport) enterKeyExchange(otherInitPacket []byte) error {
 	if err != nil {
 		return err
 	}
+	firstKex := t.sessionID == nil
+	if firstKex && len(t.hostKeys) > 0 {
+		t.sessionParamsVersion = negotiateSessionParams(clientInit.KexAlgos)
+	}
+	if firstKex && contains(clientInit.KexAlgos, kexStrictClient) && contains(serverInit.KexAlgos, kexStrictServer) {
+		t.strictKex = true
+		t.conn.setStrictKex(true)
+	}
+	kexConn := kexPacketConn{keyingTransport: t.conn, strict: firstKex && t.strictKex}
 
 	// We don't send FirstKexFollows, but we handle receiving it.
 	//
@@ -740,7 +1061,7 @@ func (t *handshakeTransport) enterKeyExchange(otherInitPacket []byte) error {
 	if otherInit.FirstKexFollows && (clientInit.KexAlgos[0] != serverInit.KexAlgos[0] || clientInit.ServerHostKeyAlgos[0] != serverInit.ServerHostKeyAlgos[0]) {
 		// other side sent a kex message for the wrong algorithm,
 		// which we have to ignore.
-		if _, err := t.conn.readPacket(); err != nil {
+		if _, err := kexConn.readPacket(); err != nil {
 			return err
 		}
 	}
@@ -749,52 +1070,88 @@ func (t *handshakeTransport) enterKeyExchange(otherInitPacket []byte) error {
 	if !ok {
 		return fmt.Errorf("ssh: unexpected key exchange algorithm %v", t.algorithms.kex)
 	}
+	if gex, ok := kex.(*dhGroupExchange); ok && t.moduli != nil {
+		kex = &dhGroupExchange{hashFunc: gex.hashFunc, moduli: t.moduli}
+	}
 
 	var result *kexResult
 	if len(t.hostKeys) > 0 {
-		result, err = t.server(kex, t.algorithms, &magics)
+		result, err = t.server(kexConn, kex, t.algorithms, &magics)
 	} else {
-		result, err = t.client(kex, t.algorithms, &magics)
+		result, err = t.client(kexConn, kex, t.algorithms, &magics)
 	}
 
 	if err != nil {
 		return err
 	}
 
-	if t.sessionID == nil {
+	if firstKex {
 		t.sessionID = result.H
+		if len(t.hostKeys) == 0 {
+			t.firstKex = result
+		}
 	}
 	result.SessionID = t.sessionID
 
+	if t.config.KeyLogWriter != nil {
+		if err := writeKeyLog(t.config.KeyLogWriter, len(t.hostKeys) == 0, t.algorithms, result, t.strictKex); err != nil {
+			return err
+		}
+	}
 	if err := t.conn.prepareKeyChange(t.algorithms, result); err != nil {
 		return err
 	}
 	if err = t.conn.writePacket([]byte{msgNewKeys}); err != nil {
 		return err
 	}
-	if packet, err := t.conn.readPacket(); err != nil {
+	if packet, err := kexConn.readPacket(); err != nil {
 		return err
 	} else if packet[0] != msgNewKeys {
 		return unexpectedMessageError(msgNewKeys, packet[0])
 	}
 
+	// Announce our extensions right after the first msgNewKeys, to
+	// clients that ask for them. See RFC 8308, section 2.4.
+	if firstKex && len(t.hostKeys) > 0 && contains(clientInit.KexAlgos, extInfoClient) {
+		extensions := map[string][]byte{
+			extServerSigAlgs: []byte(strings.Join(serverSigAlgs, ",")),
+		}
+		if err := t.pushPacket(marshalExtInfo(extensions)); err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
-func (t *handshakeTransport) server(kex kexAlgorithm, algs *algorithms, magics *handshakeMagics) (*kexResult, error) {
+func (t *handshakeTransport) server(conn packetConn, kex kexAlgorithm, algs *algorithms, magics *handshakeMagics) (*kexResult, error) {
 	var hostKey Signer
 	for _, k := range t.hostKeys {
-		if algs.hostKey == k.PublicKey().Type() {
+		if contains(signerAlgorithms(k), algs.hostKey) {
 			hostKey = k
 		}
 	}
+	if algs.hostKey != hostKey.PublicKey().Type() {
+		hostKey = &algorithmSignerWrapper{hostKey.(AlgorithmSigner), underlyingAlgo(algs.hostKey)}
+	}
 
-	r, err := kex.Server(t.conn, t.config.Rand, magics, hostKey)
+	r, err := kex.Server(conn, t.config.Rand, magics, hostKey)
 	return r, err
 }
 
-func (t *handshakeTransport) client(kex kexAlgorithm, algs *algorithms, magics *handshakeMagics) (*kexResult, error) {
-	result, err := kex.Client(t.conn, t.config.Rand, magics)
+// algorithmSignerWrapper is a Signer that signs with a fixed algorithm,
+// such as the negotiated host key algorithm.
+type algorithmSignerWrapper struct {
+	AlgorithmSigner
+	algorithm string
+}
+
+func (s *algorithmSignerWrapper) Sign(rand io.Reader, data []byte) (*Signature, error) {
+	return s.SignWithAlgorithm(rand, data, s.algorithm)
+}
+
+func (t *handshakeTransport) client(conn packetConn, kex kexAlgorithm, algs *algorithms, magics *handshakeMagics) (*kexResult, error) {
+	result, err := kex.Client(conn, t.config.Rand, magics)
 	if err != nil {
 		return nil, err
 	}
@@ -804,22 +1161,54 @@ func (t *handshakeTransport) client(kex kexAlgorithm, algs *algorithms, magics *
 		return nil, err
 	}
 
-	if err := verifyHostKeySignature(hostKey, result); err != nil {
+	if err := verifyHostKeySignature(hostKey, algs.hostKey, result); err != nil {
 		return nil, err
 	}
 
+	if t.deferringHostKeyVerification() {
+		// The proxy has no host key of its own. The server's key is
+		// checked once the proxy proves it.
+		return result, nil
+	}
+	if t.provenHostKey != nil && !bytes.Equal(hostKey.Marshal(), t.provenHostKey.Marshal()) {
+		return nil, errors.New("ssh: host key differs from the one proven by the proxy")
+	}
 	err = t.hostKeyCallback(t.dialAddress, t.remoteAddr, hostKey)
 	if err != nil {
 		return nil, err
 	}
+	t.hostKey = hostKey
 
 	return result, nil
 }
 
+// stopIncomingKex asks readOnePacket to stop handling incoming key
+// exchanges. A request that is still pending suffices, and sending
+// another could block the kex loop while the reader waits for it to
+// complete a key exchange.
+func (t *handshakeTransport) stopIncomingKex() {
+	select {
+	case t.stopInKex <- struct{}{}:
+	default:
+	}
+}
+
 func (t *handshakeTransport) stopKexHandling(stopped chan<- struct{}) {
 	t.stopOutKex <- stopped
 }
 
+// negotiatedAlgorithms returns the algorithms of the last completed key
+// exchange, or nil.
+func (t *handshakeTransport) negotiatedAlgorithms() *algorithms {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.negotiated
+}
+
 func (t *handshakeTransport) buffered() int {
 	return t.conn.buffered()
 }
+
+func (t *handshakeTransport) bufferedBytes() []byte {
+	return t.conn.bufferedBytes()
+}
@@ -5,11 +5,14 @@
 package ssh
 
 import (
+	"bufio"
 	"bytes"
 	"crypto/rand"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net"
 	"reflect"
 	"runtime"
@@ -214,6 +217,54 @@ func TestHandshakeBasic(t *testing.T) {
 	}
 }
 
+func TestHandshakeRSAHostKeyAlgorithms(t *testing.T) {
+	for _, algo := range []string{KeyAlgoRSASHA512, KeyAlgoRSASHA256, KeyAlgoRSA} {
+		clientConf := &ClientConfig{
+			HostKeyCallback:   InsecureIgnoreHostKey(),
+			HostKeyAlgorithms: []string{algo},
+		}
+		trC, trS, err := handshakePair(clientConf, "addr", false)
+		if err != nil {
+			t.Fatalf("handshakePair(%s): %v", algo, err)
+		}
+		if got := trC.negotiatedAlgorithms().hostKey; got != algo {
+			t.Errorf("negotiated host key algorithm %s, want %s", got, algo)
+		}
+		trC.Close()
+		trS.Close()
+	}
+
+	// By default, SHA-2 signatures are preferred.
+	trC, trS, err := handshakePair(&ClientConfig{HostKeyCallback: InsecureIgnoreHostKey()}, "addr", false)
+	if err != nil {
+		t.Fatalf("handshakePair: %v", err)
+	}
+	defer trC.Close()
+	defer trS.Close()
+	if got := trC.negotiatedAlgorithms().hostKey; got != KeyAlgoECDSA256 {
+		t.Errorf("negotiated host key algorithm %s, want %s", got, KeyAlgoECDSA256)
+	}
+}
+
+func TestVerifyHostKeySignatureAlgorithm(t *testing.T) {
+	data := []byte("exchange hash")
+	sig, err := testSigners["rsa"].Sign(rand.Reader, data)
+	if err != nil {
+		t.Fatalf("Sign: %v", err)
+	}
+	result := &kexResult{H: data, Signature: Marshal(sig)}
+	if err := verifyHostKeySignature(testPublicKeys["rsa"], KeyAlgoRSA, result); err != nil {
+		t.Errorf("verifyHostKeySignature: %v", err)
+	}
+	// A server must not downgrade the negotiated algorithm.
+	if err := verifyHostKeySignature(testPublicKeys["rsa"], KeyAlgoRSASHA512, result); err == nil {
+		t.Errorf("ssh-rsa signature accepted for %s", KeyAlgoRSASHA512)
+	}
+	if err := verifyHostKeySignature(testPublicKeys["ecdsa"], KeyAlgoRSA, result); err == nil {
+		t.Errorf("ECDSA host key accepted for %s", KeyAlgoRSA)
+	}
+}
+
 func TestForceFirstKex(t *testing.T) {
 	// like handshakePair, but must access the keyingTransport.
 	checker := &testChecker{}
@@ -377,9 +428,20 @@ func (t *errorKeyingTransport) getSequenceNumbers() (out uint32, in uint32) {
 	return 0, 0
 }
 
+func (t *errorKeyingTransport) getLastSequenceNumbers() (out uint32, in uint32) {
+	return 0, 0
+}
+
+func (t *errorKeyingTransport) getIncomingSequenceNumbers() (last uint32, next uint32) {
+	return 0, 0
+}
+
 func (t *errorKeyingTransport) setOutgoingSequenceNumber(seqNum uint32) {
 }
 
+func (t *errorKeyingTransport) setStrictKex(bool) {
+}
+
 func (t *errorKeyingTransport) setIncomingSequenceNumber(seqNum uint32) {
 }
 
@@ -567,3 +629,127 @@ func TestHandshakeRekeyDefault(t *testing.T) {
 		t.Errorf("got rekey after %dG write, want 64G", wgb)
 	}
 }
+
+func TestStrictKexNegotiated(t *testing.T) {
+	trC, trS, err := handshakePair(&ClientConfig{HostKeyCallback: InsecureIgnoreHostKey()}, "addr", false)
+	if err != nil {
+		t.Fatalf("handshakePair: %v", err)
+	}
+	defer trC.Close()
+	defer trS.Close()
+
+	if !trC.strictKex || !trS.strictKex {
+		t.Fatalf("got strict kex %v for client, %v for server, want both", trC.strictKex, trS.strictKex)
+	}
+
+	// The client sent msgKexInit, msgKexECDHInit and msgNewKeys,
+	// after which its sequence number starts over.
+	if out, _ := trC.getSequenceNumbers(); out != 0 {
+		t.Errorf("got client sequence number %d after msgNewKeys, want 0", out)
+	}
+	if err := trC.writePacket([]byte{msgRequestSuccess, 0, 0}); err != nil {
+		t.Fatalf("writePacket: %v", err)
+	}
+	if _, err := trS.readPacket(); err != nil {
+		t.Fatalf("readPacket: %v", err)
+	}
+	if _, in := trS.getLastSequenceNumbers(); in != 0 {
+		t.Errorf("server read packet with sequence number %d, want 0", in)
+	}
+}
+
+// terrapinConn carries packets from r to w like a man in the middle
+// mounting the Terrapin attack (CVE-2023-48795): it inserts msgIgnore
+// right before msgNewKeys, and drops the first packet after it. This
+// keeps the sequence numbers of both sides in step, so without strict
+// key exchange the packet goes missing unnoticed.
+func terrapinConn(w io.Writer, r io.Reader) error {
+	br := bufio.NewReader(r)
+	for {
+		var length [4]byte
+		if _, err := io.ReadFull(br, length[:]); err != nil {
+			return err
+		}
+		packet := make([]byte, 4+binary.BigEndian.Uint32(length[:]))
+		copy(packet, length[:])
+		if _, err := io.ReadFull(br, packet[4:]); err != nil {
+			return err
+		}
+		if packet[5] == msgNewKeys {
+			ignore := []byte{0, 0, 0, 12, 6, msgIgnore, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}
+			if _, err := w.Write(ignore); err != nil {
+				return err
+			}
+		}
+		if _, err := w.Write(packet); err != nil {
+			return err
+		}
+		if packet[5] == msgNewKeys {
+			break
+		}
+	}
+
+	// The packet after msgNewKeys is encrypted, but its length is
+	// not with an encrypt-then-MAC algorithm.
+	var length [4]byte
+	if _, err := io.ReadFull(br, length[:]); err != nil {
+		return err
+	}
+	n := int64(binary.BigEndian.Uint32(length[:])) + 32
+	if _, err := io.CopyN(ioutil.Discard, br, n); err != nil {
+		return err
+	}
+	_, err := io.Copy(w, br)
+	return err
+}
+
+func TestStrictKexTerrapin(t *testing.T) {
+	for _, fromServer := range []bool{true, false} {
+		a, toClient, err := netPipe()
+		if err != nil {
+			t.Fatalf("netPipe: %v", err)
+		}
+		toServer, b, err := netPipe()
+		if err != nil {
+			t.Fatalf("netPipe: %v", err)
+		}
+		if fromServer {
+			go terrapinConn(toClient, toServer)
+			go io.Copy(toServer, toClient)
+		} else {
+			go io.Copy(toClient, toServer)
+			go terrapinConn(toServer, toClient)
+		}
+
+		config := Config{
+			Ciphers: []string{"aes128-ctr"},
+			MACs:    []string{"hmac-sha2-256-etm@openssh.com"},
+		}
+		clientConf := &ClientConfig{Config: config, HostKeyCallback: InsecureIgnoreHostKey()}
+		clientConf.SetDefaults()
+		serverConf := &ServerConfig{Config: config}
+		serverConf.AddHostKey(testSigners["ecdsa"])
+		serverConf.SetDefaults()
+
+		v := []byte("version")
+		client := newClientTransport(newTransport(a, rand.Reader, true), v, v, clientConf, "addr", a.RemoteAddr())
+		server := newServerTransport(newTransport(b, rand.Reader, false), v, v, serverConf)
+
+		victim, other := client, server
+		if !fromServer {
+			victim, other = server, client
+		}
+		otherErr := make(chan error, 1)
+		go func() { otherErr <- other.waitSession() }()
+
+		err = victim.waitSession()
+		if err == nil || !strings.Contains(err.Error(), "strict key exchange") {
+			t.Errorf("attack from server %v: got error %v, want strict key exchange violation", fromServer, err)
+		}
+
+		for _, c := range []net.Conn{a, b, toClient, toServer} {
+			c.Close()
+		}
+		<-otherErr
+	}
+}
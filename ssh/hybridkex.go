@@ -0,0 +1,207 @@
+package ssh
+
+import (
+	"crypto"
+	"crypto/subtle"
+	"errors"
+	"io"
+
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/internal/mlkem768"
+	"golang.org/x/crypto/internal/sntrup761"
+)
+
+// kem is the post-quantum key encapsulation method of a hybrid key
+// exchange.
+type kem interface {
+	// generateKey returns an encoded encapsulation key, and a
+	// function decapsulating the keys encapsulated to it.
+	generateKey(rand io.Reader) (ek []byte, decapsulate func(ciphertext []byte) ([]byte, error), err error)
+
+	// encapsulate returns a shared key and its encapsulation to ek.
+	encapsulate(rand io.Reader, ek []byte) (ciphertext, key []byte, err error)
+
+	encapsulationKeySize() int
+	ciphertextSize() int
+}
+
+type mlkem768KEM struct{}
+
+func (mlkem768KEM) generateKey(rand io.Reader) ([]byte, func([]byte) ([]byte, error), error) {
+	dk, err := mlkem768.GenerateKey(rand)
+	if err != nil {
+		return nil, nil, err
+	}
+	return dk.EncapsulationKey(), func(c []byte) ([]byte, error) { return mlkem768.Decapsulate(dk, c) }, nil
+}
+
+func (mlkem768KEM) encapsulate(rand io.Reader, ek []byte) ([]byte, []byte, error) {
+	return mlkem768.Encapsulate(rand, ek)
+}
+
+func (mlkem768KEM) encapsulationKeySize() int { return mlkem768.EncapsulationKeySize }
+func (mlkem768KEM) ciphertextSize() int       { return mlkem768.CiphertextSize }
+
+type sntrup761KEM struct{}
+
+func (sntrup761KEM) generateKey(rand io.Reader) ([]byte, func([]byte) ([]byte, error), error) {
+	dk, err := sntrup761.GenerateKey(rand)
+	if err != nil {
+		return nil, nil, err
+	}
+	return dk.EncapsulationKey(), func(c []byte) ([]byte, error) { return sntrup761.Decapsulate(dk, c) }, nil
+}
+
+func (sntrup761KEM) encapsulate(rand io.Reader, ek []byte) ([]byte, []byte, error) {
+	return sntrup761.Encapsulate(rand, ek)
+}
+
+func (sntrup761KEM) encapsulationKeySize() int { return sntrup761.EncapsulationKeySize }
+func (sntrup761KEM) ciphertextSize() int       { return sntrup761.CiphertextSize }
+
+// hybridKex implements the key exchanges combining a post-quantum KEM
+// with curve25519: mlkem768x25519-sha256, as described in
+// draft-ietf-sshm-mlkem-hybrid-kex, and sntrup761x25519-sha512, as
+// described in draft-josefsson-ntruprime-ssh. The client sends a KEM
+// encapsulation key and a curve25519 public value, and the server
+// replies with a ciphertext encapsulating a key to the former and its
+// own curve25519 public value. The shared secret is the hash of both
+// secrets, encoded as a string rather than as an mpint.
+type hybridKex struct {
+	kem      kem
+	hashFunc crypto.Hash
+}
+
+// secret returns the shared secret K as hashed into H.
+func (kex *hybridKex) secret(kemKey []byte, priv, peerPub *[32]byte) ([]byte, error) {
+	var secret [32]byte
+	curve25519.ScalarMult(&secret, priv, peerPub)
+	if subtle.ConstantTimeCompare(secret[:], curve25519Zeros[:]) == 1 {
+		return nil, errors.New("ssh: peer's curve25519 public value has wrong order")
+	}
+	h := kex.hashFunc.New()
+	h.Write(kemKey)
+	h.Write(secret[:])
+	k := h.Sum(nil)
+
+	K := make([]byte, stringLength(len(k)))
+	marshalString(K, k)
+	return K, nil
+}
+
+func (kex *hybridKex) Client(c packetConn, rand io.Reader, magics *handshakeMagics) (*kexResult, error) {
+	ek, decapsulate, err := kex.kem.generateKey(rand)
+	if err != nil {
+		return nil, err
+	}
+	var kp curve25519KeyPair
+	if err := kp.generate(rand); err != nil {
+		return nil, err
+	}
+	clientInit := append(ek, kp.pub[:]...)
+	if err := c.writePacket(Marshal(&kexECDHInitMsg{clientInit})); err != nil {
+		return nil, err
+	}
+
+	packet, err := c.readPacket()
+	if err != nil {
+		return nil, err
+	}
+	var reply kexECDHReplyMsg
+	if err = Unmarshal(packet, &reply); err != nil {
+		return nil, err
+	}
+	ctSize := kex.kem.ciphertextSize()
+	if len(reply.EphemeralPubKey) != ctSize+32 {
+		return nil, errors.New("ssh: peer's hybrid key exchange reply has wrong length")
+	}
+
+	kemKey, err := decapsulate(reply.EphemeralPubKey[:ctSize])
+	if err != nil {
+		return nil, err
+	}
+	var servPub [32]byte
+	copy(servPub[:], reply.EphemeralPubKey[ctSize:])
+	K, err := kex.secret(kemKey, &kp.priv, &servPub)
+	if err != nil {
+		return nil, err
+	}
+
+	h := kex.hashFunc.New()
+	magics.write(h)
+	writeString(h, reply.HostKey)
+	writeString(h, clientInit)
+	writeString(h, reply.EphemeralPubKey)
+	h.Write(K)
+
+	return &kexResult{
+		H:         h.Sum(nil),
+		K:         K,
+		HostKey:   reply.HostKey,
+		Signature: reply.Signature,
+		Hash:      kex.hashFunc,
+	}, nil
+}
+
+func (kex *hybridKex) Server(c packetConn, rand io.Reader, magics *handshakeMagics, priv Signer) (*kexResult, error) {
+	packet, err := c.readPacket()
+	if err != nil {
+		return nil, err
+	}
+	var kexInit kexECDHInitMsg
+	if err = Unmarshal(packet, &kexInit); err != nil {
+		return nil, err
+	}
+	ekSize := kex.kem.encapsulationKeySize()
+	if len(kexInit.ClientPubKey) != ekSize+32 {
+		return nil, errors.New("ssh: peer's hybrid key exchange init has wrong length")
+	}
+
+	var kp curve25519KeyPair
+	if err := kp.generate(rand); err != nil {
+		return nil, err
+	}
+	ciphertext, kemKey, err := kex.kem.encapsulate(rand, kexInit.ClientPubKey[:ekSize])
+	if err != nil {
+		return nil, err
+	}
+	var clientPub [32]byte
+	copy(clientPub[:], kexInit.ClientPubKey[ekSize:])
+	K, err := kex.secret(kemKey, &kp.priv, &clientPub)
+	if err != nil {
+		return nil, err
+	}
+	serverReply := append(ciphertext, kp.pub[:]...)
+
+	hostKeyBytes := priv.PublicKey().Marshal()
+
+	h := kex.hashFunc.New()
+	magics.write(h)
+	writeString(h, hostKeyBytes)
+	writeString(h, kexInit.ClientPubKey)
+	writeString(h, serverReply)
+	h.Write(K)
+
+	H := h.Sum(nil)
+
+	sig, err := signAndMarshal(priv, rand, H)
+	if err != nil {
+		return nil, err
+	}
+
+	reply := kexECDHReplyMsg{
+		EphemeralPubKey: serverReply,
+		HostKey:         hostKeyBytes,
+		Signature:       sig,
+	}
+	if err := c.writePacket(Marshal(&reply)); err != nil {
+		return nil, err
+	}
+	return &kexResult{
+		H:         H,
+		K:         K,
+		HostKey:   hostKeyBytes,
+		Signature: sig,
+		Hash:      kex.hashFunc,
+	}, nil
+}
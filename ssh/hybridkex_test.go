@@ -0,0 +1,172 @@
+package ssh
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"testing"
+)
+
+// sequence returns n bytes counting up from start, as predictable
+// randomness.
+func sequence(start, n int) *bytes.Reader {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = byte(start + i)
+	}
+	return bytes.NewReader(b)
+}
+
+// recordingPacketConn records the packets written to it.
+type recordingPacketConn struct {
+	packetConn
+	written [][]byte
+}
+
+func (c *recordingPacketConn) writePacket(p []byte) error {
+	c.written = append(c.written, append([]byte(nil), p...))
+	return c.packetConn.writePacket(p)
+}
+
+// TestMLKEM768X25519KnownAnswer checks the messages, shared secret and
+// exchange hash of a run with fixed randomness against values computed
+// separately, with crypto/mlkem, crypto/mlkem/mlkemtest and crypto/ecdh
+// of the Go standard library. OpenSSH only implements this exchange
+// from 9.9 on; the construction it shares with sntrup761x25519-sha512
+// is checked against OpenSSH by TestSNTRUP761X25519KnownAnswer.
+func TestMLKEM768X25519KnownAnswer(t *testing.T) {
+	magics := &handshakeMagics{
+		clientVersion: []byte("SSH-2.0-client"),
+		serverVersion: []byte("SSH-2.0-server"),
+		clientKexInit: []byte("client kexinit"),
+		serverKexInit: []byte("server kexinit"),
+	}
+	const (
+		wantInit  = "d99e4496af749b54ee4a2d270c8057450624ecc5dc0866295ffc504a26134ad4" // SHA-256
+		wantReply = "3a974acc1e860aeccb0e36dc9ec8f82a73bea387edbeaa065df1549201601b6f" // SHA-256
+		wantK     = "00000020cd030db3a4226b991d728883a6940665f7cf50b2df99bb5b0da74f8cb48c0c02"
+		wantH     = "72807d81fbc6769db7bbec3dba4f4c8259f2a138a187ff1e3f412f9f62f8120f"
+	)
+
+	a, b := memPipe()
+	defer a.Close()
+	defer b.Close()
+	client := &recordingPacketConn{packetConn: a}
+	server := &recordingPacketConn{packetConn: b}
+	kex := kexAlgoMap[kexAlgoMLKEM768X25519SHA256]
+
+	type kexResultErr struct {
+		result *kexResult
+		err    error
+	}
+	s := make(chan kexResultErr, 1)
+	go func() {
+		// The server's curve25519 key, then the ML-KEM message.
+		r, err := kex.Server(server, sequence(128, 64), magics, testSigners["ed25519"])
+		s <- kexResultErr{r, err}
+	}()
+	// The ML-KEM seed, then the client's curve25519 key.
+	clientRes, err := kex.Client(client, sequence(0, 96), magics)
+	if err != nil {
+		t.Fatalf("client: %v", err)
+	}
+	serverRes := <-s
+	if serverRes.err != nil {
+		t.Fatalf("server: %v", serverRes.err)
+	}
+
+	var init kexECDHInitMsg
+	var reply kexECDHReplyMsg
+	if len(client.written) != 1 || Unmarshal(client.written[0], &init) != nil ||
+		len(server.written) != 1 || Unmarshal(server.written[0], &reply) != nil {
+		t.Fatalf("got %d client and %d server packets, want one init and one reply", len(client.written), len(server.written))
+	}
+	if got := sha256.Sum256(init.ClientPubKey); hex.EncodeToString(got[:]) != wantInit {
+		t.Errorf("got init with SHA-256 %x, want %s", got, wantInit)
+	}
+	if got := sha256.Sum256(reply.EphemeralPubKey); hex.EncodeToString(got[:]) != wantReply {
+		t.Errorf("got reply with SHA-256 %x, want %s", got, wantReply)
+	}
+	for _, res := range []*kexResult{clientRes, serverRes.result} {
+		if got := hex.EncodeToString(res.K); got != wantK {
+			t.Errorf("got K %s, want %s", got, wantK)
+		}
+		if got := hex.EncodeToString(res.H); got != wantH {
+			t.Errorf("got H %s, want %s", got, wantH)
+		}
+	}
+}
+
+// TestSNTRUP761X25519KnownAnswer replays the client's side of a key
+// exchange with OpenSSH 9.2p1. The server's randomness was fixed, and
+// OpenSSH completed the connection, so it derived the same secret.
+func TestSNTRUP761X25519KnownAnswer(t *testing.T) {
+	const (
+		clientInit = "bf64e914e3ee76c4ba9501aad8979113c28cd00cfe779771357b5a5e36d21e7bfaa1ad666988997ecc400ef8bdccacb13f72273ee3def1bdcceeb26dd23889676bb81abd1dc0609e1af2706ec07cb11ecec94ce284b24933fc8c206496ea5beb3860556d4a313e79f583b682d278559ca71d8cb2050d8d5f33626bcd1ed6d16d688773b8e63f6cc61e3b7b35c9406230d80ffbfaf92b23f0977fa7e30222a1ab822a2e88a00cf586c2502aa3e40c3137d3ada937445344674059e13c527617d0f5cf5101b893f6d175dd0b7fe4f6bd3dda512408edd673ebf2012c550c9d65777ce0cbcc1c473d81837e8e9941ecc0ad7d6bf2e64173d41e8bca0a886f8ac7bf3755eaba19d294fd8a2fd60c9bcc2702f872e345fdc8627674e23ce7b828c1f0acdd845891b25a8950b50a7ae96870c339d5ddc8a37ae1f9ba991b9e7631daf93539fb0f18326305c28c2eb881af3b42777a67ee1c54891cbb9c6b77f895f03f7a7985727805555d05f856307df803dc643f6d7280865f307da43817d726a46e32c2af1ff2f92a24536f5e25374456159711be732dfb1694a31a24bf8afc9ad389b50dead7721fb7f101247de77cb655aef29441e558f591d184d945fe55135c3ec8d18fa8177c107de1be67bc336f8b8918818a0257a2aa1662689bdc8ee60b604c01caf272a0b5dde0149fe38a2e35f5ed0a129738012f3f8c50c8b25e46a90bb88351cd16e13d9717c3ab8bf1752a0a01aa112a2c64b5d5179c41bc159cf72c2a4a0557ea528338917f881793345a46634f410ee21f95a6b83ad3059ebd8a2aeabf1ded8794f8636f1509d475d6bbb4116034ff8b22887de925da6654e36fe57caa0f14774b0c14c377480bc1a509e1c809e882b9e2d3c591cb91e5d8cab48a10574334ac2fccd95b4453a37b8db8894a85b3f9094fa40a5708f5f6f9d1ae2459d6b341c619fd5fbd768bb1ff9568f72b3a023fa82132ab985dd9f63ea16a928aeb8e0ee1c35cbfc610f6c56c6399b4d9a77d94011fcabdf860238205951726f2265b286197993f762d7c6cf6d5c04f19db703f43a15af76bb89084b9baa286aee7b99533a68486dd31d6e2ef0df5a08349ce4792fd1851d3282fa198e185cb96439ad87d3215c4690ea9ec6fa2bc63c2dae12504b217f4110eb69f38d7f6dea965c45aea20eec07d79ff15fc0f28ae1c225d687a0a17eb68739feb38ed5a9f1305e4d034279fdf9e0f0360c4b3f339acf3f35d9b1d5fa9f4942e014108e7c333187f7eda5106e12ee06ebcaef99b9f8898479faca0c57d1d22855e1a5a0eb743dd0f88ad9cdb437f60f152bac604bca7afdf6363ba3f3d3099c67f5b22f666beef83a8a93c458a495823684b0dbbb8563486c83615cfd07e4c46bfdae562f2254bbfbc64b4585685bdbe0000b94aad118772f2c05607f22ecd326175f668842cddfc02c17cf3707f8cfdc75ca8a384c9c483ee94b30fd00ac425699eb1998cb28ccfecccb9524a1f2ddab083b96d899039bcea0043eb4f58bd20753044ed9a34b44ef5ad3d0da51532cf12723e971f5638fe2fdbba37b2001c3bfb098d1d051c0d3c589c873c5436b90129f46c95ec3cd95ec6f737d2b413a9d920faea1fb0b9150971051615d91f879b961121b0ddc4f3542d3ffddaad15921da27f7eb013d35899077b"
+		wantReply  = "70f9b5106648a27e73d944ae4994bb0d46ce87d498b0cd46543829ea48da2f59" // SHA-256
+		wantK      = "00000040c749a809e98c35f1c227780fe90b3d1d076d70bc6bfcfa22ca307d92f531c9da3cdedfefb49a34f211b21ae9a5f10cb56976999bd32f0c5d53ba0b605c291889"
+	)
+	init, err := hex.DecodeString(clientInit)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a, b := memPipe()
+	defer a.Close()
+	defer b.Close()
+	go a.writePacket(Marshal(&kexECDHInitMsg{ClientPubKey: init}))
+	// The server's curve25519 key, then the sntrup761 randomness.
+	res, err := kexAlgoMap[kexAlgoSNTRUP761X25519SHA512].Server(b, sequence(128, 32+4*761), &handshakeMagics{}, testSigners["ed25519"])
+	if err != nil {
+		t.Fatalf("server: %v", err)
+	}
+	packet, err := a.readPacket()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var reply kexECDHReplyMsg
+	if err := Unmarshal(packet, &reply); err != nil {
+		t.Fatal(err)
+	}
+	if got := sha256.Sum256(reply.EphemeralPubKey); hex.EncodeToString(got[:]) != wantReply {
+		t.Errorf("got reply with SHA-256 %x, want %s", got, wantReply)
+	}
+	if got := hex.EncodeToString(res.K); got != wantK {
+		t.Errorf("got K %s, want %s", got, wantK)
+	}
+}
+
+func TestHybridKexRejectsShortInit(t *testing.T) {
+	for _, algo := range []string{kexAlgoMLKEM768X25519SHA256, kexAlgoSNTRUP761X25519SHA512} {
+		a, b := memPipe()
+		go a.writePacket(Marshal(&kexECDHInitMsg{ClientPubKey: make([]byte, 32)}))
+		if _, err := kexAlgoMap[algo].Server(b, rand.Reader, &handshakeMagics{}, testSigners["ed25519"]); err == nil {
+			t.Errorf("%s: server accepted a curve25519 public value alone", algo)
+		}
+		a.Close()
+		b.Close()
+	}
+}
+
+func TestHybridKexSecret(t *testing.T) {
+	for algo, size := range map[string]int{
+		kexAlgoMLKEM768X25519SHA256:  32,
+		kexAlgoSNTRUP761X25519SHA512: 64,
+	} {
+		a, b := memPipe()
+		kex := kexAlgoMap[algo]
+		go kex.Server(b, rand.Reader, &handshakeMagics{}, testSigners["ed25519"])
+		res, err := kex.Client(a, rand.Reader, &handshakeMagics{})
+		a.Close()
+		b.Close()
+		if err != nil {
+			t.Errorf("%s: %v", algo, err)
+			continue
+		}
+		// The secret is a string holding a hash, not an mpint.
+		if len(res.K) != 4+size || res.K[3] != byte(size) || len(res.H) != size {
+			t.Errorf("%s: got K %x and a %d-byte H, want a %d-byte string and hash", algo, res.K, len(res.H), size)
+		}
+	}
+}
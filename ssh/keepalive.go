@@ -0,0 +1,59 @@
+package ssh
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+// ErrKeepaliveTimeout is returned by Wait when the connection was
+// closed because the peer left too many keepalive requests unanswered.
+var ErrKeepaliveTimeout = errors.New("ssh: keepalive timeout, peer not responding")
+
+// keepaliveRequest is the global request OpenSSH sends as keepalive.
+// Peers answer it with a failure, which is enough to show that they
+// are alive.
+const keepaliveRequest = "keepalive@openssh.com"
+
+// defaultKeepaliveCountMax is the number of missed keepalives after
+// which the connection is closed, as in OpenSSH.
+const defaultKeepaliveCountMax = 3
+
+// keepalive sends a keepalive request whenever nothing was received
+// from the peer for interval. As in OpenSSH, it closes the connection
+// once more than countMax intervals passed without any packet.
+func (m *mux) keepalive(interval time.Duration, countMax int) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var reply <-chan interface{}
+	missed := 0
+	for {
+		select {
+		case <-ticker.C:
+		case <-m.closed:
+			return
+		}
+		if atomic.SwapInt32(&m.received, 0) != 0 {
+			missed = 0
+			continue
+		}
+		missed++
+		if missed > countMax {
+			m.closeWithError(ErrKeepaliveTimeout)
+			return
+		}
+
+		// Until the last keepalive is answered, there is no need to
+		// send another one. Nobody waits for the reply, so requests
+		// sent meanwhile through SendRequest are not held up.
+		if reply != nil {
+			select {
+			case <-reply:
+			default:
+				continue
+			}
+		}
+		reply, _ = m.sendGlobalRequest(globalRequestMsg{Type: keepaliveRequest, WantReply: true})
+	}
+}
@@ -0,0 +1,222 @@
+package ssh
+
+import (
+	"testing"
+	"time"
+)
+
+// keepalivePair connects a client and a server using the given
+// configurations. Unlike Client, the client answers global requests
+// only if answer is set, and so does the server. The server accepts
+// sessions and acknowledges their requests without ever completing
+// them.
+func keepalivePair(t *testing.T, clientConf *ClientConfig, serverConf *ServerConfig, answer bool) (Conn, *ServerConn) {
+	c1, c2, err := netPipe()
+	if err != nil {
+		t.Fatalf("netPipe: %v", err)
+	}
+	serverConf.NoClientAuth = true
+	serverConf.AddHostKey(testSigners["ecdsa"])
+	done := make(chan *ServerConn, 1)
+	go func() {
+		conn, chans, reqs, err := NewServerConn(c1, serverConf)
+		if err != nil {
+			t.Errorf("NewServerConn: %v", err)
+			close(done)
+			return
+		}
+		done <- conn
+		if answer {
+			go DiscardRequests(reqs)
+		}
+		for newCh := range chans {
+			_, reqs, err := newCh.Accept()
+			if err != nil {
+				continue
+			}
+			go func() {
+				for r := range reqs {
+					r.Reply(true, nil)
+				}
+			}()
+		}
+	}()
+
+	clientConf.User = "testuser"
+	clientConf.HostKeyCallback = InsecureIgnoreHostKey()
+	conn, chans, reqs, err := NewClientConn(c2, "", clientConf)
+	if err != nil {
+		t.Fatalf("NewClientConn: %v", err)
+	}
+	go func() {
+		for newCh := range chans {
+			newCh.Reject(Prohibited, "no channels")
+		}
+	}()
+	if answer {
+		go DiscardRequests(reqs)
+	}
+	server := <-done
+	if server == nil {
+		t.FailNow()
+	}
+	return conn, server
+}
+
+// waitTimeout returns the error of conn's Wait, or fails if it does not
+// return within d.
+func waitTimeout(t *testing.T, conn Conn, d time.Duration) error {
+	done := make(chan error, 1)
+	go func() { done <- conn.Wait() }()
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(d):
+		t.Fatalf("Wait did not return within %v", d)
+	}
+	return nil
+}
+
+func TestServerAliveTimeout(t *testing.T) {
+	client, server := keepalivePair(t, &ClientConfig{
+		ServerAliveInterval: 10 * time.Millisecond,
+		ServerAliveCountMax: 2,
+	}, &ServerConfig{}, false)
+	defer server.Close()
+
+	ch, reqs, err := client.OpenChannel("session", nil)
+	if err != nil {
+		t.Fatalf("OpenChannel: %v", err)
+	}
+	session, err := newSession(ch, reqs)
+	if err != nil {
+		t.Fatalf("newSession: %v", err)
+	}
+	if err := session.Start("sleep"); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+
+	if err := waitTimeout(t, client, 5*time.Second); err != ErrKeepaliveTimeout {
+		t.Errorf("Wait: got %v, want %v", err, ErrKeepaliveTimeout)
+	}
+	waited := make(chan error, 1)
+	go func() { waited <- session.Wait() }()
+	select {
+	case <-waited:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("session Wait did not return after the keepalive timeout")
+	}
+}
+
+func TestClientAliveTimeout(t *testing.T) {
+	client, server := keepalivePair(t, &ClientConfig{}, &ServerConfig{
+		ClientAliveInterval: 10 * time.Millisecond,
+	}, false)
+	defer client.Close()
+
+	if err := waitTimeout(t, server, 5*time.Second); err != ErrKeepaliveTimeout {
+		t.Errorf("Wait: got %v, want %v", err, ErrKeepaliveTimeout)
+	}
+}
+
+func TestKeepaliveAnswered(t *testing.T) {
+	client, server := keepalivePair(t, &ClientConfig{
+		ServerAliveInterval: 20 * time.Millisecond,
+	}, &ServerConfig{
+		ClientAliveInterval: 20 * time.Millisecond,
+	}, true)
+	defer client.Close()
+	defer server.Close()
+
+	// Both sides answer the keepalives of the other, so the connection
+	// outlives many intervals.
+	time.Sleep(300 * time.Millisecond)
+	if ok, _, err := client.SendRequest("test", true, nil); err != nil || ok {
+		t.Fatalf("SendRequest: %v, %v", ok, err)
+	}
+	if _, _, err := server.SendRequest("test", true, nil); err != nil {
+		t.Fatalf("SendRequest: %v", err)
+	}
+}
+
+func TestSendRequestDuringKeepalive(t *testing.T) {
+	c1, c2, err := netPipe()
+	if err != nil {
+		t.Fatalf("netPipe: %v", err)
+	}
+	defer c1.Close()
+	defer c2.Close()
+	serverConf := &ServerConfig{NoClientAuth: true}
+	serverConf.AddHostKey(testSigners["ecdsa"])
+	serverReqs := make(chan (<-chan *Request), 1)
+	go func() {
+		_, chans, reqs, err := NewServerConn(c1, serverConf)
+		if err != nil {
+			t.Errorf("NewServerConn: %v", err)
+			close(serverReqs)
+			return
+		}
+		go func() {
+			for newCh := range chans {
+				newCh.Reject(Prohibited, "no channels")
+			}
+		}()
+		serverReqs <- reqs
+	}()
+
+	client, _, _, err := NewClientConn(c2, "", &ClientConfig{
+		User:                "testuser",
+		HostKeyCallback:     InsecureIgnoreHostKey(),
+		ServerAliveInterval: 10 * time.Millisecond,
+		ServerAliveCountMax: 1000,
+	})
+	if err != nil {
+		t.Fatalf("NewClientConn: %v", err)
+	}
+	defer client.Close()
+	reqs := <-serverReqs
+	if reqs == nil {
+		t.FailNow()
+	}
+
+	next := func() *Request {
+		select {
+		case r := <-reqs:
+			return r
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no request from the client")
+		}
+		return nil
+	}
+	keepalive := next()
+	if keepalive.Type != keepaliveRequest {
+		t.Fatalf("got request %q, want a keepalive", keepalive.Type)
+	}
+
+	// The keepalive is left unanswered, which must not hold up
+	// other requests.
+	type result struct {
+		ok      bool
+		payload []byte
+		err     error
+	}
+	done := make(chan result, 1)
+	go func() {
+		ok, payload, err := client.SendRequest("test", true, nil)
+		done <- result{ok, payload, err}
+	}()
+	if r := next(); r.Type != "test" {
+		t.Fatalf("got request %q, want the test request", r.Type)
+	} else {
+		keepalive.Reply(false, nil)
+		r.Reply(true, []byte("reply"))
+	}
+	select {
+	case r := <-done:
+		if r.err != nil || !r.ok || string(r.payload) != "reply" {
+			t.Errorf("SendRequest: got %v, %q, %v; want the reply to the test request", r.ok, r.payload, r.err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("SendRequest did not return")
+	}
+}
@@ -10,7 +10,9 @@ import (
 	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/subtle"
+	"encoding/binary"
 	"errors"
+	"fmt"
 	"io"
 	"math/big"
 
@@ -20,10 +22,19 @@ import (
 const (
 	kexAlgoDH1SHA1          = "diffie-hellman-group1-sha1"
 	kexAlgoDH14SHA1         = "diffie-hellman-group14-sha1"
+	kexAlgoDH14SHA256       = "diffie-hellman-group14-sha256"
+	kexAlgoDH16SHA512       = "diffie-hellman-group16-sha512"
+	kexAlgoDH18SHA512       = "diffie-hellman-group18-sha512"
 	kexAlgoECDH256          = "ecdh-sha2-nistp256"
 	kexAlgoECDH384          = "ecdh-sha2-nistp384"
 	kexAlgoECDH521          = "ecdh-sha2-nistp521"
 	kexAlgoCurve25519SHA256 = "curve25519-sha256@libssh.org"
+	kexAlgoDHGEXSHA1        = "diffie-hellman-group-exchange-sha1"
+	kexAlgoDHGEXSHA256      = "diffie-hellman-group-exchange-sha256"
+
+	kexAlgoMLKEM768X25519SHA256         = "mlkem768x25519-sha256"
+	kexAlgoSNTRUP761X25519SHA512        = "sntrup761x25519-sha512"
+	kexAlgoSNTRUP761X25519SHA512OpenSSH = "sntrup761x25519-sha512@openssh.com"
 )
 
 // kexResult captures the outcome of a key exchange.
@@ -78,6 +89,7 @@ type kexAlgorithm interface {
 // dhGroup is a multiplicative group suitable for implementing Diffie-Hellman key agreement.
 type dhGroup struct {
 	g, p, pMinus1 *big.Int
+	hashFunc      crypto.Hash
 }
 
 func (group *dhGroup) diffieHellman(theirPublic, myPrivate *big.Int) (*big.Int, error) {
@@ -87,21 +99,24 @@ func (group *dhGroup) diffieHellman(theirPublic, myPrivate *big.Int) (*big.Int,
 	return new(big.Int).Exp(theirPublic, myPrivate, group.p), nil
 }
 
-func (group *dhGroup) Client(c packetConn, randSource io.Reader, magics *handshakeMagics) (*kexResult, error) {
-	hashFunc := crypto.SHA1
-
-	var x *big.Int
+// generateKey returns a private exponent and the matching public value.
+func (group *dhGroup) generateKey(randSource io.Reader) (x, X *big.Int, err error) {
 	for {
-		var err error
 		if x, err = rand.Int(randSource, group.pMinus1); err != nil {
-			return nil, err
+			return nil, nil, err
 		}
 		if x.Sign() > 0 {
 			break
 		}
 	}
+	return x, new(big.Int).Exp(group.g, x, group.p), nil
+}
 
-	X := new(big.Int).Exp(group.g, x, group.p)
+func (group *dhGroup) Client(c packetConn, randSource io.Reader, magics *handshakeMagics) (*kexResult, error) {
+	x, X, err := group.generateKey(randSource)
+	if err != nil {
+		return nil, err
+	}
 	kexDHInit := kexDHInitMsg{
 		X: X,
 	}
@@ -124,7 +139,7 @@ func (group *dhGroup) Client(c packetConn, randSource io.Reader, magics *handsha
 		return nil, err
 	}
 
-	h := hashFunc.New()
+	h := group.hashFunc.New()
 	magics.write(h)
 	writeString(h, kexDHReply.HostKey)
 	writeInt(h, X)
@@ -138,12 +153,11 @@ func (group *dhGroup) Client(c packetConn, randSource io.Reader, magics *handsha
 		K:         K,
 		HostKey:   kexDHReply.HostKey,
 		Signature: kexDHReply.Signature,
-		Hash:      crypto.SHA1,
+		Hash:      group.hashFunc,
 	}, nil
 }
 
 func (group *dhGroup) Server(c packetConn, randSource io.Reader, magics *handshakeMagics, priv Signer) (result *kexResult, err error) {
-	hashFunc := crypto.SHA1
 	packet, err := c.readPacket()
 	if err != nil {
 		return
@@ -153,17 +167,10 @@ func (group *dhGroup) Server(c packetConn, randSource io.Reader, magics *handsha
 		return
 	}
 
-	var y *big.Int
-	for {
-		if y, err = rand.Int(randSource, group.pMinus1); err != nil {
-			return
-		}
-		if y.Sign() > 0 {
-			break
-		}
+	y, Y, err := group.generateKey(randSource)
+	if err != nil {
+		return nil, err
 	}
-
-	Y := new(big.Int).Exp(group.g, y, group.p)
 	kInt, err := group.diffieHellman(kexDHInit.X, y)
 	if err != nil {
 		return nil, err
@@ -171,7 +178,7 @@ func (group *dhGroup) Server(c packetConn, randSource io.Reader, magics *handsha
 
 	hostKeyBytes := priv.PublicKey().Marshal()
 
-	h := hashFunc.New()
+	h := group.hashFunc.New()
 	magics.write(h)
 	writeString(h, hostKeyBytes)
 	writeInt(h, kexDHInit.X)
@@ -203,10 +210,231 @@ func (group *dhGroup) Server(c packetConn, randSource io.Reader, magics *handsha
 		K:         K,
 		HostKey:   hostKeyBytes,
 		Signature: sig,
-		Hash:      crypto.SHA1,
+		Hash:      group.hashFunc,
 	}, nil
 }
 
+// These are the group sizes, in bits, that a client requests in
+// Diffie-Hellman group exchange, and that a server accepts.
+const (
+	dhGroupExchangeMinimumBits   = 2048
+	dhGroupExchangePreferredBits = 3072
+	dhGroupExchangeMaximumBits   = 8192
+)
+
+// dhGroupExchange implements Diffie-Hellman group exchange, as
+// described in RFC 4419. The server picks the group from moduli, or
+// from defaultModuli if it is nil.
+type dhGroupExchange struct {
+	hashFunc crypto.Hash
+	moduli   ModuliSource
+}
+
+func (gex *dhGroupExchange) Client(c packetConn, randSource io.Reader, magics *handshakeMagics) (*kexResult, error) {
+	request := kexDHGexRequestMsg{
+		MinBits:       dhGroupExchangeMinimumBits,
+		PreferredBits: dhGroupExchangePreferredBits,
+		MaxBits:       dhGroupExchangeMaximumBits,
+	}
+	if err := c.writePacket(Marshal(&request)); err != nil {
+		return nil, err
+	}
+
+	packet, err := c.readPacket()
+	if err != nil {
+		return nil, err
+	}
+	var groupMsg kexDHGexGroupMsg
+	if err = Unmarshal(packet, &groupMsg); err != nil {
+		return nil, err
+	}
+	m := Modulus{Generator: groupMsg.G, Prime: groupMsg.P}
+	if err := m.check(); err != nil {
+		return nil, err
+	}
+	if bits := m.Prime.BitLen(); bits < dhGroupExchangeMinimumBits || bits > dhGroupExchangeMaximumBits {
+		return nil, fmt.Errorf("ssh: server sent a %d-bit group, want %d to %d bits", bits, dhGroupExchangeMinimumBits, dhGroupExchangeMaximumBits)
+	}
+	group := m.group()
+
+	x, X, err := group.generateKey(randSource)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.writePacket(Marshal(&kexDHGexInitMsg{X: X})); err != nil {
+		return nil, err
+	}
+
+	if packet, err = c.readPacket(); err != nil {
+		return nil, err
+	}
+	var reply kexDHGexReplyMsg
+	if err = Unmarshal(packet, &reply); err != nil {
+		return nil, err
+	}
+	kInt, err := group.diffieHellman(reply.Y, x)
+	if err != nil {
+		return nil, err
+	}
+
+	h := gex.hashFunc.New()
+	magics.write(h)
+	writeString(h, reply.HostKey)
+	binary.Write(h, binary.BigEndian, request)
+	writeInt(h, group.p)
+	writeInt(h, group.g)
+	writeInt(h, X)
+	writeInt(h, reply.Y)
+	K := make([]byte, intLength(kInt))
+	marshalInt(K, kInt)
+	h.Write(K)
+
+	return &kexResult{
+		H:         h.Sum(nil),
+		K:         K,
+		HostKey:   reply.HostKey,
+		Signature: reply.Signature,
+		Hash:      gex.hashFunc,
+	}, nil
+}
+
+func (gex *dhGroupExchange) Server(c packetConn, randSource io.Reader, magics *handshakeMagics, priv Signer) (*kexResult, error) {
+	packet, err := c.readPacket()
+	if err != nil {
+		return nil, err
+	}
+	var request kexDHGexRequestMsg
+	if err = Unmarshal(packet, &request); err != nil {
+		return nil, err
+	}
+	if request.MinBits > request.PreferredBits || request.PreferredBits > request.MaxBits {
+		return nil, fmt.Errorf("ssh: invalid group size request %d <= %d <= %d", request.MinBits, request.PreferredBits, request.MaxBits)
+	}
+
+	moduli := gex.moduli
+	if moduli == nil {
+		moduli = defaultModuli
+	}
+	candidates, err := moduli.Moduli()
+	if err != nil {
+		return nil, err
+	}
+	m, err := chooseModulus(candidates, request, randSource)
+	if err != nil {
+		return nil, err
+	}
+	group := m.group()
+	if err := c.writePacket(Marshal(&kexDHGexGroupMsg{P: group.p, G: group.g})); err != nil {
+		return nil, err
+	}
+
+	if packet, err = c.readPacket(); err != nil {
+		return nil, err
+	}
+	var init kexDHGexInitMsg
+	if err = Unmarshal(packet, &init); err != nil {
+		return nil, err
+	}
+
+	y, Y, err := group.generateKey(randSource)
+	if err != nil {
+		return nil, err
+	}
+	kInt, err := group.diffieHellman(init.X, y)
+	if err != nil {
+		return nil, err
+	}
+
+	hostKeyBytes := priv.PublicKey().Marshal()
+
+	h := gex.hashFunc.New()
+	magics.write(h)
+	writeString(h, hostKeyBytes)
+	binary.Write(h, binary.BigEndian, request)
+	writeInt(h, group.p)
+	writeInt(h, group.g)
+	writeInt(h, init.X)
+	writeInt(h, Y)
+	K := make([]byte, intLength(kInt))
+	marshalInt(K, kInt)
+	h.Write(K)
+
+	H := h.Sum(nil)
+
+	// H is already a hash, but the hostkey signing will apply its
+	// own key-specific hash algorithm.
+	sig, err := signAndMarshal(priv, randSource, H)
+	if err != nil {
+		return nil, err
+	}
+
+	reply := kexDHGexReplyMsg{
+		HostKey:   hostKeyBytes,
+		Y:         Y,
+		Signature: sig,
+	}
+	if err := c.writePacket(Marshal(&reply)); err != nil {
+		return nil, err
+	}
+	return &kexResult{
+		H:         H,
+		K:         K,
+		HostKey:   hostKeyBytes,
+		Signature: sig,
+		Hash:      gex.hashFunc,
+	}, nil
+}
+
+// chooseModulus picks a group for a client's request, as sshd does:
+// among the groups within the requested bounds, and within those the
+// server accepts, it prefers the smallest at least as large as
+// requested, or else the largest. Groups of the chosen size are picked
+// at random. Groups that fail check, which a ModuliSource may return,
+// are skipped.
+func chooseModulus(moduli []Modulus, request kexDHGexRequestMsg, randSource io.Reader) (Modulus, error) {
+	var usable []Modulus
+	for _, m := range moduli {
+		if m.check() == nil {
+			usable = append(usable, m)
+		}
+	}
+	moduli = usable
+
+	min, max := int(request.MinBits), int(request.MaxBits)
+	if min < dhGroupExchangeMinimumBits {
+		min = dhGroupExchangeMinimumBits
+	}
+	if max > dhGroupExchangeMaximumBits {
+		max = dhGroupExchangeMaximumBits
+	}
+	want := int(request.PreferredBits)
+
+	best := 0
+	for _, m := range moduli {
+		bits := m.Prime.BitLen()
+		if bits < min || bits > max {
+			continue
+		}
+		if best == 0 || bits >= want && (bits < best || best < want) || bits > best && best < want {
+			best = bits
+		}
+	}
+	var candidates []Modulus
+	for _, m := range moduli {
+		if m.Prime.BitLen() == best {
+			candidates = append(candidates, m)
+		}
+	}
+	if len(candidates) == 0 {
+		return Modulus{}, fmt.Errorf("ssh: no group of %d to %d bits", min, max)
+	}
+	i, err := rand.Int(randSource, big.NewInt(int64(len(candidates))))
+	if err != nil {
+		return Modulus{}, err
+	}
+	return candidates[i.Int64()], nil
+}
+
 // ecdh performs Elliptic Curve Diffie-Hellman key exchange as
 // described in RFC 5656, section 4.
 type ecdh struct {
@@ -378,30 +606,40 @@ func (kex *ecdh) Server(c packetConn, rand io.Reader, magics *handshakeMagics, p
 
 var kexAlgoMap = map[string]kexAlgorithm{}
 
+// newDHGroup returns the group of generator 2 modulo the prime in hex,
+// hashing with hashFunc.
+func newDHGroup(hex string, hashFunc crypto.Hash) *dhGroup {
+	p, _ := new(big.Int).SetString(hex, 16)
+	return &dhGroup{
+		g:        big.NewInt(2),
+		p:        p,
+		pMinus1:  new(big.Int).Sub(p, bigOne),
+		hashFunc: hashFunc,
+	}
+}
+
 func init() {
 	// This is the group called diffie-hellman-group1-sha1 in RFC
 	// 4253 and Oakley Group 2 in RFC 2409.
-	p, _ := new(big.Int).SetString("FFFFFFFFFFFFFFFFC90FDAA22168C234C4C6628B80DC1CD129024E088A67CC74020BBEA63B139B22514A08798E3404DDEF9519B3CD3A431B302B0A6DF25F14374FE1356D6D51C245E485B576625E7EC6F44C42E9A637ED6B0BFF5CB6F406B7EDEE386BFB5A899FA5AE9F24117C4B1FE649286651ECE65381FFFFFFFFFFFFFFFF", 16)
-	kexAlgoMap[kexAlgoDH1SHA1] = &dhGroup{
-		g:       new(big.Int).SetInt64(2),
-		p:       p,
-		pMinus1: new(big.Int).Sub(p, bigOne),
-	}
+	kexAlgoMap[kexAlgoDH1SHA1] = newDHGroup("FFFFFFFFFFFFFFFFC90FDAA22168C234C4C6628B80DC1CD129024E088A67CC74020BBEA63B139B22514A08798E3404DDEF9519B3CD3A431B302B0A6DF25F14374FE1356D6D51C245E485B576625E7EC6F44C42E9A637ED6B0BFF5CB6F406B7EDEE386BFB5A899FA5AE9F24117C4B1FE649286651ECE65381FFFFFFFFFFFFFFFF", crypto.SHA1)
 
 	// This is the group called diffie-hellman-group14-sha1 in RFC
-	// 4253 and Oakley Group 14 in RFC 3526.
-	p, _ = new(big.Int).SetString("FFFFFFFFFFFFFFFFC90FDAA22168C234C4C6628B80DC1CD129024E088A67CC74020BBEA63B139B22514A08798E3404DDEF9519B3CD3A431B302B0A6DF25F14374FE1356D6D51C245E485B576625E7EC6F44C42E9A637ED6B0BFF5CB6F406B7EDEE386BFB5A899FA5AE9F24117C4B1FE649286651ECE45B3DC2007CB8A163BF0598DA48361C55D39A69163FA8FD24CF5F83655D23DCA3AD961C62F356208552BB9ED529077096966D670C354E4ABC9804F1746C08CA18217C32905E462E36CE3BE39E772C180E86039B2783A2EC07A28FB5C55DF06F4C52C9DE2BCBF6955817183995497CEA956AE515D2261898FA051015728E5A8AACAA68FFFFFFFFFFFFFFFF", 16)
-
-	kexAlgoMap[kexAlgoDH14SHA1] = &dhGroup{
-		g:       new(big.Int).SetInt64(2),
-		p:       p,
-		pMinus1: new(big.Int).Sub(p, bigOne),
-	}
+	// 4253 and Oakley Group 14 in RFC 3526. RFC 8268 pairs it and
+	// the larger MODP groups of RFC 3526 with SHA-2.
+	kexAlgoMap[kexAlgoDH14SHA1] = newDHGroup(modp2048, crypto.SHA1)
+	kexAlgoMap[kexAlgoDH14SHA256] = newDHGroup(modp2048, crypto.SHA256)
+	kexAlgoMap[kexAlgoDH16SHA512] = newDHGroup(modp4096, crypto.SHA512)
+	kexAlgoMap[kexAlgoDH18SHA512] = newDHGroup(modp8192, crypto.SHA512)
 
 	kexAlgoMap[kexAlgoECDH521] = &ecdh{elliptic.P521()}
 	kexAlgoMap[kexAlgoECDH384] = &ecdh{elliptic.P384()}
 	kexAlgoMap[kexAlgoECDH256] = &ecdh{elliptic.P256()}
 	kexAlgoMap[kexAlgoCurve25519SHA256] = &curve25519sha256{}
+	kexAlgoMap[kexAlgoDHGEXSHA1] = &dhGroupExchange{hashFunc: crypto.SHA1}
+	kexAlgoMap[kexAlgoDHGEXSHA256] = &dhGroupExchange{hashFunc: crypto.SHA256}
+	kexAlgoMap[kexAlgoMLKEM768X25519SHA256] = &hybridKex{mlkem768KEM{}, crypto.SHA256}
+	kexAlgoMap[kexAlgoSNTRUP761X25519SHA512] = &hybridKex{sntrup761KEM{}, crypto.SHA512}
+	kexAlgoMap[kexAlgoSNTRUP761X25519SHA512OpenSSH] = &hybridKex{sntrup761KEM{}, crypto.SHA512}
 }
 
 // curve25519sha256 implements the curve25519-sha256@libssh.org key
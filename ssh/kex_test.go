@@ -7,6 +7,7 @@ package ssh
 // Key exchange tests.
 
 import (
+	"crypto"
 	"crypto/rand"
 	"reflect"
 	"testing"
@@ -48,3 +49,112 @@ func TestKexes(t *testing.T) {
 		}
 	}
 }
+
+func TestDHGroupExchangeRejectsSmallGroup(t *testing.T) {
+	a, b := memPipe()
+	defer a.Close()
+	defer b.Close()
+
+	group1 := kexAlgoMap[kexAlgoDH1SHA1].(*dhGroup)
+	go func() {
+		if _, err := b.readPacket(); err == nil {
+			b.writePacket(Marshal(&kexDHGexGroupMsg{P: group1.p, G: group1.g}))
+		}
+	}()
+	kex := kexAlgoMap[kexAlgoDHGEXSHA256]
+	if _, err := kex.Client(a, rand.Reader, &handshakeMagics{}); err == nil {
+		t.Error("client accepted a 1024-bit group")
+	}
+}
+
+// countingModuli is a ModuliSource that counts its uses.
+type countingModuli struct {
+	ModuliList
+	calls int
+}
+
+func (m *countingModuli) Moduli() ([]Modulus, error) {
+	m.calls++
+	return m.ModuliList, nil
+}
+
+func TestDHGroupExchangeModuli(t *testing.T) {
+	c1, c2, err := netPipe()
+	if err != nil {
+		t.Fatalf("netPipe: %v", err)
+	}
+	defer c1.Close()
+	defer c2.Close()
+
+	moduli := &countingModuli{ModuliList: defaultModuli[:1]}
+	serverConfig := &ServerConfig{NoClientAuth: true, Moduli: moduli}
+	serverConfig.AddHostKey(testSigners["ecdsa"])
+	go newServer(c1, serverConfig)
+
+	clientConfig := &ClientConfig{
+		HostKeyCallback: InsecureIgnoreHostKey(),
+		Config:          Config{KeyExchanges: []string{kexAlgoDHGEXSHA256}},
+	}
+	conn, _, _, err := NewClientConn(c2, "", clientConfig)
+	if err != nil {
+		t.Fatalf("NewClientConn: %v", err)
+	}
+	defer conn.Close()
+	if moduli.calls != 1 {
+		t.Errorf("moduli source used %d times, want 1", moduli.calls)
+	}
+}
+
+func TestDHGroups(t *testing.T) {
+	for _, test := range []struct {
+		algo string
+		bits int
+		hash crypto.Hash
+	}{
+		{kexAlgoDH1SHA1, 1024, crypto.SHA1},
+		{kexAlgoDH14SHA1, 2048, crypto.SHA1},
+		{kexAlgoDH14SHA256, 2048, crypto.SHA256},
+		{kexAlgoDH16SHA512, 4096, crypto.SHA512},
+		{kexAlgoDH18SHA512, 8192, crypto.SHA512},
+	} {
+		group := kexAlgoMap[test.algo].(*dhGroup)
+		if group.p.BitLen() != test.bits || group.hashFunc != test.hash {
+			t.Errorf("%s: got a %d-bit group with hash %v, want %d bits and %v", test.algo, group.p.BitLen(), group.hashFunc, test.bits, test.hash)
+		}
+	}
+}
+
+func TestSHA1KexNotDefault(t *testing.T) {
+	for _, algo := range supportedKexAlgos {
+		if kex, ok := kexAlgoMap[algo].(*dhGroup); ok && kex.hashFunc == crypto.SHA1 {
+			t.Errorf("%s is used by default", algo)
+		}
+	}
+
+	// Both sides may still choose it.
+	c1, c2, err := netPipe()
+	if err != nil {
+		t.Fatalf("netPipe: %v", err)
+	}
+	defer c1.Close()
+	defer c2.Close()
+
+	serverConfig := &ServerConfig{
+		Config:       Config{KeyExchanges: []string{kexAlgoDH14SHA1}},
+		NoClientAuth: true,
+	}
+	serverConfig.AddHostKey(testSigners["ecdsa"])
+	go newServer(c1, serverConfig)
+
+	conn, _, _, err := NewClientConn(c2, "", &ClientConfig{
+		HostKeyCallback: InsecureIgnoreHostKey(),
+		Config:          Config{KeyExchanges: []string{kexAlgoDH14SHA1}},
+	})
+	if err != nil {
+		t.Fatalf("NewClientConn: %v", err)
+	}
+	defer conn.Close()
+	if algs := conn.(*connection).transport.negotiatedAlgorithms(); algs.kex != kexAlgoDH14SHA1 {
+		t.Errorf("negotiated %s, want %s", algs.kex, kexAlgoDH14SHA1)
+	}
+}
@@ -0,0 +1,344 @@
+package ssh
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/internal/inflate"
+)
+
+// keyLogLabel starts the lines written to Config.KeyLogWriter.
+const keyLogLabel = "SSH_KEYS"
+
+const (
+	keyLogClientToServer = "client-to-server"
+	keyLogServerToClient = "server-to-client"
+)
+
+// keyLogMu serializes writes to key log writers, which connections
+// may share.
+var keyLogMu sync.Mutex
+
+// KeyLogEntry holds the keys of one direction of a key exchange, as
+// written to a Config.KeyLogWriter.
+type KeyLogEntry struct {
+	SessionID    []byte
+	ExchangeHash []byte
+
+	// ClientToServer is set for the keys of the packets sent by the
+	// client.
+	ClientToServer bool
+
+	Cipher      string
+	MAC         string
+	Compression string
+
+	// Strict is set if sequence numbers reset to zero once these
+	// keys take effect, as strict key exchange requires.
+	Strict bool
+
+	IV     []byte
+	Key    []byte
+	MACKey []byte
+}
+
+// writeKeyLog writes the keys derived from result in both directions.
+func writeKeyLog(w io.Writer, isClient bool, algs *algorithms, result *kexResult, strict bool) error {
+	c2s, s2c := algs.w, algs.r
+	if !isClient {
+		c2s, s2c = s2c, c2s
+	}
+	var buf bytes.Buffer
+	for _, e := range []struct {
+		dir  direction
+		name string
+		algs directionAlgorithms
+	}{
+		{clientKeys, keyLogClientToServer, c2s},
+		{serverKeys, keyLogServerToClient, s2c},
+	} {
+		iv, key, macKey := generateKeys(e.dir, e.algs, result)
+		mac := e.algs.MAC
+		if mac == "" {
+			mac = "-"
+		}
+		flag := 0
+		if strict {
+			flag = 1
+		}
+		fmt.Fprintf(&buf, "%s %s %s %s %s %s %s %d %s %s %s\n", keyLogLabel,
+			keyLogHex(result.SessionID), keyLogHex(result.H), e.name,
+			e.algs.Cipher, mac, e.algs.Compression, flag,
+			keyLogHex(iv), keyLogHex(key), keyLogHex(macKey))
+	}
+
+	keyLogMu.Lock()
+	defer keyLogMu.Unlock()
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+func keyLogHex(b []byte) string {
+	if len(b) == 0 {
+		return "-"
+	}
+	return hex.EncodeToString(b)
+}
+
+func parseKeyLogHex(s string) ([]byte, error) {
+	if s == "-" {
+		return nil, nil
+	}
+	return hex.DecodeString(s)
+}
+
+// ParseKeyLog reads the entries written to a Config.KeyLogWriter. Lines
+// that are empty or start with # are skipped.
+func ParseKeyLog(r io.Reader) ([]*KeyLogEntry, error) {
+	var entries []*KeyLogEntry
+	s := bufio.NewScanner(r)
+	for line := 1; s.Scan(); line++ {
+		text := strings.TrimSpace(s.Text())
+		if text == "" || text[0] == '#' {
+			continue
+		}
+		f := strings.Fields(text)
+		if len(f) != 11 || f[0] != keyLogLabel {
+			return nil, fmt.Errorf("ssh: key log line %d: malformed entry", line)
+		}
+
+		e := &KeyLogEntry{Cipher: f[4], Compression: f[6]}
+		switch f[3] {
+		case keyLogClientToServer:
+			e.ClientToServer = true
+		case keyLogServerToClient:
+		default:
+			return nil, fmt.Errorf("ssh: key log line %d: unknown direction %q", line, f[3])
+		}
+		if f[5] != "-" {
+			e.MAC = f[5]
+		}
+		switch f[7] {
+		case "1":
+			e.Strict = true
+		case "0":
+		default:
+			return nil, fmt.Errorf("ssh: key log line %d: invalid strict flag %q", line, f[7])
+		}
+
+		var err error
+		for i, b := range []*[]byte{&e.SessionID, &e.ExchangeHash, nil, nil, nil, nil, nil, &e.IV, &e.Key, &e.MACKey} {
+			if b == nil {
+				continue
+			}
+			if *b, err = parseKeyLogHex(f[i+1]); err != nil {
+				return nil, fmt.Errorf("ssh: key log line %d: %v", line, err)
+			}
+		}
+		entries = append(entries, e)
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// DecodedPacket is a packet of a connection decrypted by DecryptStream.
+type DecodedPacket struct {
+	// Offset is the position of the packet in the stream.
+	Offset int64
+
+	// SeqNum is the sequence number of the packet.
+	SeqNum uint32
+
+	// Payload is the decrypted and decompressed payload.
+	Payload []byte
+}
+
+// DecryptStream decrypts what one side of a connection sent, as
+// captured from the network, starting with its version line. Each time
+// msgNewKeys takes effect, it picks among the entries for that
+// direction the keys that authenticate the next packet. It returns the
+// packets decoded until the end of the stream, or until one could not
+// be decoded, along with the error.
+//
+// zlib@openssh.com compression is assumed to start at the first packet
+// that begins with a zlib header, as the byte 0x78 is not an SSH
+// message number.
+//
+// The keys of an endpoint decrypt what it sent and what it received,
+// so those of either end of the connection will do. DecryptStream is
+// meant for debugging only.
+//
+// A proxy handing off a client shifts the sequence numbers of both
+// directions. The shift of the packets the client sends is only found
+// in what it received, so use DecryptConnection for those.
+func DecryptStream(r io.Reader, clientToServer bool, keys []*KeyLogEntry) ([]DecodedPacket, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	packets, _, err := decryptStream(data, clientToServer, keys, nil)
+	return packets, err
+}
+
+// DecryptConnection decrypts both directions of a connection, as
+// DecryptStream does, following the sequence numbers through any
+// handoffs by a proxy. Packets are decoded until the end of each stream,
+// or until one could not be decoded, and the first error is returned.
+func DecryptConnection(clientToServer, serverToClient io.Reader, keys []*KeyLogEntry) (c2s, s2c []DecodedPacket, err error) {
+	c2sData, err := ioutil.ReadAll(clientToServer)
+	if err != nil {
+		return nil, nil, err
+	}
+	s2cData, err := ioutil.ReadAll(serverToClient)
+	if err != nil {
+		return nil, nil, err
+	}
+	s2c, deltas, s2cErr := decryptStream(s2cData, false, keys, nil)
+	c2s, _, err = decryptStream(c2sData, true, keys, deltas)
+	if s2cErr != nil {
+		err = s2cErr
+	}
+	return c2s, s2c, err
+}
+
+// decryptStream decrypts data, the stream of one direction. In the
+// server to client direction, it returns the shifts of the client's
+// sequence numbers announced by updateSessionParams requests. In the
+// other direction, those shifts are applied in order after each
+// confirmSessionParams request.
+func decryptStream(data []byte, clientToServer bool, keys []*KeyLogEntry, c2sDeltas []uint32) ([]DecodedPacket, []uint32, error) {
+	// Skip the version line, and any lines a server sends before it.
+	var offset int
+	for {
+		i := bytes.IndexByte(data[offset:], '\n')
+		if i < 0 {
+			return nil, nil, errors.New("ssh: no version line in stream")
+		}
+		line := data[offset : offset+i]
+		offset += i + 1
+		if bytes.HasPrefix(line, []byte("SSH-")) {
+			break
+		}
+	}
+
+	var (
+		packets []DecodedPacket
+		deltas  []uint32
+		cipher  packetCipher = &streamPacketCipher{cipher: noneCipher{}}
+		entry   *KeyLogEntry
+		seqNum  uint32
+		used    = make(map[*KeyLogEntry]bool)
+		z       *inflate.Inflater
+	)
+	for offset < len(data) {
+		rd := bytes.NewReader(data[offset:])
+		p, err := cipher.readPacket(seqNum, rd)
+		if err != nil {
+			return packets, deltas, fmt.Errorf("ssh: packet at offset %d with sequence number %d: %v", offset, seqNum, err)
+		}
+		if entry != nil && entry.Compression != compressionNone && z == nil && len(p) > 0 && p[0] == 0x78 {
+			z = &inflate.Inflater{}
+		}
+		if z != nil {
+			if p, err = z.Inflate(nil, p, maxPacket); err != nil {
+				return packets, deltas, fmt.Errorf("ssh: packet at offset %d: decompression failed: %v", offset, err)
+			}
+		}
+		// The cipher reuses its buffer.
+		if z == nil {
+			p = append([]byte(nil), p...)
+		}
+		packets = append(packets, DecodedPacket{Offset: int64(offset), SeqNum: seqNum, Payload: p})
+		seqNum++
+
+		// The packet after a session parameters update, or its
+		// confirmation, continues with the sequence numbers of the
+		// proxy's connection to the server.
+		if msg := sessionParamsRequest(p); msg != nil {
+			switch {
+			case msg.Type == updateSessionParamsReqId && !clientToServer:
+				var params updateSessionParams
+				if err := Unmarshal(msg.Data, &params); err != nil {
+					return packets, deltas, fmt.Errorf("ssh: packet at offset %d: %v", offset, err)
+				}
+				seqNum += params.DeltaS2C
+				deltas = append(deltas, params.DeltaC2S)
+			case msg.Type == confirmSessionParamsReqId && clientToServer:
+				if len(c2sDeltas) == 0 {
+					return packets, deltas, fmt.Errorf("ssh: packet at offset %d: session parameters confirmed without a known update", offset)
+				}
+				seqNum += c2sDeltas[0]
+				c2sDeltas = c2sDeltas[1:]
+			}
+		}
+		offset = len(data) - rd.Len()
+
+		if len(p) == 0 || p[0] != msgNewKeys || offset == len(data) {
+			continue
+		}
+		cipher, entry, seqNum, err = nextKeys(data[offset:], clientToServer, keys, used, seqNum)
+		if err != nil {
+			return packets, deltas, fmt.Errorf("ssh: packet at offset %d: %v", offset, err)
+		}
+		used[entry] = true
+		z = nil
+	}
+	return packets, deltas, nil
+}
+
+// sessionParamsRequest returns p if it is a session parameters
+// request, and nil otherwise.
+func sessionParamsRequest(p []byte) *globalRequestMsg {
+	if len(p) == 0 || p[0] != msgGlobalRequest {
+		return nil
+	}
+	var msg globalRequestMsg
+	if Unmarshal(p, &msg) != nil {
+		return nil
+	}
+	if msg.Type != updateSessionParamsReqId && msg.Type != confirmSessionParamsReqId {
+		return nil
+	}
+	return &msg
+}
+
+// nextKeys returns the cipher of the first unused entry that decrypts
+// the start of data, which follows msgNewKeys, and the sequence number
+// to decrypt it with.
+func nextKeys(data []byte, clientToServer bool, keys []*KeyLogEntry, used map[*KeyLogEntry]bool, seqNum uint32) (packetCipher, *KeyLogEntry, uint32, error) {
+	for _, e := range keys {
+		if used[e] || e.ClientToServer != clientToServer {
+			continue
+		}
+		mode := cipherModes[e.Cipher]
+		if mode == nil || (!mode.aead() && macModes[e.MAC] == nil) {
+			continue
+		}
+		seq := seqNum
+		if e.Strict {
+			seq = 0
+		}
+		algs := directionAlgorithms{Cipher: e.Cipher, MAC: e.MAC, Compression: e.Compression}
+		// Some ciphers advance the IV in place, so give each its own.
+		trial, err := mode.create(append([]byte(nil), e.IV...), e.Key, e.MACKey, algs)
+		if err != nil {
+			continue
+		}
+		if _, err := trial.readPacket(seq, bytes.NewReader(data)); err != nil {
+			continue
+		}
+		// The trial consumed the first packet, so start over.
+		c, _ := mode.create(append([]byte(nil), e.IV...), e.Key, e.MACKey, algs)
+		return c, e, seq, nil
+	}
+	return nil, nil, 0, fmt.Errorf("no logged keys decrypt the packet after msgNewKeys with sequence number %d or 0", seqNum)
+}
@@ -0,0 +1,275 @@
+package ssh
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// captureConn records what is written to and read from a connection.
+type captureConn struct {
+	net.Conn
+
+	mu            sync.Mutex
+	written, read bytes.Buffer
+}
+
+func (c *captureConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.mu.Lock()
+	c.written.Write(b[:n])
+	c.mu.Unlock()
+	return n, err
+}
+
+func (c *captureConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.mu.Lock()
+	c.read.Write(b[:n])
+	c.mu.Unlock()
+	return n, err
+}
+
+// channelData returns the data of the msgChannelData packets.
+func channelData(packets []DecodedPacket) string {
+	var data []byte
+	for _, p := range packets {
+		var msg channelDataMsg
+		if len(p.Payload) > 0 && p.Payload[0] == msgChannelData && Unmarshal(p.Payload, &msg) == nil {
+			data = append(data, msg.Rest...)
+		}
+	}
+	return string(data)
+}
+
+func TestKeyLogDecryptStream(t *testing.T) {
+	for _, algs := range []directionAlgorithms{
+		{Cipher: chacha20Poly1305ID, Compression: compressionNone},
+		{Cipher: "aes128-ctr", MAC: "hmac-sha2-256-etm@openssh.com", Compression: compressionZlibOpenSSH},
+		{Cipher: gcmCipherID, Compression: compressionZlib},
+		{Cipher: "aes256-ctr", MAC: "hmac-sha1", Compression: compressionNone},
+	} {
+		c1, c2, err := netPipe()
+		if err != nil {
+			t.Fatalf("netPipe: %v", err)
+		}
+		capture := &captureConn{Conn: c2}
+
+		config := Config{Ciphers: []string{algs.Cipher}, Compressions: []string{algs.Compression}}
+		if algs.MAC != "" {
+			config.MACs = []string{algs.MAC}
+		}
+		serverConf := &ServerConfig{Config: config, NoClientAuth: true}
+		serverConf.AddHostKey(testSigners["ecdsa"])
+		go func() {
+			defer c1.Close()
+			_, chans, reqs, err := NewServerConn(c1, serverConf)
+			if err != nil {
+				t.Errorf("NewServerConn: %v", err)
+				return
+			}
+			go DiscardRequests(reqs)
+			for newCh := range chans {
+				ch, reqs, err := newCh.Accept()
+				if err != nil {
+					continue
+				}
+				go DiscardRequests(reqs)
+				go io.Copy(ch, ch)
+			}
+		}()
+
+		var keyLog bytes.Buffer
+		var kexes int32
+		clientConf := &ClientConfig{
+			Config:          config,
+			User:            "testuser",
+			HostKeyCallback: InsecureIgnoreHostKey(),
+		}
+		clientConf.KeyLogWriter = &keyLog
+		clientConf.KexCallback = func() { atomic.AddInt32(&kexes, 1) }
+		conn, chans, reqs, err := NewClientConn(capture, "", clientConf)
+		if err != nil {
+			t.Fatalf("%s: NewClientConn: %v", algs.Cipher, err)
+		}
+		client := NewClient(conn, chans, reqs)
+
+		ch, _, err := client.OpenChannel("session", nil)
+		if err != nil {
+			t.Fatalf("%s: OpenChannel: %v", algs.Cipher, err)
+		}
+		buf := make([]byte, 6)
+		for i, msg := range []string{"first!", "second"} {
+			if i == 1 {
+				conn.(*connection).RequestKeyChange()
+				for atomic.LoadInt32(&kexes) < 2 {
+					time.Sleep(time.Millisecond)
+				}
+			}
+			io.WriteString(ch, msg)
+			if _, err := io.ReadFull(ch, buf); err != nil {
+				t.Fatalf("%s: ReadFull: %v", algs.Cipher, err)
+			}
+		}
+		client.Close()
+
+		keys, err := ParseKeyLog(&keyLog)
+		if err != nil {
+			t.Fatalf("%s: ParseKeyLog: %v", algs.Cipher, err)
+		}
+		if len(keys) != 4 {
+			t.Fatalf("%s: got %d key log entries, want 4", algs.Cipher, len(keys))
+		}
+		for _, e := range keys {
+			if e.Cipher != algs.Cipher || e.MAC != algs.MAC || e.Compression != algs.Compression || !e.Strict {
+				t.Errorf("%s: got entry for %s, %q, %s, strict %v", algs.Cipher, e.Cipher, e.MAC, e.Compression, e.Strict)
+			}
+		}
+
+		capture.mu.Lock()
+		for _, dir := range []struct {
+			data           []byte
+			clientToServer bool
+		}{
+			{capture.written.Bytes(), true},
+			{capture.read.Bytes(), false},
+		} {
+			packets, err := DecryptStream(bytes.NewReader(dir.data), dir.clientToServer, keys)
+			if err != nil {
+				t.Fatalf("%s: DecryptStream(clientToServer = %v): %v", algs.Cipher, dir.clientToServer, err)
+			}
+			if got := channelData(packets); got != "first!second" {
+				t.Errorf("%s: got channel data %q, want %q", algs.Cipher, got, "first!second")
+			}
+
+			// With strict key exchange, sequence numbers restart
+			// after each msgNewKeys.
+			var newKeys int
+			for i, p := range packets {
+				want := uint32(0)
+				if i > 0 && packets[i-1].Payload[0] != msgNewKeys {
+					want = packets[i-1].SeqNum + 1
+				}
+				if p.SeqNum != want {
+					t.Errorf("%s: packet %d has sequence number %d, want %d", algs.Cipher, i, p.SeqNum, want)
+				}
+				if p.Payload[0] == msgNewKeys {
+					newKeys++
+				}
+			}
+			if newKeys != 2 {
+				t.Errorf("%s: got %d msgNewKeys, want 2", algs.Cipher, newKeys)
+			}
+		}
+		capture.mu.Unlock()
+	}
+}
+
+func TestParseKeyLog(t *testing.T) {
+	log := "# comment\n\n" +
+		"SSH_KEYS 0102 0304 server-to-client aes128-gcm@openssh.com - none 0 aabb ccdd -\n"
+	keys, err := ParseKeyLog(strings.NewReader(log))
+	if err != nil {
+		t.Fatalf("ParseKeyLog: %v", err)
+	}
+	if len(keys) != 1 {
+		t.Fatalf("got %d entries, want 1", len(keys))
+	}
+	e := keys[0]
+	if !bytes.Equal(e.SessionID, []byte{1, 2}) || !bytes.Equal(e.ExchangeHash, []byte{3, 4}) ||
+		e.ClientToServer || e.Cipher != gcmCipherID || e.MAC != "" || e.Compression != "none" || e.Strict ||
+		!bytes.Equal(e.IV, []byte{0xaa, 0xbb}) || !bytes.Equal(e.Key, []byte{0xcc, 0xdd}) || e.MACKey != nil {
+		t.Errorf("got %+v", e)
+	}
+
+	for _, bad := range []string{
+		"SSH_KEYS 0102 0304 server-to-client aes128-ctr hmac-sha1 none 0 aabb ccdd\n",
+		"SSH_KEYS 0102 0304 sideways aes128-ctr hmac-sha1 none 0 aabb ccdd eeff\n",
+		"SSH_KEYS 0102 0304 server-to-client aes128-ctr hmac-sha1 none 2 aabb ccdd eeff\n",
+		"SSH_KEYS 0102 0304 server-to-client aes128-ctr hmac-sha1 none 0 aabb ccdd xx\n",
+	} {
+		if _, err := ParseKeyLog(strings.NewReader(bad)); err == nil {
+			t.Errorf("ParseKeyLog(%q) succeeded", bad)
+		}
+	}
+}
+
+func TestKeyLogHandoff(t *testing.T) {
+	for _, strict := range []bool{true, false} {
+		fil, err := NewPolicyFilter(&Policy{
+			Commands: []CommandRule{{Rule: Rule{Decision: Allow}, Match: MatchGlob, Pattern: "*"}},
+			Channels: []ChannelRule{{Rule: Rule{Decision: Allow}, Type: "session"}},
+		}, nil)
+		if err != nil {
+			t.Fatalf("NewPolicyFilter: %v", err)
+		}
+		var capture *captureConn
+		var keyLog bytes.Buffer
+		clientConf := &ClientConfig{
+			HostKeyCallback:          InsecureIgnoreHostKey(),
+			DeferHostKeyVerification: true,
+		}
+		clientConf.KeyLogWriter = &keyLog
+		client, pc, serverConns := proxyTestClientWrapped(t, func(c net.Conn) net.Conn {
+			capture = &captureConn{Conn: c}
+			return capture
+		}, &ProxyConfig{Filter: fil}, clientConf, &ServerConfig{})
+		done := pc.Run()
+		if ok, _, err := client.SendRequest(NoMoreSessionRequestName, true, nil); err != nil || !ok {
+			t.Fatalf("no-more-sessions: %v, %v", ok, err)
+		}
+		server := <-serverConns
+		if !strict {
+			nonStrictServer(pc, server)
+		}
+
+		checkEcho(t, client, 10)
+		handoff(t, client, pc, done)
+		checkEcho(t, client, 20)
+		client.Close()
+
+		keys, err := ParseKeyLog(&keyLog)
+		if err != nil {
+			t.Fatalf("ParseKeyLog: %v", err)
+		}
+		capture.mu.Lock()
+		c2s, s2c, err := DecryptConnection(bytes.NewReader(capture.written.Bytes()), bytes.NewReader(capture.read.Bytes()), keys)
+		capture.mu.Unlock()
+		if err != nil {
+			t.Fatalf("strict %v: DecryptConnection: %v", strict, err)
+		}
+		want := strings.Repeat("x", 10) + strings.Repeat("x", 20)
+		if got := channelData(s2c); got != want {
+			t.Errorf("strict %v: got channel data %q, want %q", strict, got, want)
+		}
+
+		// The packet after the update, and after its confirmation,
+		// continues with the sequence numbers of the server.
+		for _, dir := range []struct {
+			packets []DecodedPacket
+			reqType string
+		}{
+			{s2c, updateSessionParamsReqId},
+			{c2s, confirmSessionParamsReqId},
+		} {
+			var found bool
+			for i, p := range dir.packets[:len(dir.packets)-1] {
+				if msg := sessionParamsRequest(p.Payload); msg == nil || msg.Type != dir.reqType {
+					continue
+				}
+				found = true
+				if next := dir.packets[i+1].SeqNum; next == p.SeqNum+1 {
+					t.Errorf("strict %v: sequence number after %s did not change", strict, dir.reqType)
+				}
+			}
+			if !found {
+				t.Errorf("strict %v: no %s in capture", strict, dir.reqType)
+			}
+		}
+	}
+}
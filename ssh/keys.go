@@ -37,6 +37,13 @@ const (
 	KeyAlgoECDSA521 = "ecdsa-sha2-nistp521"
 	KeyAlgoED25519  = "ssh-ed25519"
 	KeyAlgoNone     = "none"
+
+	// KeyAlgoRSASHA256 and KeyAlgoRSASHA512 are only public key
+	// algorithms, not public key formats, so they can't appear as
+	// a PublicKey.Type. They name RSA signatures with SHA-2 hashes,
+	// as defined in RFC 8332.
+	KeyAlgoRSASHA256 = "rsa-sha2-256"
+	KeyAlgoRSASHA512 = "rsa-sha2-512"
 )
 
 // parsePubKey parses a public key of the given algorithm.
@@ -63,6 +70,31 @@ func parsePubKey(in []byte, algo string) (pubKey PublicKey, rest []byte, err err
 	return nil, nil, fmt.Errorf("ssh: unknown key algorithm: %v", algo)
 }
 
+// algorithmsForKeyFormat returns the public key algorithms that may be
+// used with a key of the given format, as returned by PublicKey.Type,
+// in order of preference.
+func algorithmsForKeyFormat(keyFormat string) []string {
+	switch keyFormat {
+	case KeyAlgoRSA:
+		return []string{KeyAlgoRSASHA512, KeyAlgoRSASHA256, KeyAlgoRSA}
+	case CertAlgoRSAv01:
+		return []string{CertAlgoRSASHA512v01, CertAlgoRSASHA256v01, CertAlgoRSAv01}
+	default:
+		return []string{keyFormat}
+	}
+}
+
+// signerAlgorithms returns the public key algorithms signer can sign
+// with, in order of preference. Only an AlgorithmSigner can choose
+// another algorithm than the default of its key.
+func signerAlgorithms(signer Signer) []string {
+	keyFormat := signer.PublicKey().Type()
+	if _, ok := signer.(AlgorithmSigner); ok {
+		return algorithmsForKeyFormat(keyFormat)
+	}
+	return []string{keyFormat}
+}
+
 // parseAuthorizedKey parses a public key in OpenSSH authorized_keys format
 // (see sshd(8) manual page) once the options and key type fields have been
 // removed.
@@ -303,6 +335,20 @@ type Signer interface {
 	Sign(rand io.Reader, data []byte) (*Signature, error)
 }
 
+// An AlgorithmSigner is a Signer that also supports specifying an
+// algorithm to use for signing, such as KeyAlgoRSASHA256 for an RSA
+// key.
+type AlgorithmSigner interface {
+	Signer
+
+	// SignWithAlgorithm is like Signer.Sign, but allows specifying a
+	// desired signing algorithm. Callers may pass an empty string for
+	// the algorithm, in which case the AlgorithmSigner uses the
+	// default algorithm of the key type. An error is returned if the
+	// algorithm is not compatible with the key.
+	SignWithAlgorithm(rand io.Reader, data []byte, algorithm string) (*Signature, error)
+}
+
 type rsaPublicKey rsa.PublicKey
 
 func (r *rsaPublicKey) Type() string {
@@ -351,13 +397,22 @@ func (r *rsaPublicKey) Marshal() []byte {
 }
 
 func (r *rsaPublicKey) Verify(data []byte, sig *Signature) error {
-	if sig.Format != r.Type() {
+	hashFunc, ok := rsaHashFuncs[sig.Format]
+	if !ok {
 		return fmt.Errorf("ssh: signature type %s for key type %s", sig.Format, r.Type())
 	}
-	h := crypto.SHA1.New()
+	h := hashFunc.New()
 	h.Write(data)
 	digest := h.Sum(nil)
-	return rsa.VerifyPKCS1v15((*rsa.PublicKey)(r), crypto.SHA1, digest, sig.Blob)
+	return rsa.VerifyPKCS1v15((*rsa.PublicKey)(r), hashFunc, digest, sig.Blob)
+}
+
+// rsaHashFuncs maps the signature algorithms of RSA keys to their
+// hashes.
+var rsaHashFuncs = map[string]crypto.Hash{
+	KeyAlgoRSA:       crypto.SHA1,
+	KeyAlgoRSASHA256: crypto.SHA256,
+	KeyAlgoRSASHA512: crypto.SHA512,
 }
 
 func (r *rsaPublicKey) CryptoPublicKey() crypto.PublicKey {
@@ -734,10 +789,22 @@ func (s *wrappedSigner) PublicKey() PublicKey {
 }
 
 func (s *wrappedSigner) Sign(rand io.Reader, data []byte) (*Signature, error) {
-	var hashFunc crypto.Hash
+	return s.SignWithAlgorithm(rand, data, "")
+}
 
+func (s *wrappedSigner) SignWithAlgorithm(rand io.Reader, data []byte, algorithm string) (*Signature, error) {
+	if algorithm == "" {
+		algorithm = s.pubKey.Type()
+	}
+
+	var hashFunc crypto.Hash
 	switch key := s.pubKey.(type) {
-	case *rsaPublicKey, *dsaPublicKey:
+	case *rsaPublicKey:
+		var ok bool
+		if hashFunc, ok = rsaHashFuncs[algorithm]; !ok {
+			return nil, fmt.Errorf("ssh: unsupported signature algorithm %s for key type %s", algorithm, key.Type())
+		}
+	case *dsaPublicKey:
 		hashFunc = crypto.SHA1
 	case *ecdsaPublicKey:
 		hashFunc = ecHash(key.Curve)
@@ -745,6 +812,9 @@ func (s *wrappedSigner) Sign(rand io.Reader, data []byte) (*Signature, error) {
 	default:
 		return nil, fmt.Errorf("ssh: unsupported key type %T", key)
 	}
+	if _, ok := s.pubKey.(*rsaPublicKey); !ok && algorithm != s.pubKey.Type() {
+		return nil, fmt.Errorf("ssh: unsupported signature algorithm %s for key type %s", algorithm, s.pubKey.Type())
+	}
 
 	var digest []byte
 	if hashFunc != 0 {
@@ -788,7 +858,7 @@ func (s *wrappedSigner) Sign(rand io.Reader, data []byte) (*Signature, error) {
 	}
 
 	return &Signature{
-		Format: s.pubKey.Type(),
+		Format: algorithm,
 		Blob:   signature,
 	}, nil
 }
@@ -107,6 +107,44 @@ func TestKeySignVerify(t *testing.T) {
 	}
 }
 
+func TestRSASignatureAlgorithms(t *testing.T) {
+	signer := testSigners["rsa"].(AlgorithmSigner)
+	data := []byte("sign me")
+	for _, algo := range []string{KeyAlgoRSA, KeyAlgoRSASHA256, KeyAlgoRSASHA512} {
+		sig, err := signer.SignWithAlgorithm(rand.Reader, data, algo)
+		if err != nil {
+			t.Fatalf("SignWithAlgorithm(%s): %v", algo, err)
+		}
+		if sig.Format != algo {
+			t.Errorf("got signature format %s, want %s", sig.Format, algo)
+		}
+		if err := signer.PublicKey().Verify(data, sig); err != nil {
+			t.Errorf("Verify(%s): %v", algo, err)
+		}
+
+		// The format names the hash, which the signature must use.
+		for _, other := range []string{KeyAlgoRSA, KeyAlgoRSASHA256, KeyAlgoRSASHA512} {
+			if other == algo {
+				continue
+			}
+			forged := &Signature{Format: other, Blob: sig.Blob}
+			if err := signer.PublicKey().Verify(data, forged); err == nil {
+				t.Errorf("%s signature verified as %s", algo, other)
+			}
+		}
+	}
+
+	if sig, err := signer.SignWithAlgorithm(rand.Reader, data, ""); err != nil || sig.Format != KeyAlgoRSA {
+		t.Errorf("got %v, %v for the default algorithm, want an ssh-rsa signature", sig, err)
+	}
+	if _, err := signer.SignWithAlgorithm(rand.Reader, data, KeyAlgoECDSA256); err == nil {
+		t.Errorf("RSA key signed with %s", KeyAlgoECDSA256)
+	}
+	if _, err := testSigners["ecdsa"].(AlgorithmSigner).SignWithAlgorithm(rand.Reader, data, KeyAlgoRSASHA256); err == nil {
+		t.Errorf("ECDSA key signed with %s", KeyAlgoRSASHA256)
+	}
+}
+
 func TestParseRSAPrivateKey(t *testing.T) {
 	key := testPrivateKeys["rsa"]
 
@@ -10,7 +10,10 @@ import (
 	"crypto/hmac"
 	"crypto/sha1"
 	"crypto/sha256"
+	"crypto/sha512"
 	"hash"
+
+	"golang.org/x/crypto/internal/umac"
 )
 
 type macMode struct {
@@ -45,10 +48,69 @@ func (t truncatingMAC) Size() int {
 
 func (t truncatingMAC) BlockSize() int { return t.hmac.BlockSize() }
 
+// umacHash adapts UMAC to the hash.Hash interface the packet ciphers
+// use. As in OpenSSH, UMAC does not authenticate the sequence number,
+// which the ciphers write first, but takes it as its nonce.
+type umacHash struct {
+	mac *umac.MAC
+
+	// nonce is the sequence number as a 64-bit big-endian integer,
+	// of which n bytes were written.
+	nonce [8]byte
+	n     int
+}
+
+func newUMAC(key []byte, size int) hash.Hash {
+	mac, err := umac.New(key, size)
+	if err != nil {
+		panic(err)
+	}
+	return &umacHash{mac: mac}
+}
+
+func (u *umacHash) Write(data []byte) (int, error) {
+	n := len(data)
+	if u.n < 4 {
+		c := copy(u.nonce[4+u.n:], data)
+		u.n += c
+		data = data[c:]
+	}
+	u.mac.Write(data)
+	return n, nil
+}
+
+func (u *umacHash) Sum(in []byte) []byte {
+	return u.mac.Sum(in, u.nonce[:])
+}
+
+func (u *umacHash) Reset() {
+	u.mac.Reset()
+	u.n = 0
+}
+
+func (u *umacHash) Size() int { return u.mac.Size() }
+
+func (u *umacHash) BlockSize() int { return 32 }
+
 var macModes = map[string]*macMode{
+	"hmac-sha2-512-etm@openssh.com": {64, true, func(key []byte) hash.Hash {
+		return hmac.New(sha512.New, key)
+	}},
 	"hmac-sha2-256-etm@openssh.com": {32, true, func(key []byte) hash.Hash {
 		return hmac.New(sha256.New, key)
 	}},
+	"hmac-sha1-etm@openssh.com": {20, true, func(key []byte) hash.Hash {
+		return hmac.New(sha1.New, key)
+	}},
+	"umac-64-etm@openssh.com": {umac.KeySize, true, func(key []byte) hash.Hash {
+		return newUMAC(key, 8)
+	}},
+	"umac-128-etm@openssh.com": {umac.KeySize, true, func(key []byte) hash.Hash {
+		return newUMAC(key, 16)
+	}},
+	"hmac-sha2-512": {64, false, func(key []byte) hash.Hash {
+		return hmac.New(sha512.New, key)
+	}},
 	"hmac-sha2-256": {32, false, func(key []byte) hash.Hash {
 		return hmac.New(sha256.New, key)
 	}},
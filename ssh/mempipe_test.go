@@ -66,6 +66,14 @@ func (t *memTransport) writePacket(p []byte) error {
 	return nil
 }
 
+func (t *memTransport) buffered() int {
+	return 0
+}
+
+func (t *memTransport) bufferedBytes() []byte {
+	return nil
+}
+
 func memPipe() (a, b packetConn) {
 	t1 := memTransport{}
 	t2 := memTransport{}
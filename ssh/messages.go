@@ -12,6 +12,7 @@ import (
 	"io"
 	"math/big"
 	"reflect"
+	"sort"
 	"strconv"
 	"strings"
 )
@@ -101,6 +102,36 @@ type kexDHReplyMsg struct {
 	Signature []byte
 }
 
+// See RFC 4419, section 5.
+const msgKexDHGexGroup = 31
+
+type kexDHGexGroupMsg struct {
+	P *big.Int `sshtype:"31"`
+	G *big.Int
+}
+
+const msgKexDHGexInit = 32
+
+type kexDHGexInitMsg struct {
+	X *big.Int `sshtype:"32"`
+}
+
+const msgKexDHGexReply = 33
+
+type kexDHGexReplyMsg struct {
+	HostKey   []byte `sshtype:"33"`
+	Y         *big.Int
+	Signature []byte
+}
+
+const msgKexDHGexRequest = 34
+
+type kexDHGexRequestMsg struct {
+	MinBits       uint32 `sshtype:"34"`
+	PreferredBits uint32
+	MaxBits       uint32
+}
+
 // See RFC 4253, section 10.
 const msgServiceRequest = 5
 
@@ -115,6 +146,55 @@ type serviceAcceptMsg struct {
 	Service string `sshtype:"6"`
 }
 
+// See RFC 8308, section 2.3.
+const msgExtInfo = 7
+
+type extInfoMsg struct {
+	NumExtensions uint32 `sshtype:"7"`
+	Payload       []byte `ssh:"rest"`
+}
+
+// marshalExtInfo returns an extInfoMsg packet announcing extensions,
+// in the order of their names.
+func marshalExtInfo(extensions map[string][]byte) []byte {
+	names := make([]string, 0, len(extensions))
+	for name := range extensions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	msg := extInfoMsg{NumExtensions: uint32(len(names))}
+	for _, name := range names {
+		msg.Payload = appendString(msg.Payload, name)
+		msg.Payload = appendString(msg.Payload, string(extensions[name]))
+	}
+	return Marshal(&msg)
+}
+
+// parseExtInfo returns the extensions announced in an extInfoMsg
+// packet, by name.
+func parseExtInfo(packet []byte) (map[string][]byte, error) {
+	var msg extInfoMsg
+	if err := Unmarshal(packet, &msg); err != nil {
+		return nil, err
+	}
+	extensions := make(map[string][]byte)
+	payload := msg.Payload
+	for i := uint32(0); i < msg.NumExtensions; i++ {
+		name, rest, ok := parseString(payload)
+		if !ok {
+			return nil, parseError(msgExtInfo)
+		}
+		value, rest, ok := parseString(rest)
+		if !ok {
+			return nil, parseError(msgExtInfo)
+		}
+		extensions[string(name)] = value
+		payload = rest
+	}
+	return extensions, nil
+}
+
 // See RFC 4252, section 5.
 const msgUserAuthRequest = 50
 
@@ -728,12 +808,20 @@ func decode(packet []byte) (interface{}, error) {
 		msg = new(serviceRequestMsg)
 	case msgServiceAccept:
 		msg = new(serviceAcceptMsg)
+	case msgExtInfo:
+		msg = new(extInfoMsg)
 	case msgKexInit:
 		msg = new(kexInitMsg)
 	case msgKexDHInit:
 		msg = new(kexDHInitMsg)
 	case msgKexDHReply:
 		msg = new(kexDHReplyMsg)
+	case msgKexDHGexInit:
+		msg = new(kexDHGexInitMsg)
+	case msgKexDHGexReply:
+		msg = new(kexDHGexReplyMsg)
+	case msgKexDHGexRequest:
+		msg = new(kexDHGexRequestMsg)
 	case msgUserAuthRequest:
 		msg = new(userAuthRequestMsg)
 	case msgUserAuthSuccess:
@@ -286,3 +286,24 @@ func BenchmarkUnmarshalKexDHInitMsg(b *testing.B) {
 		Unmarshal(_kexDHInit, m)
 	}
 }
+
+func TestExtInfo(t *testing.T) {
+	extensions := map[string][]byte{
+		extServerSigAlgs:  []byte("ssh-ed25519,rsa-sha2-512"),
+		"no-flow-control": []byte("p"),
+		"empty":           {},
+	}
+	packet := marshalExtInfo(extensions)
+	got, err := parseExtInfo(packet)
+	if err != nil {
+		t.Fatalf("parseExtInfo: %v", err)
+	}
+	if !reflect.DeepEqual(got, extensions) {
+		t.Errorf("got %q, want %q", got, extensions)
+	}
+
+	// A truncated payload is an error.
+	if _, err := parseExtInfo(packet[:len(packet)-1]); err == nil {
+		t.Error("parseExtInfo succeeded on a truncated packet")
+	}
+}
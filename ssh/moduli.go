@@ -0,0 +1,154 @@
+package ssh
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+// Modulus is a group offered by a server in Diffie-Hellman group
+// exchange, as described in RFC 4419.
+type Modulus struct {
+	Generator *big.Int
+	Prime     *big.Int
+}
+
+// ModuliSource supplies the groups a server offers in Diffie-Hellman
+// group exchange.
+type ModuliSource interface {
+	// Moduli returns the groups to choose from. It is called for
+	// each group exchange, so a source may reload a file. Groups
+	// that are incomplete or unfit for Diffie-Hellman are skipped.
+	Moduli() ([]Modulus, error)
+}
+
+// ModuliList is a ModuliSource that always offers the same groups.
+type ModuliList []Modulus
+
+// Moduli returns l.
+func (l ModuliList) Moduli() ([]Modulus, error) {
+	return l, nil
+}
+
+// These are the MODP groups of RFC 3526, all with generator 2.
+const (
+	modp2048 = "FFFFFFFFFFFFFFFFC90FDAA22168C234C4C6628B80DC1CD129024E088A67CC74020BBEA63B139B22514A08798E3404DDEF9519B3CD3A431B302B0A6DF25F14374FE1356D6D51C245E485B576625E7EC6F44C42E9A637ED6B0BFF5CB6F406B7EDEE386BFB5A899FA5AE9F24117C4B1FE649286651ECE45B3DC2007CB8A163BF0598DA48361C55D39A69163FA8FD24CF5F83655D23DCA3AD961C62F356208552BB9ED529077096966D670C354E4ABC9804F1746C08CA18217C32905E462E36CE3BE39E772C180E86039B2783A2EC07A28FB5C55DF06F4C52C9DE2BCBF6955817183995497CEA956AE515D2261898FA051015728E5A8AACAA68FFFFFFFFFFFFFFFF"
+	modp3072 = "FFFFFFFFFFFFFFFFC90FDAA22168C234C4C6628B80DC1CD129024E088A67CC74020BBEA63B139B22514A08798E3404DDEF9519B3CD3A431B302B0A6DF25F14374FE1356D6D51C245E485B576625E7EC6F44C42E9A637ED6B0BFF5CB6F406B7EDEE386BFB5A899FA5AE9F24117C4B1FE649286651ECE45B3DC2007CB8A163BF0598DA48361C55D39A69163FA8FD24CF5F83655D23DCA3AD961C62F356208552BB9ED529077096966D670C354E4ABC9804F1746C08CA18217C32905E462E36CE3BE39E772C180E86039B2783A2EC07A28FB5C55DF06F4C52C9DE2BCBF6955817183995497CEA956AE515D2261898FA051015728E5A8AAAC42DAD33170D04507A33A85521ABDF1CBA64ECFB850458DBEF0A8AEA71575D060C7DB3970F85A6E1E4C7ABF5AE8CDB0933D71E8C94E04A25619DCEE3D2261AD2EE6BF12FFA06D98A0864D87602733EC86A64521F2B18177B200CBBE117577A615D6C770988C0BAD946E208E24FA074E5AB3143DB5BFCE0FD108E4B82D120A93AD2CAFFFFFFFFFFFFFFFF"
+	modp4096 = "FFFFFFFFFFFFFFFFC90FDAA22168C234C4C6628B80DC1CD129024E088A67CC74020BBEA63B139B22514A08798E3404DDEF9519B3CD3A431B302B0A6DF25F14374FE1356D6D51C245E485B576625E7EC6F44C42E9A637ED6B0BFF5CB6F406B7EDEE386BFB5A899FA5AE9F24117C4B1FE649286651ECE45B3DC2007CB8A163BF0598DA48361C55D39A69163FA8FD24CF5F83655D23DCA3AD961C62F356208552BB9ED529077096966D670C354E4ABC9804F1746C08CA18217C32905E462E36CE3BE39E772C180E86039B2783A2EC07A28FB5C55DF06F4C52C9DE2BCBF6955817183995497CEA956AE515D2261898FA051015728E5A8AAAC42DAD33170D04507A33A85521ABDF1CBA64ECFB850458DBEF0A8AEA71575D060C7DB3970F85A6E1E4C7ABF5AE8CDB0933D71E8C94E04A25619DCEE3D2261AD2EE6BF12FFA06D98A0864D87602733EC86A64521F2B18177B200CBBE117577A615D6C770988C0BAD946E208E24FA074E5AB3143DB5BFCE0FD108E4B82D120A92108011A723C12A787E6D788719A10BDBA5B2699C327186AF4E23C1A946834B6150BDA2583E9CA2AD44CE8DBBBC2DB04DE8EF92E8EFC141FBECAA6287C59474E6BC05D99B2964FA090C3A2233BA186515BE7ED1F612970CEE2D7AFB81BDD762170481CD0069127D5B05AA993B4EA988D8FDDC186FFB7DC90A6C08F4DF435C934063199FFFFFFFFFFFFFFFF"
+	modp6144 = "FFFFFFFFFFFFFFFFC90FDAA22168C234C4C6628B80DC1CD129024E088A67CC74020BBEA63B139B22514A08798E3404DDEF9519B3CD3A431B302B0A6DF25F14374FE1356D6D51C245E485B576625E7EC6F44C42E9A637ED6B0BFF5CB6F406B7EDEE386BFB5A899FA5AE9F24117C4B1FE649286651ECE45B3DC2007CB8A163BF0598DA48361C55D39A69163FA8FD24CF5F83655D23DCA3AD961C62F356208552BB9ED529077096966D670C354E4ABC9804F1746C08CA18217C32905E462E36CE3BE39E772C180E86039B2783A2EC07A28FB5C55DF06F4C52C9DE2BCBF6955817183995497CEA956AE515D2261898FA051015728E5A8AAAC42DAD33170D04507A33A85521ABDF1CBA64ECFB850458DBEF0A8AEA71575D060C7DB3970F85A6E1E4C7ABF5AE8CDB0933D71E8C94E04A25619DCEE3D2261AD2EE6BF12FFA06D98A0864D87602733EC86A64521F2B18177B200CBBE117577A615D6C770988C0BAD946E208E24FA074E5AB3143DB5BFCE0FD108E4B82D120A92108011A723C12A787E6D788719A10BDBA5B2699C327186AF4E23C1A946834B6150BDA2583E9CA2AD44CE8DBBBC2DB04DE8EF92E8EFC141FBECAA6287C59474E6BC05D99B2964FA090C3A2233BA186515BE7ED1F612970CEE2D7AFB81BDD762170481CD0069127D5B05AA993B4EA988D8FDDC186FFB7DC90A6C08F4DF435C93402849236C3FAB4D27C7026C1D4DCB2602646DEC9751E763DBA37BDF8FF9406AD9E530EE5DB382F413001AEB06A53ED9027D831179727B0865A8918DA3EDBEBCF9B14ED44CE6CBACED4BB1BDB7F1447E6CC254B332051512BD7AF426FB8F401378CD2BF5983CA01C64B92ECF032EA15D1721D03F482D7CE6E74FEF6D55E702F46980C82B5A84031900B1C9E59E7C97FBEC7E8F323A97A7E36CC88BE0F1D45B7FF585AC54BD407B22B4154AACC8F6D7EBF48E1D814CC5ED20F8037E0A79715EEF29BE32806A1D58BB7C5DA76F550AA3D8A1FBFF0EB19CCB1A313D55CDA56C9EC2EF29632387FE8D76E3C0468043E8F663F4860EE12BF2D5B0B7474D6E694F91E6DCC4024FFFFFFFFFFFFFFFF"
+	modp8192 = "FFFFFFFFFFFFFFFFC90FDAA22168C234C4C6628B80DC1CD129024E088A67CC74020BBEA63B139B22514A08798E3404DDEF9519B3CD3A431B302B0A6DF25F14374FE1356D6D51C245E485B576625E7EC6F44C42E9A637ED6B0BFF5CB6F406B7EDEE386BFB5A899FA5AE9F24117C4B1FE649286651ECE45B3DC2007CB8A163BF0598DA48361C55D39A69163FA8FD24CF5F83655D23DCA3AD961C62F356208552BB9ED529077096966D670C354E4ABC9804F1746C08CA18217C32905E462E36CE3BE39E772C180E86039B2783A2EC07A28FB5C55DF06F4C52C9DE2BCBF6955817183995497CEA956AE515D2261898FA051015728E5A8AAAC42DAD33170D04507A33A85521ABDF1CBA64ECFB850458DBEF0A8AEA71575D060C7DB3970F85A6E1E4C7ABF5AE8CDB0933D71E8C94E04A25619DCEE3D2261AD2EE6BF12FFA06D98A0864D87602733EC86A64521F2B18177B200CBBE117577A615D6C770988C0BAD946E208E24FA074E5AB3143DB5BFCE0FD108E4B82D120A92108011A723C12A787E6D788719A10BDBA5B2699C327186AF4E23C1A946834B6150BDA2583E9CA2AD44CE8DBBBC2DB04DE8EF92E8EFC141FBECAA6287C59474E6BC05D99B2964FA090C3A2233BA186515BE7ED1F612970CEE2D7AFB81BDD762170481CD0069127D5B05AA993B4EA988D8FDDC186FFB7DC90A6C08F4DF435C93402849236C3FAB4D27C7026C1D4DCB2602646DEC9751E763DBA37BDF8FF9406AD9E530EE5DB382F413001AEB06A53ED9027D831179727B0865A8918DA3EDBEBCF9B14ED44CE6CBACED4BB1BDB7F1447E6CC254B332051512BD7AF426FB8F401378CD2BF5983CA01C64B92ECF032EA15D1721D03F482D7CE6E74FEF6D55E702F46980C82B5A84031900B1C9E59E7C97FBEC7E8F323A97A7E36CC88BE0F1D45B7FF585AC54BD407B22B4154AACC8F6D7EBF48E1D814CC5ED20F8037E0A79715EEF29BE32806A1D58BB7C5DA76F550AA3D8A1FBFF0EB19CCB1A313D55CDA56C9EC2EF29632387FE8D76E3C0468043E8F663F4860EE12BF2D5B0B7474D6E694F91E6DBE115974A3926F12FEE5E438777CB6A932DF8CD8BEC4D073B931BA3BC832B68D9DD300741FA7BF8AFC47ED2576F6936BA424663AAB639C5AE4F5683423B4742BF1C978238F16CBE39D652DE3FDB8BEFC848AD922222E04A4037C0713EB57A81A23F0C73473FC646CEA306B4BCBC8862F8385DDFA9D4B7FA2C087E879683303ED5BDD3A062B3CF5B3A278A66D2A13F83F44F82DDF310EE074AB6A364597E899A0255DC164F31CC50846851DF9AB48195DED7EA1B1D510BD7EE74D73FAF36BC31ECFA268359046F4EB879F924009438B481C6CD7889A002ED5EE382BC9190DA6FC026E479558E4475677E9AA9E3050E2765694DFC81F56E880B96E7160C980DD98EDD3DFFFFFFFFFFFFFFFFF"
+)
+
+// defaultModuli is offered if ServerConfig.Moduli is nil. Like OpenSSH
+// without a moduli file, it falls back to the RFC 3526 groups.
+var defaultModuli = func() ModuliList {
+	var moduli ModuliList
+	for _, hex := range []string{modp2048, modp3072, modp4096, modp6144, modp8192} {
+		p, _ := new(big.Int).SetString(hex, 16)
+		moduli = append(moduli, Modulus{Generator: big.NewInt(2), Prime: p})
+	}
+	return moduli
+}()
+
+// These are the values of the type and tests fields of an OpenSSH
+// moduli file that matter here.
+const (
+	moduliTypeSafe      = 2
+	moduliTestComposite = 0x01
+)
+
+// ParseModuli parses groups in the format of the OpenSSH moduli file,
+// described in moduli(5). Like sshd, it skips groups that are not
+// safe primes or whose primality was not tested. Groups with a size
+// that does not match their prime, or an unusable generator, are
+// errors.
+func ParseModuli(r io.Reader) (ModuliList, error) {
+	var moduli ModuliList
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || text[0] == '#' {
+			continue
+		}
+		m, ok, err := parseModulus(text)
+		if err != nil {
+			return nil, fmt.Errorf("ssh: moduli line %d: %v", line, err)
+		}
+		if ok {
+			moduli = append(moduli, m)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return moduli, nil
+}
+
+// parseModulus parses a line of a moduli file. It returns false if the
+// group is well-formed but not fit for use.
+func parseModulus(text string) (Modulus, bool, error) {
+	fields := strings.Fields(text)
+	if len(fields) != 7 {
+		return Modulus{}, false, errors.New("want 7 fields")
+	}
+	var values [4]uint64
+	for i, field := range fields[1:5] {
+		v, err := strconv.ParseUint(field, 10, 32)
+		if err != nil {
+			return Modulus{}, false, err
+		}
+		values[i] = v
+	}
+	typ, tests, tries, size := values[0], values[1], values[2], values[3]
+
+	var m Modulus
+	var ok bool
+	if m.Generator, ok = new(big.Int).SetString(fields[5], 16); !ok {
+		return Modulus{}, false, errors.New("malformed generator")
+	}
+	if m.Prime, ok = new(big.Int).SetString(fields[6], 16); !ok {
+		return Modulus{}, false, errors.New("malformed prime")
+	}
+	// The size is that of the prime minus one.
+	if uint64(m.Prime.BitLen()) != size+1 {
+		return Modulus{}, false, fmt.Errorf("prime has %d bits, want %d", m.Prime.BitLen(), size+1)
+	}
+	if err := m.check(); err != nil {
+		return Modulus{}, false, err
+	}
+
+	if typ != moduliTypeSafe || tests&moduliTestComposite != 0 || tests&^moduliTestComposite == 0 || tries == 0 {
+		return Modulus{}, false, nil
+	}
+	return m, true, nil
+}
+
+// group returns m as a dhGroup, leaving the hash to the caller.
+func (m Modulus) group() *dhGroup {
+	return &dhGroup{
+		g:       m.Generator,
+		p:       m.Prime,
+		pMinus1: new(big.Int).Sub(m.Prime, bigOne),
+	}
+}
+
+// check checks that m is usable for Diffie-Hellman: the prime is odd,
+// and the generator lies strictly between 1 and the prime minus one.
+// It does not test primality, which is expensive for large groups.
+func (m Modulus) check() error {
+	if m.Prime == nil || m.Generator == nil {
+		return errors.New("ssh: incomplete group")
+	}
+	if m.Prime.Bit(0) == 0 {
+		return errors.New("ssh: even group prime")
+	}
+	pMinus1 := new(big.Int).Sub(m.Prime, bigOne)
+	if m.Generator.Cmp(bigOne) <= 0 || m.Generator.Cmp(pMinus1) >= 0 {
+		return errors.New("ssh: group generator out of range")
+	}
+	return nil
+}
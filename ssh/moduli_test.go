@@ -0,0 +1,106 @@
+package ssh
+
+import (
+	"crypto/rand"
+	"fmt"
+	"math/big"
+	"strings"
+	"testing"
+)
+
+// moduliLine formats m as a line of an OpenSSH moduli file.
+func moduliLine(typ, tests, tries, size int, m Modulus) string {
+	return fmt.Sprintf("20240101000000 %d %d %d %d %X %X", typ, tests, tries, size, m.Generator, m.Prime)
+}
+
+func TestParseModuli(t *testing.T) {
+	m2048, m3072 := defaultModuli[0], defaultModuli[1]
+	file := strings.Join([]string{
+		"#    $OpenBSD: moduli,v 1.1 2024/01/01 00:00:00 user Exp $",
+		"# Time Type Tests Tries Size Generator Modulus",
+		moduliLine(2, 6, 100, 2047, m2048),
+		"",
+		moduliLine(2, 6, 100, 3071, m3072),
+		// Not a safe prime.
+		moduliLine(4, 6, 100, 3071, m3072),
+		// Composite, and untested.
+		moduliLine(2, 7, 100, 3071, m3072),
+		moduliLine(2, 0, 100, 3071, m3072),
+		// Not tried.
+		moduliLine(2, 6, 0, 3071, m3072),
+	}, "\n")
+	moduli, err := ParseModuli(strings.NewReader(file))
+	if err != nil {
+		t.Fatalf("ParseModuli: %v", err)
+	}
+	if len(moduli) != 2 || moduli[0].Prime.Cmp(m2048.Prime) != 0 || moduli[1].Prime.Cmp(m3072.Prime) != 0 {
+		t.Errorf("got %d groups, want the 2048- and 3072-bit ones", len(moduli))
+	}
+
+	for _, line := range []string{
+		moduliLine(2, 6, 100, 2048, m2048),
+		moduliLine(2, 6, 100, 2047, Modulus{Generator: big.NewInt(1), Prime: m2048.Prime}),
+		moduliLine(2, 6, 100, 2047, Modulus{Generator: big.NewInt(2), Prime: new(big.Int).Sub(m2048.Prime, bigOne)}),
+		"20240101000000 2 6 100 2047 2",
+		"20240101000000 2 6 100 2047 2 XYZ",
+	} {
+		if _, err := ParseModuli(strings.NewReader(line)); err == nil {
+			t.Errorf("ParseModuli(%.40q...) succeeded, want error", line)
+		}
+	}
+}
+
+func TestChooseModulus(t *testing.T) {
+	for _, test := range []struct {
+		min, preferred, max uint32
+		want                int
+	}{
+		{2048, 3072, 8192, 3072},
+		{2048, 3000, 8192, 3072},
+		{2048, 2048, 2048, 2048},
+		{1024, 1024, 1024, 0},
+		{1024, 5000, 5000, 4096},
+		{4097, 9000, 10000, 8192},
+		{8193, 9000, 10000, 0},
+	} {
+		request := kexDHGexRequestMsg{test.min, test.preferred, test.max}
+		m, err := chooseModulus(defaultModuli, request, rand.Reader)
+		if test.want == 0 {
+			if err == nil {
+				t.Errorf("%v: got a %d-bit group, want error", request, m.Prime.BitLen())
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v: %v", request, err)
+		} else if m.Prime.BitLen() != test.want {
+			t.Errorf("%v: got a %d-bit group, want %d bits", request, m.Prime.BitLen(), test.want)
+		}
+	}
+}
+
+func TestChooseModulusSkipsInvalid(t *testing.T) {
+	p := defaultModuli[0].Prime
+	even := new(big.Int).Sub(p, bigOne)
+	moduli := ModuliList{
+		{},
+		{Generator: big.NewInt(2)},
+		{Prime: p},
+		{Generator: big.NewInt(2), Prime: even},
+		{Generator: bigOne, Prime: p},
+		{Generator: new(big.Int).Sub(p, bigOne), Prime: p},
+	}
+	request := kexDHGexRequestMsg{2048, 2048, 8192}
+	if m, err := chooseModulus(moduli, request, rand.Reader); err == nil {
+		t.Fatalf("got group %+v from invalid moduli, want error", m)
+	}
+
+	moduli = append(moduli, defaultModuli[0])
+	m, err := chooseModulus(moduli, request, rand.Reader)
+	if err != nil {
+		t.Fatalf("chooseModulus: %v", err)
+	}
+	if m.Prime != p || m.Generator.Cmp(big.NewInt(2)) != 0 {
+		t.Errorf("got group %+v, want the valid one", m)
+	}
+}
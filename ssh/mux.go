@@ -91,12 +91,26 @@ type mux struct {
 
 	incomingChannels chan NewChannel
 
+	// globalSentMu protects globalReplies, which holds a channel for
+	// each global request awaiting a reply. Replies come in the order
+	// the requests were sent. globalReplies is nil once the loop
+	// exits.
 	globalSentMu     sync.Mutex
-	globalResponses  chan interface{}
+	globalReplies    []chan interface{}
 	incomingRequests chan *Request
 
 	errCond *sync.Cond
 	err     error
+
+	// closeErr, if set, is the error Wait returns once the loop
+	// exits, rather than that of reading from the closed connection.
+	// It is protected by errCond.L.
+	closeErr error
+
+	// closed is closed when the loop exits, and received is set
+	// whenever a packet arrives. It is accessed atomically.
+	closed   chan struct{}
+	received int32
 }
 
 // When debugging, each new chanList instantiation has a different
@@ -117,9 +131,10 @@ func newMux(p packetConn) *mux {
 	m := &mux{
 		conn:             p,
 		incomingChannels: make(chan NewChannel, chanSize),
-		globalResponses:  make(chan interface{}, 1),
+		globalReplies:    []chan interface{}{},
 		incomingRequests: make(chan *Request, chanSize),
 		errCond:          newCond(),
+		closed:           make(chan struct{}),
 	}
 	if debugMux {
 		m.chanList.offset = atomic.AddUint32(&globalOff, 1)
@@ -137,17 +152,34 @@ func (m *mux) sendMessage(msg interface{}) error {
 	return m.conn.writePacket(p)
 }
 
-func (m *mux) SendRequest(name string, wantReply bool, payload []byte) (bool, []byte, error) {
-	if wantReply {
-		m.globalSentMu.Lock()
-		defer m.globalSentMu.Unlock()
+// sendGlobalRequest sends msg and, if it wants a reply, returns the
+// channel the reply will be sent on. The channel is closed without a
+// reply if the connection ends first.
+func (m *mux) sendGlobalRequest(msg globalRequestMsg) (<-chan interface{}, error) {
+	if !msg.WantReply {
+		return nil, m.sendMessage(msg)
 	}
 
-	if err := m.sendMessage(globalRequestMsg{
+	m.globalSentMu.Lock()
+	defer m.globalSentMu.Unlock()
+	if m.globalReplies == nil {
+		return nil, io.EOF
+	}
+	if err := m.sendMessage(msg); err != nil {
+		return nil, err
+	}
+	reply := make(chan interface{}, 1)
+	m.globalReplies = append(m.globalReplies, reply)
+	return reply, nil
+}
+
+func (m *mux) SendRequest(name string, wantReply bool, payload []byte) (bool, []byte, error) {
+	reply, err := m.sendGlobalRequest(globalRequestMsg{
 		Type:      name,
 		WantReply: wantReply,
 		Data:      payload,
-	}); err != nil {
+	})
+	if err != nil {
 		return false, nil, err
 	}
 
@@ -155,7 +187,7 @@ func (m *mux) SendRequest(name string, wantReply bool, payload []byte) (bool, []
 		return false, nil, nil
 	}
 
-	msg, ok := <-m.globalResponses
+	msg, ok := <-reply
 	if !ok {
 		return false, nil, io.EOF
 	}
@@ -184,6 +216,16 @@ func (m *mux) Close() error {
 	return m.conn.Close()
 }
 
+// closeWithError closes the connection, and makes Wait return err.
+func (m *mux) closeWithError(err error) {
+	m.errCond.L.Lock()
+	if m.closeErr == nil {
+		m.closeErr = err
+	}
+	m.errCond.L.Unlock()
+	m.conn.Close()
+}
+
 // loop runs the connection machine. It will process packets until an
 // error is encountered. To synchronize on loop exit, use mux.Wait.
 func (m *mux) loop() {
@@ -198,14 +240,23 @@ func (m *mux) loop() {
 
 	close(m.incomingChannels)
 	close(m.incomingRequests)
-	close(m.globalResponses)
+	m.globalSentMu.Lock()
+	for _, reply := range m.globalReplies {
+		close(reply)
+	}
+	m.globalReplies = nil
+	m.globalSentMu.Unlock()
 
 	m.conn.Close()
 
 	m.errCond.L.Lock()
+	if m.closeErr != nil {
+		err = m.closeErr
+	}
 	m.err = err
 	m.errCond.Broadcast()
 	m.errCond.L.Unlock()
+	close(m.closed)
 
 	if debugMux {
 		log.Println("loop exit", err)
@@ -218,6 +269,7 @@ func (m *mux) onePacket() error {
 	if err != nil {
 		return err
 	}
+	atomic.StoreInt32(&m.received, 1)
 
 	if debugMux {
 		if packet[0] == msgChannelData || packet[0] == msgChannelExtendedData {
@@ -262,10 +314,17 @@ func (m *mux) handleGlobalPacket(packet []byte) error {
 			Payload:   msg.Data,
 			mux:       m,
 		}
-	case *globalRequestSuccessMsg, *globalRequestFailureMsg:
-		m.globalResponses <- msg
-	case *unimplementedMsg:
-		m.globalResponses <- msg
+	case *globalRequestSuccessMsg, *globalRequestFailureMsg, *unimplementedMsg:
+		m.globalSentMu.Lock()
+		if len(m.globalReplies) == 0 {
+			m.globalSentMu.Unlock()
+			// A reply to no request, which is ignored.
+			return nil
+		}
+		reply := m.globalReplies[0]
+		m.globalReplies = m.globalReplies[1:]
+		m.globalSentMu.Unlock()
+		reply <- msg
 	default:
 		panic(fmt.Sprintf("not a global message %#v", msg))
 	}
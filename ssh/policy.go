@@ -0,0 +1,467 @@
+package ssh
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Decision is the outcome of evaluating a client request against a
+// Policy.
+type Decision int
+
+const (
+	// Deny rejects the request. It is the zero value, so that an
+	// unset Rule never grants access by accident.
+	Deny Decision = iota
+
+	// Allow forwards the request to the server.
+	Allow
+
+	// Escalate forwards the request only if the Filter's
+	// escalation callback approves it.
+	Escalate
+)
+
+// String returns the keyword used for d in policy files.
+func (d Decision) String() string {
+	switch d {
+	case Deny:
+		return "deny"
+	case Allow:
+		return "allow"
+	case Escalate:
+		return "escalate"
+	}
+	return fmt.Sprintf("unknown decision %d", int(d))
+}
+
+// Rule describes what happens to a request it applies to.
+type Rule struct {
+	Decision Decision
+
+	// Message, if non-empty, is sent back to the client when the
+	// request is denied, in place of the default text. It is
+	// carried by channel open failures and disconnects; other
+	// failure replies have no room for a message.
+	Message string
+
+	// Disconnect, if set, makes a denial terminate the whole
+	// connection instead of failing only the offending request.
+	Disconnect bool
+}
+
+// MatchType selects how a CommandRule's Pattern is compared with
+// the requested command.
+type MatchType int
+
+const (
+	// MatchExact requires the command to equal the pattern.
+	MatchExact MatchType = iota
+
+	// MatchGlob treats the pattern as a wildcard expression in
+	// which '*' matches any run of characters and '?' matches
+	// any single character.
+	MatchGlob
+
+	// MatchRegexp treats the pattern as a regular expression in
+	// the syntax of package regexp. Like the other match types, it
+	// must match the whole command: the pattern is anchored at both
+	// ends.
+	MatchRegexp
+)
+
+// CommandRule applies to "exec" requests whose command matches
+// Pattern. A "shell" request is treated as a command equal to the
+// empty string.
+type CommandRule struct {
+	Rule
+	Match   MatchType
+	Pattern string
+
+	re *regexp.Regexp
+}
+
+func (r *CommandRule) matches(cmd string) bool {
+	switch r.Match {
+	case MatchExact:
+		return cmd == r.Pattern
+	case MatchGlob:
+		return wildcardMatch(r.Pattern, cmd)
+	case MatchRegexp:
+		return r.re != nil && r.re.MatchString(cmd)
+	}
+	return false
+}
+
+// ChannelRule applies to channel open requests whose type matches
+// the wildcard expression Type.
+type ChannelRule struct {
+	Rule
+	Type string
+}
+
+// RequestRule applies to channel requests other than "exec" and
+// "shell", such as "pty-req", "env" or "subsystem". Type is matched
+// exactly. For "env" and "subsystem" requests, Name is a wildcard
+// expression matched against the variable or subsystem name; an
+// empty Name matches any.
+type RequestRule struct {
+	Rule
+	Type string
+	Name string
+}
+
+// ForwardRule applies to port forwardings: the destination of a
+// "direct-tcpip" channel, or the bind address of a "tcpip-forward"
+// global request. Host is a wildcard expression; a Port of zero
+// matches any port.
+type ForwardRule struct {
+	Rule
+	Host string
+	Port uint32
+}
+
+// Policy decides which client requests a Filter lets through to the
+// server. Within each list, the first matching rule wins. Requests
+// that no rule matches are handled according to Default.
+type Policy struct {
+	Commands []CommandRule
+	Channels []ChannelRule
+	Requests []RequestRule
+	Forwards []ForwardRule
+
+	// MaxSessions limits the number of "session" channels the
+	// client may open over the lifetime of the connection. If
+	// zero, the number of sessions is not limited.
+	MaxSessions int
+
+	// Default applies to requests that no rule matches. The zero
+	// value denies them.
+	Default Rule
+}
+
+// compile prepares the policy for use, checking that all regular
+// expressions are valid.
+func (p *Policy) compile() error {
+	for i := range p.Commands {
+		r := &p.Commands[i]
+		if r.Match != MatchRegexp {
+			continue
+		}
+		re, err := regexp.Compile(`^(?:` + r.Pattern + `)$`)
+		if err != nil {
+			return fmt.Errorf("ssh: invalid command pattern %q: %v", r.Pattern, err)
+		}
+		r.re = re
+	}
+	return nil
+}
+
+func (p *Policy) command(cmd string) Rule {
+	for _, r := range p.Commands {
+		if r.matches(cmd) {
+			return r.Rule
+		}
+	}
+	return p.Default
+}
+
+func (p *Policy) channel(chanType string) Rule {
+	for _, r := range p.Channels {
+		if wildcardMatch(r.Type, chanType) {
+			return r.Rule
+		}
+	}
+	return p.Default
+}
+
+func (p *Policy) request(reqType, name string) Rule {
+	for _, r := range p.Requests {
+		if r.Type == reqType && (r.Name == "" || wildcardMatch(r.Name, name)) {
+			return r.Rule
+		}
+	}
+	return p.Default
+}
+
+func (p *Policy) forward(host string, port uint32) Rule {
+	for _, r := range p.Forwards {
+		if wildcardMatch(r.Host, host) && (r.Port == 0 || r.Port == port) {
+			return r.Rule
+		}
+	}
+	return p.Default
+}
+
+// stricter returns whichever of a and b is the more restrictive
+// rule. Deny is stricter than Escalate, which is stricter than Allow.
+func stricter(a, b Rule) Rule {
+	rank := func(d Decision) int {
+		switch d {
+		case Allow:
+			return 0
+		case Escalate:
+			return 1
+		}
+		return 2
+	}
+	if rank(b.Decision) > rank(a.Decision) {
+		return b
+	}
+	return a
+}
+
+// wildcardMatch reports whether str matches pat, in which '*'
+// matches any run of characters and '?' matches any single one.
+//
+// Only the last '*' is backtracked to, which is enough since it can
+// absorb whatever an earlier one would have, so the running time is at
+// most proportional to len(pat)*len(str) however many stars pat has.
+func wildcardMatch(pat, str string) bool {
+	p, s := 0, 0
+	star, next := -1, 0
+	for s < len(str) {
+		switch {
+		case p < len(pat) && (pat[p] == '?' || pat[p] == str[s]):
+			p++
+			s++
+		case p < len(pat) && pat[p] == '*':
+			star, next = p, s
+			p++
+		case star >= 0:
+			// Let the last star absorb one more character.
+			next++
+			p, s = star+1, next
+		default:
+			return false
+		}
+	}
+	for p < len(pat) && pat[p] == '*' {
+		p++
+	}
+	return p == len(pat)
+}
+
+// LoadPolicy reads and parses the policy file at path. See
+// ParsePolicy for the file format.
+func LoadPolicy(path string) (*Policy, error) {
+	in, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParsePolicy(in)
+}
+
+// ParsePolicy parses a policy in its textual form. Each non-empty
+// line holds one directive; '#' starts a comment. Arguments
+// containing spaces may be enclosed in double quotes, in which
+// backslash escapes the next character. The directives are:
+//
+//	command (exact|glob|regexp) PATTERN DECISION [OPTIONS]
+//	channel TYPE DECISION [OPTIONS]
+//	request TYPE [NAME] DECISION [OPTIONS]
+//	forward HOST:PORT DECISION [OPTIONS]
+//	max-sessions N
+//	default DECISION [OPTIONS]
+//
+// DECISION is one of allow, deny or escalate. OPTIONS are
+// message="TEXT", setting Rule.Message, and disconnect, setting
+// Rule.Disconnect. In a forward directive, a PORT of * matches any
+// port. Rules keep the order in which they appear in the file.
+func ParsePolicy(in []byte) (*Policy, error) {
+	p := &Policy{}
+	s := bufio.NewScanner(bytes.NewReader(in))
+	lineNum := 0
+	for s.Scan() {
+		lineNum++
+		fields, err := splitPolicyLine(s.Text())
+		if err != nil {
+			return nil, fmt.Errorf("ssh: policy line %d: %v", lineNum, err)
+		}
+		if len(fields) == 0 {
+			continue
+		}
+		if err := p.parseDirective(fields); err != nil {
+			return nil, fmt.Errorf("ssh: policy line %d: %v", lineNum, err)
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	if err := p.compile(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func (p *Policy) parseDirective(fields []string) error {
+	args := fields[1:]
+	switch fields[0] {
+	case "command":
+		if len(args) < 3 {
+			return errors.New("command needs a match type, a pattern and a decision")
+		}
+		var match MatchType
+		switch args[0] {
+		case "exact":
+			match = MatchExact
+		case "glob":
+			match = MatchGlob
+		case "regexp":
+			match = MatchRegexp
+		default:
+			return fmt.Errorf("unknown match type %q", args[0])
+		}
+		rule, err := parseRule(args[2:])
+		if err != nil {
+			return err
+		}
+		p.Commands = append(p.Commands, CommandRule{Rule: rule, Match: match, Pattern: args[1]})
+	case "channel":
+		if len(args) < 2 {
+			return errors.New("channel needs a type and a decision")
+		}
+		rule, err := parseRule(args[1:])
+		if err != nil {
+			return err
+		}
+		p.Channels = append(p.Channels, ChannelRule{Rule: rule, Type: args[0]})
+	case "request":
+		if len(args) < 2 {
+			return errors.New("request needs a type and a decision")
+		}
+		r := RequestRule{Type: args[0]}
+		rest := args[1:]
+		if _, err := parseDecision(rest[0]); err != nil {
+			r.Name = rest[0]
+			rest = rest[1:]
+		}
+		rule, err := parseRule(rest)
+		if err != nil {
+			return err
+		}
+		r.Rule = rule
+		p.Requests = append(p.Requests, r)
+	case "forward":
+		if len(args) < 2 {
+			return errors.New("forward needs a destination and a decision")
+		}
+		host, portStr, err := net.SplitHostPort(args[0])
+		if err != nil {
+			return err
+		}
+		var port uint64
+		if portStr != "*" {
+			if port, err = strconv.ParseUint(portStr, 10, 16); err != nil || port == 0 {
+				return fmt.Errorf("invalid port %q", portStr)
+			}
+		}
+		rule, err := parseRule(args[1:])
+		if err != nil {
+			return err
+		}
+		p.Forwards = append(p.Forwards, ForwardRule{Rule: rule, Host: host, Port: uint32(port)})
+	case "max-sessions":
+		if len(args) != 1 {
+			return errors.New("max-sessions needs exactly one argument")
+		}
+		n, err := strconv.Atoi(args[0])
+		if err != nil || n < 0 {
+			return fmt.Errorf("invalid session count %q", args[0])
+		}
+		p.MaxSessions = n
+	case "default":
+		rule, err := parseRule(args)
+		if err != nil {
+			return err
+		}
+		p.Default = rule
+	default:
+		return fmt.Errorf("unknown directive %q", fields[0])
+	}
+	return nil
+}
+
+func parseDecision(s string) (Decision, error) {
+	switch s {
+	case "allow":
+		return Allow, nil
+	case "deny":
+		return Deny, nil
+	case "escalate":
+		return Escalate, nil
+	}
+	return Deny, fmt.Errorf("unknown decision %q", s)
+}
+
+// parseRule parses a decision followed by its options.
+func parseRule(fields []string) (Rule, error) {
+	var r Rule
+	if len(fields) == 0 {
+		return r, errors.New("missing decision")
+	}
+	d, err := parseDecision(fields[0])
+	if err != nil {
+		return r, err
+	}
+	r.Decision = d
+	for _, opt := range fields[1:] {
+		switch {
+		case opt == "disconnect":
+			r.Disconnect = true
+		case strings.HasPrefix(opt, "message="):
+			r.Message = opt[len("message="):]
+		default:
+			return r, fmt.Errorf("unknown option %q", opt)
+		}
+	}
+	return r, nil
+}
+
+// splitPolicyLine splits a policy line into whitespace separated
+// fields, honoring double quotes and dropping comments.
+func splitPolicyLine(line string) ([]string, error) {
+	var fields []string
+	var cur []byte
+	inField, inQuote, escaped := false, false, false
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case escaped:
+			cur = append(cur, c)
+			escaped = false
+		case c == '\\' && inQuote:
+			escaped = true
+		case c == '"':
+			inQuote = !inQuote
+			inField = true
+		case inQuote:
+			cur = append(cur, c)
+		case c == '#':
+			i = len(line)
+		case c == ' ' || c == '\t':
+			if inField {
+				fields = append(fields, string(cur))
+				cur = cur[:0]
+				inField = false
+			}
+		default:
+			cur = append(cur, c)
+			inField = true
+		}
+	}
+	if inQuote {
+		return nil, errors.New("unterminated quote")
+	}
+	if inField {
+		fields = append(fields, string(cur))
+	}
+	return fields, nil
+}
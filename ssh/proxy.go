@@ -1,12 +1,20 @@
 package ssh
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
 	"log"
 	"net"
-	"reflect"
+	"sync"
+	"time"
 )
 
-const debugProxy = true
+// debugProxy, if set, logs the proxy's progress. Applications should
+// use ProxyConfig.Events instead.
+const debugProxy = false
 
 type side struct {
 	conn      net.Conn
@@ -17,8 +25,80 @@ type side struct {
 type ProxyConn interface {
 	Run() (done <-chan error)
 	BufferedFromServer() int
+
+	// Stats returns a snapshot of the state of the connection.
+	Stats() *ProxyStats
+
+	// Handoff returns the streams to relay between the client and
+	// the server once Run completed a handoff without error.
+	Handoff() (*HandoffStreams, error)
+
+	// Close closes the connections to both the client and the
+	// server, stopping any forwarding started by Run. After a
+	// successful handoff the connections belong to the caller, and
+	// Close must not be called.
+	Close() error
+}
+
+// ProxyPhase identifies a stage in the life of a proxied connection.
+type ProxyPhase int
+
+const (
+	// PhaseVersion is the exchange of version strings.
+	PhaseVersion ProxyPhase = iota
+
+	// PhaseKex is the initial key exchange with either side.
+	PhaseKex
+
+	// PhaseAuth is the authentication to the server, and of the
+	// client to the proxy.
+	PhaseAuth
+
+	// PhaseFilter is the forwarding of packets through the Filter,
+	// until the client initiates a handoff.
+	PhaseFilter
+
+	// PhaseHandoff is the forwarding of the client's key exchange
+	// to the server.
+	PhaseHandoff
+)
+
+func (p ProxyPhase) String() string {
+	switch p {
+	case PhaseVersion:
+		return "version"
+	case PhaseKex:
+		return "kex"
+	case PhaseAuth:
+		return "auth"
+	case PhaseFilter:
+		return "filter"
+	case PhaseHandoff:
+		return "handoff"
+	}
+	return "unknown"
+}
+
+// ProxyError is returned by NewProxyConnContext and through the channel
+// returned by Run, recording the phase in which the error occurred.
+type ProxyError struct {
+	Phase ProxyPhase
+	Err   error
 }
 
+func (e *ProxyError) Error() string {
+	return "ssh: proxy " + e.Phase.String() + ": " + e.Err.Error()
+}
+
+// Unwrap returns the underlying error.
+func (e *ProxyError) Unwrap() error {
+	return e.Err
+}
+
+// errProxyClosed is returned when the proxy is closed while waiting
+// for key exchange handling to stop.
+var errProxyClosed = errors.New("ssh: proxy closed")
+
 type proxy struct {
 	toClient side
 	toServer side
@@ -27,16 +107,271 @@ type proxy struct {
 	serverConf ServerConfig
 
 	filter *Filter
+	events EventSink
+	full   bool
+	stats  *proxyStats
+
+	closeOnce sync.Once
+	closed    chan struct{}
+	closeErr  error
+
+	mu         sync.Mutex
+	handingOff bool
+	handedOff  bool
+	remap      *seqNumRemap
+}
+
+// seqNumRemap is a pending rewrite of the client's sequence numbers to
+// continue those of the server connection. It is prepared when the
+// client's KEXINIT is forwarded, and sent to the client just before the
+// next packet from the server, whose sequence number then becomes the
+// client's incoming sequence number.
+type seqNumRemap struct {
+	// oldIncoming and newIncoming are the sequence numbers of the
+	// client's next packet on the connection to the proxy and on
+	// the connection to the server.
+	oldIncoming uint32
+	newIncoming uint32
+}
+
+// errRepeatedKexInit is returned if the client sends a second KEXINIT
+// before completing the handoff. Only one handoff per connection is
+// supported.
+var errRepeatedKexInit = errors.New("ssh: repeated key exchange init during handoff")
+
+// errHandoffUnsupported is returned if the client initiates a handoff
+// without having advertised support for the session parameters
+// extension, which would leave its sequence numbers out of sync with
+// the server's.
+var errHandoffUnsupported = errors.New("ssh: client does not support the session parameters extension needed for handoff")
+
+// errStrictKexMismatch is returned if the client initiates a handoff
+// while its strict key exchange mode differs from the server's, and its
+// version of the session parameters extension cannot change it.
+var errStrictKexMismatch = errors.New("ssh: client cannot follow the server's strict key exchange mode for handoff")
+
+// HandoffStreams holds the streams of a proxied connection after the
+// handoff, when the client and server talk directly and the caller
+// only has to copy bytes between them.
+type HandoffStreams struct {
+	// ClientConn and ServerConn are the connections to the client
+	// and the server.
+	ClientConn net.Conn
+	ServerConn net.Conn
+
+	// FromClient and FromServer hold the bytes the proxy read from
+	// the client and the server past the handoff. They must be
+	// written to the other side before anything else read from
+	// ClientConn or ServerConn.
+	FromClient io.Reader
+	FromServer io.Reader
+}
+
+// Relay copies FromClient and then ClientConn to ServerConn, and
+// FromServer and then ServerConn to ClientConn, until either side
+// closes its connection, and then closes both connections. If both
+// connections are TCP connections, Linux copies between them with
+// splice(2), without passing the data through user space.
+func (h *HandoffStreams) Relay() error {
+	errc := make(chan error, 2)
+	relay := func(dst, src net.Conn, buffered io.Reader) {
+		_, err := io.Copy(dst, buffered)
+		if err == nil {
+			_, err = io.Copy(dst, src)
+		}
+		errc <- err
+	}
+	go relay(h.ServerConn, h.ClientConn, h.FromClient)
+	go relay(h.ClientConn, h.ServerConn, h.FromServer)
+
+	// The first copy to finish determines the outcome; closing the
+	// connections stops the other one.
+	err := <-errc
+	h.ClientConn.Close()
+	h.ServerConn.Close()
+	<-errc
+	return err
+}
+
+// ProxyConfig holds the configuration of a proxied connection.
+type ProxyConfig struct {
+	// ClientConfig is used to connect and authenticate to the
+	// server.
+	ClientConfig *ClientConfig
+
+	// Filter decides which client packets are forwarded to the
+	// server.
+	Filter *Filter
+
+	// Events, if non-nil, receives the events of the connection,
+	// including those of Filter.
+	Events EventSink
+
+	// VersionTimeout, KexTimeout and AuthTimeout bound the version
+	// exchange, the initial key exchanges and authentication
+	// respectively. Zero means no limit besides the deadline of the
+	// context passed to NewProxyConnContext.
+	VersionTimeout time.Duration
+	KexTimeout     time.Duration
+	AuthTimeout    time.Duration
+
+	// FullProxy keeps the proxy in the data path for the whole
+	// connection instead of handing it off to the client. The proxy
+	// answers the client's key exchanges itself, each side rekeys
+	// independently, and every packet goes through Filter until
+	// either side disconnects.
+	FullProxy bool
+
+	// HostKey is the key presented to the client in full proxy
+	// mode, where it is required. Otherwise the proxy presents no
+	// key, and the client verifies the server's key after the
+	// handoff.
+	HostKey Signer
+
+	// Registry, if non-nil, tracks the connection while it is
+	// live.
+	Registry *ProxyRegistry
+
+	// Delegate, if non-nil, signs the proxy's public key
+	// authentication to the server in place of ClientConfig.Auth,
+	// so that the proxy holds no credentials. A user approving
+	// each signature may take a while, which AuthTimeout must
+	// allow for.
+	Delegate Delegate
+}
+
+// validate reports the fields of config that a proxied connection
+// cannot do without.
+func (config *ProxyConfig) validate() error {
+	switch {
+	case config == nil:
+		return errors.New("ssh: nil ProxyConfig")
+	case config.ClientConfig == nil:
+		return errors.New("ssh: ProxyConfig.ClientConfig is nil")
+	case config.Filter == nil:
+		return errors.New("ssh: ProxyConfig.Filter is nil")
+	case config.FullProxy && config.HostKey == nil:
+		return errors.New("ssh: full proxy mode requires a host key")
+	}
+	return nil
 }
 
 type MessageFilterCallback func(p []byte) (isOK bool, response []byte, err error)
 
+// NewProxyConn is like NewProxyConnWithConfig, with a ProxyConfig
+// that emits no events.
 func NewProxyConn(dialAddress string, toClient net.Conn, toServer net.Conn, clientConfig *ClientConfig, fil *Filter) (ProxyConn, error) {
+	return NewProxyConnWithConfig(dialAddress, toClient, toServer, &ProxyConfig{
+		ClientConfig: clientConfig,
+		Filter:       fil,
+	})
+}
+
+// NewProxyConnWithConfig is like NewProxyConnContext, with a context
+// that is never canceled.
+func NewProxyConnWithConfig(dialAddress string, toClient net.Conn, toServer net.Conn, config *ProxyConfig) (ProxyConn, error) {
+	return NewProxyConnContext(context.Background(), dialAddress, toClient, toServer, config)
+}
+
+// aLongTimeAgo is a deadline in the past, used to interrupt blocked
+// reads and writes.
+var aLongTimeAgo = time.Unix(1, 0)
+
+// phaseDeadline returns the deadline of a phase that may last timeout,
+// or until ctx expires.
+func phaseDeadline(ctx context.Context, timeout time.Duration) time.Time {
+	var deadline time.Time
+	if timeout > 0 {
+		deadline = time.Now().Add(timeout)
+	}
+	if d, ok := ctx.Deadline(); ok && (deadline.IsZero() || d.Before(deadline)) {
+		deadline = d
+	}
+	return deadline
+}
+
+// NewProxyConnContext relays the version exchange and key exchanges
+// between the client on toClient and the server on toServer,
+// authenticates to the server, and returns a ProxyConn ready to forward
+// the client's requests through config.Filter.
+//
+// If ctx is canceled or a phase exceeds its timeout before the
+// ProxyConn is returned, both connections are interrupted. Errors are
+// of type *ProxyError, and both connections are closed on error.
+//
+// Unless config.FullProxy is set, forwarding ends with a handoff: the
+// client's key exchange is relayed to the server, after which the
+// client and server talk directly over the two connections.
+func NewProxyConnContext(ctx context.Context, dialAddress string, toClient net.Conn, toServer net.Conn, config *ProxyConfig) (ProxyConn, error) {
+	if err := config.validate(); err != nil {
+		toClient.Close()
+		toServer.Close()
+		return nil, &ProxyError{Phase: PhaseVersion, Err: err}
+	}
+
+	// Interrupt any blocked I/O if ctx is canceled.
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		select {
+		case <-ctx.Done():
+			toClient.SetDeadline(aLongTimeAgo)
+			toServer.SetDeadline(aLongTimeAgo)
+		case <-stop:
+		}
+	}()
+
+	stats := newProxyStats(dialAddress, config.ClientConfig.User)
+	stats.close = func() error {
+		toClient.Close()
+		return toServer.Close()
+	}
+	if config.Registry != nil {
+		config.Registry.add(stats)
+	}
+
+	p, phase, err := newProxy(ctx, dialAddress, toClient, toServer, config, stats)
+	close(stop)
+	<-stopped
+	if ctx.Err() != nil {
+		// Report the cancellation rather than the I/O error it
+		// caused.
+		err = ctx.Err()
+	}
+	if err != nil {
+		toClient.Close()
+		toServer.Close()
+		stats.end(false)
+		return nil, &ProxyError{Phase: phase, Err: err}
+	}
+
+	toClient.SetDeadline(time.Time{})
+	toServer.SetDeadline(time.Time{})
+	stats.setClose(p.Close)
+	stats.enterPhase(PhaseFilter)
+	return p, nil
+}
+
+// newProxy runs the phases of NewProxyConnContext, returning the phase
+// that failed on error.
+func newProxy(ctx context.Context, dialAddress string, toClient net.Conn, toServer net.Conn, config *ProxyConfig, stats *proxyStats) (*proxy, ProxyPhase, error) {
 	var err error
+	clientConfig := config.ClientConfig
+	fil := config.Filter
+	fil.events = config.Events
+
+	enterPhase := func(phase ProxyPhase, timeout time.Duration) {
+		stats.enterPhase(phase)
+		deadline := phaseDeadline(ctx, timeout)
+		toClient.SetDeadline(deadline)
+		toServer.SetDeadline(deadline)
+	}
 
+	enterPhase(PhaseVersion, config.VersionTimeout)
 	serverVersion, err := readVersion(toServer)
 	if err != nil {
-		return nil, err
+		return nil, PhaseVersion, err
 	}
 	if debugProxy {
 		log.Printf("Read version: \"%s\" from server", serverVersion)
@@ -44,20 +379,26 @@ func NewProxyConn(dialAddress string, toClient net.Conn, toServer net.Conn, clie
 
 	clientVersion, err := exchangeVersions(toClient, serverVersion)
 	if err != nil {
-		return nil, err
+		return nil, PhaseVersion, err
 	}
 	if debugProxy {
 		log.Printf("Read version: \"%s\" from client", clientVersion)
 	}
+	emitEvent(config.Events, &VersionEvent{
+		Time:          time.Now(),
+		ClientVersion: string(clientVersion),
+		ServerVersion: string(serverVersion),
+	})
 
 	// Connect to server
 	clientConfig.SetDefaults()
 	clientConfig.ClientVersion = string(clientVersion)
 
 	if err = writeVersion(toServer, clientVersion); err != nil {
-		return nil, err
+		return nil, PhaseVersion, err
 	}
 
+	enterPhase(PhaseKex, config.KexTimeout)
 	toServerTransport := newClientTransport(
 		newTransport(toServer, clientConfig.Rand, true /* is client */),
 		clientVersion, serverVersion, clientConfig, dialAddress, toServer.RemoteAddr())
@@ -66,33 +407,58 @@ func NewProxyConn(dialAddress string, toClient net.Conn, toServer net.Conn, clie
 	serverConf := ServerConfig{}
 	serverConf.SetDefaults()
 	serverConf.ServerVersion = string(serverVersion)
-	serverConf.AddHostKey(&NonePrivateKey{})
+	if config.FullProxy {
+		serverConf.AddHostKey(config.HostKey)
+	} else {
+		serverConf.AddHostKey(&NonePrivateKey{})
+	}
 
 	toClientTransport := newServerTransport(
 		newTransport(toClient, serverConf.Rand, false /* not client */),
 		clientVersion, serverVersion, &serverConf)
+	stats.setTransports(toClientTransport, toServerTransport)
 
 	// Establish sessions
 	if err := toServerTransport.waitSession(); err != nil {
 		toClientTransport.writePacket(Marshal(disconnectMsg{Message: err.Error()}))
-		return nil, err
+		return nil, PhaseKex, err
 	}
 
 	toServerSessionID := toServerTransport.getSessionID()
+	fil.setConnection(dialAddress, clientConfig.User, toServerTransport.hostKey)
 	if debugProxy {
 		log.Printf("Connected to server successfully")
 	}
 	toServerConn := &connection{transport: toServerTransport}
 
 	if err = toClientTransport.waitSession(); err != nil {
-		return nil, err
+		return nil, PhaseKex, err
 	}
 
 	toClientSessionID := toClientTransport.getSessionID()
 	toClientConn := &connection{transport: toClientTransport}
 
+	if !config.FullProxy && toClientTransport.sessionParamsVersion > 0 {
+		// Let the client verify the server's host key before it
+		// authenticates.
+		if err := toClientTransport.sendHostKeyProof(toServerTransport.firstKex); err != nil {
+			return nil, PhaseKex, err
+		}
+	}
+
 	// Authentication
-	err = toServerConn.clientAuthenticate(clientConfig)
+	enterPhase(PhaseAuth, config.AuthTimeout)
+	authConfig := clientConfig
+	if config.Delegate != nil {
+		authConfig = delegatedConfig(clientConfig, config.Delegate, SignRequest{
+			SessionID:     toServerSessionID,
+			ServerAddress: dialAddress,
+			User:          clientConfig.User,
+			Command:       fil.promisedCommand(),
+		})
+	}
+	err = toServerConn.clientAuthenticate(authConfig)
+	emitEvent(config.Events, &AuthEvent{Time: time.Now(), User: clientConfig.User, Err: err})
 	if err != nil {
 		// Simulate authentication failure for client
 		serverConf.PublicKeyCallback = func(conn ConnMetadata, key PublicKey) (*Permissions, error) {
@@ -100,19 +466,22 @@ func NewProxyConn(dialAddress string, toClient net.Conn, toServer net.Conn, clie
 		}
 
 		toClientConn.serverAuthenticate(&serverConf)
-		return nil, err
+		return nil, PhaseAuth, err
 	}
 
 	serverConf.NoClientAuth = true
 	_, err = toClientConn.serverAuthenticate(&serverConf)
 	if err != nil {
-		return nil, err
+		return nil, PhaseAuth, err
 	}
 
-	// Stop kex handling with client
-	doneWithKex := make(chan struct{})
-	toClientTransport.stopKexHandling(doneWithKex)
-	<-doneWithKex
+	if !config.FullProxy {
+		// Stop kex handling with client. The kex loop signals once
+		// it exits, which it also does if the connection fails.
+		doneWithKex := make(chan struct{}, 1)
+		toClientTransport.stopKexHandling(doneWithKex)
+		<-doneWithKex
+	}
 
 	return &proxy{
 		toClient:   side{toClient, toClientTransport, toClientSessionID},
@@ -120,130 +489,337 @@ func NewProxyConn(dialAddress string, toClient net.Conn, toServer net.Conn, clie
 		clientConf: clientConfig,
 		serverConf: serverConf,
 		filter:     fil,
-	}, nil
+		events:     config.Events,
+		full:       config.FullProxy,
+		stats:      stats,
+		closed:     make(chan struct{}),
+	}, PhaseAuth, nil
 }
 
 func (p *proxy) Run() <-chan error {
 	forwardingDone := make(chan error, 2)
-	var err error
 	go func() {
-		// From client to server forwarding
-		for {
-			packet, err := p.toClient.trans.readPacket()
-			if err != nil {
-				forwardingDone <- err
-				return
-			}
-
-			msgNum := packet[0]
-			msg, err := decode(packet)
-			log.Printf("Got message %d from client: %s", msgNum, reflect.TypeOf(msg))
-			allowed, response, err := p.filter.FilterClientPacket(packet)
-			if err != nil {
+		forwardingDone <- p.forwardClientToServer()
+	}()
+	go func() {
+		forwardingDone <- p.forwardServerToClient()
+	}()
+
+	done := make(chan error, 1)
+	go func() {
+		err := <-forwardingDone
+		if p.full {
+			// Without a handoff, the connection ends as soon as
+			// either side ends it.
+			p.Close()
+			done <- err
+			return
+		}
+		if err == nil {
+			err = <-forwardingDone
+		}
+		if err == nil {
+			p.mu.Lock()
+			p.handedOff = true
+			p.mu.Unlock()
+		}
+		if err != nil {
+			// Unblock the other direction.
+			p.Close()
+		} else {
+			p.stats.end(true)
+		}
+		emitEvent(p.events, &HandoffCompleteEvent{Time: time.Now(), Err: err})
+		done <- err
+	}()
+	return done
+}
+
+// readError wraps an error reading from either side. In full proxy
+// mode, the end of either connection ends forwarding cleanly.
+func (p *proxy) readError(err error) error {
+	if p.full && err == io.EOF {
+		return nil
+	}
+	return p.phaseError(err)
+}
+
+// phaseError wraps err in a ProxyError for the current phase of
+// forwarding.
+func (p *proxy) phaseError(err error) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	phase := PhaseFilter
+	if p.handingOff {
+		phase = PhaseHandoff
+	}
+	return &ProxyError{Phase: phase, Err: err}
+}
+
+// stopServerKex stops the server transport from handling key
+// exchanges, so that the client's key exchange can be forwarded.
+func (p *proxy) stopServerKex() error {
+	// The kex loop signals once it exits, which it may already have
+	// done if the connection failed; so don't wait past Close.
+	doneWithKex := make(chan struct{}, 1)
+	p.toServer.trans.stopKexHandling(doneWithKex)
+	select {
+	case <-doneWithKex:
+		return nil
+	case <-p.closed:
+		return errProxyClosed
+	}
+}
+
+func (p *proxy) forwardClientToServer() error {
+	for {
+		packet, err := p.toClient.trans.readPacket()
+		if err != nil {
+			return p.readError(err)
+		}
+		p.stats.packetRead(ClientToServer, len(packet))
+		_, in := p.toClient.trans.getLastSequenceNumbers()
+		ev := &PacketEvent{
+			Time:      time.Now(),
+			Direction: ClientToServer,
+			Type:      packet[0],
+			Name:      msgName(packet[0]),
+			InSeqNum:  in,
+		}
+
+		msgNum := packet[0]
+		if debugProxy {
+			log.Printf("Got message %d from client", msgNum)
+		}
+		allowed, response, err := p.filter.FilterClientPacket(packet)
+		if err != nil {
+			if debugProxy {
 				log.Printf("Got error from client packet filter: %s", err)
+			}
+			p.stats.packetBlocked(ClientToServer)
+			emitEvent(p.events, ev)
+			if response != nil {
 				p.toClient.trans.writePacket(response)
-				p.toServer.trans.Close()
-				break
 			}
-			if !allowed {
-				log.Printf("Packet from client to server blocked")
-				if err = p.toClient.trans.writePacket(response); err != nil {
-					break
+			p.toServer.trans.Close()
+			return p.phaseError(err)
+		}
+		if !allowed {
+			p.stats.packetBlocked(ClientToServer)
+			emitEvent(p.events, ev)
+			if response != nil {
+				if err := p.toClient.trans.writePacket(response); err != nil {
+					return p.phaseError(err)
 				}
-				// Send a msgIgnore instead to keep sequence numbers aligned
-				p.toServer.trans.writePacket([]byte{msgIgnore})
 			}
-			if msgNum == msgKexInit {
+			if p.full {
+				// Both sides have their own sequence numbers.
+				continue
+			}
+			// Send a msgIgnore instead to keep sequence numbers aligned
+			if err := p.toServer.trans.writePacket([]byte{msgIgnore}); err != nil {
+				return p.phaseError(err)
+			}
+			continue
+		}
+		if msgNum == msgKexInit {
+			p.mu.Lock()
+			repeated := p.handingOff
+			p.handingOff = true
+			p.mu.Unlock()
+			if repeated {
+				emitEvent(p.events, ev)
+				p.toClient.trans.writePacket(Marshal(disconnectMsg{Reason: 2, Message: errRepeatedKexInit.Error()}))
+				return p.phaseError(errRepeatedKexInit)
+			}
+			if !p.full && p.toClient.trans.sessionParamsVersion == 0 {
+				emitEvent(p.events, ev)
+				p.toClient.trans.writePacket(Marshal(disconnectMsg{Reason: 2, Message: errHandoffUnsupported.Error()}))
+				return p.phaseError(errHandoffUnsupported)
+			}
+			if !p.full && p.toClient.trans.sessionParamsVersion < 2 && p.toClient.trans.strictKex != p.toServer.trans.strictKex {
+				emitEvent(p.events, ev)
+				p.toClient.trans.writePacket(Marshal(disconnectMsg{Reason: 2, Message: errStrictKexMismatch.Error()}))
+				return p.phaseError(errStrictKexMismatch)
+			}
+			emitEvent(p.events, &HandoffStartEvent{Time: time.Now()})
+			p.stats.enterPhase(PhaseHandoff)
+			if debugProxy {
 				log.Printf("Client has initiated handoff: stopping kex with server")
-				doneWithKex := make(chan struct{})
-				p.toServer.trans.stopKexHandling(doneWithKex)
-				<-doneWithKex
-				log.Printf("Done with Kex")
 			}
-			// Packet allowed message, forwarding it.
-			err = p.toServer.trans.writePacket(packet)
-			if err != nil {
-				break
+			// Any key exchange the server started first completes
+			// before this returns.
+			if err := p.stopServerKex(); err != nil {
+				return p.phaseError(err)
 			}
+
+			// The server cannot answer before the KEXINIT is
+			// written, so the remap is in place before any packet
+			// that is part of the handoff arrives.
+			_, p2s := p.toServer.trans.getOutgoingSequenceNumbers()
 			_, in := p.toClient.trans.getSequenceNumbers()
-			p2s, s2p := p.toServer.trans.getSequenceNumbers()
-			log.Printf("Forwarded seqNum: %d from client to server as: %d", in-1, p2s-1)
-			if msgNum == msgNewKeys {
+			p.mu.Lock()
+			p.remap = &seqNumRemap{oldIncoming: in, newIncoming: p2s + 1}
+			p.mu.Unlock()
+		}
+		// Packet allowed message, forwarding it.
+		if err := p.toServer.trans.writePacket(packet); err != nil {
+			return p.phaseError(err)
+		}
+		p2s, _ := p.toServer.trans.getOutgoingSequenceNumbers()
+		ev.Allowed = true
+		ev.OutSeqNum = p2s
+		emitEvent(p.events, ev)
+		if msgNum == msgDisconnect && p.full {
+			return nil
+		} else if msgNum == msgNewKeys {
+			if debugProxy {
 				log.Printf("Got msgNewKeys from client, finishing client->server forwarding")
-				break
-			} else if msgNum == msgKexInit {
-				sessionID := p.toServer.trans.getSessionID()
-				if err = p.toClient.trans.updateSessionParams(sessionID, s2p, p2s); err != nil {
-					log.Printf("Failed to send updateClientSessionParams")
-					break
-				}
 			}
+			return nil
 		}
-		forwardingDone <- err
-	}()
+	}
+}
 
-	go func() {
-		for {
-			// From server to client forwarding
-			packet, err := p.toServer.trans.readPacket()
-			if err != nil {
-				break
-			}
+// syncSeqNums prepares the connection to the client for forwarding a
+// packet that the server sent with sequence number seqNum. Before the
+// handoff, the proxy's own sequence numbers are used. Once the client
+// initiated the handoff, the first packet is preceded by the remap of
+// the client's sequence numbers. Any later gap, left by packets the
+// proxy consumed itself before it stopped handling key exchanges with
+// the server, is filled with msgIgnore.
+func (p *proxy) syncSeqNums(seqNum uint32) error {
+	p.mu.Lock()
+	remap := p.remap
+	p.remap = nil
+	handingOff := p.handingOff
+	p.mu.Unlock()
+
+	_, out := p.toClient.trans.getOutgoingSequenceNumbers()
+	if remap != nil {
+		sessionID := p.toServer.trans.getSessionID()
+		if err := p.toClient.trans.updateSessionParams(sessionID, seqNum, remap.newIncoming-remap.oldIncoming, p.toServer.trans.strictKex); err != nil {
+			return err
+		}
+		emitEvent(p.events, &SeqNumRemapEvent{
+			Time:        time.Now(),
+			OldOutgoing: out,
+			OldIncoming: remap.oldIncoming,
+			NewOutgoing: seqNum,
+			NewIncoming: remap.newIncoming,
+		})
+		return nil
+	}
+	if !handingOff || p.full {
+		return nil
+	}
+	for ; int32(seqNum-out) > 0; out++ {
+		if err := p.toClient.trans.writePacket([]byte{msgIgnore}); err != nil {
+			return err
+		}
+	}
+	if out != seqNum {
+		return fmt.Errorf("ssh: server packet %d precedes sequence number %d of client", seqNum, out)
+	}
+	return nil
+}
+
+func (p *proxy) forwardServerToClient() error {
+	for {
+		packet, err := p.toServer.trans.readPacket()
+		if err != nil {
+			return p.readError(err)
+		}
+		p.stats.packetRead(ServerToClient, len(packet))
+		_, in := p.toServer.trans.getLastSequenceNumbers()
+		ev := &PacketEvent{
+			Time:      time.Now(),
+			Direction: ServerToClient,
+			Type:      packet[0],
+			Name:      msgName(packet[0]),
+			InSeqNum:  in,
+		}
 
-			msgNum := packet[0]
-			msg, err := decode(packet)
+		msgNum := packet[0]
+		if debugProxy {
+			log.Printf("Got message %d from server", msgNum)
+		}
 
+		validState, response, err := p.filter.FilterServerPacket(packet)
+		if err != nil {
 			if debugProxy {
-				log.Printf("Got message %d from server: %s", packet[0], reflect.TypeOf(msg))
-			}
-
-			validState, response, err := p.filter.FilterServerPacket(packet)
-			if err != nil {
 				log.Printf("Got error from server packet filter: %s", err)
+			}
+			p.stats.packetBlocked(ServerToClient)
+			emitEvent(p.events, ev)
+			if response != nil {
 				p.toClient.trans.writePacket(response)
-				break
 			}
-			if !validState {
+			return p.phaseError(err)
+		}
+		if !validState {
+			if debugProxy {
 				log.Printf("Packet from server to client ends connection")
-				if err = p.toClient.trans.writePacket(response); err != nil {
-					break
-				}
-				// No need to send a msgIgnore for seq # since server->client msg was blocked
 			}
-
-			err = p.toClient.trans.writePacket(packet)
-			if err != nil {
-				break
+			if err := p.toClient.trans.writePacket(response); err != nil {
+				return p.phaseError(err)
 			}
-			out, _ := p.toClient.trans.getSequenceNumbers()
-			_, in := p.toServer.trans.getSequenceNumbers()
+			// No need to send a msgIgnore for seq # since server->client msg was blocked
+		}
+
+		if err := p.syncSeqNums(in); err != nil {
+			return p.phaseError(err)
+		}
+		if err := p.toClient.trans.writePacket(packet); err != nil {
+			return p.phaseError(err)
+		}
+		out, _ := p.toClient.trans.getOutgoingSequenceNumbers()
+		ev.Allowed = true
+		ev.OutSeqNum = out
+		emitEvent(p.events, ev)
+		if msgNum == msgDisconnect && p.full {
+			return nil
+		} else if msgNum == msgNewKeys {
 			if debugProxy {
-				log.Printf("Forwarded seqNum: %d from server to client as: %d", in-1, out-1)
+				log.Printf("Got msgNewKeys from server, finishing server->client forwarding")
 			}
-			if msgNum == msgNewKeys {
-				if debugProxy {
-					log.Printf("Got msgNewKeys from server, finishing server->client forwarding")
-				}
-				break
-			}
-		}
-		forwardingDone <- err
-	}()
-	done := make(chan error)
-	go func() {
-		if err := <-forwardingDone; err != nil {
-			done <- err
-			return
+			return nil
 		}
-		if err := <-forwardingDone; err != nil {
-			done <- err
-			return
+	}
+}
+
+// Close closes both transports, which makes Run's forwarding fail with
+// an error unless it has already completed.
+func (p *proxy) Close() error {
+	p.closeOnce.Do(func() {
+		close(p.closed)
+		p.closeErr = p.toClient.trans.Close()
+		if err := p.toServer.trans.Close(); p.closeErr == nil {
+			p.closeErr = err
 		}
-		done <- nil
-	}()
-	return done
+		p.stats.end(false)
+	})
+	return p.closeErr
+}
+
+func (p *proxy) Stats() *ProxyStats {
+	return p.stats.snapshot()
 }
 
 func (p *proxy) BufferedFromServer() int {
 	return p.toServer.trans.buffered()
 }
+
+func (p *proxy) Handoff() (*HandoffStreams, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.handedOff {
+		return nil, errors.New("ssh: handoff has not completed")
+	}
+	return &HandoffStreams{
+		ClientConn: p.toClient.conn,
+		ServerConn: p.toServer.conn,
+		FromClient: bytes.NewReader(p.toClient.trans.bufferedBytes()),
+		FromServer: bytes.NewReader(p.toServer.trans.bufferedBytes()),
+	}, nil
+}
@@ -0,0 +1,884 @@
+package ssh
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// proxyTestServer accepts one connection on c and answers "exec"
+// requests by echoing the command back.
+func proxyTestServer(t *testing.T, c net.Conn) {
+	proxyTestServerConfig(t, c, &ServerConfig{})
+}
+
+// proxyTestServerConfig is like proxyTestServer, using conf. The
+// connection is sent on the returned channel once established.
+func proxyTestServerConfig(t *testing.T, c net.Conn, conf *ServerConfig) <-chan *ServerConn {
+	conf.PasswordCallback = func(conn ConnMetadata, password []byte) (*Permissions, error) {
+		return nil, nil
+	}
+	conf.AddHostKey(testSigners["ecdsa"])
+
+	conns := make(chan *ServerConn, 1)
+	go func() {
+		conn, chans, reqs, err := NewServerConn(c, conf)
+		if err != nil {
+			t.Errorf("NewServerConn: %v", err)
+			return
+		}
+		defer conn.Close()
+		conns <- conn
+		go func() {
+			for r := range reqs {
+				r.Reply(r.Type == NoMoreSessionRequestName, nil)
+			}
+		}()
+		for newCh := range chans {
+			ch, reqs, err := newCh.Accept()
+			if err != nil {
+				t.Errorf("Accept: %v", err)
+				return
+			}
+			go func() {
+				for r := range reqs {
+					r.Reply(r.Type == "exec", nil)
+					if r.Type != "exec" {
+						continue
+					}
+					var cmd execMsg
+					Unmarshal(r.Payload, &cmd)
+					io.WriteString(ch, cmd.Command)
+					ch.SendRequest("exit-status", false, []byte{0, 0, 0, 0})
+					ch.Close()
+				}
+			}()
+		}
+	}()
+	return conns
+}
+
+// proxyTestClient connects a client to a server through a proxy
+// configured with fil and sink.
+func proxyTestClient(t *testing.T, fil *Filter, sink EventSink) (*Client, ProxyConn) {
+	client, pc, _ := proxyTestClientConfig(t, &ProxyConfig{Filter: fil, Events: sink}, &ClientConfig{
+		HostKeyCallback:          InsecureIgnoreHostKey(),
+		DeferHostKeyVerification: true,
+	}, &ServerConfig{})
+	return client, pc
+}
+
+// proxyTestClientConfig connects a client using clientConfig to a
+// server using serverConfig through a proxy configured with config.
+// The user and the proxy's ClientConfig are filled in. The server's end
+// of the connection is sent on the returned channel.
+func proxyTestClientConfig(t *testing.T, config *ProxyConfig, clientConfig *ClientConfig, serverConfig *ServerConfig) (*Client, ProxyConn, <-chan *ServerConn) {
+	return proxyTestClientWrapped(t, nil, config, clientConfig, serverConfig)
+}
+
+// proxyTestClientWrapped is like proxyTestClientConfig, but the client
+// talks over wrap of its connection to the proxy if wrap is not nil.
+func proxyTestClientWrapped(t *testing.T, wrap func(net.Conn) net.Conn, config *ProxyConfig, clientConfig *ClientConfig, serverConfig *ServerConfig) (*Client, ProxyConn, <-chan *ServerConn) {
+	toServer, serverSide, err := netPipe()
+	if err != nil {
+		t.Fatalf("netPipe: %v", err)
+	}
+	clientSide, toClient, err := netPipe()
+	if err != nil {
+		t.Fatalf("netPipe: %v", err)
+	}
+	serverConns := proxyTestServerConfig(t, serverSide, serverConfig)
+
+	type result struct {
+		pc  ProxyConn
+		err error
+	}
+	proxyResult := make(chan result, 1)
+	go func() {
+		if config.ClientConfig == nil {
+			config.ClientConfig = &ClientConfig{}
+		}
+		config.ClientConfig.User = "user"
+		config.ClientConfig.Auth = []AuthMethod{Password("secret")}
+		config.ClientConfig.HostKeyCallback = InsecureIgnoreHostKey()
+		pc, err := NewProxyConnWithConfig("server", toClient, toServer, config)
+		proxyResult <- result{pc, err}
+	}()
+
+	clientConfig.User = "user"
+	if wrap != nil {
+		clientSide = wrap(clientSide)
+	}
+	conn, chans, reqs, err := NewClientConn(clientSide, "server", clientConfig)
+	if err != nil {
+		t.Fatalf("NewClientConn: %v", err)
+	}
+	res := <-proxyResult
+	if res.err != nil {
+		t.Fatalf("NewProxyConnWithConfig: %v", res.err)
+	}
+	return NewClient(conn, chans, reqs), res.pc, serverConns
+}
+
+type eventRecorder struct {
+	mu     sync.Mutex
+	events []Event
+}
+
+func (r *eventRecorder) Event(e Event) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.events = append(r.events, e)
+}
+
+func (r *eventRecorder) get() []Event {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]Event(nil), r.events...)
+}
+
+func TestProxyEvents(t *testing.T) {
+	rec := &eventRecorder{}
+	client, pc := proxyTestClient(t, NewFilter("true", nil), rec)
+	defer client.Close()
+	pc.Run()
+
+	if ok, _, err := client.SendRequest(NoMoreSessionRequestName, true, nil); err != nil || !ok {
+		t.Fatalf("no-more-sessions: %v, %v", ok, err)
+	}
+	session, err := client.NewSession()
+	if err != nil {
+		t.Fatalf("NewSession: %v", err)
+	}
+	if out, err := session.Output("true"); err != nil || !bytes.Equal(out, []byte("true")) {
+		t.Fatalf("Output: %q, %v", out, err)
+	}
+	if _, err := client.NewSession(); err == nil {
+		t.Fatalf("second session was allowed")
+	}
+
+	events := rec.get()
+	if v, ok := events[0].(*VersionEvent); !ok || v.ClientVersion != packageVersion || v.ServerVersion != packageVersion {
+		t.Errorf("first event: got %#v, want version exchange", events[0])
+	}
+	if a, ok := events[1].(*AuthEvent); !ok || a.User != "user" || a.Err != nil {
+		t.Errorf("second event: got %#v, want successful auth", events[1])
+	}
+
+	var nmsStatus []int
+	var blocked []string
+	for _, e := range events {
+		switch e := e.(type) {
+		case *NoMoreSessionsEvent:
+			nmsStatus = append(nmsStatus, e.Status)
+		case *PacketEvent:
+			if !e.Allowed {
+				blocked = append(blocked, e.Name)
+			}
+		}
+	}
+	if len(nmsStatus) != 2 || nmsStatus[0] != AwaitingReply || nmsStatus[1] != Success {
+		t.Errorf("got no-more-sessions statuses %v, want [AwaitingReply Success]", nmsStatus)
+	}
+	if len(blocked) != 1 || blocked[0] != "SSH_MSG_CHANNEL_OPEN" {
+		t.Errorf("got blocked packets %v, want the second channel open", blocked)
+	}
+}
+
+// stalledProxy runs NewProxyConnContext against a server that stops
+// after sending its version, and a client that stops after sending
+// clientVersion, if any.
+func stalledProxy(t *testing.T, ctx context.Context, clientVersion string, config *ProxyConfig) error {
+	toServer, serverSide, err := netPipe()
+	if err != nil {
+		t.Fatalf("netPipe: %v", err)
+	}
+	clientSide, toClient, err := netPipe()
+	if err != nil {
+		t.Fatalf("netPipe: %v", err)
+	}
+	defer clientSide.Close()
+	defer serverSide.Close()
+	io.WriteString(serverSide, packageVersion+"\r\n")
+	go io.Copy(io.Discard, serverSide)
+	if clientVersion != "" {
+		io.WriteString(clientSide, clientVersion+"\r\n")
+	}
+
+	config.ClientConfig = &ClientConfig{
+		User:            "user",
+		Auth:            []AuthMethod{Password("secret")},
+		HostKeyCallback: InsecureIgnoreHostKey(),
+	}
+	config.Filter = NewFilter("true", nil)
+	_, err = NewProxyConnContext(ctx, "server", toClient, toServer, config)
+	if err == nil {
+		t.Fatalf("NewProxyConnContext succeeded with a stalled client")
+	}
+	return err
+}
+
+func TestProxyConnPhaseTimeouts(t *testing.T) {
+	for _, tc := range []struct {
+		clientVersion string
+		want          ProxyPhase
+	}{
+		{"", PhaseVersion},
+		{packageVersion, PhaseKex},
+	} {
+		err := stalledProxy(t, context.Background(), tc.clientVersion, &ProxyConfig{
+			VersionTimeout: 100 * time.Millisecond,
+			KexTimeout:     100 * time.Millisecond,
+		})
+		var perr *ProxyError
+		if !errors.As(err, &perr) || perr.Phase != tc.want {
+			t.Errorf("client version %q: got %v, want %v error", tc.clientVersion, err, tc.want)
+			continue
+		}
+		if !errors.Is(err, os.ErrDeadlineExceeded) {
+			t.Errorf("client version %q: got %v, want deadline exceeded", tc.clientVersion, err)
+		}
+	}
+}
+
+func TestProxyConfigIncomplete(t *testing.T) {
+	clientConfig := &ClientConfig{HostKeyCallback: InsecureIgnoreHostKey()}
+	fil := NewFilter("true", nil)
+	for _, config := range []*ProxyConfig{
+		nil,
+		{Filter: fil},
+		{ClientConfig: clientConfig},
+		{ClientConfig: clientConfig, Filter: fil, FullProxy: true},
+	} {
+		toClient, clientSide, err := netPipe()
+		if err != nil {
+			t.Fatalf("netPipe: %v", err)
+		}
+		toServer, serverSide, err := netPipe()
+		if err != nil {
+			t.Fatalf("netPipe: %v", err)
+		}
+		_, err = NewProxyConnContext(context.Background(), "server", toClient, toServer, config)
+		var perr *ProxyError
+		if !errors.As(err, &perr) || perr.Phase != PhaseVersion {
+			t.Errorf("config %+v: got %v, want version phase error", config, err)
+		}
+		// Both connections are closed.
+		for _, c := range []net.Conn{clientSide, serverSide} {
+			if _, err := c.Read(make([]byte, 1)); err != io.EOF {
+				t.Errorf("config %+v: got %v reading from a proxy connection, want EOF", config, err)
+			}
+			c.Close()
+		}
+	}
+}
+
+func TestProxyConnContextCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+	err := stalledProxy(t, ctx, packageVersion, &ProxyConfig{})
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("got %v, want context.Canceled", err)
+	}
+}
+
+func TestProxyConnClose(t *testing.T) {
+	client, pc := proxyTestClient(t, NewFilter("true", nil), nil)
+	defer client.Close()
+	done := pc.Run()
+	if err := pc.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	select {
+	case err := <-done:
+		var perr *ProxyError
+		if !errors.As(err, &perr) || perr.Phase != PhaseFilter {
+			t.Errorf("got %v, want filter phase error", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Run did not return after Close")
+	}
+}
+
+func TestFullProxy(t *testing.T) {
+	var clientKexes, proxyKexes, serverKexes int32
+	fil, err := NewPolicyFilter(&Policy{
+		Commands: []CommandRule{{Rule: Rule{Decision: Allow}, Match: MatchGlob, Pattern: "echo *"}},
+		Channels: []ChannelRule{{Rule: Rule{Decision: Allow}, Type: "session"}},
+	}, nil)
+	if err != nil {
+		t.Fatalf("NewPolicyFilter: %v", err)
+	}
+	proxyConfig := &ProxyConfig{
+		ClientConfig: &ClientConfig{Config: Config{
+			RekeyThreshold: minRekeyThreshold,
+			KexCallback:    func() { atomic.AddInt32(&proxyKexes, 1) },
+		}},
+		Filter:    fil,
+		FullProxy: true,
+		HostKey:   testSigners["rsa"],
+	}
+	clientConfig := &ClientConfig{
+		Config: Config{
+			RekeyThreshold: minRekeyThreshold,
+			KexCallback:    func() { atomic.AddInt32(&clientKexes, 1) },
+		},
+		HostKeyCallback: FixedHostKey(testSigners["rsa"].PublicKey()),
+	}
+	serverConfig := &ServerConfig{Config: Config{
+		KexCallback: func() { atomic.AddInt32(&serverKexes, 1) },
+	}}
+	client, pc, _ := proxyTestClientConfig(t, proxyConfig, clientConfig, serverConfig)
+	done := pc.Run()
+
+	for i := 0; i < 5; i++ {
+		session, err := client.NewSession()
+		if err != nil {
+			t.Fatalf("NewSession: %v", err)
+		}
+		cmd := "echo " + strings.Repeat("x", 100)
+		if out, err := session.Output(cmd); err != nil || string(out) != cmd {
+			t.Fatalf("Output: %q, %v", out, err)
+		}
+	}
+	session, err := client.NewSession()
+	if err != nil {
+		t.Fatalf("NewSession: %v", err)
+	}
+	if err := session.Run("rm -rf /"); err == nil {
+		t.Errorf("command outside the policy was allowed")
+	}
+	session.Close()
+
+	// Each side rekeyed on its own; the client's rekeys were answered
+	// by the proxy rather than forwarded.
+	clientKexes, proxyKexes, serverKexes = atomic.LoadInt32(&clientKexes), atomic.LoadInt32(&proxyKexes), atomic.LoadInt32(&serverKexes)
+	if clientKexes < 2 || proxyKexes < 2 {
+		t.Errorf("got %d client and %d proxy kexes, want rekeys on both sides", clientKexes, proxyKexes)
+	}
+	if serverKexes != proxyKexes {
+		t.Errorf("server saw %d kexes, proxy %d", serverKexes, proxyKexes)
+	}
+
+	client.Close()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Run: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Run did not return after the client disconnected")
+	}
+}
+
+// handoff makes client hand off the connection proxied by pc, whose
+// Run returned done, and relays the connection afterwards.
+func handoff(t *testing.T, client *Client, pc ProxyConn, done <-chan error) {
+	client.Conn.(*connection).RequestKeyChange()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Run: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("handoff did not complete")
+	}
+	h, err := pc.Handoff()
+	if err != nil {
+		t.Fatalf("Handoff: %v", err)
+	}
+	go h.Relay()
+}
+
+func TestProxyHandoff(t *testing.T) {
+	client, pc := proxyTestClient(t, NewFilter("true", nil), nil)
+	defer client.Close()
+	done := pc.Run()
+	if _, err := pc.Handoff(); err == nil {
+		t.Errorf("Handoff succeeded before the handoff")
+	}
+
+	if ok, _, err := client.SendRequest(NoMoreSessionRequestName, true, nil); err != nil || !ok {
+		t.Fatalf("no-more-sessions: %v, %v", ok, err)
+	}
+	session, err := client.NewSession()
+	if err != nil {
+		t.Fatalf("NewSession: %v", err)
+	}
+	if _, err := session.Output("true"); err != nil {
+		t.Fatalf("Output: %v", err)
+	}
+	handoff(t, client, pc, done)
+
+	// The client now talks to the server directly, past the filter.
+	session, err = client.NewSession()
+	if err != nil {
+		t.Fatalf("NewSession after handoff: %v", err)
+	}
+	cmd := strings.Repeat("x", 100000)
+	if out, err := session.Output(cmd); err != nil || string(out) != cmd {
+		t.Fatalf("Output after handoff: %d bytes, %v", len(out), err)
+	}
+}
+
+// handoffTestClient connects a client through a proxy that allows any
+// command in any number of sessions, starts forwarding, and sends
+// no-more-sessions. It returns the channel returned by Run.
+func handoffTestClient(t *testing.T, serverConfig *ServerConfig) (*Client, ProxyConn, <-chan error, *ServerConn) {
+	fil, err := NewPolicyFilter(&Policy{
+		Commands: []CommandRule{{Rule: Rule{Decision: Allow}, Match: MatchGlob, Pattern: "*"}},
+		Channels: []ChannelRule{{Rule: Rule{Decision: Allow}, Type: "session"}},
+	}, nil)
+	if err != nil {
+		t.Fatalf("NewPolicyFilter: %v", err)
+	}
+	client, pc, serverConns := proxyTestClientConfig(t, &ProxyConfig{Filter: fil}, &ClientConfig{
+		HostKeyCallback:          InsecureIgnoreHostKey(),
+		DeferHostKeyVerification: true,
+	}, serverConfig)
+	done := pc.Run()
+	if ok, _, err := client.SendRequest(NoMoreSessionRequestName, true, nil); err != nil || !ok {
+		t.Fatalf("no-more-sessions: %v, %v", ok, err)
+	}
+	return client, pc, done, <-serverConns
+}
+
+// checkEcho runs a command of n bytes, which the test server echoes.
+func checkEcho(t *testing.T, client *Client, n int) {
+	session, err := client.NewSession()
+	if err != nil {
+		t.Fatalf("NewSession: %v", err)
+	}
+	cmd := strings.Repeat("x", n)
+	if out, err := session.Output(cmd); err != nil || string(out) != cmd {
+		t.Fatalf("Output: %d bytes, %v", len(out), err)
+	}
+}
+
+func TestProxyHandoffGroupExchange(t *testing.T) {
+	// The kex messages of the handoff pass through the filter.
+	fil, err := NewPolicyFilter(&Policy{
+		Commands: []CommandRule{{Rule: Rule{Decision: Allow}, Match: MatchGlob, Pattern: "*"}},
+		Channels: []ChannelRule{{Rule: Rule{Decision: Allow}, Type: "session"}},
+	}, nil)
+	if err != nil {
+		t.Fatalf("NewPolicyFilter: %v", err)
+	}
+	client, pc, _ := proxyTestClientConfig(t, &ProxyConfig{Filter: fil}, &ClientConfig{
+		HostKeyCallback:          InsecureIgnoreHostKey(),
+		DeferHostKeyVerification: true,
+		Config:                   Config{KeyExchanges: []string{kexAlgoDHGEXSHA256}},
+	}, &ServerConfig{})
+	defer client.Close()
+	done := pc.Run()
+	if ok, _, err := client.SendRequest(NoMoreSessionRequestName, true, nil); err != nil || !ok {
+		t.Fatalf("no-more-sessions: %v, %v", ok, err)
+	}
+	handoff(t, client, pc, done)
+	checkEcho(t, client, 10000)
+	if algs := client.Conn.(*connection).transport.negotiatedAlgorithms(); algs.kex != kexAlgoDHGEXSHA256 {
+		t.Errorf("handoff used %s, want %s", algs.kex, kexAlgoDHGEXSHA256)
+	}
+}
+
+func TestProxyHandoffAfterServerRekey(t *testing.T) {
+	var serverKexes int32
+	client, pc, done, _ := handoffTestClient(t, &ServerConfig{Config: Config{
+		RekeyThreshold: minRekeyThreshold,
+		KexCallback:    func() { atomic.AddInt32(&serverKexes, 1) },
+	}})
+	defer client.Close()
+
+	// The server rekeys with the proxy while the client's output
+	// passes through it.
+	for i := 0; i < 3; i++ {
+		checkEcho(t, client, 1000)
+	}
+	if n := atomic.LoadInt32(&serverKexes); n < 2 {
+		t.Fatalf("server did %d key exchanges, want a rekey before the handoff", n)
+	}
+	handoff(t, client, pc, done)
+	checkEcho(t, client, 10000)
+}
+
+func TestProxyHandoffDuringServerRekey(t *testing.T) {
+	// The server's KEXINIT may reach the proxy before or after the
+	// client's; repeat to see both orderings.
+	for i := 0; i < 20; i++ {
+		client, pc, done, server := handoffTestClient(t, &ServerConfig{})
+		checkEcho(t, client, 100)
+
+		server.Conn.(*connection).transport.requestKeyExchange()
+		handoff(t, client, pc, done)
+		checkEcho(t, client, 10000)
+		client.Close()
+	}
+}
+
+func TestProxyRepeatedKexInit(t *testing.T) {
+	client, _, done, _ := handoffTestClient(t, &ServerConfig{})
+	defer client.Close()
+
+	// Bypass the client's key exchange logic to send two KEXINITs
+	// in a row.
+	config := &ClientConfig{}
+	config.SetDefaults()
+	kexInit := Marshal(&kexInitMsg{
+		KexAlgos:                config.KeyExchanges,
+		ServerHostKeyAlgos:      []string{KeyAlgoNone},
+		CiphersClientServer:     config.Ciphers,
+		CiphersServerClient:     config.Ciphers,
+		MACsClientServer:        config.MACs,
+		MACsServerClient:        config.MACs,
+		CompressionClientServer: config.Compressions,
+		CompressionServerClient: config.Compressions,
+	})
+	conn := client.Conn.(*connection).transport.conn
+	for i := 0; i < 2; i++ {
+		if err := conn.writePacket(append([]byte(nil), kexInit...)); err != nil {
+			t.Fatalf("writePacket: %v", err)
+		}
+	}
+
+	select {
+	case err := <-done:
+		var perr *ProxyError
+		if !errors.As(err, &perr) || perr.Phase != PhaseHandoff || perr.Err != errRepeatedKexInit {
+			t.Errorf("got %v, want repeated kexinit error", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Run did not return")
+	}
+}
+
+func TestNegotiateSessionParams(t *testing.T) {
+	for _, tc := range []struct {
+		algos []string
+		want  uint32
+	}{
+		{nil, 0},
+		{[]string{kexAlgoCurve25519SHA256}, 0},
+		{[]string{kexAlgoCurve25519SHA256, sessionParamsAlgo(1)}, 1},
+		{[]string{sessionParamsAlgo(sessionParamsVersion + 1), sessionParamsAlgo(1)}, 1},
+		{[]string{sessionParamsAlgo(sessionParamsVersion + 1)}, 0},
+	} {
+		if got := negotiateSessionParams(tc.algos); got != tc.want {
+			t.Errorf("negotiateSessionParams(%q) = %d, want %d", tc.algos, got, tc.want)
+		}
+	}
+}
+
+func TestProxyHandoffUnsupported(t *testing.T) {
+	client, pc, done, _ := handoffTestClient(t, &ServerConfig{})
+	defer client.Close()
+	if v := pc.(*proxy).toClient.trans.sessionParamsVersion; v != sessionParamsVersion {
+		t.Fatalf("negotiated version %d, want %d", v, sessionParamsVersion)
+	}
+
+	// Pretend the client did not advertise the extension.
+	pc.(*proxy).toClient.trans.sessionParamsVersion = 0
+	client.Conn.(*connection).RequestKeyChange()
+
+	select {
+	case err := <-done:
+		var perr *ProxyError
+		if !errors.As(err, &perr) || perr.Phase != PhaseHandoff || perr.Err != errHandoffUnsupported {
+			t.Errorf("got %v, want unsupported handoff error", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Run did not return")
+	}
+	if err := client.Wait(); err == nil || !strings.Contains(err.Error(), "session parameters extension") {
+		t.Errorf("client got %v, want disconnect explaining the missing extension", err)
+	}
+}
+
+// nonStrictServer makes the server, and the proxy's view of it, behave
+// as if the first key exchange had not negotiated strict key exchange.
+func nonStrictServer(pc ProxyConn, server *ServerConn) {
+	for _, trans := range []*handshakeTransport{pc.(*proxy).toServer.trans, server.Conn.(*connection).transport} {
+		trans.strictKex = false
+		trans.conn.setStrictKex(false)
+	}
+}
+
+func TestProxyHandoffStrictKex(t *testing.T) {
+	client, pc, done, server := handoffTestClient(t, &ServerConfig{})
+	defer client.Close()
+	trans := client.Conn.(*connection).transport
+	if !trans.strictKex {
+		t.Fatalf("client did not negotiate strict key exchange with the proxy")
+	}
+
+	// The client leaves strict mode along with the session
+	// parameters of the server.
+	nonStrictServer(pc, server)
+	handoff(t, client, pc, done)
+	checkEcho(t, client, 10000)
+	if trans.strictKex {
+		t.Errorf("client kept strict key exchange after handing off to a server without it")
+	}
+}
+
+func TestProxyHandoffStrictKexMismatch(t *testing.T) {
+	client, pc, done, server := handoffTestClient(t, &ServerConfig{})
+	defer client.Close()
+
+	// Version 1 of the extension cannot tell the client to leave
+	// strict mode.
+	pc.(*proxy).toClient.trans.sessionParamsVersion = 1
+	nonStrictServer(pc, server)
+	client.Conn.(*connection).RequestKeyChange()
+
+	select {
+	case err := <-done:
+		var perr *ProxyError
+		if !errors.As(err, &perr) || perr.Err != errStrictKexMismatch {
+			t.Errorf("got %v, want strict key exchange mismatch", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Run did not return")
+	}
+}
+
+func TestProxyHandoffCompression(t *testing.T) {
+	fil, err := NewPolicyFilter(&Policy{
+		Commands: []CommandRule{{Rule: Rule{Decision: Allow}, Match: MatchGlob, Pattern: "*"}},
+		Channels: []ChannelRule{{Rule: Rule{Decision: Allow}, Type: "session"}},
+	}, nil)
+	if err != nil {
+		t.Fatalf("NewPolicyFilter: %v", err)
+	}
+	// Both legs of the proxy compress, and so does the connection
+	// handed off to the server.
+	compress := Config{Compressions: []string{compressionZlibOpenSSH}}
+	client, pc, _ := proxyTestClientConfig(t, &ProxyConfig{
+		Filter:       fil,
+		ClientConfig: &ClientConfig{Config: compress},
+	}, &ClientConfig{
+		HostKeyCallback:          InsecureIgnoreHostKey(),
+		DeferHostKeyVerification: true,
+		Config:                   compress,
+	}, &ServerConfig{})
+	defer client.Close()
+	done := pc.Run()
+	if ok, _, err := client.SendRequest(NoMoreSessionRequestName, true, nil); err != nil || !ok {
+		t.Fatalf("no-more-sessions: %v, %v", ok, err)
+	}
+
+	checkEcho(t, client, 10000)
+	handoff(t, client, pc, done)
+	checkEcho(t, client, 100000)
+}
+
+func TestProxyHostKeyProof(t *testing.T) {
+	var mu sync.Mutex
+	var keys []PublicKey
+	client, pc, _ := proxyTestClientConfig(t, &ProxyConfig{Filter: NewFilter("true", nil)}, &ClientConfig{
+		HostKeyCallback: func(hostname string, remote net.Addr, key PublicKey) error {
+			mu.Lock()
+			keys = append(keys, key)
+			mu.Unlock()
+			return FixedHostKey(testSigners["ecdsa"].PublicKey())(hostname, remote, key)
+		},
+		DeferHostKeyVerification: true,
+	}, &ServerConfig{})
+	defer client.Close()
+	mu.Lock()
+	if len(keys) != 1 {
+		t.Fatalf("host key callback called %d times during the handshake, want once", len(keys))
+	}
+	mu.Unlock()
+
+	done := pc.Run()
+	if ok, _, err := client.SendRequest(NoMoreSessionRequestName, true, nil); err != nil || !ok {
+		t.Fatalf("no-more-sessions: %v, %v", ok, err)
+	}
+	handoff(t, client, pc, done)
+	checkEcho(t, client, 1000)
+
+	// The server's key is checked again in the key exchange that
+	// completes the handoff.
+	mu.Lock()
+	defer mu.Unlock()
+	if len(keys) != 2 {
+		t.Errorf("host key callback called %d times, want twice", len(keys))
+	}
+}
+
+func TestProxyHostKeyProofMismatch(t *testing.T) {
+	toServer, serverSide, err := netPipe()
+	if err != nil {
+		t.Fatalf("netPipe: %v", err)
+	}
+	clientSide, toClient, err := netPipe()
+	if err != nil {
+		t.Fatalf("netPipe: %v", err)
+	}
+	defer clientSide.Close()
+	proxyTestServerConfig(t, serverSide, &ServerConfig{})
+	go NewProxyConnWithConfig("server", toClient, toServer, &ProxyConfig{
+		ClientConfig: &ClientConfig{
+			User:            "user",
+			Auth:            []AuthMethod{Password("secret")},
+			HostKeyCallback: InsecureIgnoreHostKey(),
+		},
+		Filter: NewFilter("true", nil),
+	})
+
+	_, _, _, err = NewClientConn(clientSide, "server", &ClientConfig{
+		User:                     "user",
+		HostKeyCallback:          FixedHostKey(testSigners["rsa"].PublicKey()),
+		DeferHostKeyVerification: true,
+	})
+	if err == nil || !strings.Contains(err.Error(), "host key mismatch") {
+		t.Errorf("got %v, want host key mismatch", err)
+	}
+}
+
+func TestVerifyHostKeyProof(t *testing.T) {
+	sessionID := []byte("session id")
+	sig, err := testSigners["ecdsa"].Sign(rand.Reader, sessionID)
+	if err != nil {
+		t.Fatalf("Sign: %v", err)
+	}
+	proof := hostKeyProof{
+		HostKey:   testSigners["ecdsa"].PublicKey().Marshal(),
+		Signature: Marshal(sig),
+		SessionID: []byte("other session id"),
+	}
+	trans := &handshakeTransport{
+		deferHostKeyVerification: 1,
+		hostKeyCallback:          InsecureIgnoreHostKey(),
+		hostKeyAlgorithms:        supportedHostKeyAlgos,
+	}
+	if err := trans.verifyHostKeyProof(Marshal(proof)); err == nil {
+		t.Errorf("proof with a signature over another session ID was accepted")
+	}
+
+	proof.SessionID = sessionID
+	if err := trans.verifyHostKeyProof(Marshal(proof)); err != nil {
+		t.Fatalf("verifyHostKeyProof: %v", err)
+	}
+	if !bytes.Equal(trans.provenSessionID, sessionID) {
+		t.Errorf("proven session ID %q, want %q", trans.provenSessionID, sessionID)
+	}
+}
+
+func TestProxyStats(t *testing.T) {
+	registry := &ProxyRegistry{}
+	client, pc, _ := proxyTestClientConfig(t, &ProxyConfig{
+		Filter:   NewFilter("true", nil),
+		Registry: registry,
+	}, &ClientConfig{
+		HostKeyCallback:          FixedHostKey(testSigners["ecdsa"].PublicKey()),
+		DeferHostKeyVerification: true,
+	}, &ServerConfig{})
+	defer client.Close()
+	done := pc.Run()
+
+	// Stats may be polled while packets go through.
+	stop := make(chan struct{})
+	polled := make(chan struct{})
+	go func() {
+		defer close(polled)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				registry.Stats()
+			}
+		}
+	}()
+
+	session, err := client.NewSession()
+	if err != nil {
+		t.Fatalf("NewSession: %v", err)
+	}
+	if err := session.Run("ls"); err == nil {
+		t.Fatalf("blocked command succeeded")
+	}
+	session.Close()
+	if ok, _, err := client.SendRequest(NoMoreSessionRequestName, true, nil); err != nil || !ok {
+		t.Fatalf("no-more-sessions: %v, %v", ok, err)
+	}
+	close(stop)
+	<-polled
+
+	stats := pc.Stats()
+	if stats.Phase != PhaseFilter || stats.Ended {
+		t.Errorf("got phase %v, ended %v; want filtering", stats.Phase, stats.Ended)
+	}
+	for _, phase := range []ProxyPhase{PhaseVersion, PhaseKex, PhaseAuth, PhaseFilter} {
+		if _, ok := stats.PhaseDurations[phase]; !ok {
+			t.Errorf("no duration for phase %v", phase)
+		}
+	}
+	if stats.ClientToServer.Packets == 0 || stats.ServerToClient.Packets == 0 || stats.ClientToServer.Bytes == 0 {
+		t.Errorf("got traffic %+v and %+v, want packets both ways", stats.ClientToServer, stats.ServerToClient)
+	}
+	if stats.ClientToServer.Blocked != 1 {
+		t.Errorf("got %d blocked packets, want 1", stats.ClientToServer.Blocked)
+	}
+	if algs := stats.ServerLeg.Algorithms; algs == nil || algs.HostKey != KeyAlgoECDSA256 {
+		t.Errorf("got server algorithms %+v, want the server's ecdsa host key", algs)
+	}
+	if algs := stats.ClientLeg.Algorithms; algs == nil || algs.Read.Cipher == "" {
+		t.Errorf("got client algorithms %+v", algs)
+	}
+	if stats.ServerLeg.OutSeqNum == 0 || stats.ClientLeg.InSeqNum == 0 {
+		t.Errorf("got sequence numbers %+v and %+v", stats.ClientLeg, stats.ServerLeg)
+	}
+	if live := registry.Stats(); len(live) != 1 || live[0].ID != stats.ID {
+		t.Errorf("registry lists %d connections, want this one", len(live))
+	}
+
+	handoff(t, client, pc, done)
+	stats = pc.Stats()
+	if stats.Phase != PhaseHandoff || !stats.Ended || !stats.HandedOff {
+		t.Errorf("got phase %v, ended %v, handed off %v after handoff", stats.Phase, stats.Ended, stats.HandedOff)
+	}
+	if live := registry.Stats(); len(live) != 0 {
+		t.Errorf("registry lists %d connections after handoff", len(live))
+	}
+}
+
+func TestProxyRegistryClose(t *testing.T) {
+	registry := &ProxyRegistry{}
+	errc := make(chan error, 1)
+	go func() {
+		errc <- stalledProxy(t, context.Background(), packageVersion, &ProxyConfig{Registry: registry})
+	}()
+
+	// The connection is stuck waiting for the client's KEXINIT.
+	var live []*ProxyStats
+	for i := 0; i < 100; i++ {
+		if live = registry.Stats(); len(live) == 1 && live[0].Phase == PhaseKex {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if len(live) != 1 || live[0].Phase != PhaseKex {
+		t.Fatalf("got %+v, want one connection in the key exchange", live)
+	}
+	if err := registry.Close(live[0].ID); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	var perr *ProxyError
+	if err := <-errc; !errors.As(err, &perr) || perr.Phase != PhaseKex {
+		t.Errorf("got %v, want kex error", err)
+	}
+	if live := registry.Stats(); len(live) != 0 {
+		t.Errorf("registry lists %d connections after Close", len(live))
+	}
+}
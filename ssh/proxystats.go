@@ -0,0 +1,285 @@
+package ssh
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ProxyStats is a snapshot of the state of a proxied connection.
+type ProxyStats struct {
+	// ID identifies the connection in its ProxyRegistry, if any.
+	ID uint64
+
+	// DialAddress is the address the proxy dialed, and User the
+	// user it authenticates as.
+	DialAddress string
+	User        string
+
+	// Phase is the current phase, or the last one if the
+	// connection ended. HandedOff reports whether the connection
+	// ended with a successful handoff.
+	Phase     ProxyPhase
+	Ended     bool
+	HandedOff bool
+
+	// Started is when the proxy started the version exchange.
+	// PhaseDurations holds the time spent in each phase entered so
+	// far, including the current one.
+	Started        time.Time
+	PhaseDurations map[ProxyPhase]time.Duration
+
+	// LastPacket is when the proxy last read a packet from either
+	// side, or the zero time if it did not forward any yet. A
+	// connection whose last packet is long past is likely stuck.
+	LastPacket time.Time
+
+	ClientToServer TrafficStats
+	ServerToClient TrafficStats
+
+	// ClientLeg and ServerLeg describe the proxy's connections to
+	// the client and to the server.
+	ClientLeg LegStats
+	ServerLeg LegStats
+}
+
+// TrafficStats counts the packets forwarded in one direction, after
+// authentication.
+type TrafficStats struct {
+	// Packets and Bytes count the packets read, and the size of
+	// their payloads.
+	Packets uint64
+	Bytes   uint64
+
+	// Blocked counts the packets the filter did not forward.
+	Blocked uint64
+}
+
+// LegStats describes one of the proxy's two connections.
+type LegStats struct {
+	// OutSeqNum and InSeqNum are the sequence numbers of the next
+	// packets the proxy writes and reads.
+	OutSeqNum uint32
+	InSeqNum  uint32
+
+	// Algorithms are those negotiated in the last key exchange, or
+	// nil before the first one completes.
+	Algorithms *Algorithms
+}
+
+// Algorithms lists the algorithms negotiated in a key exchange.
+type Algorithms struct {
+	Kex     string
+	HostKey string
+
+	// Read and Write apply to packets read from and written to the
+	// connection, respectively.
+	Read  DirectionAlgorithms
+	Write DirectionAlgorithms
+}
+
+// DirectionAlgorithms lists the algorithms protecting packets in one
+// direction of a connection. MAC is empty for AEAD ciphers, which
+// authenticate packets themselves.
+type DirectionAlgorithms struct {
+	Cipher      string
+	MAC         string
+	Compression string
+}
+
+func exportAlgorithms(algs *algorithms) *Algorithms {
+	if algs == nil {
+		return nil
+	}
+	return &Algorithms{
+		Kex:     algs.kex,
+		HostKey: algs.hostKey,
+		Read:    DirectionAlgorithms(algs.r),
+		Write:   DirectionAlgorithms(algs.w),
+	}
+}
+
+// proxyStats tracks the state of a proxied connection from the start
+// of the version exchange.
+type proxyStats struct {
+	id          uint64
+	dialAddress string
+	user        string
+	registry    *ProxyRegistry
+
+	mu         sync.Mutex
+	phase      ProxyPhase
+	phaseStart [PhaseHandoff + 1]time.Time
+	ended      time.Time
+	handedOff  bool
+	lastPacket time.Time
+	traffic    [2]TrafficStats
+
+	// toClient and toServer are set once the transports exist.
+	toClient *handshakeTransport
+	toServer *handshakeTransport
+
+	// close interrupts the connection, in whichever phase it is.
+	close func() error
+}
+
+func newProxyStats(dialAddress, user string) *proxyStats {
+	s := &proxyStats{dialAddress: dialAddress, user: user}
+	s.phaseStart[PhaseVersion] = time.Now()
+	return s
+}
+
+func (s *proxyStats) enterPhase(phase ProxyPhase) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.phase = phase
+	s.phaseStart[phase] = time.Now()
+}
+
+func (s *proxyStats) setTransports(toClient, toServer *handshakeTransport) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.toClient = toClient
+	s.toServer = toServer
+}
+
+func (s *proxyStats) setClose(close func() error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.close = close
+}
+
+// packetRead records a packet of length n read in direction d.
+func (s *proxyStats) packetRead(d Direction, n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastPacket = time.Now()
+	s.traffic[d].Packets++
+	s.traffic[d].Bytes += uint64(n)
+}
+
+func (s *proxyStats) packetBlocked(d Direction) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.traffic[d].Blocked++
+}
+
+// end records the end of the connection, which leaves the registry.
+func (s *proxyStats) end(handedOff bool) {
+	s.mu.Lock()
+	if s.ended.IsZero() {
+		s.ended = time.Now()
+		s.handedOff = handedOff
+	}
+	s.mu.Unlock()
+	if s.registry != nil {
+		s.registry.remove(s.id)
+	}
+}
+
+func (s *proxyStats) snapshot() *ProxyStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stats := &ProxyStats{
+		ID:             s.id,
+		DialAddress:    s.dialAddress,
+		User:           s.user,
+		Phase:          s.phase,
+		Ended:          !s.ended.IsZero(),
+		HandedOff:      s.handedOff,
+		Started:        s.phaseStart[PhaseVersion],
+		PhaseDurations: make(map[ProxyPhase]time.Duration),
+		LastPacket:     s.lastPacket,
+		ClientToServer: s.traffic[ClientToServer],
+		ServerToClient: s.traffic[ServerToClient],
+	}
+	end := s.ended
+	if end.IsZero() {
+		end = time.Now()
+	}
+	for phase := s.phase; phase >= PhaseVersion; phase-- {
+		if s.phaseStart[phase].IsZero() {
+			// PhaseHandoff is skipped in full proxy mode.
+			continue
+		}
+		stats.PhaseDurations[phase] = end.Sub(s.phaseStart[phase])
+		end = s.phaseStart[phase]
+	}
+	if s.toClient != nil {
+		stats.ClientLeg = legStats(s.toClient)
+		stats.ServerLeg = legStats(s.toServer)
+	}
+	return stats
+}
+
+func legStats(t *handshakeTransport) LegStats {
+	out, in := t.getSequenceNumbers()
+	return LegStats{
+		OutSeqNum:  out,
+		InSeqNum:   in,
+		Algorithms: exportAlgorithms(t.negotiatedAlgorithms()),
+	}
+}
+
+// ProxyRegistry tracks live proxied connections, from the start of the
+// version exchange until they end or are handed off, so that a program
+// running many of them can find those that are stuck. Connections are
+// added by setting ProxyConfig.Registry. The zero value is an empty
+// registry ready to use.
+type ProxyRegistry struct {
+	mu     sync.Mutex
+	nextID uint64
+	conns  map[uint64]*proxyStats
+}
+
+func (r *ProxyRegistry) add(s *proxyStats) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.conns == nil {
+		r.conns = make(map[uint64]*proxyStats)
+	}
+	r.nextID++
+	s.id = r.nextID
+	s.registry = r
+	r.conns[s.id] = s
+}
+
+func (r *ProxyRegistry) remove(id uint64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.conns, id)
+}
+
+// Stats returns a snapshot of each live connection, ordered by ID.
+func (r *ProxyRegistry) Stats() []*ProxyStats {
+	r.mu.Lock()
+	conns := make([]*proxyStats, 0, len(r.conns))
+	for _, s := range r.conns {
+		conns = append(conns, s)
+	}
+	r.mu.Unlock()
+
+	stats := make([]*ProxyStats, len(conns))
+	for i, s := range conns {
+		stats[i] = s.snapshot()
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].ID < stats[j].ID })
+	return stats
+}
+
+// Close closes both connections of the live connection id, whatever
+// its phase. A connection still being set up makes
+// NewProxyConnContext fail.
+func (r *ProxyRegistry) Close(id uint64) error {
+	r.mu.Lock()
+	s, ok := r.conns[id]
+	r.mu.Unlock()
+	if !ok {
+		return errors.New("ssh: no such proxied connection")
+	}
+	s.mu.Lock()
+	close := s.close
+	s.mu.Unlock()
+	return close()
+}
@@ -0,0 +1,416 @@
+// Package proxytest runs SSH connections through an ssh.ProxyConn
+// entirely in process, so that filter policies and handoffs can be
+// tested without a real sshd.
+//
+// A Harness connects a handoff-capable client to an in-memory server
+// through a proxy, over loopback TCP. Scripted sessions are made of
+// Steps, which check the proxy's decisions and, after the handoff, the
+// integrity of the data the client and the server exchange directly.
+// Faults are injected by dropping or delaying what either endpoint
+// writes, by delaying the server's replies and by rekeying at
+// arbitrary points of the script.
+//
+// The server accepts any password. It answers "exec" requests by
+// echoing the command, and "shell" requests and "direct-tcpip"
+// channels by echoing their input until EOF. It accepts "pty-req" and
+// "env" requests, and rejects other requests and channel types. It
+// acknowledges no-more-sessions@openssh.com without enforcing it, so
+// that new sessions can check the data integrity after the handoff.
+package proxytest
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Config configures a Harness. The zero value is usable.
+type Config struct {
+	// Policy is enforced by the proxy. If nil, everything is
+	// allowed.
+	Policy *ssh.Policy
+
+	// Approver decides the requests that Policy escalates.
+	Approver ssh.Approver
+
+	// ServerConfig configures the server, for example to rekey
+	// after a small number of bytes. A host key is added, and a
+	// password callback if there is none.
+	ServerConfig *ssh.ServerConfig
+
+	// ReplyDelay delays the server's replies to global requests
+	// and channel opens.
+	ReplyDelay time.Duration
+
+	// StepTimeout limits the time a Step may take. If zero, 10
+	// seconds are allowed.
+	StepTimeout time.Duration
+}
+
+// Side identifies an endpoint of a proxied connection.
+type Side int
+
+const (
+	Client Side = iota
+	Server
+)
+
+func (s Side) String() string {
+	if s == Client {
+		return "client"
+	}
+	return "server"
+}
+
+// A Harness is a client connected to a server through a proxy.
+type Harness struct {
+	Client *ssh.Client
+	Server *ssh.ServerConn
+	Proxy  ssh.ProxyConn
+
+	// HostKey is the server's host key. The client only accepts
+	// this key, which the proxy proves to it.
+	HostKey ssh.PublicKey
+
+	config  Config
+	links   [2]*Link
+	events  eventRecorder
+	done    <-chan error
+	handoff *ssh.HandoffStreams
+}
+
+// New connects a client to a server through a proxy, and starts the
+// proxy. Close must be called to release the connections.
+func New(config *Config) (*Harness, error) {
+	h := &Harness{}
+	if config != nil {
+		h.config = *config
+	}
+	if h.config.Policy == nil {
+		h.config.Policy = &ssh.Policy{Default: ssh.Rule{Decision: ssh.Allow}}
+	}
+	if h.config.StepTimeout == 0 {
+		h.config.StepTimeout = 10 * time.Second
+	}
+	serverConfig := h.config.ServerConfig
+	if serverConfig == nil {
+		serverConfig = &ssh.ServerConfig{}
+	}
+	if serverConfig.PasswordCallback == nil {
+		serverConfig.PasswordCallback = func(ssh.ConnMetadata, []byte) (*ssh.Permissions, error) {
+			return nil, nil
+		}
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		return nil, err
+	}
+	serverConfig.AddHostKey(signer)
+	h.HostKey = signer.PublicKey()
+
+	fil, err := ssh.NewPolicyFilter(h.config.Policy, h.config.Approver)
+	if err != nil {
+		return nil, err
+	}
+
+	toServer, serverSide, err := loopback()
+	if err != nil {
+		return nil, err
+	}
+	clientSide, toClient, err := loopback()
+	if err != nil {
+		toServer.Close()
+		serverSide.Close()
+		return nil, err
+	}
+	h.links[Client] = &Link{Conn: clientSide}
+	h.links[Server] = &Link{Conn: serverSide}
+
+	type serverResult struct {
+		conn *ssh.ServerConn
+		err  error
+	}
+	serverDone := make(chan serverResult, 1)
+	go func() {
+		conn, chans, reqs, err := ssh.NewServerConn(h.links[Server], serverConfig)
+		if err == nil {
+			go h.serveRequests(reqs)
+			go h.serveChannels(chans)
+		}
+		serverDone <- serverResult{conn, err}
+	}()
+
+	type proxyResult struct {
+		pc  ssh.ProxyConn
+		err error
+	}
+	proxyDone := make(chan proxyResult, 1)
+	go func() {
+		pc, err := ssh.NewProxyConnWithConfig("server", toClient, toServer, &ssh.ProxyConfig{
+			ClientConfig: &ssh.ClientConfig{
+				User:            "user",
+				Auth:            []ssh.AuthMethod{ssh.Password("secret")},
+				HostKeyCallback: ssh.FixedHostKey(h.HostKey),
+			},
+			Filter: fil,
+			Events: &h.events,
+		})
+		proxyDone <- proxyResult{pc, err}
+	}()
+
+	conn, chans, reqs, clientErr := ssh.NewClientConn(h.links[Client], "server", &ssh.ClientConfig{
+		User:                     "user",
+		HostKeyCallback:          ssh.FixedHostKey(h.HostKey),
+		DeferHostKeyVerification: true,
+	})
+	proxy := <-proxyDone
+	server := <-serverDone
+	if err := firstError(clientErr, proxy.err, server.err); err != nil {
+		for _, c := range []io.Closer{h.links[Client], h.links[Server], toClient, toServer} {
+			c.Close()
+		}
+		return nil, err
+	}
+	h.Client = ssh.NewClient(conn, chans, reqs)
+	h.Server = server.conn
+	h.Proxy = proxy.pc
+	h.done = h.Proxy.Run()
+	return h, nil
+}
+
+func firstError(errs ...error) error {
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loopback returns both ends of a TCP connection on the loopback
+// interface.
+func loopback() (net.Conn, net.Conn, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		listener, err = net.Listen("tcp", "[::1]:0")
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	defer listener.Close()
+	c1, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		return nil, nil, err
+	}
+	c2, err := listener.Accept()
+	if err != nil {
+		c1.Close()
+		return nil, nil, err
+	}
+	return c1, c2, nil
+}
+
+// Link returns the connection of side s to the proxy.
+func (h *Harness) Link(s Side) *Link {
+	return h.links[s]
+}
+
+// Events returns the events the proxy emitted so far.
+func (h *Harness) Events() []ssh.Event {
+	return h.events.get()
+}
+
+// Escalations returns the outcomes of the escalations so far.
+func (h *Harness) Escalations() []*ssh.EscalationEvent {
+	var escalations []*ssh.EscalationEvent
+	for _, e := range h.Events() {
+		if e, ok := e.(*ssh.EscalationEvent); ok {
+			escalations = append(escalations, e)
+		}
+	}
+	return escalations
+}
+
+// HandedOff reports whether the Handoff step completed.
+func (h *Harness) HandedOff() bool {
+	return h.handoff != nil
+}
+
+// Run runs steps in order, stopping at the first one that fails or
+// times out.
+func (h *Harness) Run(steps ...Step) error {
+	for i, step := range steps {
+		result := make(chan error, 1)
+		go func(step Step) {
+			result <- step.run(h)
+		}(step)
+		var err error
+		select {
+		case err = <-result:
+		case <-time.After(h.config.StepTimeout):
+			err = fmt.Errorf("timed out after %v", h.config.StepTimeout)
+		}
+		if err != nil {
+			return fmt.Errorf("proxytest: step %d (%s): %v", i, step.name, err)
+		}
+	}
+	return nil
+}
+
+// Close closes the client and server connections, and the proxy if
+// it did not hand off.
+func (h *Harness) Close() error {
+	err := h.Client.Close()
+	h.Server.Close()
+	if h.handoff == nil {
+		h.Proxy.Close()
+	}
+	return err
+}
+
+func (h *Harness) delayReply() {
+	if h.config.ReplyDelay > 0 {
+		time.Sleep(h.config.ReplyDelay)
+	}
+}
+
+func (h *Harness) serveRequests(reqs <-chan *ssh.Request) {
+	for req := range reqs {
+		h.delayReply()
+		req.Reply(req.Type == ssh.NoMoreSessionRequestName, nil)
+	}
+}
+
+func (h *Harness) serveChannels(chans <-chan ssh.NewChannel) {
+	for newCh := range chans {
+		h.delayReply()
+		switch newCh.ChannelType() {
+		case "session":
+			ch, reqs, err := newCh.Accept()
+			if err != nil {
+				continue
+			}
+			go serveSession(ch, reqs)
+		case "direct-tcpip":
+			ch, reqs, err := newCh.Accept()
+			if err != nil {
+				continue
+			}
+			go ssh.DiscardRequests(reqs)
+			go func() {
+				io.Copy(ch, ch)
+				ch.Close()
+			}()
+		default:
+			newCh.Reject(ssh.UnknownChannelType, "unknown channel type")
+		}
+	}
+}
+
+type execMsg struct {
+	Command string
+}
+
+func serveSession(ch ssh.Channel, reqs <-chan *ssh.Request) {
+	exit := func() {
+		ch.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{0}))
+		ch.Close()
+	}
+	for req := range reqs {
+		switch req.Type {
+		case "pty-req", "env":
+			req.Reply(true, nil)
+		case "exec":
+			var msg execMsg
+			if err := ssh.Unmarshal(req.Payload, &msg); err != nil {
+				req.Reply(false, nil)
+				continue
+			}
+			req.Reply(true, nil)
+			io.WriteString(ch, msg.Command)
+			exit()
+		case "shell":
+			req.Reply(true, nil)
+			go func() {
+				io.Copy(ch, ch)
+				exit()
+			}()
+		default:
+			req.Reply(false, nil)
+		}
+	}
+}
+
+type eventRecorder struct {
+	mu     sync.Mutex
+	events []ssh.Event
+}
+
+func (r *eventRecorder) Event(e ssh.Event) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.events = append(r.events, e)
+}
+
+func (r *eventRecorder) get() []ssh.Event {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]ssh.Event(nil), r.events...)
+}
+
+// A Link is an endpoint's connection to the proxy. Faults are
+// injected into what the endpoint writes.
+type Link struct {
+	net.Conn
+
+	mu    sync.Mutex
+	drop  int
+	delay time.Duration
+}
+
+// Drop discards the next n writes. The SSH transport writes each
+// packet at once unless it is larger than its write buffer, so this
+// normally drops n packets, and the peer fails to decrypt the
+// following one.
+func (l *Link) Drop(n int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.drop += n
+}
+
+// SetDelay delays every later write by d. A zero d removes the delay.
+func (l *Link) SetDelay(d time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.delay = d
+}
+
+// Write writes b to the connection, unless it is to be dropped.
+func (l *Link) Write(b []byte) (int, error) {
+	l.mu.Lock()
+	drop := l.drop > 0
+	if drop {
+		l.drop--
+	}
+	delay := l.delay
+	l.mu.Unlock()
+
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+	if drop {
+		return len(b), nil
+	}
+	return l.Conn.Write(b)
+}
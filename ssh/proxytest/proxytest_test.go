@@ -0,0 +1,148 @@
+package proxytest
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func newHarness(t *testing.T, config *Config) *Harness {
+	h, err := New(config)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	return h
+}
+
+func TestScriptedSession(t *testing.T) {
+	h := newHarness(t, &Config{Policy: &ssh.Policy{
+		Commands: []ssh.CommandRule{
+			{Rule: ssh.Rule{Decision: ssh.Allow}, Match: ssh.MatchExact, Pattern: "ls"},
+			{Rule: ssh.Rule{Decision: ssh.Allow}, Match: ssh.MatchExact, Pattern: ""},
+		},
+		Channels: []ssh.ChannelRule{
+			{Rule: ssh.Rule{Decision: ssh.Allow}, Type: "session"},
+			{Rule: ssh.Rule{Decision: ssh.Allow}, Type: "direct-tcpip"},
+		},
+		Requests: []ssh.RequestRule{{Rule: ssh.Rule{Decision: ssh.Allow}, Type: "pty-req"}},
+		Forwards: []ssh.ForwardRule{{Rule: ssh.Rule{Decision: ssh.Allow}, Host: "db.internal", Port: 5432}},
+	}})
+	defer h.Close()
+
+	err := h.Run(
+		Exec("ls", true),
+		Exec("rm -rf /", false),
+		Pty("xterm", true),
+		Shell("hello", true),
+		OpenChannel("x11", false),
+		Dial("db.internal:5432", true),
+		Dial("db.internal:22", false),
+		NoMoreSessions(),
+		Handoff(),
+		Exec("rm -rf /", true),
+		Echo(100000),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestEscalation(t *testing.T) {
+	approve := true
+	h := newHarness(t, &Config{
+		Policy: &ssh.Policy{
+			Commands: []ssh.CommandRule{{Rule: ssh.Rule{Decision: ssh.Escalate}, Match: ssh.MatchGlob, Pattern: "sudo *"}},
+			Channels: []ssh.ChannelRule{{Rule: ssh.Rule{Decision: ssh.Allow}, Type: "session"}},
+		},
+		Approver: ssh.EscalateFunc(func() error {
+			if approve {
+				return nil
+			}
+			return errors.New("denied")
+		}),
+	})
+	defer h.Close()
+
+	if err := h.Run(Exec("sudo reboot", true)); err != nil {
+		t.Fatal(err)
+	}
+	approve = false
+	if err := h.Run(Exec("sudo reboot", false)); err != nil {
+		t.Fatal(err)
+	}
+	escalations := h.Escalations()
+	if len(escalations) != 2 || escalations[0].Err != nil || escalations[1].Err == nil {
+		t.Errorf("got escalations %+v, want one approved and one denied", escalations)
+	}
+
+	// Without no-more-sessions, the handoff is escalated too.
+	if err := h.Run(Fails(Handoff())); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRekeys(t *testing.T) {
+	h := newHarness(t, &Config{ServerConfig: &ssh.ServerConfig{Config: ssh.Config{RekeyThreshold: 4096}}})
+	defer h.Close()
+
+	err := h.Run(
+		Rekey(Server),
+		Echo(10000),
+		Rekey(Server),
+		NoMoreSessions(),
+		Rekey(Server),
+		Handoff(),
+		Echo(10000),
+		Rekey(Client),
+		Rekey(Server),
+		Echo(10000),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDelayedConfirmations(t *testing.T) {
+	h := newHarness(t, &Config{ReplyDelay: 50 * time.Millisecond})
+	defer h.Close()
+
+	err := h.Run(
+		Exec("ls", true),
+		NoMoreSessions(),
+		Delay(Client, 20*time.Millisecond),
+		Handoff(),
+		Echo(1000),
+		Delay(Client, 0),
+		Echo(100000),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDroppedPackets(t *testing.T) {
+	// The proxy waits for the dropped packet until the client's next
+	// one, which it fails to decrypt.
+	h := newHarness(t, &Config{StepTimeout: time.Second})
+	defer h.Close()
+	if err := h.Run(Drop(Client, 1), Fails(Exec("ls", true)), Fails(Handoff())); err != nil {
+		t.Fatal(err)
+	}
+
+	// After the handoff, the server is left waiting for the
+	// dropped packet.
+	h = newHarness(t, &Config{StepTimeout: time.Second})
+	defer h.Close()
+	err := h.Run(
+		NoMoreSessions(),
+		Handoff(),
+		Echo(1000),
+		Drop(Client, 1),
+		Fails(Echo(1000)),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,244 @@
+package proxytest
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+var errHandoffTwice = errors.New("already handed off")
+
+// A Step is one action of a scripted session, run by Harness.Run.
+type Step struct {
+	name string
+	run  func(h *Harness) error
+}
+
+// String returns a description of the step.
+func (s Step) String() string {
+	return s.name
+}
+
+// checkAllowed compares the outcome of a request, err, with whether
+// it was expected to be allowed.
+func checkAllowed(err error, allowed bool) error {
+	if allowed && err != nil {
+		return fmt.Errorf("blocked: %v", err)
+	}
+	if !allowed && err == nil {
+		return errors.New("allowed, want blocked")
+	}
+	return nil
+}
+
+// Exec runs cmd in a new session, and checks that the proxy allows it
+// or not, and if it does, that the server's output arrives intact.
+func Exec(cmd string, allowed bool) Step {
+	return Step{"exec " + cmd, func(h *Harness) error {
+		session, err := h.Client.NewSession()
+		if err != nil {
+			return err
+		}
+		defer session.Close()
+		out, err := session.Output(cmd)
+		if err := checkAllowed(err, allowed); err != nil || !allowed {
+			return err
+		}
+		if string(out) != cmd {
+			return fmt.Errorf("got output %q, want %q", out, cmd)
+		}
+		return nil
+	}}
+}
+
+// Shell starts a shell in a new session, and checks that the proxy
+// allows it or not, and if it does, that input is echoed intact.
+func Shell(input string, allowed bool) Step {
+	return Step{"shell", func(h *Harness) error {
+		return shell(h, []byte(input), allowed)
+	}}
+}
+
+func shell(h *Harness, input []byte, allowed bool) error {
+	session, err := h.Client.NewSession()
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+	stdin, err := session.StdinPipe()
+	if err != nil {
+		return err
+	}
+	var out bytes.Buffer
+	session.Stdout = &out
+	if err := checkAllowed(session.Shell(), allowed); err != nil || !allowed {
+		return err
+	}
+	go func() {
+		stdin.Write(input)
+		stdin.Close()
+	}()
+	if err := session.Wait(); err != nil {
+		return err
+	}
+	if !bytes.Equal(out.Bytes(), input) {
+		return fmt.Errorf("got %d bytes of output, want the %d bytes of input", out.Len(), len(input))
+	}
+	return nil
+}
+
+// Pty requests a pseudo-terminal in a new session, and checks that
+// the proxy allows it or not.
+func Pty(term string, allowed bool) Step {
+	return Step{"pty " + term, func(h *Harness) error {
+		session, err := h.Client.NewSession()
+		if err != nil {
+			return err
+		}
+		defer session.Close()
+		return checkAllowed(session.RequestPty(term, 24, 80, ssh.TerminalModes{}), allowed)
+	}}
+}
+
+// OpenChannel opens a channel of type chanType, and checks that the
+// proxy allows it or not. The server only accepts "session" and
+// "direct-tcpip" channels, so other allowed channels are expected to
+// be rejected by the server rather than by the proxy.
+func OpenChannel(chanType string, allowed bool) Step {
+	return Step{"channel " + chanType, func(h *Harness) error {
+		ch, reqs, err := h.Client.OpenChannel(chanType, nil)
+		if err == nil {
+			go ssh.DiscardRequests(reqs)
+			ch.Close()
+		}
+		if openErr, ok := err.(*ssh.OpenChannelError); ok && openErr.Reason == ssh.UnknownChannelType {
+			// The server, not the proxy, rejected the channel.
+			err = nil
+		}
+		return checkAllowed(err, allowed)
+	}}
+}
+
+// Dial opens a "direct-tcpip" channel to addr, and checks that the
+// proxy allows it or not, and if it does, that data is echoed intact.
+func Dial(addr string, allowed bool) Step {
+	return Step{"dial " + addr, func(h *Harness) error {
+		conn, err := h.Client.Dial("tcp", addr)
+		if err := checkAllowed(err, allowed); err != nil || !allowed {
+			return err
+		}
+		defer conn.Close()
+		want := []byte("hello " + addr)
+		if _, err := conn.Write(want); err != nil {
+			return err
+		}
+		got := make([]byte, len(want))
+		if _, err := io.ReadFull(conn, got); err != nil {
+			return err
+		}
+		if !bytes.Equal(got, want) {
+			return fmt.Errorf("got %q, want %q", got, want)
+		}
+		return nil
+	}}
+}
+
+// NoMoreSessions sends no-more-sessions@openssh.com, which the server
+// acknowledges, allowing a handoff without escalation.
+func NoMoreSessions() Step {
+	return Step{"no-more-sessions", func(h *Harness) error {
+		ok, _, err := h.Client.SendRequest(ssh.NoMoreSessionRequestName, true, nil)
+		if err == nil && !ok {
+			err = errors.New("request failed")
+		}
+		return err
+	}}
+}
+
+// Handoff hands the connection off from the proxy to the client, and
+// starts relaying between the client and the server.
+func Handoff() Step {
+	return Step{"handoff", func(h *Harness) error {
+		if h.handoff != nil {
+			return errHandoffTwice
+		}
+		h.Client.RequestKeyChange()
+		if err := <-h.done; err != nil {
+			return err
+		}
+		streams, err := h.Proxy.Handoff()
+		if err != nil {
+			return err
+		}
+		h.handoff = streams
+		go streams.Relay()
+		return nil
+	}}
+}
+
+// Echo sends n bytes of pseudo-random data through a shell, and
+// checks that they are echoed intact. After the handoff, this checks
+// that the client and the server agree on keys and sequence numbers.
+func Echo(n int) Step {
+	return Step{fmt.Sprintf("echo %d bytes", n), func(h *Harness) error {
+		input := make([]byte, n)
+		rand.New(rand.NewSource(int64(n))).Read(input)
+		return shell(h, input, true)
+	}}
+}
+
+// Rekey makes side s start a key exchange, without waiting for it to
+// complete. Before the handoff, a client key exchange is the handoff,
+// so only the server may rekey.
+func Rekey(s Side) Step {
+	return Step{"rekey " + s.String(), func(h *Harness) error {
+		if s == Server {
+			h.Server.RequestKeyChange()
+			return nil
+		}
+		if h.handoff == nil {
+			return errors.New("client rekey before handoff")
+		}
+		h.Client.RequestKeyChange()
+		return nil
+	}}
+}
+
+// Drop discards the next n writes of side s to the proxy.
+func Drop(s Side, n int) Step {
+	return Step{fmt.Sprintf("drop %d %s writes", n, s), func(h *Harness) error {
+		h.Link(s).Drop(n)
+		return nil
+	}}
+}
+
+// Delay delays every later write of side s to the proxy by d.
+func Delay(s Side, d time.Duration) Step {
+	return Step{fmt.Sprintf("delay %s writes by %v", s, d), func(h *Harness) error {
+		h.Link(s).SetDelay(d)
+		return nil
+	}}
+}
+
+// Fails runs step, and succeeds only if it fails or times out.
+func Fails(step Step) Step {
+	return Step{step.name + " fails", func(h *Harness) error {
+		result := make(chan error, 1)
+		go func() {
+			result <- step.run(h)
+		}()
+		select {
+		case err := <-result:
+			if err == nil {
+				return errors.New("succeeded")
+			}
+		case <-time.After(h.config.StepTimeout / 2):
+		}
+		return nil
+	}}
+}
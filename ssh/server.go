@@ -11,6 +11,7 @@ import (
 	"io"
 	"net"
 	"strings"
+	"time"
 )
 
 // The Permissions type holds fine-grained permissions that are
@@ -62,6 +63,17 @@ type ServerConfig struct {
 	// to 6.
 	MaxAuthTries int
 
+	// ClientAliveInterval, if positive, makes the server send a
+	// keepalive@openssh.com request whenever it received nothing
+	// from the client for that long.
+	ClientAliveInterval time.Duration
+
+	// ClientAliveCountMax is the number of keepalive requests that
+	// may go unanswered. Once exceeded, the server closes the
+	// connection, and Wait returns ErrKeepaliveTimeout. If zero, 3
+	// is used.
+	ClientAliveCountMax int
+
 	// PasswordCallback, if non-nil, is called when a user
 	// attempts to authenticate using a password.
 	PasswordCallback func(conn ConnMetadata, password []byte) (*Permissions, error)
@@ -95,6 +107,11 @@ type ServerConfig struct {
 	// Note that RFC 4253 section 4.2 requires that this string start with
 	// "SSH-2.0-".
 	ServerVersion string
+
+	// Moduli supplies the groups offered in Diffie-Hellman group
+	// exchange. If nil, the 2048- to 8192-bit groups of RFC 3526
+	// are offered. See ParseModuli to use an OpenSSH moduli file.
+	Moduli ModuliSource
 }
 
 // AddHostKey adds a private key as a host key. If an existing host
@@ -168,6 +185,9 @@ func NewServerConn(c net.Conn, config *ServerConfig) (*ServerConn, <-chan NewCha
 	if fullConf.MaxAuthTries == 0 {
 		fullConf.MaxAuthTries = 6
 	}
+	if fullConf.ClientAliveCountMax == 0 {
+		fullConf.ClientAliveCountMax = defaultKeepaliveCountMax
+	}
 
 	s := &connection{
 		sshConn: sshConn{conn: c},
@@ -227,13 +247,16 @@ func (s *connection) serverHandshake(config *ServerConfig) (*Permissions, error)
 		return nil, err
 	}
 	s.mux = newMux(s.transport)
+	if config.ClientAliveInterval > 0 {
+		go s.mux.keepalive(config.ClientAliveInterval, config.ClientAliveCountMax)
+	}
 	return perms, err
 }
 
 func isAcceptableAlgo(algo string) bool {
 	switch algo {
-	case KeyAlgoRSA, KeyAlgoDSA, KeyAlgoECDSA256, KeyAlgoECDSA384, KeyAlgoECDSA521, KeyAlgoED25519,
-		CertAlgoRSAv01, CertAlgoDSAv01, CertAlgoECDSA256v01, CertAlgoECDSA384v01, CertAlgoECDSA521v01:
+	case KeyAlgoRSA, KeyAlgoRSASHA256, KeyAlgoRSASHA512, KeyAlgoDSA, KeyAlgoECDSA256, KeyAlgoECDSA384, KeyAlgoECDSA521, KeyAlgoED25519,
+		CertAlgoRSAv01, CertAlgoRSASHA256v01, CertAlgoRSASHA512v01, CertAlgoDSAv01, CertAlgoECDSA256v01, CertAlgoECDSA384v01, CertAlgoECDSA521v01:
 		return true
 	}
 	return false
@@ -411,6 +434,10 @@ userAuthLoop:
 			if err != nil {
 				return nil, err
 			}
+			if !contains(algorithmsForKeyFormat(pubKey.Type()), algo) {
+				authErr = fmt.Errorf("ssh: algorithm %q not accepted for key type %s", algo, pubKey.Type())
+				break
+			}
 
 			candidate, ok := cache.get(s.user, pubKeyData)
 			if !ok {
@@ -454,7 +481,8 @@ userAuthLoop:
 				// algorithm name that corresponds to algo with
 				// sig.Format.  This is usually the same, but
 				// for certs, the names differ.
-				if !isAcceptableAlgo(sig.Format) {
+				if !isAcceptableAlgo(sig.Format) || sig.Format != underlyingAlgo(algo) {
+					authErr = fmt.Errorf("ssh: signature algorithm %q not accepted for %q", sig.Format, algo)
 					break
 				}
 				signedData := buildDataSignedForAuth(sessionID, userAuthReq, algoBytes, pubKeyData)
@@ -9,6 +9,7 @@ import (
 	"errors"
 	"io"
 	"log"
+	"sync/atomic"
 )
 
 // debugTransport if set, will print packet types as they go over the
@@ -16,9 +17,11 @@ import (
 const debugTransport = false
 
 const (
-	gcmCipherID    = "aes128-gcm@openssh.com"
-	aes128cbcID    = "aes128-cbc"
-	tripledescbcID = "3des-cbc"
+	gcmCipherID        = "aes128-gcm@openssh.com"
+	gcm256CipherID     = "aes256-gcm@openssh.com"
+	chacha20Poly1305ID = "chacha20-poly1305@openssh.com"
+	aes128cbcID        = "aes128-cbc"
+	tripledescbcID     = "3des-cbc"
 )
 
 // packetConn represents a transport that implements packet based
@@ -35,6 +38,10 @@ type packetConn interface {
 	// buffered returns the number of bytes that are currently buffered by the read-side.
 	buffered() int
 
+	// bufferedBytes returns a copy of the bytes that are currently
+	// buffered by the read-side.
+	bufferedBytes() []byte
+
 	// Close closes the write-side of the connection.
 	Close() error
 }
@@ -70,9 +77,23 @@ type packetCipher interface {
 // keys, and can even have its own algorithms
 type connectionState struct {
 	packetCipher
-	seqNum           uint32
+
+	// seqNum is the sequence number of the next packet, and
+	// lastSeqNum that of the last one. They are accessed atomically,
+	// since a proxy reads them while packets go through.
+	seqNum     uint32
+	lastSeqNum uint32
+
 	dir              direction
 	pendingKeyChange chan packetCipher
+
+	// strictKex makes msgNewKeys reset the sequence number to zero,
+	// as strict key exchange requires.
+	strictKex bool
+
+	// afterAuth is set once authentication succeeded, which turns
+	// on zlib@openssh.com compression. It is accessed atomically.
+	afterAuth int32
 }
 
 // prepareKeyChange sets up key material for a keychange. The key changes in
@@ -82,40 +103,62 @@ func (t *transport) prepareKeyChange(algs *algorithms, kexResult *kexResult) err
 	if ciph, err := newPacketCipher(t.reader.dir, algs.r, kexResult); err != nil {
 		return err
 	} else {
-		t.reader.pendingKeyChange <- ciph
+		t.reader.pendingKeyChange <- newCompressionCipher(ciph, algs.r.Compression, &t.reader.afterAuth)
 	}
 
 	if ciph, err := newPacketCipher(t.writer.dir, algs.w, kexResult); err != nil {
 		return err
 	} else {
-		t.writer.pendingKeyChange <- ciph
+		t.writer.pendingKeyChange <- newCompressionCipher(ciph, algs.w.Compression, &t.writer.afterAuth)
 	}
 
 	return nil
 }
 
 func (t *transport) getSequenceNumbers() (out uint32, in uint32) {
-	return t.writer.seqNum, t.reader.seqNum
+	return atomic.LoadUint32(&t.writer.seqNum), atomic.LoadUint32(&t.reader.seqNum)
+}
+
+// getLastSequenceNumbers returns the sequence numbers of the packets
+// last written and read. Since strict key exchange resets sequence
+// numbers after msgNewKeys, these are not always one less than the next
+// ones.
+func (t *transport) getLastSequenceNumbers() (out uint32, in uint32) {
+	return atomic.LoadUint32(&t.writer.lastSeqNum), atomic.LoadUint32(&t.reader.lastSeqNum)
+}
+
+func (t *transport) getIncomingSequenceNumbers() (last uint32, next uint32) {
+	return atomic.LoadUint32(&t.reader.lastSeqNum), atomic.LoadUint32(&t.reader.seqNum)
 }
 
 func (t *transport) setOutgoingSequenceNumber(seqNum uint32) {
-	t.writer.seqNum = seqNum
+	atomic.StoreUint32(&t.writer.seqNum, seqNum)
 	if debugTransport {
-		log.Printf("Updated outoing sequence number to: %d", t.writer.seqNum)
+		log.Printf("Updated outoing sequence number to: %d", seqNum)
 	}
 }
 
 func (t *transport) setIncomingSequenceNumber(seqNum uint32) {
-	t.reader.seqNum = seqNum
+	atomic.StoreUint32(&t.reader.seqNum, seqNum)
 	if debugTransport {
-		log.Printf("Updated incoming sequence number to: %d", t.reader.seqNum)
+		log.Printf("Updated incoming sequence number to: %d", seqNum)
 	}
 }
 
+func (t *transport) setStrictKex(strict bool) {
+	t.reader.strictKex = strict
+	t.writer.strictKex = strict
+}
+
 func (t *transport) buffered() int {
 	return t.bufReader.Buffered()
 }
 
+func (t *transport) bufferedBytes() []byte {
+	b, _ := t.bufReader.Peek(t.bufReader.Buffered())
+	return append([]byte(nil), b...)
+}
+
 func (t *transport) printPacket(p []byte, write bool) {
 	if len(p) == 0 {
 		return
@@ -141,13 +184,19 @@ func (t *transport) readPacket() (p []byte, err error) {
 	if debugTransport {
 		t.printPacket(p, false)
 	}
+	if t.isClient && p[0] == msgUserAuthSuccess {
+		// The server compresses everything after this packet.
+		atomic.StoreInt32(&t.reader.afterAuth, 1)
+		atomic.StoreInt32(&t.writer.afterAuth, 1)
+	}
 
 	return p, err
 }
 
 func (s *connectionState) readPacket(r *bufio.Reader) ([]byte, error) {
-	packet, err := s.packetCipher.readPacket(s.seqNum, r)
-	s.seqNum++
+	seqNum := atomic.LoadUint32(&s.seqNum)
+	packet, err := s.packetCipher.readPacket(seqNum, r)
+	s.setSequenceNumbers(seqNum, seqNum+1)
 	if err == nil && len(packet) == 0 {
 		err = errors.New("ssh: zero length packet")
 	}
@@ -162,6 +211,9 @@ func (s *connectionState) readPacket(r *bufio.Reader) ([]byte, error) {
 				// TODO(dimakogan): handle this more accurately.
 				//				return nil, errors.New("ssh: got bogus newkeys message.")
 			}
+			if s.strictKex {
+				atomic.StoreUint32(&s.seqNum, 0)
+			}
 
 		case msgDisconnect:
 			// Transform a disconnect message into an
@@ -189,20 +241,30 @@ func (t *transport) writePacket(packet []byte) error {
 	if debugTransport {
 		t.printPacket(packet, true)
 	}
-	return t.writer.writePacket(t.bufWriter, t.rand, packet)
+	if t.isClient || len(packet) == 0 || packet[0] != msgUserAuthSuccess {
+		return t.writer.writePacket(t.bufWriter, t.rand, packet)
+	}
+
+	// The client compresses everything after this packet, and may
+	// answer as soon as it is written.
+	atomic.StoreInt32(&t.reader.afterAuth, 1)
+	err := t.writer.writePacket(t.bufWriter, t.rand, packet)
+	atomic.StoreInt32(&t.writer.afterAuth, 1)
+	return err
 }
 
 func (s *connectionState) writePacket(w *bufio.Writer, rand io.Reader, packet []byte) error {
 	changeKeys := len(packet) > 0 && packet[0] == msgNewKeys
 
-	err := s.packetCipher.writePacket(s.seqNum, w, rand, packet)
+	seqNum := atomic.LoadUint32(&s.seqNum)
+	err := s.packetCipher.writePacket(seqNum, w, rand, packet)
 	if err != nil {
 		return err
 	}
 	if err = w.Flush(); err != nil {
 		return err
 	}
-	s.seqNum++
+	s.setSequenceNumbers(seqNum, seqNum+1)
 	if changeKeys {
 		select {
 		case cipher := <-s.pendingKeyChange:
@@ -211,10 +273,20 @@ func (s *connectionState) writePacket(w *bufio.Writer, rand io.Reader, packet []
 			// TODO(dimakogan): handle this more accurately.
 			//			panic("ssh: no key material for msgNewKeys")
 		}
+		if s.strictKex {
+			atomic.StoreUint32(&s.seqNum, 0)
+		}
 	}
 	return err
 }
 
+// setSequenceNumbers records that the packet with sequence number last
+// went through, and that next is that of the following packet.
+func (s *connectionState) setSequenceNumbers(last, next uint32) {
+	atomic.StoreUint32(&s.lastSeqNum, last)
+	atomic.StoreUint32(&s.seqNum, next)
+}
+
 func newTransport(rwc io.ReadWriteCloser, rand io.Reader, isClient bool) *transport {
 	t := &transport{
 		bufReader: bufio.NewReader(rwc),
@@ -257,15 +329,16 @@ var (
 // generateKeys generates key material for IV, MAC and encryption.
 func generateKeys(d direction, algs directionAlgorithms, kex *kexResult) (iv, key, macKey []byte) {
 	cipherMode := cipherModes[algs.Cipher]
-	macMode := macModes[algs.MAC]
 
 	iv = make([]byte, cipherMode.ivSize)
 	key = make([]byte, cipherMode.keySize)
-	macKey = make([]byte, macMode.keySize)
-
 	generateKeyMaterial(iv, d.ivTag, kex)
 	generateKeyMaterial(key, d.keyTag, kex)
-	generateKeyMaterial(macKey, d.macKeyTag, kex)
+
+	if !cipherMode.aead() {
+		macKey = make([]byte, macModes[algs.MAC].keySize)
+		generateKeyMaterial(macKey, d.macKeyTag, kex)
+	}
 	return
 }
 
@@ -274,32 +347,7 @@ func generateKeys(d direction, algs directionAlgorithms, kex *kexResult) (iv, ke
 // (to setup server->client keys) or clientKeys (for client->server keys).
 func newPacketCipher(d direction, algs directionAlgorithms, kex *kexResult) (packetCipher, error) {
 	iv, key, macKey := generateKeys(d, algs, kex)
-
-	if algs.Cipher == gcmCipherID {
-		return newGCMCipher(iv, key, macKey)
-	}
-
-	if algs.Cipher == aes128cbcID {
-		return newAESCBCCipher(iv, key, macKey, algs)
-	}
-
-	if algs.Cipher == tripledescbcID {
-		return newTripleDESCBCCipher(iv, key, macKey, algs)
-	}
-
-	c := &streamPacketCipher{
-		mac: macModes[algs.MAC].new(macKey),
-		etm: macModes[algs.MAC].etm,
-	}
-	c.macResult = make([]byte, c.mac.Size())
-
-	var err error
-	c.cipher, err = cipherModes[algs.Cipher].createStream(key, iv)
-	if err != nil {
-		return nil, err
-	}
-
-	return c, nil
+	return cipherModes[algs.Cipher].create(iv, key, macKey, algs)
 }
 
 // generateKeyMaterial fills out with key material generated from tag, K, H